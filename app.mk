@@ -2,7 +2,7 @@ GOPATH				:=	$(shell go env GOPATH)
 APP_VERSION			:=	$(shell git describe --tags --always)
 APP_RELATIVE_PATH	:=	$(shell a=`basename $$PWD` && cd .. && b=`basename $$PWD` && echo $$b/$$a)
 
-.PHONY: dep api conf ent wire openapi build clean run test
+.PHONY: dep api conf ent wire openapi build clean run migrate test
 
 # download dependencies of module
 dep:
@@ -51,6 +51,10 @@ clean:
 run:
 	@go run ./cmd/server -conf ./configs
 
+# apply the database migrations
+migrate:
+	@go run ./cmd/migrate -conf ./configs up
+
 # run tests
 test:
 	@go test -v ./... -cover
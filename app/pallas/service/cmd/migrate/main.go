@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/config"
+	"github.com/go-kratos/kratos/v2/config/file"
+	"github.com/go-kratos/kratos/v2/log"
+
+	"github.com/hominsu/pallas/app/pallas/service/internal/conf"
+	"github.com/hominsu/pallas/app/pallas/service/internal/data"
+)
+
+// Name is the name of the compiled software.
+var Name = "pallas.pallas.migrate"
+
+var (
+	// flagconf is the config flag.
+	flagconf string
+	// flagdir is the directory the diff is written to.
+	flagdir string
+	// flagtimeout bounds the command, including the wait for the lock.
+	flagtimeout time.Duration
+)
+
+func init() {
+	flag.StringVar(&flagconf, "conf", "../../configs", "config path, eg: -conf config.yaml")
+	flag.StringVar(&flagdir, "dir", "./internal/data/migrations", "migrations directory of diff")
+	flag.DurationVar(&flagtimeout, "timeout", 10*time.Minute, "timeout of the command")
+	flag.Usage = func() {
+		_, _ = fmt.Fprintf(flag.CommandLine.Output(), `Usage: %s [flags] <command>
+
+Commands:
+  status       list the migrations and whether applied
+  up [n]       apply n pending migrations, all of them by default
+  down [n]     revert n applied migrations, 1 by default
+  diff <name>  generate the up file from the ent schema against the database
+
+Flags:
+`, os.Args[0])
+		flag.PrintDefaults()
+	}
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	c := config.New(
+		config.WithSource(
+			file.NewSource(flagconf),
+		),
+	)
+	defer func(c config.Config) {
+		err := c.Close()
+		if err != nil {
+			panic(err)
+		}
+	}(c)
+	if err := c.Load(); err != nil {
+		panic(err)
+	}
+
+	var bc conf.Bootstrap
+	if err := c.Scan(&bc); err != nil {
+		panic(err)
+	}
+
+	logger := log.With(log.NewStdLogger(os.Stdout),
+		"service.name", Name,
+		"ts", log.Timestamp(time.RFC3339),
+	)
+
+	client := data.NewEntClient(bc.Data, logger)
+	defer func() { _ = client.Close() }()
+	migrator := data.NewMigrator(client, bc.Data.Database.Driver, data.NewSRPParams(bc.Secret, logger), logger)
+
+	ctx, cancel := context.WithTimeout(context.Background(), flagtimeout)
+	defer cancel()
+
+	if err := run(ctx, migrator, flag.Args()); err != nil {
+		cancel()
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, migrator *data.Migrator, args []string) error {
+	count := func(def int) (int, error) {
+		if len(args) < 2 {
+			return def, nil
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			return 0, fmt.Errorf("invalid number of migrations: %s", args[1])
+		}
+		return n, nil
+	}
+
+	switch args[0] {
+	case "status":
+		states, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range states {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format(time.RFC3339)
+			}
+			if s.Unknown {
+				applied += " (unknown to the release)"
+			}
+			fmt.Printf("%s  %-40s  %s\n", s.Version, s.Description, applied)
+		}
+	case "up":
+		n, err := count(0)
+		if err != nil {
+			return err
+		}
+		applied, err := migrator.Up(ctx, n)
+		fmt.Printf("%d migrations applied\n", applied)
+		return err
+	case "down":
+		n, err := count(1)
+		if err != nil {
+			return err
+		}
+		reverted, err := migrator.Down(ctx, n)
+		fmt.Printf("%d migrations reverted\n", reverted)
+		return err
+	case "diff":
+		if len(args) < 2 {
+			return fmt.Errorf("the name of the migration is required")
+		}
+		file, err := migrator.Diff(ctx, flagdir, args[1])
+		if err != nil {
+			return err
+		}
+		if file == "" {
+			fmt.Println("the database is up to date with the ent schema")
+			return nil
+		}
+		fmt.Printf("%s generated, review it and write the down file\n", file)
+	default:
+		flag.Usage()
+		return fmt.Errorf("unknown command: %s", args[0])
+	}
+	return nil
+}
@@ -12,6 +12,7 @@ import (
 	"github.com/go-kratos/kratos/v2/transport/http"
 
 	"github.com/hominsu/pallas/app/pallas/service/internal/conf"
+	"github.com/hominsu/pallas/app/pallas/service/internal/server"
 )
 
 // go build -ldflags "-X main.Version=x.y.z"
@@ -30,7 +31,7 @@ func init() {
 	flag.StringVar(&flagconf, "conf", "../../configs", "config path, eg: -conf config.yaml")
 }
 
-func newApp(logger log.Logger, hs *http.Server) *kratos.App {
+func newApp(logger log.Logger, hs *http.Server, cs *server.CronServer, ms *server.MetricsServer) *kratos.App {
 	return kratos.New(
 		kratos.Name(Name),
 		kratos.Version(Version),
@@ -38,6 +39,8 @@ func newApp(logger log.Logger, hs *http.Server) *kratos.App {
 		kratos.Logger(logger),
 		kratos.Server(
 			hs,
+			cs,
+			ms,
 		),
 	)
 }
@@ -73,7 +76,7 @@ func main() {
 		"caller", log.Caller(5),
 	)
 
-	app, cleanup, err := initApp(bc.Server, bc.Data, bc.Secret, Version, logger)
+	app, cleanup, err := initApp(bc.Server, bc.Data, bc.Secret, bc.Auth, Version, logger)
 	if err != nil {
 		panic(err)
 	}
@@ -22,6 +22,7 @@ func initApp(
 	confServer *conf.Server,
 	confData *conf.Data,
 	confSecret *conf.Secret,
+	confAuth *conf.Auth,
 	version string,
 	logger log.Logger,
 ) (*kratos.App, func(), error) {
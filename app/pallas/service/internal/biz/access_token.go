@@ -0,0 +1,226 @@
+package biz
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
+)
+
+// AccessToken is a personal access token of a user, presented as 'Authorization: Bearer <token>'.
+type AccessToken struct {
+	Id         int64        `json:"id,omitempty"`
+	UserId     int64        `json:"userId,omitempty"`
+	Name       string       `json:"name,omitempty"`
+	Scopes     []TokenScope `json:"scopes,omitempty"`
+	ExpireAt   *time.Time   `json:"expireAt,omitempty"`
+	LastUsedAt *time.Time   `json:"lastUsedAt,omitempty"`
+	CreateAt   time.Time    `json:"createAt"`
+}
+
+type TokenScope string
+
+// TokenScope values.
+const (
+	ScopeReadOnly TokenScope = "read_only"
+	ScopeUser     TokenScope = "user"
+	ScopeAdmin    TokenScope = "admin"
+)
+
+func (s TokenScope) String() string {
+	return string(s)
+}
+
+const (
+	// accessTokenPrefix makes the token recognizable, e.g. by secret scanners
+	accessTokenPrefix = "pallas_pat_"
+
+	// accessTokenTouchInterval throttles the update of last used time
+	accessTokenTouchInterval = time.Minute
+)
+
+type AccessTokenRepo interface {
+	Create(ctx context.Context, token *AccessToken, hash string) (*AccessToken, error)
+	GetByHash(ctx context.Context, hash string) (*AccessToken, error)
+	ListByUser(ctx context.Context, userId int64) ([]*AccessToken, error)
+	Delete(ctx context.Context, userId, tokenId int64) error
+	Touch(ctx context.Context, tokenId int64, t time.Time) error
+}
+
+type AccessTokenUsecase struct {
+	ar  AccessTokenRepo
+	ur  UserRepo
+	gr  GroupRepo
+	log *log.Helper
+}
+
+func NewAccessTokenUsecase(ar AccessTokenRepo, ur UserRepo, gr GroupRepo, logger log.Logger) *AccessTokenUsecase {
+	return &AccessTokenUsecase{
+		ar:  ar,
+		ur:  ur,
+		gr:  gr,
+		log: log.NewHelper(logger),
+	}
+}
+
+// CreateAccessToken mint a token for user, the plaintext token is only returned here.
+// A zero expiresIn means the token never expires, and a negative one is rejected.
+func (uc *AccessTokenUsecase) CreateAccessToken(
+	ctx context.Context,
+	userId int64,
+	name string,
+	scopes []TokenScope,
+	expiresIn time.Duration,
+) (string, *AccessToken, error) {
+	if expiresIn < 0 {
+		return "", nil, v1.ErrorInvalidArgument("invalid argument: negative expires in %v", expiresIn)
+	}
+	for _, s := range scopes {
+		switch s {
+		case ScopeReadOnly, ScopeUser:
+		case ScopeAdmin:
+			// the operations are still checked against the permissions of user
+			permissions, err := userPermissions(ctx, uc.ur, uc.gr, userId)
+			if err != nil {
+				return "", nil, err
+			}
+			if len(permissions) == 0 {
+				return "", nil, v1.ErrorInvalidArgument("admin scope requires admin user")
+			}
+		default:
+			return "", nil, v1.ErrorInvalidArgument("invalid argument: unknown scope %q", s)
+		}
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, v1.ErrorInternal("generate token error: %v", err)
+	}
+	raw := accessTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+
+	t := &AccessToken{
+		UserId: userId,
+		Name:   name,
+		Scopes: scopes,
+	}
+	if expiresIn > 0 {
+		expireAt := time.Now().Add(expiresIn)
+		t.ExpireAt = &expireAt
+	}
+	res, err := uc.ar.Create(ctx, t, hashAccessToken(raw))
+	if err != nil {
+		return "", nil, err
+	}
+	return raw, res, nil
+}
+
+// Authenticate returns the access token of raw, the token must not be expired.
+func (uc *AccessTokenUsecase) Authenticate(ctx context.Context, raw string) (*AccessToken, error) {
+	if !strings.HasPrefix(raw, accessTokenPrefix) {
+		return nil, v1.ErrorSigninOperation("invalid access token")
+	}
+
+	t, err := uc.ar.GetByHash(ctx, hashAccessToken(raw))
+	switch {
+	case err != nil && v1.IsNotFound(err):
+		return nil, v1.ErrorSigninOperation("invalid access token")
+	case err != nil:
+		return nil, err
+	}
+
+	now := time.Now()
+	if t.ExpireAt != nil && now.After(*t.ExpireAt) {
+		return nil, v1.ErrorSigninOperation("access token expired")
+	}
+	if t.LastUsedAt == nil || now.Sub(*t.LastUsedAt) > accessTokenTouchInterval {
+		// the last used time is informative, do not fail the request
+		if err = uc.ar.Touch(ctx, t.Id, now); err != nil {
+			uc.log.Warnf("failed to update last used time of access token %d: %v", t.Id, err)
+		}
+	}
+	return t, nil
+}
+
+func (uc *AccessTokenUsecase) ListAccessTokens(ctx context.Context, userId int64) ([]*v1.AccessToken, error) {
+	res, err := uc.ar.ListByUser(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	return ToProtoAccessTokenList(res), nil
+}
+
+func (uc *AccessTokenUsecase) DeleteAccessToken(ctx context.Context, userId, tokenId int64) error {
+	return uc.ar.Delete(ctx, userId, tokenId)
+}
+
+// HasScope reports whether scopes contains s
+func HasScope(scopes []TokenScope, s TokenScope) bool {
+	for _, scope := range scopes {
+		if scope == s {
+			return true
+		}
+	}
+	return false
+}
+
+func hashAccessToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+func ToTokenScope(p v1.AccessToken_Scope) TokenScope {
+	if v, ok := v1.AccessToken_Scope_name[int32(p)]; ok && p != v1.AccessToken_SCOPE_UNSPECIFIED {
+		return TokenScope(strings.ToLower(v))
+	}
+	return ""
+}
+
+func ToTokenScopeList(p []v1.AccessToken_Scope) []TokenScope {
+	scopes := make([]TokenScope, len(p))
+	for i, s := range p {
+		scopes[i] = ToTokenScope(s)
+	}
+	return scopes
+}
+
+func toProtoTokenScope(s TokenScope) v1.AccessToken_Scope {
+	if v, ok := v1.AccessToken_Scope_value[strings.ToUpper(string(s))]; ok {
+		return v1.AccessToken_Scope(v)
+	}
+	return v1.AccessToken_SCOPE_UNSPECIFIED
+}
+
+func ToProtoAccessToken(t *AccessToken) *v1.AccessToken {
+	p := &v1.AccessToken{}
+	p.Id = t.Id
+	p.UserId = t.UserId
+	p.Name = t.Name
+	p.Scopes = make([]v1.AccessToken_Scope, len(t.Scopes))
+	for i, s := range t.Scopes {
+		p.Scopes[i] = toProtoTokenScope(s)
+	}
+	if t.ExpireAt != nil {
+		p.ExpireAt = timestamppb.New(*t.ExpireAt)
+	}
+	if t.LastUsedAt != nil {
+		p.LastUsedAt = timestamppb.New(*t.LastUsedAt)
+	}
+	p.CreatedAt = timestamppb.New(t.CreateAt)
+	return p
+}
+
+func ToProtoAccessTokenList(t []*AccessToken) []*v1.AccessToken {
+	pbList := make([]*v1.AccessToken, len(t))
+	for i, token := range t {
+		pbList[i] = ToProtoAccessToken(token)
+	}
+	return pbList
+}
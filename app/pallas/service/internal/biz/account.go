@@ -0,0 +1,245 @@
+package biz
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
+)
+
+// UserExport is the machine-readable export of everything about the user.
+type UserExport struct {
+	User              *User
+	Identities        []*Identity
+	AccessTokens      []*AccessToken
+	Sessions          []*Session
+	ScoreTransactions []*ScoreTransaction
+	AuditEvents       []*AuditEvent
+	ExportAt          time.Time
+}
+
+type accountOptions struct {
+	graceDays    int
+	reauthWindow time.Duration
+}
+
+// AccountUsecase is the lifecycle of the account managed by the user, the deletion is requested by the user,
+// and the account is purged after the grace period unless restored.
+type AccountUsecase struct {
+	ur  UserRepo
+	ir  IdentityRepo
+	tr  AccessTokenRepo
+	scr ScoreRepo
+	ar  AuditRepo
+	sr  SettingRepo
+	ssr SessionRepo
+	uu  *UserUsecase
+	log *log.Helper
+}
+
+func NewAccountUsecase(
+	ur UserRepo,
+	ir IdentityRepo,
+	tr AccessTokenRepo,
+	scr ScoreRepo,
+	ar AuditRepo,
+	sr SettingRepo,
+	ssr SessionRepo,
+	uu *UserUsecase,
+	logger log.Logger,
+) *AccountUsecase {
+	return &AccountUsecase{
+		ur:  ur,
+		ir:  ir,
+		tr:  tr,
+		scr: scr,
+		ar:  ar,
+		sr:  sr,
+		ssr: ssr,
+		uu:  uu,
+		log: log.NewHelper(logger),
+	}
+}
+
+// RequestDeletion disables the account of user, which is purged after account_deletion_grace_days. The user must
+// have signed in within account_reauth_window, a nil signinAt is never recent, and the code of the second factor
+// is required if totp is enabled. All the sessions are revoked.
+func (uc *AccountUsecase) RequestDeletion(
+	ctx context.Context,
+	userId int64,
+	signinAt *time.Time,
+	code string,
+) (*v1.User, error) {
+	AuditTarget(ctx, AuditTargetUser, userId)
+	opts, err := uc.options(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if signinAt == nil || time.Since(*signinAt) > opts.reauthWindow {
+		return nil, v1.ErrorReauthenticationRequired("sign in again to delete the account")
+	}
+
+	u, err := uc.ur.Get(ctx, userId, UserViewBasic)
+	if err != nil {
+		return nil, err
+	}
+	if u.Status != StatusActive {
+		return nil, v1.ErrorInvalidArgument("invalid argument: the account of status %s can not be deleted", u.Status)
+	}
+	admin, err := uc.uu.IsAdminUser(ctx, userId)
+	if err != nil {
+		return nil, err
+	}
+	if admin {
+		return nil, v1.ErrorBadGroupOperation("the account of admin can not be deleted")
+	}
+	if u.TOTP.Enabled {
+		if err = uc.uu.VerifySecondFactor(ctx, userId, code); err != nil {
+			return nil, err
+		}
+	}
+
+	deleteAt := time.Now().AddDate(0, 0, opts.graceDays)
+	AuditDiff(ctx, UserFieldStatus, u.Status.String(), StatusPendingDeletion.String())
+	u.Status = StatusPendingDeletion
+	u.DeleteAt = &deleteAt
+	res, err := uc.ur.Update(ctx, u, UserFieldStatus, UserFieldDeleteAt)
+	if err != nil {
+		return nil, err
+	}
+	if err = uc.ssr.RevokeAll(ctx, userId); err != nil {
+		return nil, err
+	}
+	return ToProtoUser(res)
+}
+
+// RestoreUser cancels the pending deletion of user.
+func (uc *AccountUsecase) RestoreUser(ctx context.Context, userId int64) (*v1.User, error) {
+	AuditTarget(ctx, AuditTargetUser, userId)
+	u, err := uc.ur.Get(ctx, userId, UserViewBasic)
+	if err != nil {
+		return nil, err
+	}
+	if u.Status != StatusPendingDeletion {
+		return nil, v1.ErrorInvalidArgument("invalid argument: the account is not pending deletion")
+	}
+
+	AuditDiff(ctx, UserFieldStatus, u.Status.String(), StatusActive.String())
+	u.Status = StatusActive
+	u.DeleteAt = nil
+	res, err := uc.ur.Update(ctx, u, UserFieldStatus, UserFieldDeleteAt)
+	if err != nil {
+		return nil, err
+	}
+	return ToProtoUser(res)
+}
+
+// PurgeDeletedUsers deletes the users whose grace period is over, it is run by the cron server. The audit events
+// performed by the users are kept until audit_retention_days.
+func (uc *AccountUsecase) PurgeDeletedUsers(ctx context.Context) error {
+	purged, err := uc.ur.PurgeDeleted(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+	for _, id := range purged {
+		// the sessions have been revoked on request, revoke again in case of signing in during the grace period
+		if err = uc.ssr.RevokeAll(ctx, id); err != nil {
+			return err
+		}
+	}
+	if len(purged) > 0 {
+		uc.log.Infof("%d deleted users purged", len(purged))
+	}
+	return nil
+}
+
+// ExportUser returns the profile, linked identities, access tokens, sessions, score history and the audit events
+// performed by the user.
+func (uc *AccountUsecase) ExportUser(ctx context.Context, userId int64) (*UserExport, error) {
+	u, err := uc.ur.Get(ctx, userId, UserViewBasic)
+	if err != nil {
+		return nil, err
+	}
+	res := &UserExport{User: u, ExportAt: time.Now()}
+
+	if res.Identities, err = uc.ir.ListByUser(ctx, userId); err != nil {
+		return nil, err
+	}
+	if res.AccessTokens, err = uc.tr.ListByUser(ctx, userId); err != nil {
+		return nil, err
+	}
+	if res.Sessions, err = uc.ssr.List(ctx, userId); err != nil {
+		return nil, err
+	}
+
+	for token := ""; ; {
+		page, lErr := uc.scr.List(ctx, userId, MaxPageSize, token)
+		if lErr != nil {
+			return nil, lErr
+		}
+		res.ScoreTransactions = append(res.ScoreTransactions, page.Transactions...)
+		if token = page.NextPageToken; token == "" {
+			break
+		}
+	}
+	for token := ""; ; {
+		page, lErr := uc.ar.List(ctx, &AuditFilter{ActorId: &userId}, MaxPageSize, token)
+		if lErr != nil {
+			return nil, lErr
+		}
+		res.AuditEvents = append(res.AuditEvents, page.Events...)
+		if token = page.NextPageToken; token == "" {
+			break
+		}
+	}
+	return res, nil
+}
+
+func (uc *AccountUsecase) options(ctx context.Context) (*accountOptions, error) {
+	options, err := uc.sr.ListByType(ctx, TypeAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	return &accountOptions{
+		graceDays:    int(settingInt(options, AccountDeletionGraceDays)),
+		reauthWindow: time.Duration(settingInt(options, AccountReauthWindow)) * time.Second,
+	}, nil
+}
+
+func ToProtoSession(s *Session) *v1.Session {
+	return &v1.Session{
+		Id:         s.Id,
+		SigninAt:   timestamppb.New(s.SigninAt),
+		RemoteAddr: s.RemoteAddr,
+		UserAgent:  s.UserAgent,
+		ExpireAt:   timestamppb.New(s.ExpireAt),
+	}
+}
+
+func ToProtoSessionList(s []*Session) []*v1.Session {
+	list := make([]*v1.Session, len(s))
+	for i, session := range s {
+		list[i] = ToProtoSession(session)
+	}
+	return list
+}
+
+func ToProtoUserExport(e *UserExport) (*v1.UserExport, error) {
+	u, err := ToProtoUser(e.User)
+	if err != nil {
+		return nil, err
+	}
+	return &v1.UserExport{
+		User:              u,
+		Identities:        ToProtoIdentityList(e.Identities),
+		AccessTokens:      ToProtoAccessTokenList(e.AccessTokens),
+		Sessions:          ToProtoSessionList(e.Sessions),
+		ScoreTransactions: ToProtoScoreTransactionList(e.ScoreTransactions),
+		AuditEvents:       ToProtoAuditEventList(e.AuditEvents),
+		ExportedAt:        timestamppb.New(e.ExportAt),
+	}, nil
+}
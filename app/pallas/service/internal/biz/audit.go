@@ -0,0 +1,247 @@
+package biz
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
+)
+
+// AuditEvent records who did what to which target, from where, and what was changed.
+type AuditEvent struct {
+	Id         int64                   `json:"id,omitempty"`
+	Action     string                  `json:"action,omitempty"`
+	ActorId    *int64                  `json:"actorId,omitempty"`
+	TargetType string                  `json:"targetType,omitempty"`
+	TargetId   string                  `json:"targetId,omitempty"`
+	RemoteAddr string                  `json:"remoteAddr,omitempty"`
+	RequestId  string                  `json:"requestId,omitempty"`
+	Success    bool                    `json:"success"`
+	Reason     string                  `json:"reason,omitempty"`
+	Diff       map[string]*AuditChange `json:"diff,omitempty"`
+	CreateAt   time.Time               `json:"createAt"`
+}
+
+type AuditChange struct {
+	Before any `json:"before"`
+	After  any `json:"after"`
+}
+
+// AuditTarget values.
+const (
+	AuditTargetUser    = "user"
+	AuditTargetGroup   = "group"
+	AuditTargetSetting = "setting"
+	AuditTargetEmail   = "email"
+)
+
+type AuditFilter struct {
+	ActorId    *int64
+	Action     string
+	TargetType string
+	TargetId   string
+	Success    *bool
+	Since      *time.Time
+	Until      *time.Time
+}
+
+type AuditEventPage struct {
+	Events        []*AuditEvent
+	NextPageToken string
+}
+
+type AuditRepo interface {
+	// Create writes the event asynchronously, so that the request is not blocked by the audit log.
+	Create(ctx context.Context, event *AuditEvent)
+	// List returns the events matched the filter, the latest first.
+	List(ctx context.Context, filter *AuditFilter, pageSize int, pageToken string) (*AuditEventPage, error)
+	// DeleteBefore deletes the events created before t, and returns the number of the events deleted.
+	DeleteBefore(ctx context.Context, t time.Time) (int, error)
+}
+
+type AuditUsecase struct {
+	ar  AuditRepo
+	sr  SettingRepo
+	log *log.Helper
+}
+
+func NewAuditUsecase(ar AuditRepo, sr SettingRepo, logger log.Logger) *AuditUsecase {
+	return &AuditUsecase{
+		ar:  ar,
+		sr:  sr,
+		log: log.NewHelper(logger),
+	}
+}
+
+// Record records the event unless the audit log is disabled.
+func (uc *AuditUsecase) Record(ctx context.Context, event *AuditEvent) {
+	enable, _, err := uc.options(ctx)
+	if err != nil {
+		// record anyway, the event is more important than the setting
+		uc.log.Warnf("failed to get audit options: %v", err)
+	}
+	if err == nil && !enable {
+		return
+	}
+	uc.ar.Create(ctx, event)
+}
+
+func (uc *AuditUsecase) ListEvents(
+	ctx context.Context,
+	filter *AuditFilter,
+	pageSize int,
+	pageToken string,
+) ([]*v1.AuditEvent, string, error) {
+	if pageSize > MaxPageSize {
+		pageSize = MaxPageSize
+	}
+	page, err := uc.ar.List(ctx, filter, pageSize, pageToken)
+	if err != nil {
+		return nil, "", err
+	}
+	return ToProtoAuditEventList(page.Events), page.NextPageToken, nil
+}
+
+// Purge deletes the events older than audit_retention_days, it is run by the cron server.
+func (uc *AuditUsecase) Purge(ctx context.Context) error {
+	_, days, err := uc.options(ctx)
+	if err != nil {
+		return err
+	}
+	if days == 0 {
+		return nil
+	}
+	n, err := uc.ar.DeleteBefore(ctx, time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		uc.log.Infof("%d audit events purged", n)
+	}
+	return nil
+}
+
+func (uc *AuditUsecase) options(ctx context.Context) (enable bool, retentionDays int, err error) {
+	options, err := uc.sr.ListByType(ctx, TypeAudit)
+	if err != nil {
+		return false, 0, err
+	}
+
+	return settingBool(options, AuditEnable), int(settingInt(options, AuditRetentionDays)), nil
+}
+
+type auditRecordKey struct{}
+
+// AuditRecord collects the actor, target and changes of the audited request, the usecases fill it
+// by AuditActor, AuditTarget and AuditDiff, and the audit middleware records it after the request.
+type AuditRecord struct {
+	mu         sync.Mutex
+	actorId    *int64
+	targetType string
+	targetId   string
+	diff       map[string]*AuditChange
+}
+
+// NewAuditContext returns a context carries a new AuditRecord.
+func NewAuditContext(ctx context.Context) (context.Context, *AuditRecord) {
+	r := &AuditRecord{}
+	return context.WithValue(ctx, auditRecordKey{}, r), r
+}
+
+// Fill sets the actor, target and changes collected to the event, the actor is kept if not collected.
+func (r *AuditRecord) Fill(e *AuditEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.actorId != nil {
+		e.ActorId = r.actorId
+	}
+	e.TargetType, e.TargetId = r.targetType, r.targetId
+	if len(r.diff) > 0 {
+		e.Diff = r.diff
+	}
+}
+
+// AuditActor sets the actor of the audited request, e.g. the user just signed in.
+func AuditActor(ctx context.Context, userId int64) {
+	if r, ok := ctx.Value(auditRecordKey{}).(*AuditRecord); ok {
+		r.mu.Lock()
+		r.actorId = &userId
+		r.mu.Unlock()
+	}
+}
+
+// AuditTarget sets the target of the audited request.
+func AuditTarget(ctx context.Context, targetType string, targetId any) {
+	if r, ok := ctx.Value(auditRecordKey{}).(*AuditRecord); ok {
+		r.mu.Lock()
+		r.targetType, r.targetId = targetType, fmt.Sprint(targetId)
+		r.mu.Unlock()
+	}
+}
+
+// AuditDiff records the change of the field if the value is changed.
+func AuditDiff(ctx context.Context, field string, before, after any) {
+	if reflect.DeepEqual(before, after) {
+		return
+	}
+	if r, ok := ctx.Value(auditRecordKey{}).(*AuditRecord); ok {
+		r.mu.Lock()
+		if r.diff == nil {
+			r.diff = make(map[string]*AuditChange)
+		}
+		r.diff[field] = &AuditChange{Before: before, After: after}
+		r.mu.Unlock()
+	}
+}
+
+func toProtoAuditValue(v any) *structpb.Value {
+	if v == nil {
+		return structpb.NewNullValue()
+	}
+	p, err := structpb.NewValue(v)
+	if err != nil {
+		// the types not supported by structpb, e.g. the named string types
+		return structpb.NewStringValue(fmt.Sprint(v))
+	}
+	return p
+}
+
+func ToProtoAuditEvent(e *AuditEvent) *v1.AuditEvent {
+	p := &v1.AuditEvent{
+		Id:         e.Id,
+		Action:     e.Action,
+		ActorId:    e.ActorId,
+		TargetType: e.TargetType,
+		TargetId:   e.TargetId,
+		RemoteAddr: e.RemoteAddr,
+		RequestId:  e.RequestId,
+		Success:    e.Success,
+		Reason:     e.Reason,
+		CreatedAt:  timestamppb.New(e.CreateAt),
+	}
+	if len(e.Diff) > 0 {
+		p.Diff = make(map[string]*v1.AuditEvent_Change, len(e.Diff))
+		for k, c := range e.Diff {
+			p.Diff[k] = &v1.AuditEvent_Change{
+				Before: toProtoAuditValue(c.Before),
+				After:  toProtoAuditValue(c.After),
+			}
+		}
+	}
+	return p
+}
+
+func ToProtoAuditEventList(e []*AuditEvent) []*v1.AuditEvent {
+	pbList := make([]*v1.AuditEvent, len(e))
+	for i, event := range e {
+		pbList[i] = ToProtoAuditEvent(event)
+	}
+	return pbList
+}
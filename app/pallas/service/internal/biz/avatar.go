@@ -0,0 +1,236 @@
+package biz
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+
+	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
+	"github.com/hominsu/pallas/pkg/avatar"
+)
+
+// Avatar is the uploaded avatar of user in one of the sizes.
+type Avatar struct {
+	Id       int64     `json:"id,omitempty"`
+	UserId   int64     `json:"userId,omitempty"`
+	Size     int       `json:"size,omitempty"`
+	Data     []byte    `json:"data,omitempty"`
+	ETag     string    `json:"etag,omitempty"`
+	CreateAt time.Time `json:"createAt"`
+}
+
+// AvatarImage is the avatar served, either the image or the url redirected to.
+type AvatarImage struct {
+	Data        []byte
+	ContentType string
+	ETag        string
+	RedirectURL string
+}
+
+// AvatarMode values.
+const (
+	AvatarModeIdenticon = "identicon"
+	AvatarModeGravatar  = "gravatar"
+)
+
+const (
+	defaultAvatarMaxSize      = 2 << 20
+	defaultAvatarMaxDimension = 4096
+	// maxAvatarSize is the largest size in avatar_sizes, it keeps the png under the column limit
+	maxAvatarSize = 512
+)
+
+var defaultAvatarSizes = []int{40, 100, 200}
+
+type AvatarRepo interface {
+	// Save replaces the avatars of user with the avatars in all the sizes, the used storage of user is updated
+	// in the same transaction, and it fails with STORAGE_QUOTA_EXCEEDED if the usage grows over quota.
+	Save(ctx context.Context, userId int64, avatars []*Avatar, quota uint64) error
+	// Get returns the avatar of user in the smallest size not less than size, or the largest one.
+	Get(ctx context.Context, userId int64, size int) (*Avatar, error)
+}
+
+type avatarOptions struct {
+	mode           string
+	gravatarServer string
+	maxSize        int64
+	maxDimension   int
+	sizes          []int
+}
+
+type AvatarUsecase struct {
+	ar  AvatarRepo
+	ur  UserRepo
+	gr  GroupRepo
+	sr  SettingRepo
+	log *log.Helper
+}
+
+func NewAvatarUsecase(ar AvatarRepo, ur UserRepo, gr GroupRepo, sr SettingRepo, logger log.Logger) *AvatarUsecase {
+	return &AvatarUsecase{
+		ar:  ar,
+		ur:  ur,
+		gr:  gr,
+		sr:  sr,
+		log: log.NewHelper(logger),
+	}
+}
+
+// UploadAvatar crops the center square of the image, and saves it resized to all the avatar_sizes, which are
+// counted in the used storage of user.
+func (uc *AvatarUsecase) UploadAvatar(ctx context.Context, userId int64, image []byte) error {
+	opts, err := uc.options(ctx)
+	if err != nil {
+		return err
+	}
+
+	img, err := avatar.Decode(bytes.NewReader(image), opts.maxSize, opts.maxDimension)
+	switch {
+	case errors.Is(err, avatar.ErrTooLarge):
+		return v1.ErrorInvalidArgument("invalid argument: image is larger than %d bytes", opts.maxSize)
+	case errors.Is(err, avatar.ErrDimensionTooLarge):
+		return v1.ErrorInvalidArgument("invalid argument: image is larger than %dx%d",
+			opts.maxDimension, opts.maxDimension)
+	case errors.Is(err, avatar.ErrUnsupportedFormat):
+		return v1.ErrorInvalidArgument("invalid argument: image must be png, jpeg or gif")
+	case err != nil:
+		return v1.ErrorInvalidArgument("invalid argument: decode image error: %v", err)
+	}
+
+	square := avatar.CropSquare(img)
+	avatars := make([]*Avatar, len(opts.sizes))
+	for i, size := range opts.sizes {
+		data, eErr := avatar.EncodePNG(avatar.Resize(square, size, size))
+		if eErr != nil {
+			return v1.ErrorInternal("encode avatar error: %v", eErr)
+		}
+		avatars[i] = &Avatar{
+			UserId: userId,
+			Size:   size,
+			Data:   data,
+			ETag:   avatarETag(data),
+		}
+	}
+	quota, err := userQuota(ctx, uc.ur, uc.gr, userId)
+	if err != nil {
+		return err
+	}
+	return uc.ar.Save(ctx, userId, avatars, quota)
+}
+
+// GetAvatar returns the avatar of user in the smallest avatar_sizes not less than size, the largest one
+// if size is 0. Without an upload, the identicon is generated, or redirects to the Gravatar by avatar_mode.
+// The url of the Gravatar carries the hash of the email, so that it is only revealed to the viewers signed in,
+// the others are served the identicon.
+func (uc *AvatarUsecase) GetAvatar(ctx context.Context, userId int64, size int, signedIn bool) (*AvatarImage, error) {
+	opts, err := uc.options(ctx)
+	if err != nil {
+		return nil, err
+	}
+	size = fitAvatarSize(opts.sizes, size)
+
+	res, err := uc.ar.Get(ctx, userId, size)
+	switch {
+	case err == nil:
+		return &AvatarImage{Data: res.Data, ContentType: "image/png", ETag: res.ETag}, nil
+	case !v1.IsNotFound(err):
+		return nil, err
+	}
+
+	u, err := uc.ur.Get(ctx, userId, UserViewBasic)
+	if err != nil {
+		return nil, err
+	}
+	if opts.mode == AvatarModeGravatar && signedIn {
+		return &AvatarImage{
+			RedirectURL: avatar.GravatarURL(opts.gravatarServer, u.Email, size, "identicon"),
+		}, nil
+	}
+
+	data, err := avatar.EncodePNG(avatar.Identicon([]byte(strconv.FormatInt(u.Id, 10)), size))
+	if err != nil {
+		return nil, v1.ErrorInternal("encode identicon error: %v", err)
+	}
+	return &AvatarImage{Data: data, ContentType: "image/png", ETag: avatarETag(data)}, nil
+}
+
+func (uc *AvatarUsecase) options(ctx context.Context) (*avatarOptions, error) {
+	options, err := uc.sr.ListByType(ctx, TypeAvatar)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &avatarOptions{
+		mode:           AvatarModeIdenticon,
+		gravatarServer: avatar.DefaultGravatarServer,
+		maxSize:        defaultAvatarMaxSize,
+		maxDimension:   defaultAvatarMaxDimension,
+		sizes:          defaultAvatarSizes,
+	}
+	if s, ok := options[AvatarMode]; ok && *s.Value == AvatarModeGravatar {
+		opts.mode = AvatarModeGravatar
+	}
+	if s, ok := options[AvatarGravatarServer]; ok && *s.Value != "" {
+		opts.gravatarServer = *s.Value
+	}
+	if s, ok := options[AvatarMaxSize]; ok {
+		if n, pErr := strconv.ParseInt(*s.Value, 10, 64); pErr == nil && n > 0 {
+			opts.maxSize = n
+		}
+	}
+	if s, ok := options[AvatarMaxDimension]; ok {
+		if n, pErr := strconv.Atoi(*s.Value); pErr == nil && n > 0 {
+			opts.maxDimension = n
+		}
+	}
+	if s, ok := options[AvatarSizes]; ok {
+		if sizes := parseAvatarSizes(*s.Value); len(sizes) > 0 {
+			opts.sizes = sizes
+		}
+	}
+	return opts, nil
+}
+
+// parseAvatarSizes parses the comma separated sizes, the invalid ones are ignored.
+func parseAvatarSizes(s string) []int {
+	var sizes []int
+	seen := make(map[int]struct{})
+	for _, v := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || n <= 0 || n > maxAvatarSize {
+			continue
+		}
+		if _, ok := seen[n]; ok {
+			continue
+		}
+		seen[n] = struct{}{}
+		sizes = append(sizes, n)
+	}
+	sort.Ints(sizes)
+	return sizes
+}
+
+// fitAvatarSize returns the smallest of the sorted sizes not less than size, or the largest one.
+func fitAvatarSize(sizes []int, size int) int {
+	if size > 0 {
+		for _, s := range sizes {
+			if s >= size {
+				return s
+			}
+		}
+	}
+	return sizes[len(sizes)-1]
+}
+
+func avatarETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
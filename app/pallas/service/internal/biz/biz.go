@@ -7,6 +7,14 @@ var ProviderSet = wire.NewSet(
 	NewUserUsecase,
 	NewGroupUsecase,
 	NewSettingUsecase,
+	NewOIDCUsecase,
+	NewAccessTokenUsecase,
+	NewScoreUsecase,
+	NewAuditUsecase,
+	NewAvatarUsecase,
+	NewAccountUsecase,
+	NewStorageUsecase,
+	NewCronUsecase,
 )
 
 const (
@@ -0,0 +1,82 @@
+package biz
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+)
+
+const (
+	// cronLease is how long a run is leased to the instance claimed it without extending, so that the run of a
+	// crashed instance is taken over
+	cronLease = time.Minute
+	// cronSlack is how early a job is due, so that the jitter of the tickers does not skip a run
+	cronSlack = 5 * time.Second
+)
+
+// CronRepo coordinates the runs of the periodic jobs among the instances, the time of the last run is kept in the
+// database so that it survives the restarts.
+type CronRepo interface {
+	// Claim claims the run of the job if it has not run since the time given, and is not leased to another
+	// instance. The run is leased to the instance for lease.
+	Claim(ctx context.Context, name string, since time.Time, lease time.Duration) (bool, error)
+	// Extend extends the lease of the run claimed.
+	Extend(ctx context.Context, name string, lease time.Duration) error
+	// Finish records the time the run started, and releases the lease.
+	Finish(ctx context.Context, name string, runAt time.Time) error
+}
+
+type CronUsecase struct {
+	cr  CronRepo
+	log *log.Helper
+}
+
+func NewCronUsecase(cr CronRepo, logger log.Logger) *CronUsecase {
+	return &CronUsecase{
+		cr:  cr,
+		log: log.NewHelper(logger),
+	}
+}
+
+// RunDue runs the job if it has not run in interval by any instance, and reports whether it ran. The run is
+// recorded whatever the result, the failed one is retried in the next interval like the succeeded one.
+func (uc *CronUsecase) RunDue(
+	ctx context.Context,
+	name string,
+	interval time.Duration,
+	run func(ctx context.Context) error,
+) (bool, error) {
+	start := time.Now()
+	ok, err := uc.cr.Claim(ctx, name, start.Add(-interval+cronSlack), cronLease)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(cronLease / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if eErr := uc.cr.Extend(context.Background(), name, cronLease); eErr != nil {
+					uc.log.Warnf("failed extending the lease of job %s: %v", name, eErr)
+				}
+			}
+		}
+	}()
+
+	err = run(ctx)
+	close(done)
+	<-stopped
+	// recorded even if ctx is done, otherwise the run is taken over once the lease expires
+	if fErr := uc.cr.Finish(context.Background(), name, start); fErr != nil {
+		uc.log.Warnf("failed finishing the run of job %s: %v", name, fErr)
+	}
+	return true, err
+}
@@ -9,17 +9,24 @@ import (
 	"google.golang.org/protobuf/types/known/timestamppb"
 
 	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
+	"github.com/hominsu/pallas/pkg/utils"
 )
 
 type Group struct {
-	Id          int64     `json:"id,omitempty"`
-	Name        string    `json:"name,omitempty"`
-	MaxStorage  uint64    `json:"maxStorage,omitempty"`
-	ShareEnable bool      `json:"shareEnable,omitempty"`
-	SpeedLimit  int64     `json:"speedLimit,omitempty"`
-	CreateAt    time.Time `json:"createAt"`
-	UpdateAt    time.Time `json:"updateAt"`
-	Users       []*User   `json:"users,omitempty"`
+	Id          int64  `json:"id,omitempty"`
+	Name        string `json:"name,omitempty"`
+	MaxStorage  uint64 `json:"maxStorage,omitempty"`
+	ShareEnable bool   `json:"shareEnable,omitempty"`
+	SpeedLimit  int64  `json:"speedLimit,omitempty"`
+	// Permissions are granted to the users of the group
+	Permissions []Permission `json:"permissions,omitempty"`
+	CreateAt    time.Time    `json:"createAt"`
+	UpdateAt    time.Time    `json:"updateAt"`
+	// Users are the first GroupUsersPreviewSize members with GroupViewWithEdgeIds, the members are listed by
+	// GroupUsecase.ListGroupUsers
+	Users []*User `json:"users,omitempty"`
+	// UserCount is the number of the members with GroupViewWithEdgeIds
+	UserCount int64 `json:"userCount,omitempty"`
 }
 
 type GroupView int32
@@ -30,6 +37,9 @@ const (
 	GroupViewWithEdgeIds     GroupView = 2
 )
 
+// GroupUsersPreviewSize is the number of the members carried by GroupViewWithEdgeIds.
+const GroupUsersPreviewSize = 20
+
 type GroupPage struct {
 	Groups        []*Group
 	NextPageToken string
@@ -39,7 +49,9 @@ type GroupRepo interface {
 	Create(ctx context.Context, group *Group) (*Group, error)
 	Get(ctx context.Context, groupId int64, groupView GroupView) (*Group, error)
 	GetByName(ctx context.Context, name string, groupView GroupView) (*Group, error)
-	Update(ctx context.Context, group *Group) (*Group, error)
+	// Update updates the fields of group, all the fields are updated if fields is empty.
+	Update(ctx context.Context, group *Group, fields ...string) (*Group, error)
+	// Delete deletes the group, which can not be the base group of a user upgraded by the score.
 	Delete(ctx context.Context, groupId int64) error
 	List(ctx context.Context, pageSize int, pageToken string, groupView GroupView) (*GroupPage, error)
 	BatchCreate(ctx context.Context, groups []*Group) ([]*Group, error)
@@ -47,21 +59,34 @@ type GroupRepo interface {
 
 type GroupUsecase struct {
 	repo GroupRepo
+	ur   UserRepo
 	log  *log.Helper
 }
 
-func NewGroupUsecase(repo GroupRepo, logger log.Logger) *GroupUsecase {
+func NewGroupUsecase(repo GroupRepo, ur UserRepo, logger log.Logger) *GroupUsecase {
 	return &GroupUsecase{
 		repo: repo,
+		ur:   ur,
 		log:  log.NewHelper(logger),
 	}
 }
 
-func (uc *GroupUsecase) CreateGroup(ctx context.Context, group *Group) (*v1.Group, error) {
+// CreateGroup creates the group, the operator can only grant the permissions held by it.
+func (uc *GroupUsecase) CreateGroup(ctx context.Context, operatorId int64, group *Group) (*v1.Group, error) {
+	if err := checkPermissions(group.Permissions); err != nil {
+		return nil, err
+	}
+	if err := checkGrant(ctx, uc.ur, uc.repo, operatorId, nil, group.Permissions); err != nil {
+		return nil, err
+	}
 	res, err := uc.repo.Create(ctx, group)
 	if err != nil {
 		return nil, err
 	}
+	AuditTarget(ctx, AuditTargetGroup, res.Id)
+	for _, field := range groupFields {
+		AuditDiff(ctx, field, nil, groupFieldValue(res, field))
+	}
 
 	protoGroup, err := ToProtoGroup(res)
 	if err != nil {
@@ -85,11 +110,38 @@ func (uc *GroupUsecase) GetGroup(ctx context.Context, groupId int64, view GroupV
 	return protoGroup, nil
 }
 
-func (uc *GroupUsecase) UpdateGroup(ctx context.Context, group *Group) (*v1.Group, error) {
-	res, err := uc.repo.Update(ctx, group)
+// UpdateGroup updates the fields of group in paths, the group can only be updated by admin. The operator can only
+// grant or revoke the permissions held by it, and no update can leave nobody granted PermissionUsersWrite.
+func (uc *GroupUsecase) UpdateGroup(
+	ctx context.Context,
+	operatorId int64,
+	group *Group,
+	paths []string,
+) (*v1.Group, error) {
+	if err := checkUpdateMask(paths, groupFields, groupWritableFields[RoleAdmin]); err != nil {
+		return nil, err
+	}
+	if err := checkPermissions(group.Permissions); err != nil {
+		return nil, err
+	}
+
+	AuditTarget(ctx, AuditTargetGroup, group.Id)
+	before, err := uc.repo.Get(ctx, group.Id, GroupViewBasic)
 	if err != nil {
 		return nil, err
 	}
+	if utils.StringsContain(paths, GroupFieldPermissions) {
+		if err = checkGrant(ctx, uc.ur, uc.repo, operatorId, before.Permissions, group.Permissions); err != nil {
+			return nil, err
+		}
+	}
+	res, err := uc.repo.Update(ctx, group, paths...)
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		AuditDiff(ctx, path, groupFieldValue(before, path), groupFieldValue(res, path))
+	}
 
 	protoGroup, err := ToProtoGroup(res)
 	if err != nil {
@@ -99,14 +151,30 @@ func (uc *GroupUsecase) UpdateGroup(ctx context.Context, group *Group) (*v1.Grou
 	return protoGroup, nil
 }
 
-func (uc *GroupUsecase) DeleteGroup(ctx context.Context, groupId int64) error {
-	res, err := uc.repo.Get(ctx, groupId, GroupViewWithEdgeIds)
+// DeleteGroup deletes the group, the members are moved to the group reassignTo first if it is not nil, otherwise
+// the group must be empty. The group upgrades based on the group expire into reassignTo as well.
+func (uc *GroupUsecase) DeleteGroup(ctx context.Context, operatorId, groupId int64, reassignTo *int64) error {
+	AuditTarget(ctx, AuditTargetGroup, groupId)
+	count, err := uc.ur.CountByGroup(ctx, groupId)
 	if err != nil {
 		return err
 	}
 
-	if len(res.Users) != 0 {
-		return v1.ErrorBadGroupOperation("group's user is not empty")
+	if count != 0 {
+		if reassignTo == nil {
+			return v1.ErrorBadGroupOperation("group's user is not empty")
+		}
+		moved, mErr := uc.moveUsers(ctx, operatorId, groupId, *reassignTo, nil)
+		if mErr != nil {
+			return mErr
+		}
+		AuditDiff(ctx, "reassign_to", nil, *reassignTo)
+		AuditDiff(ctx, "user_ids", nil, moved)
+	}
+	if reassignTo != nil {
+		if err = uc.ur.MoveBaseGroup(ctx, groupId, *reassignTo); err != nil {
+			return err
+		}
 	}
 
 	if err = uc.repo.Delete(ctx, groupId); err != nil {
@@ -115,6 +183,56 @@ func (uc *GroupUsecase) DeleteGroup(ctx context.Context, groupId int64) error {
 	return nil
 }
 
+// MoveUsers moves the users in userIds, or all the members if all is set, from the group fromGroupId to the group
+// toGroupId, and returns the ids of the users moved.
+func (uc *GroupUsecase) MoveUsers(
+	ctx context.Context,
+	operatorId int64,
+	fromGroupId, toGroupId int64,
+	userIds []int64,
+	all bool,
+) ([]int64, error) {
+	AuditTarget(ctx, AuditTargetGroup, fromGroupId)
+	if all {
+		userIds = nil
+	} else if len(userIds) == 0 {
+		return nil, v1.ErrorInvalidArgument("invalid argument: no user to move")
+	}
+
+	moved, err := uc.moveUsers(ctx, operatorId, fromGroupId, toGroupId, userIds)
+	if err != nil {
+		return nil, err
+	}
+	AuditDiff(ctx, "to_group_id", nil, toGroupId)
+	AuditDiff(ctx, "user_ids", nil, moved)
+	return moved, nil
+}
+
+// moveUsers moves the users between the groups, the operator can only move the users between the groups differing
+// in the permissions held by it. A group granting PermissionUsersWrite, such as the built-in Admin group, can never
+// be emptied, which is checked by UserRepo.MoveGroup in the transaction.
+func (uc *GroupUsecase) moveUsers(
+	ctx context.Context,
+	operatorId, fromGroupId, toGroupId int64,
+	userIds []int64,
+) ([]int64, error) {
+	if fromGroupId == toGroupId {
+		return nil, v1.ErrorBadGroupOperation("the users can not be moved to the same group")
+	}
+	from, err := uc.repo.Get(ctx, fromGroupId, GroupViewBasic)
+	if err != nil {
+		return nil, err
+	}
+	to, err := uc.repo.Get(ctx, toGroupId, GroupViewBasic)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkGrant(ctx, uc.ur, uc.repo, operatorId, from.Permissions, to.Permissions); err != nil {
+		return nil, err
+	}
+	return uc.ur.MoveGroup(ctx, fromGroupId, toGroupId, userIds)
+}
+
 func (uc *GroupUsecase) ListGroups(
 	ctx context.Context,
 	pageSize int,
@@ -135,6 +253,30 @@ func (uc *GroupUsecase) ListGroups(
 	return protoGroups, page.NextPageToken, nil
 }
 
+// ListGroupUsers lists the members of group matched the filter, which are ordered by id.
+func (uc *GroupUsecase) ListGroupUsers(
+	ctx context.Context,
+	groupId int64,
+	filter *UserFilter,
+	pageSize int,
+	pageToken string,
+) ([]*v1.User, string, error) {
+	if _, err := uc.repo.Get(ctx, groupId, GroupViewBasic); err != nil {
+		return nil, "", err
+	}
+	page, err := uc.ur.ListByGroup(ctx, groupId, filter, pageSize, pageToken)
+	if err != nil {
+		return nil, "", err
+	}
+
+	protoUsers, err := ToProtoUserList(page.Users)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return protoUsers, page.NextPageToken, nil
+}
+
 func ToGroup(p *v1.Group) (*Group, error) {
 	g := &Group{}
 	g.Id = p.GetId()
@@ -142,13 +284,15 @@ func ToGroup(p *v1.Group) (*Group, error) {
 	g.MaxStorage = p.GetMaxStorage()
 	g.ShareEnable = p.GetShareEnabled()
 	g.SpeedLimit = p.GetSpeedLimit()
+	g.Permissions = ToPermissionList(p.GetPermissions())
+	g.UserCount = p.GetUserCount()
 	g.CreateAt = p.GetCreatedAt().AsTime()
 	g.UpdateAt = p.GetUpdatedAt().AsTime()
 	for _, user := range p.Users {
 		g.Users = append(g.Users, &User{
 			Id:       user.GetId(),
 			NickName: user.GetNickName(),
-			Status:   toUserStatus(user.GetStatus()),
+			Status:   ToUserStatus(user.GetStatus()),
 		})
 	}
 	return g, nil
@@ -173,6 +317,8 @@ func ToProtoGroup(g *Group) (*v1.Group, error) {
 	p.MaxStorage = g.MaxStorage
 	p.ShareEnabled = g.ShareEnable
 	p.SpeedLimit = g.SpeedLimit
+	p.Permissions = toProtoPermissionList(g.Permissions)
+	p.UserCount = g.UserCount
 	p.CreatedAt = timestamppb.New(g.CreateAt)
 	p.UpdatedAt = timestamppb.New(g.UpdateAt)
 	for _, user := range g.Users {
@@ -0,0 +1,35 @@
+package biz
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The outcomes of the srp handshakes
+const (
+	// srpStarted is the handshake started by the A of client
+	srpStarted = "started"
+	// srpSucceeded is the handshake whose M1 matched
+	srpSucceeded = "succeeded"
+	// srpMismatch is the handshake whose M1 mismatched, i.e. the password is wrong
+	srpMismatch = "mismatch"
+	// srpExpired is the handshake not found, e.g. expired, by the M1 of client
+	srpExpired = "expired"
+	// srpInvalid is the handshake with the A of client invalid
+	srpInvalid = "invalid"
+	// srpRejected is the handshake of the user not found or not allowed to sign in
+	srpRejected = "rejected"
+	// srpError is the handshake failed by the errors of the server
+	srpError = "error"
+)
+
+var srpHandshakes = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "pallas",
+	Subsystem: "srp",
+	Name:      "handshakes_total",
+	Help:      "The steps of the srp handshakes of the sign-ins by the outcome.",
+}, []string{"outcome"})
+
+func observeSRP(outcome string) {
+	srpHandshakes.WithLabelValues(outcome).Inc()
+}
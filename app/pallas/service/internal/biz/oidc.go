@@ -0,0 +1,332 @@
+package biz
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
+	"github.com/hominsu/pallas/pkg/srp"
+)
+
+// Identity is an external OpenID Connect identity linked to a user.
+type Identity struct {
+	Id       int64     `json:"id,omitempty"`
+	UserId   int64     `json:"userId,omitempty"`
+	Provider string    `json:"provider,omitempty"`
+	Subject  string    `json:"subject,omitempty"`
+	Email    string    `json:"email,omitempty"`
+	CreateAt time.Time `json:"createAt"`
+	UpdateAt time.Time `json:"updateAt"`
+}
+
+type OIDCProvider struct {
+	Name          string
+	DisplayName   string
+	AutoProvision bool
+	LinkByEmail   bool
+}
+
+// OIDCClaims are the claims of the id token, mapped by the claim mapping of the provider.
+type OIDCClaims struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	NickName      string
+}
+
+// OIDCAuthRequest is an ongoing authorization code flow, it is kept on the server side and looked up by the state.
+type OIDCAuthRequest struct {
+	Provider     string `json:"provider"`
+	State        string `json:"state"`
+	Nonce        string `json:"nonce"`
+	CodeVerifier string `json:"codeVerifier"`
+	// LinkUserId is the signed-in user which the identity will be linked to, zero for signin
+	LinkUserId int64 `json:"linkUserId,omitempty"`
+	// Binding is the hash of the token kept by the user agent started the flow, only which can complete it
+	Binding string `json:"binding"`
+}
+
+type IdentityRepo interface {
+	Create(ctx context.Context, identity *Identity) (*Identity, error)
+	GetBySubject(ctx context.Context, provider, subject string) (*Identity, error)
+	ListByUser(ctx context.Context, userId int64) ([]*Identity, error)
+	Delete(ctx context.Context, userId int64, provider string) error
+}
+
+type OIDCRepo interface {
+	ListProviders(ctx context.Context) []*OIDCProvider
+	GetProvider(ctx context.Context, name string) (*OIDCProvider, error)
+	// AuthCodeURL returns the authorization endpoint url with the state, nonce and PKCE challenge of req
+	AuthCodeURL(ctx context.Context, req *OIDCAuthRequest) (string, error)
+	// Exchange redeems the code with the PKCE verifier of req, and returns the claims of the verified id token
+	Exchange(ctx context.Context, req *OIDCAuthRequest, code string) (*OIDCClaims, error)
+
+	SaveAuthRequest(ctx context.Context, req *OIDCAuthRequest) error
+	// TakeAuthRequest returns and removes the auth request, so a state can only be used once
+	TakeAuthRequest(ctx context.Context, state string) (*OIDCAuthRequest, error)
+}
+
+type OIDCUsecase struct {
+	ir     IdentityRepo
+	or     OIDCRepo
+	ur     UserRepo
+	gr     GroupRepo
+	sr     SettingRepo
+	params *srp.Params
+	log    *log.Helper
+}
+
+func NewOIDCUsecase(
+	ir IdentityRepo,
+	or OIDCRepo,
+	ur UserRepo,
+	gr GroupRepo,
+	sr SettingRepo,
+	params *srp.Params,
+	logger log.Logger,
+) *OIDCUsecase {
+	return &OIDCUsecase{
+		ir:     ir,
+		or:     or,
+		ur:     ur,
+		gr:     gr,
+		sr:     sr,
+		params: params,
+		log:    log.NewHelper(logger),
+	}
+}
+
+func (uc *OIDCUsecase) ListProviders(ctx context.Context) []*OIDCProvider {
+	return uc.or.ListProviders(ctx)
+}
+
+// BeginAuth starts the authorization code flow with PKCE, and returns the url the user agent should be
+// redirected to, and the binding the user agent must keep and present to Signin, e.g. in its session, so that
+// the flow cannot be completed by another user agent. If linkUserId is not zero, the identity will be linked to
+// the user on completion.
+func (uc *OIDCUsecase) BeginAuth(ctx context.Context, provider string, linkUserId int64) (string, string, error) {
+	if _, err := uc.or.GetProvider(ctx, provider); err != nil {
+		return "", "", err
+	}
+
+	var (
+		req     = &OIDCAuthRequest{Provider: provider, LinkUserId: linkUserId}
+		binding string
+		err     error
+	)
+	if req.State, err = randomToken(); err != nil {
+		return "", "", v1.ErrorInternal("generate state error: %v", err)
+	}
+	if req.Nonce, err = randomToken(); err != nil {
+		return "", "", v1.ErrorInternal("generate nonce error: %v", err)
+	}
+	if req.CodeVerifier, err = randomToken(); err != nil {
+		return "", "", v1.ErrorInternal("generate code verifier error: %v", err)
+	}
+	if binding, err = randomToken(); err != nil {
+		return "", "", v1.ErrorInternal("generate binding error: %v", err)
+	}
+	req.Binding = hashBinding(binding)
+
+	if err = uc.or.SaveAuthRequest(ctx, req); err != nil {
+		return "", "", err
+	}
+	authURL, err := uc.or.AuthCodeURL(ctx, req)
+	if err != nil {
+		return "", "", err
+	}
+	return authURL, binding, nil
+}
+
+// Signin completes the authorization code flow started by the user agent presenting binding, and returns the user
+// the identity belongs to. An unknown identity is linked to the requesting user, the user with the same verified
+// email, or a user provisioned in register_default_group, depending on the provider. The flow linking the identity
+// must be completed in the session of the linking user, signedInUserId is the user signed in by the session.
+func (uc *OIDCUsecase) Signin(
+	ctx context.Context,
+	provider, state, code, binding string,
+	signedInUserId int64,
+) (*User, error) {
+	req, err := uc.or.TakeAuthRequest(ctx, state)
+	if err != nil {
+		return nil, err
+	}
+	if req.Provider != provider {
+		return nil, v1.ErrorOidcOperation("state mismatch")
+	}
+	if binding == "" || subtle.ConstantTimeCompare([]byte(req.Binding), []byte(hashBinding(binding))) != 1 {
+		return nil, v1.ErrorOidcOperation("state is not bound to the user agent")
+	}
+	if req.LinkUserId != 0 && req.LinkUserId != signedInUserId {
+		return nil, v1.ErrorOidcOperation("identity must be linked in the session of the user")
+	}
+	p, err := uc.or.GetProvider(ctx, provider)
+	if err != nil {
+		return nil, err
+	}
+	claims, err := uc.or.Exchange(ctx, req, code)
+	if err != nil {
+		return nil, err
+	}
+
+	identity, err := uc.ir.GetBySubject(ctx, provider, claims.Subject)
+	switch {
+	case err == nil:
+		if req.LinkUserId != 0 && req.LinkUserId != identity.UserId {
+			return nil, v1.ErrorConflict("identity is linked to another user")
+		}
+		u, err := uc.ur.Get(ctx, identity.UserId, UserViewBasic)
+		if err != nil {
+			return nil, err
+		}
+		AuditTarget(ctx, AuditTargetUser, u.Id)
+		if err = CheckSigninStatus(u.Status); err != nil {
+			return nil, err
+		}
+		AuditActor(ctx, u.Id)
+		return u, nil
+	case !v1.IsNotFound(err):
+		return nil, err
+	}
+
+	var u *User
+	if req.LinkUserId != 0 {
+		u, err = uc.ur.Get(ctx, req.LinkUserId, UserViewBasic)
+	} else {
+		u, err = uc.matchOrProvision(ctx, p, claims)
+	}
+	if err != nil {
+		return nil, err
+	}
+	AuditTarget(ctx, AuditTargetUser, u.Id)
+	if err = CheckSigninStatus(u.Status); err != nil {
+		return nil, err
+	}
+
+	if _, err = uc.ir.Create(ctx, &Identity{
+		UserId:   u.Id,
+		Provider: provider,
+		Subject:  claims.Subject,
+		Email:    claims.Email,
+	}); err != nil {
+		return nil, err
+	}
+	AuditActor(ctx, u.Id)
+	AuditDiff(ctx, "identity", nil, provider)
+	return u, nil
+}
+
+func (uc *OIDCUsecase) ListIdentities(ctx context.Context, userId int64) ([]*Identity, error) {
+	return uc.ir.ListByUser(ctx, userId)
+}
+
+func (uc *OIDCUsecase) UnlinkIdentity(ctx context.Context, userId int64, provider string) error {
+	return uc.ir.Delete(ctx, userId, provider)
+}
+
+func (uc *OIDCUsecase) matchOrProvision(ctx context.Context, p *OIDCProvider, claims *OIDCClaims) (*User, error) {
+	if p.LinkByEmail && claims.EmailVerified && claims.Email != "" {
+		u, err := uc.ur.GetByEmail(ctx, claims.Email, UserViewBasic)
+		switch {
+		case err == nil:
+			return u, nil
+		case !v1.IsNotFound(err):
+			return nil, err
+		}
+	}
+
+	if !p.AutoProvision {
+		return nil, v1.ErrorOidcOperation("no user is linked to the identity")
+	}
+	if claims.Email == "" {
+		return nil, v1.ErrorOidcOperation("email claim is required to provision user")
+	}
+	return uc.provision(ctx, claims)
+}
+
+// provision creates an active user in register_default_group. The user signs in by the identity,
+// the password is random and can be reset later.
+func (uc *OIDCUsecase) provision(ctx context.Context, claims *OIDCClaims) (*User, error) {
+	options, err := uc.sr.ListByType(ctx, TypeRegister)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkMailFilter(options, claims.Email); err != nil {
+		return nil, err
+	}
+
+	group, err := uc.gr.GetByName(ctx, settingValue(options, RegisterDefaultGroup), GroupViewBasic)
+	if err != nil {
+		return nil, err
+	}
+
+	nickName := claims.NickName
+	if nickName == "" {
+		nickName = strings.Split(claims.Email, "@")[0]
+	}
+	salt, err := randomToken()
+	if err != nil {
+		return nil, v1.ErrorInternal("generate salt error: %v", err)
+	}
+	password, err := randomToken()
+	if err != nil {
+		return nil, v1.ErrorInternal("generate password error: %v", err)
+	}
+
+	u, err := uc.ur.Create(ctx, &User{
+		Email:      claims.Email,
+		NickName:   nickName,
+		Salt:       []byte(salt),
+		Verifier:   srp.ComputeVerifier(uc.params, []byte(salt), []byte(claims.Email), []byte(password)),
+		Storage:    0,
+		Score:      0,
+		Status:     StatusActive,
+		OwnerGroup: &Group{Id: group.Id},
+	})
+	if err != nil && v1.IsConflict(err) {
+		return nil, v1.ErrorEmailExisted("email already in use")
+	}
+	return u, err
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashBinding(binding string) string {
+	sum := sha256.Sum256([]byte(binding))
+	return hex.EncodeToString(sum[:])
+}
+
+func ToProtoIdentity(i *Identity) *v1.Identity {
+	return &v1.Identity{
+		Id:        i.Id,
+		UserId:    i.UserId,
+		Provider:  i.Provider,
+		Subject:   i.Subject,
+		Email:     i.Email,
+		CreatedAt: timestamppb.New(i.CreateAt),
+		UpdatedAt: timestamppb.New(i.UpdateAt),
+	}
+}
+
+func ToProtoIdentityList(i []*Identity) []*v1.Identity {
+	pbList := make([]*v1.Identity, len(i))
+	for idx, identity := range i {
+		pbList[idx] = ToProtoIdentity(identity)
+	}
+	return pbList
+}
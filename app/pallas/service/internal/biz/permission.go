@@ -0,0 +1,134 @@
+package biz
+
+import (
+	"context"
+
+	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
+)
+
+// Permission is granted to the users of a group, it is required by the operations of AdminService.
+type Permission string
+
+// Permission values.
+const (
+	PermissionUsersRead      Permission = "users.read"
+	PermissionUsersWrite     Permission = "users.write"
+	PermissionGroupsRead     Permission = "groups.read"
+	PermissionGroupsWrite    Permission = "groups.write"
+	PermissionSettingsRead   Permission = "settings.read"
+	PermissionSettingsWrite  Permission = "settings.write"
+	PermissionAuditEventRead Permission = "audit_events.read"
+)
+
+// AllPermissions are granted to the built-in Admin group.
+var AllPermissions = []Permission{
+	PermissionUsersRead,
+	PermissionUsersWrite,
+	PermissionGroupsRead,
+	PermissionGroupsWrite,
+	PermissionSettingsRead,
+	PermissionSettingsWrite,
+	PermissionAuditEventRead,
+}
+
+func (p Permission) String() string {
+	return string(p)
+}
+
+// HasPermission reports whether p is in the permissions.
+func HasPermission(permissions []Permission, p Permission) bool {
+	for _, v := range permissions {
+		if v == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Permissions returns the permissions of user, which are granted by the group of user. The user and the group
+// are both served by the cache, and invalidated on update, so that the change of the group applies at once.
+func (uc *UserUsecase) Permissions(ctx context.Context, userId int64) ([]Permission, error) {
+	return userPermissions(ctx, uc.ur, uc.gr, userId)
+}
+
+// HasPermission reports whether user is granted the permission p.
+func (uc *UserUsecase) HasPermission(ctx context.Context, userId int64, p Permission) (bool, error) {
+	permissions, err := uc.Permissions(ctx, userId)
+	if err != nil {
+		return false, err
+	}
+	return HasPermission(permissions, p), nil
+}
+
+// IsAdminUser reports whether user is granted any permission, such a user can use the admin scope of access
+// token, and can neither delete the account nor be moved to another group by the score.
+func (uc *UserUsecase) IsAdminUser(ctx context.Context, userId int64) (bool, error) {
+	permissions, err := uc.Permissions(ctx, userId)
+	if err != nil {
+		return false, err
+	}
+	return len(permissions) > 0, nil
+}
+
+func userPermissions(ctx context.Context, ur UserRepo, gr GroupRepo, userId int64) ([]Permission, error) {
+	u, err := ur.Get(ctx, userId, UserViewBasic)
+	if err != nil {
+		return nil, err
+	}
+	g, err := gr.Get(ctx, u.GroupId, GroupViewBasic)
+	if err != nil {
+		return nil, err
+	}
+	return g.Permissions, nil
+}
+
+// checkPermissions rejects the unknown permissions.
+func checkPermissions(permissions []Permission) error {
+	for _, p := range permissions {
+		if !HasPermission(AllPermissions, p) {
+			return v1.ErrorInvalidArgument("invalid argument: unknown permission %q", p)
+		}
+	}
+	return nil
+}
+
+// checkGrant rejects the change from the permissions before to after, if any permission granted or revoked is not
+// held by the operator, so that the operator can neither grant a permission to its own group nor move itself, or
+// another user, to a group granting more.
+func checkGrant(ctx context.Context, ur UserRepo, gr GroupRepo, operatorId int64, before, after []Permission) error {
+	held, err := userPermissions(ctx, ur, gr, operatorId)
+	if err != nil {
+		return err
+	}
+	for _, p := range AllPermissions {
+		if HasPermission(before, p) != HasPermission(after, p) && !HasPermission(held, p) {
+			return v1.ErrorBadGroupOperation("the permission %s is not held by the operator", p)
+		}
+	}
+	return nil
+}
+
+// permissionValues converts the permissions to the values of audit diff.
+func permissionValues(permissions []Permission) []any {
+	list := make([]any, len(permissions))
+	for i, p := range permissions {
+		list[i] = string(p)
+	}
+	return list
+}
+
+func ToPermissionList(p []string) []Permission {
+	list := make([]Permission, len(p))
+	for i, v := range p {
+		list[i] = Permission(v)
+	}
+	return list
+}
+
+func toProtoPermissionList(p []Permission) []string {
+	list := make([]string, len(p))
+	for i, v := range p {
+		list[i] = string(v)
+	}
+	return list
+}
@@ -0,0 +1,327 @@
+package biz
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
+	"github.com/hominsu/pallas/pkg/utils"
+)
+
+// ScoreTransaction is an entry of the append-only score ledger, the score of the user is the balance of
+// the latest transaction.
+type ScoreTransaction struct {
+	Id         int64       `json:"id,omitempty"`
+	UserId     int64       `json:"userId,omitempty"`
+	Amount     int64       `json:"amount,omitempty"`
+	Balance    int64       `json:"balance,omitempty"`
+	Reason     ScoreReason `json:"reason,omitempty"`
+	Note       string      `json:"note,omitempty"`
+	OperatorId *int64      `json:"operatorId,omitempty"`
+	// IdempotencyKey makes the transaction happen at most once per user
+	IdempotencyKey *string   `json:"-"`
+	CreateAt       time.Time `json:"createAt"`
+}
+
+type ScoreReason string
+
+// ScoreReason values.
+const (
+	ReasonCheckin       ScoreReason = "checkin"
+	ReasonGrant         ScoreReason = "grant"
+	ReasonRedeemStorage ScoreReason = "redeem_storage"
+	ReasonRedeemGroup   ScoreReason = "redeem_group"
+)
+
+func (r ScoreReason) String() string {
+	return string(r)
+}
+
+// ScoreEffect is applied to the user in the same db transaction as the score transaction.
+type ScoreEffect struct {
+	// Storage is added to the storage of the user
+	Storage uint64
+	// Group moves the user to the group until it expires
+	Group *GroupUpgrade
+}
+
+type GroupUpgrade struct {
+	GroupId int64
+	// BaseGroupId is the group the user returns to when the upgrade expires
+	BaseGroupId int64
+	ExpireAt    time.Time
+}
+
+type ScoreTransactionPage struct {
+	Transactions  []*ScoreTransaction
+	NextPageToken string
+}
+
+type ScoreRepo interface {
+	// Apply appends the transaction to the ledger, adds the amount to the score of the user and applies
+	// the effect in one db transaction. The balance of the transaction is filled, and the score of the user
+	// can not be negative.
+	Apply(ctx context.Context, t *ScoreTransaction, effect *ScoreEffect) (*ScoreTransaction, error)
+	// List returns the transactions of the user, the latest first.
+	List(ctx context.Context, userId int64, pageSize int, pageToken string) (*ScoreTransactionPage, error)
+	// ExpireGroupUpgrades moves the users whose group upgrade expired before t back to their base group,
+	// and returns the number of the users moved. The users failed are logged and left to the next run.
+	ExpireGroupUpgrades(ctx context.Context, t time.Time) (int, error)
+}
+
+const (
+	defaultScoreCheckinAmount = 10
+	defaultScoreStoragePrice  = 100
+	defaultScoreUpgradeGroup  = "User"
+	defaultScoreUpgradePrice  = 50
+)
+
+type scoreOptions struct {
+	checkinEnable bool
+	checkinAmount int64
+	// storagePrice is the score of 1 GiB storage
+	storagePrice int64
+	upgradeGroup string
+	// upgradePrice is the score of 1 day group upgrade
+	upgradePrice int64
+}
+
+type ScoreUsecase struct {
+	scr ScoreRepo
+	ur  UserRepo
+	gr  GroupRepo
+	sr  SettingRepo
+	log *log.Helper
+}
+
+func NewScoreUsecase(scr ScoreRepo, ur UserRepo, gr GroupRepo, sr SettingRepo, logger log.Logger) *ScoreUsecase {
+	return &ScoreUsecase{
+		scr: scr,
+		ur:  ur,
+		gr:  gr,
+		sr:  sr,
+		log: log.NewHelper(logger),
+	}
+}
+
+// Checkin earns the score of the daily check-in, a user can only check in once a day.
+func (uc *ScoreUsecase) Checkin(ctx context.Context, userId int64) (*ScoreTransaction, error) {
+	opts, err := uc.options(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.checkinEnable {
+		return nil, v1.ErrorInvalidArgument("check-in is disabled")
+	}
+
+	key := "checkin:" + time.Now().Format("2006-01-02")
+	res, err := uc.scr.Apply(ctx, &ScoreTransaction{
+		UserId:         userId,
+		Amount:         opts.checkinAmount,
+		Reason:         ReasonCheckin,
+		IdempotencyKey: &key,
+	}, nil)
+	if err != nil && v1.IsConflict(err) {
+		return nil, v1.ErrorConflict("already checked in today")
+	}
+	return res, err
+}
+
+// Grant grants the score to the user on behalf of admin, a negative amount deducts the score.
+func (uc *ScoreUsecase) Grant(
+	ctx context.Context,
+	operatorId, userId, amount int64,
+	note string,
+) (*ScoreTransaction, error) {
+	AuditTarget(ctx, AuditTargetUser, userId)
+	if amount == 0 {
+		return nil, v1.ErrorInvalidArgument("invalid argument: zero amount")
+	}
+	res, err := uc.scr.Apply(ctx, &ScoreTransaction{
+		UserId:     userId,
+		Amount:     amount,
+		Reason:     ReasonGrant,
+		Note:       note,
+		OperatorId: &operatorId,
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	AuditDiff(ctx, UserFieldScore, res.Balance-res.Amount, res.Balance)
+	return res, nil
+}
+
+// SetScore grants the difference to the user on behalf of admin, so the score of the user becomes score.
+func (uc *ScoreUsecase) SetScore(ctx context.Context, operatorId, userId, score int64) (*ScoreTransaction, error) {
+	u, err := uc.ur.Get(ctx, userId, UserViewBasic)
+	if err != nil {
+		return nil, err
+	}
+	if u.Score == score {
+		return nil, nil
+	}
+	return uc.Grant(ctx, operatorId, userId, score-u.Score, "adjust")
+}
+
+// RedeemStorage redeems the score for the extra storage in GiB, the storage is permanent.
+func (uc *ScoreUsecase) RedeemStorage(ctx context.Context, userId, gib int64) (*ScoreTransaction, error) {
+	if gib <= 0 {
+		return nil, v1.ErrorInvalidArgument("invalid argument: quantity must be positive")
+	}
+	opts, err := uc.options(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return uc.scr.Apply(ctx, &ScoreTransaction{
+		UserId: userId,
+		Amount: -gib * opts.storagePrice,
+		Reason: ReasonRedeemStorage,
+		Note:   strconv.FormatInt(gib, 10) + " GiB",
+	}, &ScoreEffect{Storage: uint64(gib) * utils.GibiByte})
+}
+
+// RedeemGroup redeems the score for the days of the group upgrade, the user is moved to score_upgrade_group
+// and returns to the previous group when the upgrade expires. Redeem again during the upgrade extends it.
+func (uc *ScoreUsecase) RedeemGroup(ctx context.Context, userId, days int64) (*ScoreTransaction, error) {
+	if days <= 0 {
+		return nil, v1.ErrorInvalidArgument("invalid argument: quantity must be positive")
+	}
+	opts, err := uc.options(ctx)
+	if err != nil {
+		return nil, err
+	}
+	target, err := uc.gr.GetByName(ctx, opts.upgradeGroup, GroupViewBasic)
+	if err != nil {
+		return nil, err
+	}
+	u, err := uc.ur.Get(ctx, userId, UserViewBasic)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	upgrade := &GroupUpgrade{GroupId: target.Id, BaseGroupId: u.GroupId, ExpireAt: now}
+	switch {
+	case u.GroupExpireAt != nil && u.BaseGroupId != nil && u.GroupId == target.Id:
+		// extend the current upgrade
+		upgrade.BaseGroupId = *u.BaseGroupId
+		if u.GroupExpireAt.After(now) {
+			upgrade.ExpireAt = *u.GroupExpireAt
+		}
+	case u.GroupId == target.Id:
+		return nil, v1.ErrorInvalidArgument("user is already in group %s", target.Name)
+	default:
+		// moving the user out of the group would revoke the permissions
+		permissions, pErr := userPermissions(ctx, uc.ur, uc.gr, userId)
+		if pErr != nil {
+			return nil, pErr
+		}
+		if len(permissions) > 0 {
+			return nil, v1.ErrorInvalidArgument("admin user can not be upgraded")
+		}
+	}
+	upgrade.ExpireAt = upgrade.ExpireAt.Add(time.Duration(days) * 24 * time.Hour)
+
+	return uc.scr.Apply(ctx, &ScoreTransaction{
+		UserId: userId,
+		Amount: -days * opts.upgradePrice,
+		Reason: ReasonRedeemGroup,
+		Note:   target.Name + " for " + strconv.FormatInt(days, 10) + " days",
+	}, &ScoreEffect{Group: upgrade})
+}
+
+func (uc *ScoreUsecase) ListTransactions(
+	ctx context.Context,
+	userId int64,
+	pageSize int,
+	pageToken string,
+) ([]*v1.ScoreTransaction, string, error) {
+	if pageSize > MaxPageSize {
+		pageSize = MaxPageSize
+	}
+	page, err := uc.scr.List(ctx, userId, pageSize, pageToken)
+	if err != nil {
+		return nil, "", err
+	}
+	return ToProtoScoreTransactionList(page.Transactions), page.NextPageToken, nil
+}
+
+// ExpireGroupUpgrades moves the users whose group upgrade expired back to their previous group,
+// it is run by the cron server.
+func (uc *ScoreUsecase) ExpireGroupUpgrades(ctx context.Context) error {
+	n, err := uc.scr.ExpireGroupUpgrades(ctx, time.Now())
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		uc.log.Infof("%d group upgrades expired", n)
+	}
+	return nil
+}
+
+func (uc *ScoreUsecase) options(ctx context.Context) (*scoreOptions, error) {
+	options, err := uc.sr.ListByType(ctx, TypeScore)
+	if err != nil {
+		return nil, err
+	}
+
+	opts := &scoreOptions{
+		checkinEnable: true,
+		checkinAmount: defaultScoreCheckinAmount,
+		storagePrice:  defaultScoreStoragePrice,
+		upgradeGroup:  defaultScoreUpgradeGroup,
+		upgradePrice:  defaultScoreUpgradePrice,
+	}
+	if s, ok := options[ScoreCheckinEnable]; ok {
+		opts.checkinEnable = *s.Value == "true"
+	}
+	if s, ok := options[ScoreUpgradeGroup]; ok && *s.Value != "" {
+		opts.upgradeGroup = *s.Value
+	}
+	for name, v := range map[SettingName]*int64{
+		ScoreCheckinAmount: &opts.checkinAmount,
+		ScoreStoragePrice:  &opts.storagePrice,
+		ScoreUpgradePrice:  &opts.upgradePrice,
+	} {
+		if s, ok := options[name]; ok {
+			if n, pErr := strconv.ParseInt(*s.Value, 10, 64); pErr == nil && n >= 0 {
+				*v = n
+			}
+		}
+	}
+	return opts, nil
+}
+
+func toProtoScoreReason(r ScoreReason) v1.ScoreTransaction_Reason {
+	if v, ok := v1.ScoreTransaction_Reason_value[strings.ToUpper(string(r))]; ok {
+		return v1.ScoreTransaction_Reason(v)
+	}
+	return v1.ScoreTransaction_REASON_UNSPECIFIED
+}
+
+func ToProtoScoreTransaction(t *ScoreTransaction) *v1.ScoreTransaction {
+	return &v1.ScoreTransaction{
+		Id:         t.Id,
+		UserId:     t.UserId,
+		Amount:     t.Amount,
+		Balance:    t.Balance,
+		Reason:     toProtoScoreReason(t.Reason),
+		Note:       t.Note,
+		OperatorId: t.OperatorId,
+		CreatedAt:  timestamppb.New(t.CreateAt),
+	}
+}
+
+func ToProtoScoreTransactionList(t []*ScoreTransaction) []*v1.ScoreTransaction {
+	pbList := make([]*v1.ScoreTransaction, len(t))
+	for i, transaction := range t {
+		pbList[i] = ToProtoScoreTransaction(transaction)
+	}
+	return pbList
+}
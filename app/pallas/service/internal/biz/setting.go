@@ -2,8 +2,12 @@ package biz
 
 import (
 	"context"
+	"sort"
+	"strings"
 
 	"github.com/go-kratos/kratos/v2/log"
+
+	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
 )
 
 type Setting struct {
@@ -23,6 +27,50 @@ const (
 	// is disabled, "blacklist" indicates the blacklist, and "whitelist" indicates the whitelist
 	RegisterMailFilter     SettingName = "register_mail_filter"
 	RegisterMailFilterList SettingName = "register_mail_filter_list"
+
+	// AuthTOTPIssuer is the issuer shown in the authenticator apps
+	AuthTOTPIssuer SettingName = "auth_totp_issuer"
+	// AuthTOTPSkew is the number of periods before and after the current one that are also accepted
+	AuthTOTPSkew SettingName = "auth_totp_skew"
+	// AuthTOTPRecoveryCodes is the number of recovery codes generated on enrollment
+	AuthTOTPRecoveryCodes SettingName = "auth_totp_recovery_codes"
+
+	// ScoreCheckinEnable indicates whether the daily check-in is enabled
+	ScoreCheckinEnable SettingName = "score_checkin_enable"
+	// ScoreCheckinAmount is the score earned by the daily check-in
+	ScoreCheckinAmount SettingName = "score_checkin_amount"
+	// ScoreStoragePrice is the score of 1 GiB extra storage
+	ScoreStoragePrice SettingName = "score_storage_price"
+	// ScoreUpgradeGroup is the name of the group which can be upgraded to by score
+	ScoreUpgradeGroup SettingName = "score_upgrade_group"
+	// ScoreUpgradePrice is the score of 1 day group upgrade
+	ScoreUpgradePrice SettingName = "score_upgrade_price"
+
+	// AuditEnable indicates whether the audit events are recorded
+	AuditEnable SettingName = "audit_enable"
+	// AuditRetentionDays is the number of days the audit events are kept, 0 keeps them forever
+	AuditRetentionDays SettingName = "audit_retention_days"
+
+	// AvatarMode is the avatar of the users without an upload, "identicon" generates the identicon,
+	// and "gravatar" redirects the viewers signed in to the Gravatar
+	AvatarMode SettingName = "avatar_mode"
+	// AvatarGravatarServer is the Gravatar server, or a mirror of it
+	AvatarGravatarServer SettingName = "avatar_gravatar_server"
+	// AvatarMaxSize is the maximum size of the uploaded image in bytes
+	AvatarMaxSize SettingName = "avatar_max_size"
+	// AvatarMaxDimension is the maximum width and height of the uploaded image in pixels
+	AvatarMaxDimension SettingName = "avatar_max_dimension"
+	// AvatarSizes is the comma separated sizes the uploaded avatar is resized to, at most 512
+	AvatarSizes SettingName = "avatar_sizes"
+
+	// AccountDeletionGraceDays is the number of days the account pending deletion can be restored before purged
+	AccountDeletionGraceDays SettingName = "account_deletion_grace_days"
+	// AccountReauthWindow is the number of seconds since signin the deletion of account is allowed,
+	// the user must sign in again after that
+	AccountReauthWindow SettingName = "account_reauth_window"
+
+	// UploadOveruseGraceHours is the number of hours the user over quota is allowed before overuse banned
+	UploadOveruseGraceHours SettingName = "upload_overuse_grace_hours"
 )
 
 type SettingType string
@@ -43,6 +91,8 @@ const (
 	TypeTask     SettingType = "task"
 	TypeAuth     SettingType = "auth"
 	TypeCron     SettingType = "cron"
+	TypeAudit    SettingType = "audit"
+	TypeAccount  SettingType = "account"
 )
 
 func (s SettingType) String() string {
@@ -63,12 +113,129 @@ type SettingRepo interface {
 
 type SettingUsecase struct {
 	repo SettingRepo
+	gr   GroupRepo
 	log  *log.Helper
 }
 
-func NewSettingUsecase(repo SettingRepo, logger log.Logger) *SettingUsecase {
+func NewSettingUsecase(repo SettingRepo, gr GroupRepo, logger log.Logger) *SettingUsecase {
 	return &SettingUsecase{
 		repo: repo,
+		gr:   gr,
 		log:  log.NewHelper(logger),
 	}
 }
+
+// ListSettings lists the administrable settings of the type, or all of them if t is empty, in the order of
+// the schemas.
+func (uc *SettingUsecase) ListSettings(ctx context.Context, t SettingType) ([]*v1.Setting, error) {
+	var (
+		options map[SettingName]*Setting
+		err     error
+	)
+	if t == "" {
+		options, err = uc.repo.List(ctx)
+	} else {
+		if !isSettingType(t) {
+			return nil, v1.ErrorInvalidArgument("invalid argument: unknown setting type %s", t)
+		}
+		options, err = uc.repo.ListByType(ctx, t)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var settings []*v1.Setting
+	for _, schema := range settingSchemas {
+		if s, ok := options[schema.Name]; ok {
+			settings = append(settings, ToProtoSetting(s, schema))
+		}
+	}
+	return settings, nil
+}
+
+// GetSetting returns the administrable setting.
+func (uc *SettingUsecase) GetSetting(ctx context.Context, name SettingName) (*v1.Setting, error) {
+	schema, ok := GetSettingSchema(name)
+	if !ok {
+		return nil, v1.ErrorNotFound("setting not found")
+	}
+	s, err := uc.repo.GetByName(ctx, string(name))
+	if err != nil {
+		return nil, err
+	}
+	return ToProtoSetting(s, schema), nil
+}
+
+// UpdateSettings validates the values against the schemas, and upserts them in a batch. The groups named by
+// the values must exist.
+func (uc *SettingUsecase) UpdateSettings(ctx context.Context, values map[SettingName]string) ([]*v1.Setting, error) {
+	if len(values) > MaxBatchUpdateSize {
+		return nil, v1.ErrorBatchSize("batch size cannot be greater than %d", MaxBatchUpdateSize)
+	}
+
+	names := make([]string, 0, len(values))
+	for name, value := range values {
+		schema, ok := GetSettingSchema(name)
+		if !ok {
+			return nil, v1.ErrorInvalidArgument("invalid argument: unknown setting %s", name)
+		}
+		if err := schema.Validate(value); err != nil {
+			return nil, err
+		}
+		if name == RegisterDefaultGroup || name == ScoreUpgradeGroup {
+			if _, err := uc.gr.GetByName(ctx, value, GroupViewBasic); err != nil {
+				return nil, err
+			}
+		}
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+
+	before, err := uc.repo.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	AuditTarget(ctx, AuditTargetSetting, strings.Join(names, ","))
+	settings := make([]*Setting, len(names))
+	for i := range names {
+		name := names[i]
+		value, schema := values[SettingName(name)], settingSchemaIndex[SettingName(name)]
+		if s, ok := before[SettingName(name)]; ok {
+			AuditDiff(ctx, name, *s.Value, value)
+		} else {
+			AuditDiff(ctx, name, nil, value)
+		}
+		settings[i] = &Setting{Name: &name, Value: &value, Type: &schema.Type}
+	}
+	if err = uc.repo.BatchUpsert(ctx, settings); err != nil {
+		return nil, err
+	}
+
+	res := make([]*v1.Setting, len(settings))
+	for i, s := range settings {
+		res[i] = ToProtoSetting(s, settingSchemaIndex[SettingName(*s.Name)])
+	}
+	return res, nil
+}
+
+func isSettingType(t SettingType) bool {
+	switch t {
+	case TypeBasic, TypeRegister, TypeLogin, TypeMail, TypeCaptcha, TypePwa, TypeTimeout, TypeUpload, TypeShare,
+		TypeAvatar, TypePayment, TypeScore, TypeTask, TypeAuth, TypeCron, TypeAudit, TypeAccount:
+		return true
+	default:
+		return false
+	}
+}
+
+func ToProtoSetting(s *Setting, schema *SettingSchema) *v1.Setting {
+	p := &v1.Setting{
+		Name:   *s.Name,
+		Value:  *s.Value,
+		Schema: ToProtoSettingSchema(schema),
+	}
+	if s.Type != nil {
+		p.Type = s.Type.String()
+	}
+	return p
+}
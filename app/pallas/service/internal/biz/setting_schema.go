@@ -0,0 +1,245 @@
+package biz
+
+import (
+	"net/mail"
+	"strconv"
+	"strings"
+
+	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
+	"github.com/hominsu/pallas/pkg/avatar"
+)
+
+// SettingKind is the kind of the value of a setting.
+type SettingKind string
+
+const (
+	KindString SettingKind = "string"
+	KindBool   SettingKind = "bool"
+	KindInt    SettingKind = "int"
+	// KindDuration is an integer number of the Unit of the schema
+	KindDuration SettingKind = "duration"
+	KindEnum     SettingKind = "enum"
+	// KindList is the comma separated values of the Elem of the schema
+	KindList  SettingKind = "list"
+	KindEmail SettingKind = "email"
+)
+
+// SettingSchema describes the value of a setting, the value is validated against it before upsert.
+type SettingSchema struct {
+	Name SettingName
+	Type SettingType
+	Kind SettingKind
+	// Values are the allowed values of KindEnum
+	Values []string
+	// Min and Max bound the KindInt and KindDuration values, and the KindInt elements of KindList
+	Min, Max *int64
+	// Unit is the unit of KindDuration, e.g. hours
+	Unit string
+	// Elem is the kind of the elements of KindList
+	Elem SettingKind
+	// Required rejects the empty value of KindString and KindList
+	Required bool
+	// Default is seeded on start if the setting is missing, and used in place of a missing or invalid value
+	Default     string
+	Description string
+}
+
+func bound(n int64) *int64 { return &n }
+
+// settingSchemas are the settings administrable, the settings without a schema, e.g. migration, are internal.
+var settingSchemas = []*SettingSchema{
+	{Name: RegisterEnable, Type: TypeRegister, Kind: KindBool,
+		Default:     "true",
+		Description: "whether the signup is enabled"},
+	{Name: RegisterDefaultGroup, Type: TypeRegister, Kind: KindString, Required: true,
+		Default:     "Anonymous",
+		Description: "the name of the group the new users join"},
+	{Name: RegisterMailActive, Type: TypeRegister, Kind: KindBool,
+		Default:     "false",
+		Description: "whether the new users must activate the account by email"},
+	{Name: RegisterMailFilter, Type: TypeRegister, Kind: KindEnum, Values: []string{"off", "blacklist", "whitelist"},
+		Default:     "off",
+		Description: "the mode of the mail filter applied to the email domain of the new users"},
+	{Name: RegisterMailFilterList, Type: TypeRegister, Kind: KindList, Elem: KindString,
+		Default: "126.com,163.com,gmail.com,outlook.com,qq.com,foxmail.com,yeah.net,sohu.com,sohu.cn," +
+			"139.com,wo.cn,189.cn,hotmail.com,live.com,live.cn",
+		Description: "the email domains of the mail filter"},
+	{Name: AuthTOTPIssuer, Type: TypeAuth, Kind: KindString, Required: true,
+		Default:     defaultTOTPIssuer,
+		Description: "the issuer shown in the authenticator apps"},
+	{Name: AuthTOTPSkew, Type: TypeAuth, Kind: KindInt, Min: bound(0), Max: bound(10),
+		Default:     "1",
+		Description: "the number of periods before and after the current one also accepted"},
+	{Name: AuthTOTPRecoveryCodes, Type: TypeAuth, Kind: KindInt, Min: bound(1), Max: bound(100),
+		Default:     "10",
+		Description: "the number of recovery codes generated on enrollment"},
+	{Name: ScoreCheckinEnable, Type: TypeScore, Kind: KindBool,
+		Default:     "true",
+		Description: "whether the daily check-in is enabled"},
+	{Name: ScoreCheckinAmount, Type: TypeScore, Kind: KindInt, Min: bound(0),
+		Default:     "10",
+		Description: "the score earned by the daily check-in"},
+	{Name: ScoreStoragePrice, Type: TypeScore, Kind: KindInt, Min: bound(0),
+		Default:     "100",
+		Description: "the score of 1 GiB extra storage"},
+	{Name: ScoreUpgradeGroup, Type: TypeScore, Kind: KindString, Required: true,
+		Default:     "User",
+		Description: "the name of the group which can be upgraded to by score"},
+	{Name: ScoreUpgradePrice, Type: TypeScore, Kind: KindInt, Min: bound(0),
+		Default:     "50",
+		Description: "the score of 1 day group upgrade"},
+	{Name: AuditEnable, Type: TypeAudit, Kind: KindBool,
+		Default:     "true",
+		Description: "whether the audit events are recorded"},
+	{Name: AuditRetentionDays, Type: TypeAudit, Kind: KindDuration, Unit: "days", Min: bound(0),
+		Default:     "90",
+		Description: "how long the audit events are kept, 0 keeps them forever"},
+	{Name: AvatarMode, Type: TypeAvatar, Kind: KindEnum, Values: []string{AvatarModeIdenticon, AvatarModeGravatar},
+		Default:     AvatarModeIdenticon,
+		Description: "the avatar of the users without an upload"},
+	{Name: AvatarGravatarServer, Type: TypeAvatar, Kind: KindString, Required: true,
+		Default:     avatar.DefaultGravatarServer,
+		Description: "the Gravatar server, or a mirror of it"},
+	{Name: AvatarMaxSize, Type: TypeAvatar, Kind: KindInt, Min: bound(1),
+		Default:     "2097152",
+		Description: "the maximum size of the uploaded image in bytes"},
+	{Name: AvatarMaxDimension, Type: TypeAvatar, Kind: KindInt, Min: bound(1),
+		Default:     "4096",
+		Description: "the maximum width and height of the uploaded image in pixels"},
+	{Name: AvatarSizes, Type: TypeAvatar, Kind: KindList, Elem: KindInt, Min: bound(1), Max: bound(maxAvatarSize),
+		Required: true, Default: "40,100,200",
+		Description: "the sizes the uploaded avatar is resized to"},
+	{Name: AccountDeletionGraceDays, Type: TypeAccount, Kind: KindDuration, Unit: "days", Min: bound(0),
+		Default:     "14",
+		Description: "how long the account pending deletion can be restored before purged"},
+	{Name: AccountReauthWindow, Type: TypeAccount, Kind: KindDuration, Unit: "seconds", Min: bound(1),
+		Default:     "300",
+		Description: "how long since signin the deletion of account is allowed"},
+	{Name: UploadOveruseGraceHours, Type: TypeUpload, Kind: KindDuration, Unit: "hours", Min: bound(0),
+		Default:     "72",
+		Description: "how long the user over quota is allowed before overuse banned"},
+}
+
+var settingSchemaIndex = func() map[SettingName]*SettingSchema {
+	m := make(map[SettingName]*SettingSchema, len(settingSchemas))
+	for _, s := range settingSchemas {
+		m[s.Name] = s
+	}
+	return m
+}()
+
+// GetSettingSchema returns the schema of the setting, false if the setting is not administrable.
+func GetSettingSchema(name SettingName) (*SettingSchema, bool) {
+	s, ok := settingSchemaIndex[name]
+	return s, ok
+}
+
+// DefaultSettings returns the settings with the default values of the schemas.
+func DefaultSettings() []*Setting {
+	settings := make([]*Setting, len(settingSchemas))
+	for i, schema := range settingSchemas {
+		name := string(schema.Name)
+		settings[i] = &Setting{Name: &name, Value: &schema.Default, Type: &schema.Type}
+	}
+	return settings
+}
+
+// settingValue returns the value of the setting in options if valid, otherwise the default of the schema.
+func settingValue(options map[SettingName]*Setting, name SettingName) string {
+	schema, ok := settingSchemaIndex[name]
+	s, found := options[name]
+	switch {
+	case found && s.Value != nil && (!ok || schema.Validate(*s.Value) == nil):
+		return *s.Value
+	case ok:
+		return schema.Default
+	default:
+		return ""
+	}
+}
+
+// settingBool returns the setting of KindBool in options, or the default.
+func settingBool(options map[SettingName]*Setting, name SettingName) bool {
+	return settingValue(options, name) == "true"
+}
+
+// settingInt returns the setting of KindInt or KindDuration in options, or the default.
+func settingInt(options map[SettingName]*Setting, name SettingName) int64 {
+	n, _ := strconv.ParseInt(settingValue(options, name), 10, 64)
+	return n
+}
+
+// Validate checks the value against the schema.
+func (s *SettingSchema) Validate(value string) error {
+	if s.Kind != KindList {
+		return s.validate(s.Kind, value)
+	}
+	if value == "" {
+		if s.Required {
+			return v1.ErrorInvalidArgument("invalid argument: %s must not be empty", s.Name)
+		}
+		return nil
+	}
+	for _, v := range strings.Split(value, ",") {
+		if err := s.validate(s.Elem, strings.TrimSpace(v)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SettingSchema) validate(kind SettingKind, value string) error {
+	switch kind {
+	case KindString:
+		if s.Required && strings.TrimSpace(value) == "" {
+			return v1.ErrorInvalidArgument("invalid argument: %s must not be empty", s.Name)
+		}
+	case KindBool:
+		if value != "true" && value != "false" {
+			return v1.ErrorInvalidArgument("invalid argument: %s must be true or false", s.Name)
+		}
+	case KindInt, KindDuration:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return v1.ErrorInvalidArgument("invalid argument: %s must be an integer", s.Name)
+		}
+		if s.Min != nil && n < *s.Min {
+			return v1.ErrorInvalidArgument("invalid argument: %s must not be less than %d", s.Name, *s.Min)
+		}
+		if s.Max != nil && n > *s.Max {
+			return v1.ErrorInvalidArgument("invalid argument: %s must not be greater than %d", s.Name, *s.Max)
+		}
+	case KindEnum:
+		for _, v := range s.Values {
+			if v == value {
+				return nil
+			}
+		}
+		return v1.ErrorInvalidArgument("invalid argument: %s must be one of %s", s.Name, strings.Join(s.Values, ", "))
+	case KindEmail:
+		if a, err := mail.ParseAddress(value); err != nil || a.Address != value {
+			return v1.ErrorInvalidArgument("invalid argument: %s must be an email", s.Name)
+		}
+	}
+	return nil
+}
+
+func ToProtoSettingSchema(s *SettingSchema) *v1.Setting_Schema {
+	return &v1.Setting_Schema{
+		Kind:        toProtoSettingKind(s.Kind),
+		Values:      s.Values,
+		Min:         s.Min,
+		Max:         s.Max,
+		Unit:        s.Unit,
+		Elem:        toProtoSettingKind(s.Elem),
+		Required:    s.Required,
+		Description: s.Description,
+	}
+}
+
+func toProtoSettingKind(k SettingKind) v1.Setting_Kind {
+	if v, ok := v1.Setting_Kind_value[strings.ToUpper(string(k))]; ok {
+		return v1.Setting_Kind(v)
+	}
+	return v1.Setting_KIND_UNSPECIFIED
+}
@@ -0,0 +1,222 @@
+package biz
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
+)
+
+// storageEnforceBatchSize is the number of the users checked in one batch of the quota enforcement
+const storageEnforceBatchSize = 500
+
+// Usage is the storage used by user, and the quota of user. The quota is the StorageQuota of user if set,
+// otherwise the MaxStorage of the group, plus the extra Storage of user.
+type Usage struct {
+	Used         uint64
+	Quota        uint64
+	GroupQuota   uint64
+	StorageQuota *uint64
+	Extra        uint64
+	OveruseAt    *time.Time
+	// OveruseDeadline is when the user over quota is overuse banned
+	OveruseDeadline *time.Time
+}
+
+// Over reports whether the usage exceeds the quota.
+func (u *Usage) Over() bool {
+	return u.Used > u.Quota
+}
+
+type StorageRepo interface {
+	// Reconcile recomputes the used storage of all the users from the content stored, and returns the number
+	// of the users corrected. The usage changed by the uploads during the reconciliation is left to the next one.
+	Reconcile(ctx context.Context) (int, error)
+	// ListInUse lists the users using the storage or marked over quota, whose id is greater than afterId,
+	// ordered by id.
+	ListInUse(ctx context.Context, afterId int64, limit int) ([]*User, error)
+}
+
+type storageOptions struct {
+	overuseGrace time.Duration
+}
+
+// StorageUsecase is the accounting of the storage quota. The used storage is updated with the content in a
+// transaction, and reconciled nightly. The users over quota are overuse banned after upload_overuse_grace_hours,
+// which happens when the group is downgraded, and are restored once the usage is reduced under the quota.
+type StorageUsecase struct {
+	str StorageRepo
+	ur  UserRepo
+	gr  GroupRepo
+	sr  SettingRepo
+	log *log.Helper
+}
+
+func NewStorageUsecase(str StorageRepo, ur UserRepo, gr GroupRepo, sr SettingRepo, logger log.Logger) *StorageUsecase {
+	return &StorageUsecase{
+		str: str,
+		ur:  ur,
+		gr:  gr,
+		sr:  sr,
+		log: log.NewHelper(logger),
+	}
+}
+
+// GetUsage returns the usage of user.
+func (uc *StorageUsecase) GetUsage(ctx context.Context, userId int64) (*Usage, error) {
+	opts, err := uc.options(ctx)
+	if err != nil {
+		return nil, err
+	}
+	u, err := uc.ur.Get(ctx, userId, UserViewBasic)
+	if err != nil {
+		return nil, err
+	}
+	g, err := uc.gr.Get(ctx, u.GroupId, GroupViewBasic)
+	if err != nil {
+		return nil, err
+	}
+
+	usage := toUsage(u, g)
+	if usage.OveruseAt != nil {
+		deadline := usage.OveruseAt.Add(opts.overuseGrace)
+		usage.OveruseDeadline = &deadline
+	}
+	return usage, nil
+}
+
+// ReconcileUsage recomputes the used storage of the users, it is run by the cron server nightly.
+func (uc *StorageUsecase) ReconcileUsage(ctx context.Context) error {
+	n, err := uc.str.Reconcile(ctx)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		uc.log.Warnf("the used storage of %d users corrected", n)
+	}
+	return nil
+}
+
+// EnforceQuota marks the users over quota, and overuse bans the ones over quota longer than
+// upload_overuse_grace_hours. The users under quota again are unmarked, and restored if overuse banned by the
+// enforcement, the users overuse banned by admin are never marked so never restored. It is run by the cron server.
+func (uc *StorageUsecase) EnforceQuota(ctx context.Context) error {
+	opts, err := uc.options(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	groups := make(map[int64]*Group)
+	var marked, banned, restored int
+	for afterId := int64(0); ; {
+		users, lErr := uc.str.ListInUse(ctx, afterId, storageEnforceBatchSize)
+		if lErr != nil {
+			return lErr
+		}
+		for _, u := range users {
+			g, ok := groups[u.GroupId]
+			if !ok {
+				if g, err = uc.gr.Get(ctx, u.GroupId, GroupViewBasic); err != nil {
+					return err
+				}
+				groups[u.GroupId] = g
+			}
+
+			var fields []string
+			switch usage := toUsage(u, g); {
+			case usage.Over() && u.OveruseAt == nil:
+				u.OveruseAt = &now
+				fields = append(fields, UserFieldOveruseAt)
+				marked++
+			case usage.Over() && u.Status == StatusActive && now.Sub(*u.OveruseAt) >= opts.overuseGrace:
+				u.Status = StatusOveruseBaned
+				fields = append(fields, UserFieldStatus)
+				banned++
+			case !usage.Over() && u.OveruseAt != nil:
+				u.OveruseAt = nil
+				fields = append(fields, UserFieldOveruseAt)
+				if u.Status == StatusOveruseBaned {
+					u.Status = StatusActive
+					fields = append(fields, UserFieldStatus)
+					restored++
+				}
+			}
+			if len(fields) == 0 {
+				continue
+			}
+			if _, err = uc.ur.Update(ctx, u, fields...); err != nil {
+				return err
+			}
+		}
+		if len(users) < storageEnforceBatchSize {
+			break
+		}
+		afterId = users[len(users)-1].Id
+	}
+	if marked+banned+restored > 0 {
+		uc.log.Infof("storage quota enforced, %d users over quota, %d overuse banned, %d restored",
+			marked, banned, restored)
+	}
+	return nil
+}
+
+func (uc *StorageUsecase) options(ctx context.Context) (*storageOptions, error) {
+	options, err := uc.sr.ListByType(ctx, TypeUpload)
+	if err != nil {
+		return nil, err
+	}
+
+	return &storageOptions{
+		overuseGrace: time.Duration(settingInt(options, UploadOveruseGraceHours)) * time.Hour,
+	}, nil
+}
+
+// userQuota returns the quota of user in bytes.
+func userQuota(ctx context.Context, ur UserRepo, gr GroupRepo, userId int64) (uint64, error) {
+	u, err := ur.Get(ctx, userId, UserViewBasic)
+	if err != nil {
+		return 0, err
+	}
+	g, err := gr.Get(ctx, u.GroupId, GroupViewBasic)
+	if err != nil {
+		return 0, err
+	}
+	return toUsage(u, g).Quota, nil
+}
+
+func toUsage(u *User, g *Group) *Usage {
+	usage := &Usage{
+		Used:         u.UsedStorage,
+		GroupQuota:   g.MaxStorage,
+		StorageQuota: u.StorageQuota,
+		Extra:        u.Storage,
+		OveruseAt:    u.OveruseAt,
+	}
+	usage.Quota = usage.GroupQuota
+	if usage.StorageQuota != nil {
+		usage.Quota = *usage.StorageQuota
+	}
+	usage.Quota += usage.Extra
+	return usage
+}
+
+func ToProtoUsage(u *Usage) *v1.Usage {
+	p := &v1.Usage{
+		Used:         u.Used,
+		Quota:        u.Quota,
+		GroupQuota:   u.GroupQuota,
+		StorageQuota: u.StorageQuota,
+		Extra:        u.Extra,
+	}
+	if u.OveruseAt != nil {
+		p.OveruseAt = timestamppb.New(*u.OveruseAt)
+	}
+	if u.OveruseDeadline != nil {
+		p.OveruseDeadline = timestamppb.New(*u.OveruseDeadline)
+	}
+	return p
+}
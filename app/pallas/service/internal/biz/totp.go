@@ -0,0 +1,243 @@
+package biz
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
+	"github.com/hominsu/pallas/pkg/totp"
+)
+
+// TOTP is the second factor of a user. The secret is generated on enrollment but only takes
+// effect after confirmed, recovery codes are stored as sha256 hashes and each can be used once.
+type TOTP struct {
+	Secret        string
+	Enabled       bool
+	RecoveryCodes []string
+}
+
+type TOTPEnrollment struct {
+	Secret          string
+	ProvisioningURI string
+	RecoveryCodes   []string
+}
+
+const (
+	defaultTOTPIssuer        = "pallas"
+	defaultTOTPRecoveryCodes = 10
+
+	// MaxSecondFactorAttempts is the misses of the second factor allowed to a user in secondFactorFailureWindow,
+	// the pending signin is abandoned once reached.
+	MaxSecondFactorAttempts = 5
+	// secondFactorFailureWindow is how long the misses are counted since the first, which covers the time a
+	// signin may wait for the second factor.
+	secondFactorFailureWindow = 5 * time.Minute
+)
+
+// EnrollTOTP generate a new secret and recovery codes for user, replacing any unconfirmed enrollment.
+func (uc *UserUsecase) EnrollTOTP(ctx context.Context, userId int64) (*TOTPEnrollment, error) {
+	u, err := uc.ur.Get(ctx, userId, UserViewBasic)
+	if err != nil {
+		return nil, err
+	}
+	if u.TOTP.Enabled {
+		return nil, v1.ErrorTotpAlreadyEnabled("totp is already enabled")
+	}
+
+	issuer, opts, recoveryCodes, err := uc.totpOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, v1.ErrorInternal("generate totp secret error: %v", err)
+	}
+	codes, err := totp.GenerateRecoveryCodes(recoveryCodes)
+	if err != nil {
+		return nil, v1.ErrorInternal("generate recovery codes error: %v", err)
+	}
+
+	hashed := make([]string, len(codes))
+	for i, c := range codes {
+		hashed[i] = hashRecoveryCode(c)
+	}
+	if err = uc.ur.UpdateTOTP(ctx, userId, &TOTP{
+		Secret:        secret,
+		Enabled:       false,
+		RecoveryCodes: hashed,
+	}); err != nil {
+		return nil, err
+	}
+
+	return &TOTPEnrollment{
+		Secret:          secret,
+		ProvisioningURI: totp.ProvisioningURI(issuer, u.Email, secret, opts),
+		RecoveryCodes:   codes,
+	}, nil
+}
+
+// ConfirmTOTP enable the enrolled secret once the user proves the authenticator works.
+func (uc *UserUsecase) ConfirmTOTP(ctx context.Context, userId int64, code string) error {
+	u, err := uc.ur.Get(ctx, userId, UserViewBasic)
+	if err != nil {
+		return err
+	}
+	if u.TOTP.Enabled {
+		return v1.ErrorTotpAlreadyEnabled("totp is already enabled")
+	}
+	if u.TOTP.Secret == "" {
+		return v1.ErrorTotpNotEnabled("totp is not enrolled")
+	}
+
+	if err = uc.checkTOTPCode(ctx, u, code); err != nil {
+		return err
+	}
+
+	AuditTarget(ctx, AuditTargetUser, userId)
+	AuditDiff(ctx, "totp_enabled", false, true)
+	return uc.ur.UpdateTOTP(ctx, userId, &TOTP{
+		Secret:        u.TOTP.Secret,
+		Enabled:       true,
+		RecoveryCodes: u.TOTP.RecoveryCodes,
+	})
+}
+
+// DisableTOTP remove the second factor of user, a valid totp code or recovery code is required.
+func (uc *UserUsecase) DisableTOTP(ctx context.Context, userId int64, code string) error {
+	AuditTarget(ctx, AuditTargetUser, userId)
+	if err := uc.VerifySecondFactor(ctx, userId, code); err != nil {
+		return err
+	}
+	AuditDiff(ctx, "totp_enabled", true, false)
+	return uc.ur.UpdateTOTP(ctx, userId, &TOTP{})
+}
+
+// SigninSecondFactor completes the pending signin of user with the second factor. The misses are counted per user,
+// and once MaxSecondFactorAttempts is reached the code is no longer checked until the window passes, a
+// SigninOperation error is returned then and the pending signin must be abandoned.
+func (uc *UserUsecase) SigninSecondFactor(ctx context.Context, userId int64, code string) error {
+	failures, err := uc.ur.TOTPFailures(ctx, userId)
+	if err != nil {
+		return err
+	}
+	if failures >= MaxSecondFactorAttempts {
+		return v1.ErrorSigninOperation("too many second factor attempts, sign in again later")
+	}
+
+	err = uc.VerifySecondFactor(ctx, userId, code)
+	switch {
+	case err == nil:
+		if cErr := uc.ur.ClearTOTPFailures(ctx, userId); cErr != nil {
+			uc.log.Warnf("failed to clear the second factor failures of user %d: %v", userId, cErr)
+		}
+		return nil
+	case v1.IsTotpCodeMismatch(err):
+		failures, cErr := uc.ur.CountTOTPFailure(ctx, userId, secondFactorFailureWindow)
+		if cErr != nil {
+			return cErr
+		}
+		if failures >= MaxSecondFactorAttempts {
+			return v1.ErrorSigninOperation("too many second factor attempts, sign in again later")
+		}
+		return err
+	default:
+		return err
+	}
+}
+
+// VerifySecondFactor checks the code against the totp secret of user, or the recovery codes if
+// the code is in their form, a matched recovery code is consumed.
+func (uc *UserUsecase) VerifySecondFactor(ctx context.Context, userId int64, code string) error {
+	u, err := uc.ur.Get(ctx, userId, UserViewBasic)
+	if err != nil {
+		return err
+	}
+	if !u.TOTP.Enabled {
+		return v1.ErrorTotpNotEnabled("totp is not enabled")
+	}
+
+	if totp.IsRecoveryCode(code) {
+		return uc.useRecoveryCode(ctx, u, code)
+	}
+	return uc.checkTOTPCode(ctx, u, code)
+}
+
+func (uc *UserUsecase) checkTOTPCode(ctx context.Context, u *User, code string) error {
+	_, opts, _, err := uc.totpOptions(ctx)
+	if err != nil {
+		return err
+	}
+
+	counter, ok := totp.Validate(code, u.TOTP.Secret, time.Now(), opts)
+	if !ok {
+		return v1.ErrorTotpCodeMismatch("totp code mismatch")
+	}
+
+	// a code must not be accepted twice, see https://www.rfc-editor.org/rfc/rfc6238#section-5.2
+	ttl := time.Duration(2*opts.Skew+1) * opts.Period
+	first, err := uc.ur.MarkTOTPUsed(ctx, u.Id, counter, ttl)
+	if err != nil {
+		return err
+	}
+	if !first {
+		return v1.ErrorTotpCodeMismatch("totp code has been used")
+	}
+	return nil
+}
+
+func (uc *UserUsecase) useRecoveryCode(ctx context.Context, u *User, code string) error {
+	// the cached list is only read to fail fast, the code is consumed against the stored list
+	hashed := hashRecoveryCode(code)
+	found := false
+	for _, c := range u.TOTP.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(c), []byte(hashed)) == 1 {
+			found = true
+		}
+	}
+	if !found {
+		return v1.ErrorTotpCodeMismatch("recovery code mismatch")
+	}
+
+	ok, err := uc.ur.ConsumeRecoveryCode(ctx, u.Id, hashed)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return v1.ErrorTotpCodeMismatch("recovery code has been used")
+	}
+	return nil
+}
+
+func (uc *UserUsecase) totpOptions(ctx context.Context) (issuer string, opts totp.Options, recoveryCodes int, err error) {
+	options, err := uc.sr.ListByType(ctx, TypeAuth)
+	if err != nil {
+		return "", totp.Options{}, 0, err
+	}
+
+	issuer, opts, recoveryCodes = defaultTOTPIssuer, totp.DefaultOptions, defaultTOTPRecoveryCodes
+	if s, ok := options[AuthTOTPIssuer]; ok && *s.Value != "" {
+		issuer = *s.Value
+	}
+	if s, ok := options[AuthTOTPSkew]; ok {
+		if v, pErr := strconv.Atoi(*s.Value); pErr == nil && v >= 0 {
+			opts.Skew = v
+		}
+	}
+	if s, ok := options[AuthTOTPRecoveryCodes]; ok {
+		if v, pErr := strconv.Atoi(*s.Value); pErr == nil && v > 0 {
+			recoveryCodes = v
+		}
+	}
+	return issuer, opts, recoveryCodes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,133 @@
+package biz
+
+import (
+	"strconv"
+
+	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
+	"github.com/hominsu/pallas/pkg/utils"
+)
+
+// Role is the role of the operator of an update, it decides the fields can be written.
+type Role string
+
+// Role values.
+const (
+	RoleUser  Role = "user"
+	RoleAdmin Role = "admin"
+)
+
+// User fields, named as the fields of v1.User in the update mask.
+const (
+	UserFieldGroupId  = "group_id"
+	UserFieldEmail    = "email"
+	UserFieldNickName = "nick_name"
+	UserFieldStorage  = "storage"
+	UserFieldScore    = "score"
+	UserFieldStatus   = "status"
+	UserFieldDeleteAt = "delete_at"
+
+	UserFieldStorageQuota = "storage_quota"
+	UserFieldOveruseAt    = "overuse_at"
+)
+
+// Group fields, named as the fields of v1.Group in the update mask.
+const (
+	GroupFieldName         = "name"
+	GroupFieldMaxStorage   = "max_storage"
+	GroupFieldShareEnabled = "share_enabled"
+	GroupFieldSpeedLimit   = "speed_limit"
+	GroupFieldPermissions  = "permissions"
+)
+
+var (
+	userFields = []string{
+		UserFieldGroupId, UserFieldEmail, UserFieldNickName, UserFieldStorage, UserFieldScore, UserFieldStatus,
+		UserFieldDeleteAt, UserFieldStorageQuota, UserFieldOveruseAt,
+	}
+	groupFields = []string{
+		GroupFieldName, GroupFieldMaxStorage, GroupFieldShareEnabled, GroupFieldSpeedLimit, GroupFieldPermissions,
+	}
+
+	// userWritableFields is the fields of user can be written by the role in UpdateUser. The email is bound to
+	// the verifier, the status is changed by UpdateUserStatus which revokes the sessions, the score is
+	// changed through the score ledger, delete_at by the account deletion, and overuse_at by the quota
+	// enforcement, so they are not writable here. An unset storage_quota clears the override.
+	userWritableFields = map[Role][]string{
+		RoleUser:  {UserFieldNickName},
+		RoleAdmin: {UserFieldNickName, UserFieldStorage, UserFieldStorageQuota, UserFieldGroupId},
+	}
+
+	// groupWritableFields is the fields of group can be written by the role in UpdateGroup.
+	groupWritableFields = map[Role][]string{
+		RoleAdmin: {
+			GroupFieldName, GroupFieldMaxStorage, GroupFieldShareEnabled, GroupFieldSpeedLimit, GroupFieldPermissions,
+		},
+	}
+)
+
+// checkUpdateMask reports whether all the paths are writable, the violations are returned as the metadata
+// of the INVALID_ARGUMENT error, keyed by the index of the path in the update mask.
+func checkUpdateMask(paths, fields, writable []string) error {
+	if len(paths) == 0 {
+		return v1.ErrorInvalidArgument("invalid argument: empty update mask").
+			WithMetadata(map[string]string{"update_mask": "at least one field is required"})
+	}
+
+	violations := make(map[string]string)
+	for i, path := range paths {
+		key := "update_mask.paths[" + strconv.Itoa(i) + "]"
+		switch {
+		case !utils.StringsContain(fields, path):
+			violations[key] = "unknown field: " + path
+		case !utils.StringsContain(writable, path):
+			violations[key] = "field is not writable: " + path
+		}
+	}
+	if len(violations) > 0 {
+		return v1.ErrorInvalidArgument("invalid argument: update mask").WithMetadata(violations)
+	}
+	return nil
+}
+
+// userFieldValue returns the value of the field of user, it is used to audit the changes of the update.
+func userFieldValue(u *User, field string) any {
+	switch field {
+	case UserFieldGroupId:
+		return u.GroupId
+	case UserFieldEmail:
+		return u.Email
+	case UserFieldNickName:
+		return u.NickName
+	case UserFieldStorage:
+		return u.Storage
+	case UserFieldScore:
+		return u.Score
+	case UserFieldStatus:
+		return u.Status.String()
+	case UserFieldStorageQuota:
+		if u.StorageQuota == nil {
+			return nil
+		}
+		return *u.StorageQuota
+	default:
+		return nil
+	}
+}
+
+// groupFieldValue returns the value of the field of group, it is used to audit the changes of the update.
+func groupFieldValue(g *Group, field string) any {
+	switch field {
+	case GroupFieldName:
+		return g.Name
+	case GroupFieldMaxStorage:
+		return g.MaxStorage
+	case GroupFieldShareEnabled:
+		return g.ShareEnable
+	case GroupFieldSpeedLimit:
+		return g.SpeedLimit
+	case GroupFieldPermissions:
+		return permissionValues(g.Permissions)
+	default:
+		return nil
+	}
+}
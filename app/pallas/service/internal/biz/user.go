@@ -15,15 +15,28 @@ import (
 )
 
 type User struct {
-	Id         int64      `json:"id,omitempty"`
-	GroupId    int64      `json:"groupId,omitempty"`
-	Email      string     `json:"email,omitempty"`
-	NickName   string     `json:"nickName,omitempty"`
-	Salt       []byte     `json:"salt,omitempty"`
-	Verifier   []byte     `json:"verifier,omitempty"`
-	Storage    uint64     `json:"storage,omitempty"`
-	Score      int64      `json:"score,omitempty"`
-	Status     UserStatus `json:"status,omitempty"`
+	Id       int64  `json:"id,omitempty"`
+	GroupId  int64  `json:"groupId,omitempty"`
+	Email    string `json:"email,omitempty"`
+	NickName string `json:"nickName,omitempty"`
+	Salt     []byte `json:"salt,omitempty"`
+	Verifier []byte `json:"verifier,omitempty"`
+	// Storage is the extra storage redeemed by score or granted, which is added to the quota
+	Storage uint64     `json:"storage,omitempty"`
+	Score   int64      `json:"score,omitempty"`
+	Status  UserStatus `json:"status,omitempty"`
+	TOTP    TOTP       `json:"-"`
+	// BaseGroupId and GroupExpireAt are set during the group upgrade redeemed by score
+	BaseGroupId   *int64     `json:"baseGroupId,omitempty"`
+	GroupExpireAt *time.Time `json:"groupExpireAt,omitempty"`
+	// DeleteAt is when the user pending deletion is purged
+	DeleteAt *time.Time `json:"deleteAt,omitempty"`
+	// StorageQuota overrides the max storage of the group if not nil
+	StorageQuota *uint64 `json:"storageQuota,omitempty"`
+	// UsedStorage is the bytes of the content stored
+	UsedStorage uint64 `json:"usedStorage,omitempty"`
+	// OveruseAt is when the user has been over quota since
+	OveruseAt  *time.Time `json:"overuseAt,omitempty"`
 	CreateAt   time.Time  `json:"createAt"`
 	UpdateAt   time.Time  `json:"updateAt"`
 	OwnerGroup *Group     `json:"ownerGroup,omitempty"`
@@ -37,6 +50,8 @@ const (
 	StatusActive       UserStatus = "active"
 	StatusBanned       UserStatus = "banned"
 	StatusOveruseBaned UserStatus = "overuse_baned"
+	// StatusPendingDeletion is the user requested the deletion, restorable until purged
+	StatusPendingDeletion UserStatus = "pending_deletion"
 )
 
 func (s UserStatus) String() string {
@@ -51,39 +66,110 @@ const (
 	UserViewWithEdgeIds     UserView = 2
 )
 
+const (
+	// generatedPasswordLength is the length of the password generated for the user created by admin
+	generatedPasswordLength = 16
+
+	// inviteTTL is how long the invite token is valid
+	inviteTTL = 72 * time.Hour
+)
+
 type UserPage struct {
 	Users         []*User
 	NextPageToken string
 }
 
+// UserFilter filters the users listed, the zero value matches all.
+type UserFilter struct {
+	Status *UserStatus
+	// Query matches the email or nick name containing it
+	Query string
+}
+
 type UserRepo interface {
 	Create(ctx context.Context, user *User) (*User, error)
 	Get(ctx context.Context, userId int64, userView UserView) (*User, error)
 	GetByEmail(ctx context.Context, email string, userView UserView) (*User, error)
-	Update(ctx context.Context, user *User) (*User, error)
+	// Update updates the fields of user, all the fields are updated if fields is empty. Neither Update nor Delete
+	// can leave a group granting PermissionUsersWrite without a member who can sign in, see MoveGroup.
+	Update(ctx context.Context, user *User, fields ...string) (*User, error)
 	Delete(ctx context.Context, userId int64) error
+	// PurgeDeleted deletes the users pending deletion whose delete_at is not after t, with everything they own,
+	// and returns the ids of the users deleted.
+	PurgeDeleted(ctx context.Context, t time.Time) ([]int64, error)
 	List(ctx context.Context, pageSize int, pageToken string, userView UserView) (*UserPage, error)
 	BatchCreate(ctx context.Context, users []*User) ([]*User, error)
-
-	IsAdminUser(ctx context.Context, userId int64) (bool, error)
+	// ListByGroup lists the members of group matched the filter, it is not cached.
+	ListByGroup(ctx context.Context, groupId int64, filter *UserFilter, pageSize int, pageToken string) (*UserPage, error)
+	// CountByGroup returns the number of the members of group, it is not cached.
+	CountByGroup(ctx context.Context, groupId int64) (int, error)
+	// MoveGroup moves the users in userIds in a transaction, or all the members if userIds is nil in the
+	// transactions of MaxBatchUpdateSize members each, from fromGroupId to toGroupId, and returns the ids of the
+	// users moved. The users must be the members of fromGroupId, at most MaxBatchUpdateSize users are moved by
+	// userIds, and their group upgrades are dropped. A group granting PermissionUsersWrite, such as the built-in
+	// Admin group, can never be emptied, ErrorBadGroupOperation is returned.
+	MoveGroup(ctx context.Context, fromGroupId, toGroupId int64, userIds []int64) ([]int64, error)
+	// MoveBaseGroup rewrites the base group of the users upgraded from fromGroupId to toGroupId, so that their
+	// group upgrades expire into toGroupId.
+	MoveBaseGroup(ctx context.Context, fromGroupId, toGroupId int64) error
 
 	CacheSRPServer(ctx context.Context, email string, server *srp.Server) error
 	GetSRPServer(ctx context.Context, email string) (*srp.Server, error)
+
+	UpdateVerifier(ctx context.Context, userId int64, salt, verifier []byte) error
+	CacheInvite(ctx context.Context, token string, userId int64, ttl time.Duration) error
+	TakeInvite(ctx context.Context, token string) (int64, error)
+
+	UpdateTOTP(ctx context.Context, userId int64, totp *TOTP) error
+	MarkTOTPUsed(ctx context.Context, userId int64, counter int64, ttl time.Duration) (bool, error)
+	// ConsumeRecoveryCode removes the hashed recovery code of user by a conditional update, false is returned if
+	// the code is not found, including consumed by a concurrent request.
+	ConsumeRecoveryCode(ctx context.Context, userId int64, hashed string) (bool, error)
+	// CountTOTPFailure counts a miss of the second factor of user, the count is kept for the window since the first
+	// miss, and returns the misses counted.
+	CountTOTPFailure(ctx context.Context, userId int64, window time.Duration) (int64, error)
+	TOTPFailures(ctx context.Context, userId int64) (int64, error)
+	ClearTOTPFailures(ctx context.Context, userId int64) error
+}
+
+// Session is a signed-in session of user.
+type Session struct {
+	// Id is the fingerprint of the session id, the session id itself is never exposed
+	Id         string    `json:"-"`
+	SigninAt   time.Time `json:"signinAt"`
+	RemoteAddr string    `json:"remoteAddr,omitempty"`
+	UserAgent  string    `json:"userAgent,omitempty"`
+	ExpireAt   time.Time `json:"-"`
+}
+
+// SessionRepo lists and revokes the signed-in sessions of user.
+type SessionRepo interface {
+	List(ctx context.Context, userId int64) ([]*Session, error)
+	RevokeAll(ctx context.Context, userId int64) error
 }
 
 type UserUsecase struct {
 	ur     UserRepo
 	gr     GroupRepo
 	sr     SettingRepo
+	ssr    SessionRepo
 	params *srp.Params
 	log    *log.Helper
 }
 
-func NewUserUsecase(ur UserRepo, gr GroupRepo, sr SettingRepo, params *srp.Params, logger log.Logger) *UserUsecase {
+func NewUserUsecase(
+	ur UserRepo,
+	gr GroupRepo,
+	sr SettingRepo,
+	ssr SessionRepo,
+	params *srp.Params,
+	logger log.Logger,
+) *UserUsecase {
 	return &UserUsecase{
 		ur:     ur,
 		gr:     gr,
 		sr:     sr,
+		ssr:    ssr,
 		params: params,
 		log:    log.NewHelper(logger),
 	}
@@ -96,24 +182,15 @@ func (uc *UserUsecase) Signup(ctx context.Context, email string, salt, verifier
 	}
 
 	// email filter
-	if *options[RegisterMailFilter].Value != "off" {
-		filterList := strings.Split(*options[RegisterMailFilterList].Value, ",")
-		emailSplit := strings.Split(email, "@")
-		filterStatus := utils.StringsContain(filterList, emailSplit[len(emailSplit)-1])
-		eErr := v1.ErrorEmailDomainBanned("email domain is banned")
-		if *options[RegisterMailFilter].Value == "blacklist" && filterStatus {
-			return nil, eErr
-		}
-		if *options[RegisterMailFilter].Value == "whitelist" && !filterStatus {
-			return nil, eErr
-		}
+	if err = checkMailFilter(options, email); err != nil {
+		return nil, err
 	}
 
-	get, err := uc.gr.GetByName(ctx, *options[RegisterDefaultGroup].Value, GroupViewBasic)
+	get, err := uc.gr.GetByName(ctx, settingValue(options, RegisterDefaultGroup), GroupViewBasic)
 	if err != nil {
 		return nil, err
 	}
-	activeRequire := *options[RegisterMailActive].Value == "true"
+	activeRequire := settingBool(options, RegisterMailActive)
 	ownerGroupId := get.Id
 
 	u := &User{
@@ -121,7 +198,7 @@ func (uc *UserUsecase) Signup(ctx context.Context, email string, salt, verifier
 		NickName:   strings.Split(email, "@")[0],
 		Salt:       salt,
 		Verifier:   verifier,
-		Storage:    1 * utils.GibiByte,
+		Storage:    0,
 		Score:      0,
 		Status:     StatusActive,
 		OwnerGroup: &Group{Id: ownerGroupId},
@@ -170,42 +247,63 @@ func (uc *UserUsecase) Signup(ctx context.Context, email string, salt, verifier
 func (uc *UserUsecase) SigninA(ctx context.Context, email string, a []byte) ([]byte, error) {
 	secret, err := srp.GenKey()
 	if err != nil {
+		observeSRP(srpError)
 		return nil, v1.ErrorSigninOperation("failed in gen key: %v", err)
 	}
 	verifier, err := uc.getUserVerifier(ctx, email)
 	if err != nil {
+		observeSRP(srpRejected)
 		return nil, err
 	}
 
 	server := srp.NewServer(uc.params, verifier, secret)
 	if err = server.SetA(a); err != nil {
+		observeSRP(srpInvalid)
 		return nil, v1.ErrorSigninOperation("failed in set a: %v", err)
 	}
 	b := server.ComputeB()
 	if err = uc.ur.CacheSRPServer(ctx, email, server); err != nil {
+		observeSRP(srpError)
 		return nil, err
 	}
+	observeSRP(srpStarted)
 	return b, nil
 }
 
-func (uc *UserUsecase) SigninM(ctx context.Context, email string, m1 []byte) (userid int64, k []byte, err error) {
+// SigninM checks the M1 from client, secondFactor reports whether the user has to
+// complete the second factor by SigninTOTP before the session takes effect.
+func (uc *UserUsecase) SigninM(
+	ctx context.Context,
+	email string,
+	m1 []byte,
+) (userid int64, k []byte, secondFactor bool, err error) {
+	AuditTarget(ctx, AuditTargetEmail, email)
 	server, err := uc.ur.GetSRPServer(ctx, email)
 	if err != nil {
-		return 0, nil, err
+		observeSRP(srpExpired)
+		return 0, nil, false, err
 	}
 
 	_, err = server.CheckM1(m1)
 	if err != nil {
-		return 0, nil, v1.ErrorSigninOperation("password mismatch")
+		observeSRP(srpMismatch)
+		return 0, nil, false, v1.ErrorSigninOperation("password mismatch")
 	}
 
 	res, err := uc.ur.GetByEmail(ctx, email, UserViewBasic)
 	if err != nil {
-		return 0, nil, err
+		observeSRP(srpRejected)
+		return 0, nil, false, err
+	}
+	if err = CheckSigninStatus(res.Status); err != nil {
+		observeSRP(srpRejected)
+		return 0, nil, false, err
 	}
+	observeSRP(srpSucceeded)
+	AuditActor(ctx, res.Id)
 	k = server.ComputeK()
 
-	return res.Id, k, nil
+	return res.Id, k, res.TOTP.Enabled, nil
 }
 
 func (uc *UserUsecase) GetUser(ctx context.Context, userId int64) (*v1.User, error) {
@@ -227,6 +325,9 @@ func (uc *UserUsecase) GetUserSalt(ctx context.Context, email string) ([]byte, e
 	if err != nil {
 		return nil, err
 	}
+	if err = CheckSigninStatus(res.Status); err != nil {
+		return nil, err
+	}
 
 	return res.Salt, nil
 }
@@ -236,12 +337,64 @@ func (uc *UserUsecase) getUserVerifier(ctx context.Context, email string) ([]byt
 	if err != nil {
 		return nil, err
 	}
+	if err = CheckSigninStatus(res.Status); err != nil {
+		return nil, err
+	}
 
 	return res.Verifier, nil
 }
 
-func (uc *UserUsecase) UpdateUser(ctx context.Context, user *User) (*v1.User, error) {
-	res, err := uc.ur.Update(ctx, user)
+// GetUserStatus returns the status of user, it is served by the user cache.
+func (uc *UserUsecase) GetUserStatus(ctx context.Context, userId int64) (UserStatus, error) {
+	res, err := uc.ur.Get(ctx, userId, UserViewBasic)
+	if err != nil {
+		return "", err
+	}
+	return res.Status, nil
+}
+
+// SpeedLimit returns the speed_limit of the group of user in bytes per second, zero is unlimited.
+func (uc *UserUsecase) SpeedLimit(ctx context.Context, userId int64) (int64, error) {
+	u, err := uc.ur.Get(ctx, userId, UserViewBasic)
+	if err != nil {
+		return 0, err
+	}
+	g, err := uc.gr.Get(ctx, u.GroupId, GroupViewBasic)
+	if err != nil {
+		return 0, err
+	}
+	return g.SpeedLimit, nil
+}
+
+// UpdateUser updates the fields of user in paths, the fields must be writable by the role of operator.
+func (uc *UserUsecase) UpdateUser(ctx context.Context, operatorId int64, user *User, paths []string) (*v1.User, error) {
+	role, err := uc.role(ctx, operatorId)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkUpdateMask(paths, userFields, userWritableFields[role]); err != nil {
+		return nil, err
+	}
+
+	AuditTarget(ctx, AuditTargetUser, user.Id)
+	before, err := uc.ur.Get(ctx, user.Id, UserViewBasic)
+	if err != nil {
+		return nil, err
+	}
+	if utils.StringsContain(paths, UserFieldGroupId) {
+		if err = uc.checkMove(ctx, operatorId, before.GroupId, user.GroupId); err != nil {
+			return nil, err
+		}
+		user.OwnerGroup = &Group{Id: user.GroupId}
+	}
+	for _, path := range paths {
+		AuditDiff(ctx, path, userFieldValue(before, path), userFieldValue(user, path))
+	}
+	return uc.update(ctx, user, paths...)
+}
+
+func (uc *UserUsecase) update(ctx context.Context, user *User, fields ...string) (*v1.User, error) {
+	res, err := uc.ur.Update(ctx, user, fields...)
 	if err != nil {
 		return nil, err
 	}
@@ -255,10 +408,174 @@ func (uc *UserUsecase) UpdateUser(ctx context.Context, user *User) (*v1.User, er
 }
 
 func (uc *UserUsecase) DeleteUser(ctx context.Context, userId int64) error {
+	AuditTarget(ctx, AuditTargetUser, userId)
 	if err := uc.ur.Delete(ctx, userId); err != nil {
 		return err
 	}
-	return nil
+	return uc.ssr.RevokeAll(ctx, userId)
+}
+
+// CreateUser creates a user on behalf of admin. Without invite, a password is generated and returned.
+// With invite, the user is not activated until the invite token returned is accepted by AcceptInvite.
+func (uc *UserUsecase) CreateUser(
+	ctx context.Context,
+	email, nickName string,
+	groupId int64,
+	invite bool,
+) (user *v1.User, password, inviteToken string, err error) {
+	if nickName == "" {
+		nickName = strings.Split(email, "@")[0]
+	}
+	salt, err := utils.SecureRandString(20, utils.AllCharSet)
+	if err != nil {
+		return nil, "", "", v1.ErrorInternal("generate salt error: %v", err)
+	}
+	if password, err = utils.SecureRandString(generatedPasswordLength, utils.AllCharSet); err != nil {
+		return nil, "", "", v1.ErrorInternal("generate password error: %v", err)
+	}
+
+	u := &User{
+		Email:      email,
+		NickName:   nickName,
+		Salt:       []byte(salt),
+		Verifier:   srp.ComputeVerifier(uc.params, []byte(salt), []byte(email), []byte(password)),
+		Storage:    0,
+		Score:      0,
+		Status:     StatusActive,
+		OwnerGroup: &Group{Id: groupId},
+	}
+	if invite {
+		u.Status = StatusNonActivated
+		// nobody knows the password of an invited user
+		password = ""
+	}
+
+	if _, err = uc.gr.Get(ctx, groupId, GroupViewBasic); err != nil {
+		return nil, "", "", err
+	}
+	res, err := uc.ur.Create(ctx, u)
+	switch {
+	case err != nil && v1.IsConflict(err):
+		return nil, "", "", v1.ErrorEmailExisted("email already in use")
+	case err != nil:
+		return nil, "", "", err
+	}
+	AuditTarget(ctx, AuditTargetUser, res.Id)
+	AuditDiff(ctx, "email", nil, res.Email)
+	AuditDiff(ctx, UserFieldGroupId, nil, groupId)
+	AuditDiff(ctx, UserFieldStatus, nil, res.Status.String())
+
+	if invite {
+		if inviteToken, err = randomToken(); err != nil {
+			return nil, "", "", v1.ErrorInternal("generate invite token error: %v", err)
+		}
+		if err = uc.ur.CacheInvite(ctx, inviteToken, res.Id, inviteTTL); err != nil {
+			return nil, "", "", err
+		}
+	}
+
+	user, err = ToProtoUser(res)
+	if err != nil {
+		return nil, "", "", err
+	}
+	return user, password, inviteToken, nil
+}
+
+// AcceptInvite sets the password of the invited user and activates it, an invite token can only be used once.
+func (uc *UserUsecase) AcceptInvite(ctx context.Context, token string, salt, verifier []byte) error {
+	// checked before the token is taken, so that a malformed request does not burn the invite
+	if len(salt) == 0 || len(verifier) == 0 {
+		return v1.ErrorInvalidArgument("invalid argument: salt and verifier are required")
+	}
+	userId, err := uc.ur.TakeInvite(ctx, token)
+	if err != nil {
+		return err
+	}
+	AuditActor(ctx, userId)
+	AuditTarget(ctx, AuditTargetUser, userId)
+	if err = uc.ur.UpdateVerifier(ctx, userId, salt, verifier); err != nil {
+		return err
+	}
+
+	u, err := uc.ur.Get(ctx, userId, UserViewBasic)
+	if err != nil {
+		return err
+	}
+	if u.Status == StatusNonActivated {
+		u.Status = StatusActive
+		_, err = uc.ur.Update(ctx, u, UserFieldStatus)
+	}
+	return err
+}
+
+func (uc *UserUsecase) UpdateUserStatus(ctx context.Context, userId int64, status UserStatus) (*v1.User, error) {
+	u, err := uc.ur.Get(ctx, userId, UserViewBasic)
+	if err != nil {
+		return nil, err
+	}
+	AuditTarget(ctx, AuditTargetUser, userId)
+	if u.Status == status {
+		return ToProtoUser(u)
+	}
+	AuditDiff(ctx, UserFieldStatus, u.Status.String(), status.String())
+	u.Status = status
+	res, err := uc.update(ctx, u, UserFieldStatus)
+	if err != nil {
+		return nil, err
+	}
+	// the sessions signed in with the previous status must not outlive it
+	if err = uc.ssr.RevokeAll(ctx, userId); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// UpdateUserGroup moves the user to the group, see checkMove.
+func (uc *UserUsecase) UpdateUserGroup(ctx context.Context, operatorId, userId, groupId int64) (*v1.User, error) {
+	u, err := uc.ur.Get(ctx, userId, UserViewBasic)
+	if err != nil {
+		return nil, err
+	}
+	if err = uc.checkMove(ctx, operatorId, u.GroupId, groupId); err != nil {
+		return nil, err
+	}
+	AuditTarget(ctx, AuditTargetUser, userId)
+	AuditDiff(ctx, UserFieldGroupId, u.GroupId, groupId)
+	u.OwnerGroup = &Group{Id: groupId}
+	return uc.update(ctx, u, UserFieldGroupId)
+}
+
+// checkMove checks the move of a user from the group fromGroupId to the group toGroupId, the operator can only move
+// the user between the groups differing in the permissions held by it.
+func (uc *UserUsecase) checkMove(ctx context.Context, operatorId, fromGroupId, toGroupId int64) error {
+	to, err := uc.gr.Get(ctx, toGroupId, GroupViewBasic)
+	if err != nil {
+		return err
+	}
+	if fromGroupId == toGroupId {
+		return nil
+	}
+	from, err := uc.gr.Get(ctx, fromGroupId, GroupViewBasic)
+	if err != nil {
+		return err
+	}
+	return checkGrant(ctx, uc.ur, uc.gr, operatorId, from.Permissions, to.Permissions)
+}
+
+// AdjustUser sets the storage of the user, a nil value is unchanged. The score is adjusted by
+// ScoreUsecase.SetScore, so that it is recorded in the ledger.
+func (uc *UserUsecase) AdjustUser(ctx context.Context, userId int64, storage *uint64) (*v1.User, error) {
+	u, err := uc.ur.Get(ctx, userId, UserViewBasic)
+	if err != nil {
+		return nil, err
+	}
+	AuditTarget(ctx, AuditTargetUser, userId)
+	if storage == nil {
+		return ToProtoUser(u)
+	}
+	AuditDiff(ctx, UserFieldStorage, u.Storage, *storage)
+	u.Storage = *storage
+	return uc.update(ctx, u, UserFieldStorage)
 }
 
 func (uc *UserUsecase) ListUsers(
@@ -281,17 +598,58 @@ func (uc *UserUsecase) ListUsers(
 	return protoUsers, page.NextPageToken, nil
 }
 
-func (uc *UserUsecase) IsAdminUser(ctx context.Context, userId int64) (bool, error) {
-	return uc.ur.IsAdminUser(ctx, userId)
+// CheckSigninStatus reports whether the user of status can sign in, the overuse banned user
+// can sign in but is read-only, and the user pending deletion can sign in to restore the account.
+func CheckSigninStatus(status UserStatus) error {
+	switch status {
+	case StatusActive, StatusOveruseBaned, StatusPendingDeletion:
+		return nil
+	case StatusBanned:
+		return v1.ErrorUserBanned("user is banned")
+	default:
+		return v1.ErrorEmailNotActivated("email not activated")
+	}
+}
+
+// role is RoleAdmin if the user is granted users.write.
+func (uc *UserUsecase) role(ctx context.Context, userId int64) (Role, error) {
+	ok, err := uc.HasPermission(ctx, userId, PermissionUsersWrite)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return RoleAdmin, nil
+	}
+	return RoleUser, nil
+}
+
+// checkMailFilter checks the domain of email against the register_mail_filter settings
+func checkMailFilter(options map[SettingName]*Setting, email string) error {
+	mode := settingValue(options, RegisterMailFilter)
+	if mode == "off" {
+		return nil
+	}
+	filterList := strings.Split(settingValue(options, RegisterMailFilterList), ",")
+	emailSplit := strings.Split(email, "@")
+	filterStatus := utils.StringsContain(filterList, emailSplit[len(emailSplit)-1])
+	eErr := v1.ErrorEmailDomainBanned("email domain is banned")
+	if mode == "blacklist" && filterStatus {
+		return eErr
+	}
+	if mode == "whitelist" && !filterStatus {
+		return eErr
+	}
+	return nil
 }
 
-func toUserStatus(p v1.User_Status) UserStatus {
+func ToUserStatus(p v1.User_Status) UserStatus {
 	if v, ok := v1.User_Status_name[int32(p)]; ok {
 		val := map[string]string{
-			"NON_ACTIVATED": "non_activated",
-			"ACTIVE":        "active",
-			"BANNED":        "banned",
-			"OVERUSE_BANED": "overuse_baned",
+			"NON_ACTIVATED":    "non_activated",
+			"ACTIVE":           "active",
+			"BANNED":           "banned",
+			"OVERUSE_BANED":    "overuse_baned",
+			"PENDING_DELETION": "pending_deletion",
 		}[v]
 		return UserStatus(val)
 	}
@@ -312,8 +670,9 @@ func ToUser(p *v1.User) (*User, error) {
 	u.Email = p.GetEmail()
 	u.NickName = p.GetNickName()
 	u.Storage = p.GetStorage()
+	u.StorageQuota = p.StorageQuota
 	u.Score = p.GetScore()
-	u.Status = toUserStatus(p.GetStatus())
+	u.Status = ToUserStatus(p.GetStatus())
 	u.CreateAt = p.GetCreatedAt().AsTime()
 	u.UpdateAt = p.GetUpdatedAt().AsTime()
 	if p.OwnerGroup != nil {
@@ -346,6 +705,17 @@ func ToProtoUser(u *User) (*v1.User, error) {
 	p.Storage = u.Storage
 	p.Score = u.Score
 	p.Status = toProtoUserStatus(u.Status)
+	if u.GroupExpireAt != nil {
+		p.GroupExpireAt = timestamppb.New(*u.GroupExpireAt)
+	}
+	if u.DeleteAt != nil {
+		p.DeleteAt = timestamppb.New(*u.DeleteAt)
+	}
+	p.StorageQuota = u.StorageQuota
+	p.UsedStorage = u.UsedStorage
+	if u.OveruseAt != nil {
+		p.OveruseAt = timestamppb.New(*u.OveruseAt)
+	}
 	p.CreatedAt = timestamppb.New(u.CreateAt)
 	p.UpdatedAt = timestamppb.New(u.UpdateAt)
 	if u.OwnerGroup != nil {
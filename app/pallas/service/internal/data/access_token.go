@@ -0,0 +1,133 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"entgo.io/ent/dialect/sql/sqlgraph"
+	"github.com/go-kratos/kratos/v2/log"
+
+	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
+	"github.com/hominsu/pallas/app/pallas/service/internal/biz"
+	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent"
+	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent/accesstoken"
+)
+
+var _ biz.AccessTokenRepo = (*accessTokenRepo)(nil)
+
+type accessTokenRepo struct {
+	data *Data
+	log  *log.Helper
+}
+
+// NewAccessTokenRepo .
+func NewAccessTokenRepo(data *Data, logger log.Logger) biz.AccessTokenRepo {
+	return &accessTokenRepo{
+		data: data,
+		log:  log.NewHelper(log.With(logger, "module", "data/access_token")),
+	}
+}
+
+func (r *accessTokenRepo) Create(ctx context.Context, t *biz.AccessToken, hash string) (*biz.AccessToken, error) {
+	scopes := make([]string, len(t.Scopes))
+	for i, s := range t.Scopes {
+		scopes[i] = s.String()
+	}
+
+	m := r.data.db.AccessToken.Create()
+	m.SetUserID(t.UserId)
+	m.SetName(t.Name)
+	m.SetTokenHash(hash)
+	m.SetScopes(scopes)
+	m.SetNillableExpireAt(t.ExpireAt)
+	res, err := m.Save(ctx)
+	switch {
+	case err == nil:
+		return toAccessToken(res), nil
+	case sqlgraph.IsUniqueConstraintError(err):
+		return nil, v1.ErrorConflict("access token already exists: %v", err)
+	case ent.IsConstraintError(err):
+		return nil, v1.ErrorConflict("invalid argument: %v", err)
+	default:
+		return nil, v1.ErrorUnknown("unknown error: %v", err)
+	}
+}
+
+func (r *accessTokenRepo) GetByHash(ctx context.Context, hash string) (*biz.AccessToken, error) {
+	res, err := r.data.db.AccessToken.Query().
+		Where(accesstoken.TokenHashEQ(hash)).
+		Only(ctx)
+	switch {
+	case err == nil:
+		return toAccessToken(res), nil
+	case ent.IsNotFound(err):
+		return nil, v1.ErrorNotFound("access token not found: %v", err)
+	default:
+		return nil, v1.ErrorUnknown("unknown error: %v", err)
+	}
+}
+
+func (r *accessTokenRepo) ListByUser(ctx context.Context, userId int64) ([]*biz.AccessToken, error) {
+	res, err := r.data.db.AccessToken.Query().
+		Where(accesstoken.UserIDEQ(userId)).
+		Order(ent.Asc(accesstoken.FieldID)).
+		All(ctx)
+	if err != nil {
+		return nil, v1.ErrorUnknown("unknown error: %v", err)
+	}
+	return toAccessTokenList(res), nil
+}
+
+func (r *accessTokenRepo) Delete(ctx context.Context, userId, tokenId int64) error {
+	n, err := r.data.db.AccessToken.Delete().
+		Where(
+			accesstoken.IDEQ(tokenId),
+			accesstoken.UserIDEQ(userId),
+		).
+		Exec(ctx)
+	switch {
+	case err != nil:
+		return v1.ErrorUnknown("unknown error: %v", err)
+	case n == 0:
+		return v1.ErrorNotFound("access token not found")
+	default:
+		return nil
+	}
+}
+
+func (r *accessTokenRepo) Touch(ctx context.Context, tokenId int64, t time.Time) error {
+	err := r.data.db.AccessToken.UpdateOneID(tokenId).
+		SetLastUsedAt(t).
+		Exec(ctx)
+	switch {
+	case err == nil:
+		return nil
+	case ent.IsNotFound(err):
+		return v1.ErrorNotFound("access token not found: %v", err)
+	default:
+		return v1.ErrorUnknown("unknown error: %v", err)
+	}
+}
+
+func toAccessToken(e *ent.AccessToken) *biz.AccessToken {
+	t := &biz.AccessToken{}
+	t.Id = e.ID
+	t.UserId = e.UserID
+	t.Name = e.Name
+	t.Scopes = make([]biz.TokenScope, len(e.Scopes))
+	for i, s := range e.Scopes {
+		t.Scopes[i] = biz.TokenScope(s)
+	}
+	t.ExpireAt = e.ExpireAt
+	t.LastUsedAt = e.LastUsedAt
+	t.CreateAt = e.CreatedAt
+	return t
+}
+
+func toAccessTokenList(e []*ent.AccessToken) []*biz.AccessToken {
+	list := make([]*biz.AccessToken, len(e))
+	for i, entEntity := range e {
+		list[i] = toAccessToken(entEntity)
+	}
+	return list
+}
@@ -0,0 +1,101 @@
+package data
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/stretchr/testify/assert"
+
+	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
+	"github.com/hominsu/pallas/app/pallas/service/internal/biz"
+	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent/group"
+	"github.com/hominsu/pallas/pkg/srp"
+	"github.com/hominsu/pallas/pkg/utils"
+)
+
+func TestAccessTokenUsecase(t *testing.T) {
+	logger := log.With(log.NewStdLogger(io.Discard))
+
+	cs := newTestDataConf()
+	for _, c := range cs {
+		d, cleanup := newTestData(t, c)
+		ur := NewUserRepo(d, logger)
+		uc := biz.NewAccessTokenUsecase(NewAccessTokenRepo(d, logger), ur, NewGroupRepo(d, logger), logger)
+
+		t.Run(testName(c), func(t *testing.T) {
+			defer cleanup()
+			ctx := context.TODO()
+
+			params, err := srp.GetParams(2048)
+			assert.NoError(t, err)
+			targetGroup, err := d.db.Group.Query().Where(group.NameEQ("User")).Only(ctx)
+			assert.NoError(t, err)
+
+			email := "test-token@pallas.icu"
+			salt := []byte(utils.RandString(20, utils.AllCharSet))
+			password := []byte(utils.RandString(20, utils.AllCharSet))
+			u, err := ur.Create(ctx, &biz.User{
+				Email:      email,
+				NickName:   "test-token",
+				Salt:       salt,
+				Verifier:   srp.ComputeVerifier(params, salt, []byte(email), password),
+				Status:     biz.StatusActive,
+				OwnerGroup: &biz.Group{Id: targetGroup.ID},
+			})
+			assert.NoError(t, err)
+			admin, err := ur.GetByEmail(ctx, "admin@pallas.icu", biz.UserViewBasic)
+			assert.NoError(t, err)
+
+			// admin scope requires admin user
+			_, _, err = uc.CreateAccessToken(ctx, u.Id, "ci", []biz.TokenScope{biz.ScopeAdmin}, 0)
+			assert.True(t, v1.IsInvalidArgument(err))
+			_, _, err = uc.CreateAccessToken(ctx, admin.Id, "ci", []biz.TokenScope{biz.ScopeAdmin}, 0)
+			assert.NoError(t, err)
+
+			// a negative expires in is rejected rather than never expires
+			_, _, err = uc.CreateAccessToken(ctx, u.Id, "ci", []biz.TokenScope{biz.ScopeUser}, -time.Hour)
+			assert.True(t, v1.IsInvalidArgument(err))
+
+			raw, res, err := uc.CreateAccessToken(ctx, u.Id, "ci", []biz.TokenScope{biz.ScopeReadOnly}, 0)
+			assert.NoError(t, err)
+			assert.Nil(t, res.ExpireAt)
+			assert.Nil(t, res.LastUsedAt)
+
+			// authenticate and track the last used time
+			token, err := uc.Authenticate(ctx, raw)
+			assert.NoError(t, err)
+			assert.Equal(t, u.Id, token.UserId)
+			assert.Equal(t, []biz.TokenScope{biz.ScopeReadOnly}, token.Scopes)
+			token, err = uc.Authenticate(ctx, raw)
+			assert.NoError(t, err)
+			assert.NotNil(t, token.LastUsedAt)
+
+			_, err = uc.Authenticate(ctx, raw+"x")
+			assert.True(t, v1.IsSigninOperation(err))
+			_, err = uc.Authenticate(ctx, "random")
+			assert.True(t, v1.IsSigninOperation(err))
+
+			// expired token
+			expired, _, err := uc.CreateAccessToken(ctx, u.Id, "expired", []biz.TokenScope{biz.ScopeUser}, time.Nanosecond)
+			assert.NoError(t, err)
+			time.Sleep(time.Millisecond)
+			_, err = uc.Authenticate(ctx, expired)
+			assert.True(t, v1.IsSigninOperation(err))
+
+			list, err := uc.ListAccessTokens(ctx, u.Id)
+			assert.NoError(t, err)
+			assert.Len(t, list, 2)
+
+			// a token can only be deleted by its owner
+			assert.True(t, v1.IsNotFound(uc.DeleteAccessToken(ctx, admin.Id, res.Id)))
+			assert.NoError(t, uc.DeleteAccessToken(ctx, u.Id, res.Id))
+			_, err = uc.Authenticate(ctx, raw)
+			assert.True(t, v1.IsSigninOperation(err))
+
+			flushTestData(t, d)
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/stretchr/testify/assert"
+
+	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
+	"github.com/hominsu/pallas/app/pallas/service/internal/biz"
+	"github.com/hominsu/pallas/app/pallas/service/internal/conf"
+	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent/group"
+	"github.com/hominsu/pallas/pkg/sessions"
+	"github.com/hominsu/pallas/pkg/srp"
+)
+
+func TestAccountUsecase(t *testing.T) {
+	logger := log.With(log.NewStdLogger(io.Discard))
+
+	cs := newTestDataConf()
+	for _, c := range cs {
+		d, cleanup := newTestData(t, c)
+		params, err := srp.GetParams(2048)
+		assert.NoError(t, err)
+		store := NewSessionStore(d.rdCmd, &conf.Secret{Session: &conf.Secret_Session{SessionKey: "test"}}, logger)
+		ur := NewUserRepo(d, logger)
+		sr := NewSettingRepo(d, logger)
+		ssr := NewSessionRepo(store, logger)
+		scr := NewScoreRepo(d, logger)
+		ar, arCleanup := NewAuditRepo(d, logger)
+		uu := biz.NewUserUsecase(ur, NewGroupRepo(d, logger), sr, ssr, params, logger)
+		uc := biz.NewAccountUsecase(
+			ur,
+			NewIdentityRepo(d, logger),
+			NewAccessTokenRepo(d, logger),
+			scr,
+			ar,
+			sr,
+			ssr,
+			uu,
+			logger,
+		)
+
+		t.Run(testName(c), func(t *testing.T) {
+			defer cleanup()
+			defer arCleanup()
+			ctx := context.TODO()
+
+			targetGroup, err := d.db.Group.Query().Where(group.NameEQ("User")).Only(ctx)
+			assert.NoError(t, err)
+			u, err := ur.Create(ctx, &biz.User{
+				Email:      "test-account@pallas.icu",
+				NickName:   "test-account",
+				Salt:       []byte("salt"),
+				Verifier:   []byte("verifier"),
+				Status:     biz.StatusActive,
+				OwnerGroup: &biz.Group{Id: targetGroup.ID},
+			})
+			assert.NoError(t, err)
+			_, err = scr.Apply(ctx, &biz.ScoreTransaction{UserId: u.Id, Amount: 10, Reason: biz.ReasonCheckin}, nil)
+			assert.NoError(t, err)
+
+			session := sessions.NewSession(store, "pallas-session")
+			session.ID = "account-session"
+			session.Options.MaxAge = 3600
+			assert.NoError(t, store.Persist(ctx, session))
+			info, err := json.Marshal(&biz.Session{SigninAt: time.Now(), RemoteAddr: "127.0.0.1", UserAgent: "test"})
+			assert.NoError(t, err)
+			assert.NoError(t, store.Track(ctx, strconv.FormatInt(u.Id, 10), session, info))
+
+			// the export
+			export, err := uc.ExportUser(ctx, u.Id)
+			assert.NoError(t, err)
+			assert.Equal(t, u.Email, export.User.Email)
+			assert.Len(t, export.ScoreTransactions, 1)
+			if assert.Len(t, export.Sessions, 1) {
+				assert.Equal(t, "127.0.0.1", export.Sessions[0].RemoteAddr)
+				assert.Equal(t, "test", export.Sessions[0].UserAgent)
+				assert.NotEqual(t, session.ID, export.Sessions[0].Id)
+				assert.True(t, export.Sessions[0].ExpireAt.After(time.Now()))
+			}
+			p, err := biz.ToProtoUserExport(export)
+			assert.NoError(t, err)
+			assert.Equal(t, u.Id, p.GetUser().GetId())
+
+			// the signin is too old, or by an access token
+			stale := time.Now().Add(-time.Hour)
+			_, err = uc.RequestDeletion(ctx, u.Id, &stale, "")
+			assert.True(t, v1.IsReauthenticationRequired(err))
+			_, err = uc.RequestDeletion(ctx, u.Id, nil, "")
+			assert.True(t, v1.IsReauthenticationRequired(err))
+
+			// the admin can not be deleted
+			admin, err := ur.GetByEmail(ctx, "admin@pallas.icu", biz.UserViewBasic)
+			assert.NoError(t, err)
+			now := time.Now()
+			_, err = uc.RequestDeletion(ctx, admin.Id, &now, "")
+			assert.True(t, v1.IsBadGroupOperation(err))
+
+			res, err := uc.RequestDeletion(ctx, u.Id, &now, "")
+			assert.NoError(t, err)
+			assert.Equal(t, v1.User_PENDING_DELETION, res.GetStatus())
+			assert.WithinDuration(t, now.AddDate(0, 0, 14), res.GetDeleteAt().AsTime(), time.Minute)
+			sessionList, err := ssr.List(ctx, u.Id)
+			assert.NoError(t, err)
+			assert.Empty(t, sessionList)
+			// the user pending deletion can sign in to restore the account
+			status, err := uu.GetUserStatus(ctx, u.Id)
+			assert.NoError(t, err)
+			assert.NoError(t, biz.CheckSigninStatus(status))
+			_, err = uc.RequestDeletion(ctx, u.Id, &now, "")
+			assert.True(t, v1.IsInvalidArgument(err))
+
+			// restored
+			res, err = uc.RestoreUser(ctx, u.Id)
+			assert.NoError(t, err)
+			assert.Equal(t, v1.User_ACTIVE, res.GetStatus())
+			assert.Nil(t, res.GetDeleteAt())
+			_, err = uc.RestoreUser(ctx, u.Id)
+			assert.True(t, v1.IsInvalidArgument(err))
+
+			// purged after the grace period only
+			_, err = uc.RequestDeletion(ctx, u.Id, &now, "")
+			assert.NoError(t, err)
+			assert.NoError(t, uc.PurgeDeletedUsers(ctx))
+			_, err = ur.Get(ctx, u.Id, biz.UserViewBasic)
+			assert.NoError(t, err)
+			purged, err := ur.PurgeDeleted(ctx, now.AddDate(0, 0, 15))
+			assert.NoError(t, err)
+			assert.Equal(t, []int64{u.Id}, purged)
+			_, err = ur.Get(ctx, u.Id, biz.UserViewBasic)
+			assert.True(t, v1.IsNotFound(err))
+			page, err := scr.List(ctx, u.Id, 10, "")
+			assert.NoError(t, err)
+			assert.Empty(t, page.Transactions)
+
+			flushTestData(t, d)
+		})
+	}
+}
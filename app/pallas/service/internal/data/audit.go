@@ -0,0 +1,222 @@
+package data
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+
+	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
+	"github.com/hominsu/pallas/app/pallas/service/internal/biz"
+	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent"
+	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent/auditevent"
+	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent/schema"
+	"github.com/hominsu/pallas/pkg/pagination"
+)
+
+var _ biz.AuditRepo = (*auditRepo)(nil)
+
+const (
+	// auditQueueSize is the number of the events can be queued, the events are dropped when the queue is full
+	auditQueueSize = 1024
+	// auditBatchSize is the maximum number of the events written in one insert
+	auditBatchSize = 100
+	// auditFlushInterval is how long an event waits for the batch
+	auditFlushInterval = time.Second
+	// auditWriteTimeout is the timeout of writing a batch
+	auditWriteTimeout = 5 * time.Second
+)
+
+type auditRepo struct {
+	data  *Data
+	queue chan *biz.AuditEvent
+	wg    sync.WaitGroup
+	log   *log.Helper
+}
+
+// NewAuditRepo returns the audit repo with a background writer, the queued events are written on cleanup.
+func NewAuditRepo(data *Data, logger log.Logger) (biz.AuditRepo, func()) {
+	r := &auditRepo{
+		data:  data,
+		queue: make(chan *biz.AuditEvent, auditQueueSize),
+		log:   log.NewHelper(log.With(logger, "module", "data/audit")),
+	}
+	r.wg.Add(1)
+	go r.writer()
+
+	cleanup := func() {
+		close(r.queue)
+		r.wg.Wait()
+	}
+	return r, cleanup
+}
+
+func (r *auditRepo) Create(_ context.Context, event *biz.AuditEvent) {
+	if event.CreateAt.IsZero() {
+		event.CreateAt = time.Now()
+	}
+	select {
+	case r.queue <- event:
+	default:
+		r.log.Errorf("audit queue is full, event dropped: %s by %v", event.Action, event.ActorId)
+	}
+}
+
+func (r *auditRepo) List(
+	ctx context.Context,
+	filter *biz.AuditFilter,
+	pageSize int,
+	pageToken string,
+) (*biz.AuditEventPage, error) {
+	// the latest first
+	listQuery := r.data.db.AuditEvent.Query().
+		Order(ent.Desc(auditevent.FieldID)).
+		Limit(pageSize + 1)
+	if pageToken != "" {
+		token, pErr := pagination.DecodePageToken(pageToken)
+		if pErr != nil {
+			return nil, v1.ErrorInternal("decode page token err: %v", pErr)
+		}
+		listQuery = listQuery.Where(auditevent.IDLTE(token))
+	}
+	if filter != nil {
+		if filter.ActorId != nil {
+			listQuery = listQuery.Where(auditevent.ActorID(*filter.ActorId))
+		}
+		if filter.Action != "" {
+			listQuery = listQuery.Where(auditevent.Action(filter.Action))
+		}
+		if filter.TargetType != "" {
+			listQuery = listQuery.Where(auditevent.TargetType(filter.TargetType))
+		}
+		if filter.TargetId != "" {
+			listQuery = listQuery.Where(auditevent.TargetID(filter.TargetId))
+		}
+		if filter.Success != nil {
+			listQuery = listQuery.Where(auditevent.Success(*filter.Success))
+		}
+		if filter.Since != nil {
+			listQuery = listQuery.Where(auditevent.CreatedAtGTE(*filter.Since))
+		}
+		if filter.Until != nil {
+			listQuery = listQuery.Where(auditevent.CreatedAtLT(*filter.Until))
+		}
+	}
+
+	entList, err := listQuery.All(ctx)
+	if err != nil {
+		return nil, v1.ErrorUnknown("unknown error: %v", err)
+	}
+
+	// generate next page token
+	var nextPageToken string
+	if len(entList) == pageSize+1 {
+		nextPageToken, err = pagination.EncodePageToken(entList[len(entList)-1].ID)
+		if err != nil {
+			return nil, v1.ErrorInternal("encode page token error: %v", err)
+		}
+		entList = entList[:len(entList)-1]
+	}
+
+	events := make([]*biz.AuditEvent, len(entList))
+	for i, e := range entList {
+		events[i] = toAuditEvent(e)
+	}
+	return &biz.AuditEventPage{
+		Events:        events,
+		NextPageToken: nextPageToken,
+	}, nil
+}
+
+func (r *auditRepo) DeleteBefore(ctx context.Context, t time.Time) (int, error) {
+	n, err := r.data.db.AuditEvent.Delete().
+		Where(auditevent.CreatedAtLT(t)).
+		Exec(ctx)
+	if err != nil {
+		return 0, v1.ErrorUnknown("unknown error: %v", err)
+	}
+	return n, nil
+}
+
+// writer writes the queued events in batches, until the queue is closed and drained
+func (r *auditRepo) writer() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(auditFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*biz.AuditEvent, 0, auditBatchSize)
+	for {
+		select {
+		case e, ok := <-r.queue:
+			if !ok {
+				r.write(batch)
+				return
+			}
+			batch = append(batch, e)
+			if len(batch) < auditBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+		r.write(batch)
+		batch = batch[:0]
+	}
+}
+
+func (r *auditRepo) write(events []*biz.AuditEvent) {
+	if len(events) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), auditWriteTimeout)
+	defer cancel()
+
+	bulk := make([]*ent.AuditEventCreate, len(events))
+	for i, e := range events {
+		m := r.data.db.AuditEvent.Create().
+			SetAction(e.Action).
+			SetNillableActorID(e.ActorId).
+			SetTargetType(e.TargetType).
+			SetTargetID(e.TargetId).
+			SetRemoteAddr(e.RemoteAddr).
+			SetRequestID(e.RequestId).
+			SetSuccess(e.Success).
+			SetReason(e.Reason).
+			SetCreatedAt(e.CreateAt)
+		if len(e.Diff) > 0 {
+			diff := make(map[string]*schema.AuditChange, len(e.Diff))
+			for k, c := range e.Diff {
+				diff[k] = &schema.AuditChange{Before: c.Before, After: c.After}
+			}
+			m.SetDiff(diff)
+		}
+		bulk[i] = m
+	}
+	if err := r.data.db.AuditEvent.CreateBulk(bulk...).Exec(ctx); err != nil {
+		r.log.Errorf("failed to write %d audit events: %v", len(events), err)
+	}
+}
+
+func toAuditEvent(e *ent.AuditEvent) *biz.AuditEvent {
+	res := &biz.AuditEvent{
+		Id:         e.ID,
+		Action:     e.Action,
+		ActorId:    e.ActorID,
+		TargetType: e.TargetType,
+		TargetId:   e.TargetID,
+		RemoteAddr: e.RemoteAddr,
+		RequestId:  e.RequestID,
+		Success:    e.Success,
+		Reason:     e.Reason,
+		CreateAt:   e.CreatedAt,
+	}
+	if len(e.Diff) > 0 {
+		res.Diff = make(map[string]*biz.AuditChange, len(e.Diff))
+		for k, c := range e.Diff {
+			res.Diff[k] = &biz.AuditChange{Before: c.Before, After: c.After}
+		}
+	}
+	return res
+}
@@ -0,0 +1,93 @@
+package data
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hominsu/pallas/app/pallas/service/internal/biz"
+)
+
+func TestAuditUsecase(t *testing.T) {
+	logger := log.With(log.NewStdLogger(io.Discard))
+
+	cs := newTestDataConf()
+	for _, c := range cs {
+		d, cleanup := newTestData(t, c)
+		ar, arCleanup := NewAuditRepo(d, logger)
+		uc := biz.NewAuditUsecase(ar, NewSettingRepo(d, logger), logger)
+
+		t.Run(testName(c), func(t *testing.T) {
+			defer cleanup()
+			ctx := context.TODO()
+
+			actorId := int64(1)
+			old := time.Now().AddDate(0, 0, -100)
+			for i := 0; i < 5; i++ {
+				ctx, record := biz.NewAuditContext(ctx)
+				biz.AuditTarget(ctx, biz.AuditTargetUser, i)
+				biz.AuditDiff(ctx, biz.UserFieldStatus, "active", "banned")
+				biz.AuditDiff(ctx, biz.UserFieldNickName, "same", "same")
+
+				e := &biz.AuditEvent{
+					Action:     "/pallas.service.v1.AdminService/UpdateUserStatus",
+					ActorId:    &actorId,
+					RemoteAddr: "127.0.0.1",
+					RequestId:  "request-id",
+					Success:    i%2 == 0,
+				}
+				if i == 0 {
+					e.CreateAt = old
+				}
+				record.Fill(e)
+				uc.Record(ctx, e)
+			}
+			uc.Record(ctx, &biz.AuditEvent{
+				Action:     "/pallas.service.v1.UserService/SigninM",
+				TargetType: biz.AuditTargetEmail,
+				TargetId:   "test-audit@pallas.icu",
+				Reason:     "SIGNIN_OPERATION",
+			})
+			// the events are written by the background writer, the cleanup flushes the queue
+			arCleanup()
+
+			list, token, err := uc.ListEvents(ctx, &biz.AuditFilter{ActorId: &actorId}, 3, "")
+			assert.NoError(t, err)
+			assert.Len(t, list, 3)
+			assert.NotEmpty(t, token)
+			assert.Equal(t, "4", list[0].TargetId)
+			assert.Equal(t, "banned", list[0].Diff[biz.UserFieldStatus].After.GetStringValue())
+			assert.NotContains(t, list[0].Diff, biz.UserFieldNickName)
+			list, token, err = uc.ListEvents(ctx, &biz.AuditFilter{ActorId: &actorId}, 3, token)
+			assert.NoError(t, err)
+			assert.Len(t, list, 2)
+			assert.Empty(t, token)
+
+			failed := false
+			list, _, err = uc.ListEvents(ctx, &biz.AuditFilter{Success: &failed}, 10, "")
+			assert.NoError(t, err)
+			assert.Len(t, list, 3)
+			list, _, err = uc.ListEvents(ctx, &biz.AuditFilter{TargetType: biz.AuditTargetEmail}, 10, "")
+			assert.NoError(t, err)
+			assert.Len(t, list, 1)
+			assert.Nil(t, list[0].ActorId)
+			assert.Equal(t, "SIGNIN_OPERATION", list[0].Reason)
+			since := time.Now().AddDate(0, 0, -1)
+			list, _, err = uc.ListEvents(ctx, &biz.AuditFilter{Since: &since}, 10, "")
+			assert.NoError(t, err)
+			assert.Len(t, list, 5)
+
+			// the events older than the retention are purged
+			assert.NoError(t, uc.Purge(ctx))
+			list, _, err = uc.ListEvents(ctx, nil, 10, "")
+			assert.NoError(t, err)
+			assert.Len(t, list, 5)
+
+			flushTestData(t, d)
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/go-redis/cache/v9"
+
+	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
+	"github.com/hominsu/pallas/app/pallas/service/internal/biz"
+	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent"
+	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent/avatar"
+	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent/user"
+)
+
+var _ biz.AvatarRepo = (*avatarRepo)(nil)
+
+const avatarCacheKeyPrefix = "avatar_cache_key_"
+
+type avatarRepo struct {
+	data  *Data
+	users *userRepo
+	log   *log.Helper
+}
+
+// NewAvatarRepo .
+func NewAvatarRepo(data *Data, logger log.Logger) biz.AvatarRepo {
+	return &avatarRepo{
+		data:  data,
+		users: NewUserRepo(data, logger).(*userRepo),
+		log:   log.NewHelper(log.With(logger, "module", "data/avatar")),
+	}
+}
+
+func (r *avatarRepo) Save(ctx context.Context, userId int64, avatars []*biz.Avatar, quota uint64) error {
+	tx, err := r.data.db.Tx(ctx)
+	if err != nil {
+		return v1.ErrorInternal("create transactional client error: %v", err)
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			if rErr := tx.Rollback(); rErr != nil {
+				r.log.Warnf("rollback failed, err: %v", rErr)
+			}
+			panic(v)
+		}
+	}()
+
+	sizes, err := r.save(ctx, tx, userId, avatars, quota)
+	if err != nil {
+		if rErr := tx.Rollback(); rErr != nil {
+			return v1.ErrorInternal("rollback failed, err: %v",
+				fmt.Errorf("%w: rolling back transaction: %v", err, rErr))
+		}
+		return err
+	}
+	if cErr := tx.Commit(); cErr != nil {
+		return v1.ErrorInternal("failed commits the transaction, err: %v", cErr)
+	}
+
+	// the sizes of the previous avatars, and the sizes requested which are the avatar_sizes
+	keys := make([]string, 0, len(sizes)+len(avatars))
+	for _, size := range sizes {
+		keys = append(keys, r.cacheKey(userId, size))
+	}
+	for _, a := range avatars {
+		keys = append(keys, r.cacheKey(userId, a.Size))
+	}
+	if dErr := r.data.deleteCache(ctx, keys...); dErr != nil {
+		r.log.Error(dErr)
+	}
+	// the used storage of user is changed
+	u, err := r.data.db.User.Query().Where(user.ID(userId)).Select(user.FieldID, user.FieldEmail).Only(ctx)
+	if err != nil {
+		r.log.Errorf("get user error: %v", err)
+		return nil
+	}
+	r.users.invalidateCache(ctx, u.ID, u.Email)
+	return nil
+}
+
+// save replaces the avatars of user, and returns the sizes of the avatars replaced
+func (r *avatarRepo) save(
+	ctx context.Context,
+	tx *ent.Tx,
+	userId int64,
+	avatars []*biz.Avatar,
+	quota uint64,
+) ([]int, error) {
+	prev, err := tx.Avatar.Query().
+		Where(avatar.UserID(userId)).
+		Select(avatar.FieldSize, avatar.FieldData).
+		All(ctx)
+	if err != nil {
+		return nil, v1.ErrorUnknown("unknown error: %v", err)
+	}
+	sizes := make([]int, len(prev))
+	var delta int64
+	for i, a := range prev {
+		sizes[i] = a.Size
+		delta -= int64(len(a.Data))
+	}
+	for _, a := range avatars {
+		delta += int64(len(a.Data))
+	}
+	if err = addUsedStorage(ctx, tx, userId, delta, quota); err != nil {
+		return nil, err
+	}
+
+	if _, err = tx.Avatar.Delete().Where(avatar.UserID(userId)).Exec(ctx); err != nil {
+		return nil, v1.ErrorUnknown("unknown error: %v", err)
+	}
+
+	bulk := make([]*ent.AvatarCreate, len(avatars))
+	for i, a := range avatars {
+		bulk[i] = tx.Avatar.Create().
+			SetUserID(userId).
+			SetSize(a.Size).
+			SetData(a.Data).
+			SetEtag(a.ETag)
+	}
+	err = tx.Avatar.CreateBulk(bulk...).Exec(ctx)
+	switch {
+	case err == nil:
+		return sizes, nil
+	case ent.IsConstraintError(err):
+		return nil, v1.ErrorNotFound("user not found: %v", err)
+	default:
+		return nil, v1.ErrorUnknown("unknown error: %v", err)
+	}
+}
+
+func (r *avatarRepo) Get(ctx context.Context, userId int64, size int) (*biz.Avatar, error) {
+	// key: avatar_cache_key_get_avatar_user_id_size:userId_size
+	key := r.cacheKey(userId, size)
+	res := &biz.Avatar{}
+	// get cache
+	err := r.data.cache.Get(ctx, key, res)
+	if err == nil {
+		return res, nil
+	}
+	if !errors.Is(err, cache.ErrCacheMiss) {
+		r.log.Errorf("cache error: %v", err)
+	}
+
+	// get from db, the smallest one not less than size, or the largest one
+	e, err := r.data.db.Avatar.Query().
+		Where(avatar.UserID(userId), avatar.SizeGTE(size)).
+		Order(ent.Asc(avatar.FieldSize)).
+		First(ctx)
+	if ent.IsNotFound(err) {
+		e, err = r.data.db.Avatar.Query().
+			Where(avatar.UserID(userId)).
+			Order(ent.Desc(avatar.FieldSize)).
+			First(ctx)
+	}
+	switch {
+	case err == nil: // db hit, set cache
+		res = toAvatar(e)
+		if err = r.data.cache.Set(&cache.Item{
+			Ctx:   ctx,
+			Key:   key,
+			Value: res,
+			TTL:   r.data.conf.Cache.Ttl.AsDuration(),
+		}); err != nil {
+			r.log.Errorf("cache error: %v", err)
+		}
+		return res, nil
+	case ent.IsNotFound(err):
+		return nil, v1.ErrorNotFound("avatar not found")
+	default:
+		return nil, v1.ErrorUnknown("unknown error: %v", err)
+	}
+}
+
+func (r *avatarRepo) cacheKey(userId int64, size int) string {
+	return avatarCacheKeyPrefix + "get_avatar_user_id_size:" +
+		strconv.FormatInt(userId, 10) + "_" + strconv.Itoa(size)
+}
+
+func toAvatar(e *ent.Avatar) *biz.Avatar {
+	return &biz.Avatar{
+		Id:       e.ID,
+		UserId:   e.UserID,
+		Size:     e.Size,
+		Data:     e.Data,
+		ETag:     e.Etag,
+		CreateAt: e.CreatedAt,
+	}
+}
@@ -0,0 +1,113 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/stretchr/testify/assert"
+
+	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
+	"github.com/hominsu/pallas/app/pallas/service/internal/biz"
+)
+
+func TestAvatarUsecase(t *testing.T) {
+	logger := log.With(log.NewStdLogger(io.Discard))
+
+	cs := newTestDataConf()
+	for _, c := range cs {
+		d, cleanup := newTestData(t, c)
+		ur := NewUserRepo(d, logger)
+		sr := NewSettingRepo(d, logger)
+		uc := biz.NewAvatarUsecase(NewAvatarRepo(d, logger), ur, NewGroupRepo(d, logger), sr, logger)
+
+		t.Run(testName(c), func(t *testing.T) {
+			defer cleanup()
+			ctx := context.TODO()
+
+			admin, err := ur.GetByEmail(ctx, "admin@pallas.icu", biz.UserViewBasic)
+			assert.NoError(t, err)
+
+			// the identicon without an upload
+			identicon, err := uc.GetAvatar(ctx, admin.Id, 0, true)
+			assert.NoError(t, err)
+			assert.Equal(t, "image/png", identicon.ContentType)
+			cfg, err := png.DecodeConfig(bytes.NewReader(identicon.Data))
+			assert.NoError(t, err)
+			assert.Equal(t, 200, cfg.Width)
+			res, err := uc.GetAvatar(ctx, admin.Id, 0, true)
+			assert.NoError(t, err)
+			assert.Equal(t, identicon.ETag, res.ETag)
+
+			_, err = uc.GetAvatar(ctx, admin.Id+1000, 0, true)
+			assert.True(t, v1.IsNotFound(err))
+
+			// upload a landscape image
+			img := image.NewRGBA(image.Rect(0, 0, 300, 150))
+			draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{R: 0xff, A: 0xff}), image.Point{}, draw.Src)
+			var buf bytes.Buffer
+			assert.NoError(t, png.Encode(&buf, img))
+			assert.NoError(t, uc.UploadAvatar(ctx, admin.Id, buf.Bytes()))
+
+			for size, expected := range map[int]int{0: 200, 1: 40, 40: 40, 41: 100, 300: 200} {
+				res, err = uc.GetAvatar(ctx, admin.Id, size, true)
+				assert.NoError(t, err)
+				got, dErr := png.Decode(bytes.NewReader(res.Data))
+				assert.NoError(t, dErr)
+				assert.Equal(t, image.Rect(0, 0, expected, expected), got.Bounds())
+				r, _, _, _ := got.At(expected/2, expected/2).RGBA()
+				assert.Equal(t, uint32(0xffff), r)
+			}
+
+			err = uc.UploadAvatar(ctx, admin.Id, []byte("not an image"))
+			assert.True(t, v1.IsInvalidArgument(err))
+
+			// the limits come from the settings
+			options, err := sr.ListByType(ctx, biz.TypeAvatar)
+			assert.NoError(t, err)
+			for name, value := range map[biz.SettingName]string{
+				biz.AvatarMaxSize: "64",
+				biz.AvatarMode:    biz.AvatarModeGravatar,
+			} {
+				_, err = sr.Update(ctx, &biz.Setting{Id: options[name].Id, Value: &value})
+				assert.NoError(t, err)
+			}
+			err = uc.UploadAvatar(ctx, admin.Id, buf.Bytes())
+			assert.True(t, v1.IsInvalidArgument(err))
+
+			// the uploaded avatar is preferred to the Gravatar
+			res, err = uc.GetAvatar(ctx, admin.Id, 100, true)
+			assert.NoError(t, err)
+			assert.Empty(t, res.RedirectURL)
+
+			u, err := ur.Create(ctx, &biz.User{
+				Email:      "test-avatar@pallas.icu",
+				NickName:   "test-avatar",
+				Salt:       []byte("salt"),
+				Verifier:   []byte("verifier"),
+				Status:     biz.StatusActive,
+				OwnerGroup: &biz.Group{Id: admin.GroupId},
+			})
+			assert.NoError(t, err)
+			res, err = uc.GetAvatar(ctx, u.Id, 100, true)
+			assert.NoError(t, err)
+			assert.True(t, strings.HasPrefix(res.RedirectURL, "https://www.gravatar.com/avatar/"))
+			assert.Contains(t, res.RedirectURL, "s=100")
+
+			// the hash of the email is not revealed to the viewers not signed in
+			res, err = uc.GetAvatar(ctx, u.Id, 100, false)
+			assert.NoError(t, err)
+			assert.Empty(t, res.RedirectURL)
+			assert.Equal(t, "image/png", res.ContentType)
+
+			flushTestData(t, d)
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/go-redis/cache/v9"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/hominsu/pallas/app/pallas/service/internal/conf"
+	"github.com/hominsu/pallas/pkg/utils"
+)
+
+// cacheInvalidationChannel is the redis channel the invalidations of the local caches are published to
+const cacheInvalidationChannel = "pallas_cache_invalidation"
+
+// defaultLocalCacheSize is the size of the local cache enabled without the size configured
+const defaultLocalCacheSize = 10000
+
+// cacheBusPingInterval is how often the subscription is checked while idle, so that a dead connection is
+// reconnected rather than waiting for the messages forever
+const cacheBusPingInterval = 30 * time.Second
+
+// LocalCache is the TinyLFU cache of the instance in front of redis. The TinyLFU keeps the previous item of the
+// key in its window when the key is set again, and the stale item is admitted back after the key is deleted, so
+// the key is replaced on Set.
+type LocalCache struct {
+	mu   sync.Mutex
+	lfu  *cache.TinyLFU
+	size int
+	ttl  time.Duration
+}
+
+// NewLocalCache returns nil if the local cache is disabled. It is always enabled without redis, since it is the
+// only cache of the instance then.
+func NewLocalCache(conf *conf.Data) *LocalCache {
+	redisEnabled := conf.GetRedis().GetAddr() != ""
+	if !conf.Cache.LfuEnable && redisEnabled {
+		return nil
+	}
+	c := &LocalCache{
+		size: int(conf.Cache.LfuSize),
+		ttl:  conf.Cache.Ttl.AsDuration(),
+	}
+	if c.size <= 0 {
+		c.size = defaultLocalCacheSize
+	}
+	c.reset()
+	return c
+}
+
+func (c *LocalCache) Set(key string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lfu.Del(key)
+	c.lfu.Set(key, data)
+}
+
+func (c *LocalCache) Get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lfu.Get(key)
+}
+
+func (c *LocalCache) Del(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lfu.Del(key)
+}
+
+// Clear deletes all the keys.
+func (c *LocalCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reset()
+}
+
+func (c *LocalCache) reset() {
+	c.lfu = cache.NewTinyLFU(c.size, c.ttl)
+}
+
+// cacheInvalidation is the message of the bus.
+type cacheInvalidation struct {
+	// Origin is the instance published the message, which has invalidated its local cache already
+	Origin string   `json:"origin"`
+	Keys   []string `json:"keys"`
+}
+
+// cacheBus publishes the invalidations of the local cache to the other instances through redis pub/sub, and
+// applies the ones published by the other instances. The messages published while the subscription is
+// disconnected are lost, so the local cache is cleared whenever subscribed again.
+type cacheBus struct {
+	rdCmd redis.Cmdable
+	local *LocalCache
+	id    string
+	log   *log.Helper
+
+	ps     *redis.PubSub
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func newCacheBus(rdCmd redis.Cmdable, local *LocalCache, logger log.Logger) *cacheBus {
+	return &cacheBus{
+		rdCmd: rdCmd,
+		local: local,
+		id:    utils.RandString(16, utils.AllCharSet),
+		log:   log.NewHelper(log.With(logger, "module", "data/cache-bus")),
+	}
+}
+
+// Start subscribes the invalidations, it does nothing without a local cache or redis, the instance is the only
+// one without redis.
+func (b *cacheBus) Start() {
+	if b.local == nil || b.rdCmd == nil {
+		return
+	}
+	sub, ok := b.rdCmd.(interface {
+		Subscribe(ctx context.Context, channels ...string) *redis.PubSub
+	})
+	if !ok {
+		b.log.Warn("the redis client does not support pub/sub, the local cache is not invalidated across the instances")
+		return
+	}
+
+	var ctx context.Context
+	ctx, b.cancel = context.WithCancel(context.Background())
+	b.ps = sub.Subscribe(ctx, cacheInvalidationChannel)
+	// wait for the subscription, so that the writes after the start are published to the instance
+	if _, err := b.ps.ReceiveTimeout(ctx, 2*time.Second); err != nil {
+		b.log.Warnf("failed to subscribe the cache invalidations: %v", err)
+	}
+	b.done = make(chan struct{})
+	go b.run(ctx)
+}
+
+// Stop unsubscribes, and waits for the subscription to return.
+func (b *cacheBus) Stop() {
+	if b.done == nil {
+		return
+	}
+	b.cancel()
+	// the receiving is blocked on the connection, which is interrupted by the close
+	if err := b.ps.Close(); err != nil {
+		b.log.Warnf("failed to close the subscription: %v", err)
+	}
+	<-b.done
+}
+
+func (b *cacheBus) run(ctx context.Context) {
+	defer close(b.done)
+
+	for {
+		msg, err := b.ps.ReceiveTimeout(ctx, cacheBusPingInterval)
+		if ctx.Err() != nil {
+			return
+		}
+		var netErr net.Error
+		switch {
+		case errors.As(err, &netErr) && netErr.Timeout():
+			// a dead connection fails the ping, and is reconnected by the next receiving
+			if pErr := b.ps.Ping(ctx); pErr != nil {
+				b.log.Warnf("cache invalidation bus ping error: %v", pErr)
+			}
+			continue
+		case err != nil:
+			// the connection is reconnected and subscribed again by the next receiving
+			b.log.Warnf("cache invalidation bus error: %v", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			continue
+		}
+
+		switch m := msg.(type) {
+		case *redis.Subscription:
+			if m.Kind == "subscribe" {
+				// the invalidations published before the subscription may be missed
+				b.local.Clear()
+			}
+		case *redis.Message:
+			b.apply(m.Payload)
+		}
+	}
+}
+
+func (b *cacheBus) apply(payload string) {
+	var m cacheInvalidation
+	if err := json.Unmarshal([]byte(payload), &m); err != nil {
+		b.log.Warnf("invalid cache invalidation: %v", err)
+		return
+	}
+	if m.Origin == b.id {
+		return
+	}
+	for _, key := range m.Keys {
+		b.local.Del(key)
+	}
+}
+
+// Publish publishes the invalidation of the keys to the other instances, the failure is only logged since the
+// entries expire in the ttl anyway. The entries invalidated by tag are never read again, which are not published.
+func (b *cacheBus) Publish(ctx context.Context, keys []string) {
+	if b.local == nil || b.rdCmd == nil || len(keys) == 0 {
+		return
+	}
+	payload, err := json.Marshal(&cacheInvalidation{Origin: b.id, Keys: keys})
+	if err != nil {
+		b.log.Errorf("failed to marshal the cache invalidation: %v", err)
+		return
+	}
+	if err = b.rdCmd.Publish(ctx, cacheInvalidationChannel, payload).Err(); err != nil {
+		b.log.Errorf("failed to publish the cache invalidation: %v", err)
+	}
+}
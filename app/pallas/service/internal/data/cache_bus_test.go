@@ -0,0 +1,47 @@
+package data
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/cache/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheBus(t *testing.T) {
+	cs := newTestDataConf()
+	for _, c := range cs {
+		// a single instance without redis
+		if c.GetRedis() == nil {
+			continue
+		}
+		d1, cleanup1 := newTestData(t, c)
+		d2, cleanup2 := newTestData(t, c)
+
+		t.Run(testName(c), func(t *testing.T) {
+			defer cleanup1()
+			defer cleanup2()
+			ctx := context.TODO()
+
+			set := func(key string) {
+				assert.NoError(t, d1.cache.Set(&cache.Item{Ctx: ctx, Key: key, Value: key, TTL: time.Minute}))
+				_, ok := d1.local.Get(key)
+				assert.True(t, ok)
+			}
+			evicted := func(key string) func() bool {
+				return func() bool {
+					_, ok := d1.local.Get(key)
+					return !ok
+				}
+			}
+
+			// the deletion on an instance evicts the local caches of the others
+			set("test_cache_bus_key")
+			assert.NoError(t, d2.deleteCache(ctx, "test_cache_bus_key"))
+			assert.Eventually(t, evicted("test_cache_bus_key"), time.Second, 10*time.Millisecond)
+
+			flushTestData(t, d1)
+		})
+	}
+}
@@ -0,0 +1,482 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/go-redis/cache/v9"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
+
+	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
+	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent"
+	"github.com/hominsu/pallas/app/pallas/service/pkgs/replica"
+	"github.com/hominsu/pallas/pkg/utils"
+)
+
+const (
+	// cacheNegativeSuffix is the suffix of the key of the negative entry of an entry, which records that the
+	// lookup found nothing
+	cacheNegativeSuffix = "#nil"
+	// cacheLockSuffix is the suffix of the key of the lock loading an entry
+	cacheLockSuffix = "#lock"
+	// cacheVersionSuffix is the suffix of the key of the version of an entry, which is bumped by the deletion
+	cacheVersionSuffix = "#ver"
+	// cacheVersionTTL is how long the version of an entry is kept since the deletion, longer than a load and the
+	// lag of the replicas expected
+	cacheVersionTTL = 10 * time.Second
+	// cacheKeyPrefixSuffix ends the key prefixes of the repos, e.g. user_cache_key_
+	cacheKeyPrefixSuffix = "_cache_key_"
+)
+
+// repoCache is the cache-aside of a repo, the keys of the repo are <prefix><index>:<unique>.
+type repoCache struct {
+	data   *Data
+	prefix string
+	// name is the name of the repo in the metrics, e.g. user
+	name string
+	sg   singleflight.Group
+	log  *log.Helper
+}
+
+func newRepoCache(data *Data, prefix string, logger *log.Helper) *repoCache {
+	return &repoCache{
+		data:   data,
+		prefix: prefix,
+		name:   strings.TrimSuffix(prefix, cacheKeyPrefixSuffix),
+		log:    logger,
+	}
+}
+
+// key returns the key of the entry, e.g. user_cache_key_get_user_id:userId
+func (c *repoCache) key(index, unique string) string {
+	return c.prefix + index + ":" + unique
+}
+
+// tagKey returns the key of the version of the tag, e.g. user_cache_key_tag:list
+func (c *repoCache) tagKey(tag string) string {
+	return c.key("tag", tag)
+}
+
+// Delete deletes the entries of the keys from redis and the local caches of all the instances, the negative
+// entries of the keys are deleted as well, e.g. the email looked up before the user created.
+func (c *repoCache) Delete(ctx context.Context, key ...string) error {
+	if len(key) == 0 {
+		return nil
+	}
+	negative := make([]string, len(key))
+	for i, k := range key {
+		negative[i] = k + cacheNegativeSuffix
+	}
+	// the negative entries are kept out of the local caches, see cacheIndex.Get
+	if err := c.data.kv.Del(ctx, negative...); err != nil {
+		return v1.ErrorCacheOperation("delete cache error: %v", err)
+	}
+	// the loads started before are not cached, see cacheIndex.loadAndSet
+	for _, k := range key {
+		if _, err := c.data.kv.IncrExpire(ctx, k+cacheVersionSuffix, cacheVersionTTL); err != nil {
+			return v1.ErrorCacheOperation("delete cache error: %v", err)
+		}
+	}
+	return c.data.deleteCache(ctx, key...)
+}
+
+// Invalidate invalidates all the entries tagged with the tags by bumping the versions of the tags, the entries of
+// the previous versions are never read again, and expire in the ttl.
+func (c *repoCache) Invalidate(ctx context.Context, tag ...string) error {
+	for _, t := range tag {
+		key := c.tagKey(t)
+		// a version lost starts over from the time rather than 0, see tagVersions
+		if _, err := c.data.kv.SetNX(ctx, key, strconv.FormatInt(time.Now().UnixNano(), 10), 0); err != nil {
+			return v1.ErrorCacheOperation("invalidate cache tag error: %v", err)
+		}
+		if _, err := c.data.kv.Incr(ctx, key); err != nil {
+			return v1.ErrorCacheOperation("invalidate cache tag error: %v", err)
+		}
+	}
+	return nil
+}
+
+// tagVersions returns the current versions of the tags. A version missing, e.g. evicted, is started from the time,
+// so that the entries cached under the versions before the loss are not read again.
+func (c *repoCache) tagVersions(ctx context.Context, tag ...string) ([]string, error) {
+	keys := make([]string, len(tag))
+	for i, t := range tag {
+		keys[i] = c.tagKey(t)
+	}
+	values, err := c.data.kv.MGet(ctx, keys...)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]string, len(tag))
+	for i, key := range keys {
+		v, ok := values[key]
+		if !ok {
+			if _, err = c.data.kv.SetNX(ctx, key, strconv.FormatInt(time.Now().UnixNano(), 10), 0); err != nil {
+				return nil, err
+			}
+			if v, err = c.data.kv.Get(ctx, key); err != nil {
+				return nil, err
+			}
+		}
+		versions[i] = v
+	}
+	return versions, nil
+}
+
+// CacheStats counts the lookups of a cache index. Every lookup is counted once, the db queries saved by the
+// cache are Hits, by the negative entries NegativeHits, by the deduplication in the instance Coalesced, and by
+// the lock across the instances LockWaits.
+type CacheStats struct {
+	// Hits is the lookups served by the cache
+	Hits int64
+	// NegativeHits is the lookups served by the negative entries, which found nothing
+	NegativeHits int64
+	// Coalesced is the lookups sharing the load of another lookup of the instance at the same time
+	Coalesced int64
+	// LockWaits is the lookups served by the entry cached by the holder of the lock
+	LockWaits int64
+	// Loads is the lookups loaded from the db
+	Loads int64
+}
+
+// cacheStats is updated by the lookups of all the indexes with the same key prefix.
+type cacheStats struct {
+	hits, negativeHits, coalesced, lockWaits, loads int64
+	// repo and index label the stats in the metrics
+	repo, index string
+}
+
+func (s *cacheStats) snapshot() CacheStats {
+	return CacheStats{
+		Hits:         atomic.LoadInt64(&s.hits),
+		NegativeHits: atomic.LoadInt64(&s.negativeHits),
+		Coalesced:    atomic.LoadInt64(&s.coalesced),
+		LockWaits:    atomic.LoadInt64(&s.lockWaits),
+		Loads:        atomic.LoadInt64(&s.loads),
+	}
+}
+
+// cacheStatsRegistry holds the stats of the indexes by the key prefix, e.g. user_cache_key_get_user_email.
+type cacheStatsRegistry struct {
+	mu    sync.Mutex
+	stats map[string]*cacheStats
+}
+
+// get returns the stats of the index of the repo.
+func (r *cacheStatsRegistry) get(c *repoCache, index string) *cacheStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stats == nil {
+		r.stats = make(map[string]*cacheStats)
+	}
+	name := c.prefix + index
+	s, ok := r.stats[name]
+	if !ok {
+		s = &cacheStats{repo: c.name, index: index}
+		r.stats[name] = s
+	}
+	return s
+}
+
+// all returns the stats of all the indexes.
+func (r *cacheStatsRegistry) all() []*cacheStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := make([]*cacheStats, 0, len(r.stats))
+	for _, s := range r.stats {
+		res = append(res, s)
+	}
+	return res
+}
+
+func (r *cacheStatsRegistry) snapshot() map[string]CacheStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := make(map[string]CacheStats, len(r.stats))
+	for name, s := range r.stats {
+		res[name] = s.snapshot()
+	}
+	return res
+}
+
+// cachedNotFoundError is returned for a negative entry, which is told by ent.IsNotFound as the error of the load.
+type cachedNotFoundError struct {
+	label string
+}
+
+func (e *cachedNotFoundError) Error() string {
+	return "ent: " + e.label + " not found (cached)"
+}
+
+func (e *cachedNotFoundError) Unwrap() error {
+	return &ent.NotFoundError{}
+}
+
+// cacheIndex is a typed index of the entries of a repo, e.g. the users by id. The entries of an index with tags
+// are keyed with the versions of the tags as well, so that a write invalidates e.g. all the list pages in O(tags)
+// rather than scanning the keys.
+type cacheIndex[T any] struct {
+	c     *repoCache
+	name  string
+	tags  []string
+	stats *cacheStats
+	// skipLocal keeps the entries out of the local cache, e.g. the entries too large or read rarely
+	skipLocal bool
+	// notFound is the label of the entity, the lookups found nothing are cached as negative entries if set
+	notFound string
+}
+
+func newCacheIndex[T any](c *repoCache, name string, skipLocal bool, tag ...string) *cacheIndex[T] {
+	return &cacheIndex[T]{
+		c:     c,
+		name:  name,
+		tags:  tag,
+		stats: c.data.stats.get(c, name),
+		// without redis, the local cache is the only cache
+		skipLocal: skipLocal && c.data.rdCmd != nil,
+	}
+}
+
+// cacheNotFound caches the lookups found nothing, e.g. the sign-in probes of the emails not signed up, the
+// entity created must be deleted from the index by the unique to delete the negative entry.
+func (i *cacheIndex[T]) cacheNotFound(label string) *cacheIndex[T] {
+	i.notFound = label
+	return i
+}
+
+// Key returns the key of the entry, which is deleted to invalidate the entry of an index without tags.
+func (i *cacheIndex[T]) Key(unique string) string {
+	return i.c.key(i.name, unique)
+}
+
+// Get returns the entry from the cache, or loads and caches it on miss. The loads of the same entry at the same
+// time are deduplicated, and the error of load is returned as is.
+func (i *cacheIndex[T]) Get(ctx context.Context, unique string, load func(ctx context.Context) (T, error)) (T, error) {
+	key := i.Key(unique)
+	if len(i.tags) > 0 {
+		versions, err := i.c.tagVersions(ctx, i.tags...)
+		if err != nil {
+			// the entries can not be told stale without the versions
+			i.c.log.Errorf("cache error: %v", err)
+			atomic.AddInt64(&i.stats.loads, 1)
+			return load(ctx)
+		}
+		key += "@" + strings.Join(versions, ".")
+	}
+
+	shared := true
+	res, err, _ := i.c.sg.Do(key, func() (any, error) {
+		shared = false
+		get, hit, gErr := i.lookup(ctx, key)
+		if hit {
+			return get, gErr
+		}
+
+		// cache miss, get from db
+		if ttl := i.c.data.conf.Cache.GetLockTtl().AsDuration(); ttl > 0 {
+			return i.loadLocked(ctx, key, ttl, load)
+		}
+		return i.loadAndSet(ctx, key, load)
+	})
+	if shared {
+		atomic.AddInt64(&i.stats.coalesced, 1)
+	}
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return res.(T), nil
+}
+
+// lookup returns the entry or the negative entry from the cache, the hits are counted as served by the cache.
+func (i *cacheIndex[T]) lookup(ctx context.Context, key string) (T, bool, error) {
+	get, hit, err := i.peek(ctx, key)
+	if hit {
+		if err == nil {
+			atomic.AddInt64(&i.stats.hits, 1)
+		} else {
+			atomic.AddInt64(&i.stats.negativeHits, 1)
+		}
+	}
+	return get, hit, err
+}
+
+// peek returns the entry or the negative entry from the cache, the errors of the cache are logged as misses.
+func (i *cacheIndex[T]) peek(ctx context.Context, key string) (T, bool, error) {
+	get, err := i.get(ctx, key)
+	switch {
+	case err == nil:
+		return get, true, nil
+	case !errors.Is(err, cache.ErrCacheMiss):
+		i.c.log.Errorf("cache error: %v", err)
+	}
+
+	if i.notFound == "" || i.c.data.conf.Cache.GetNegativeTtl().AsDuration() <= 0 {
+		return get, false, nil
+	}
+	ok, err := i.c.data.kv.Exists(ctx, key+cacheNegativeSuffix)
+	if err != nil {
+		i.c.log.Errorf("cache error: %v", err)
+		return get, false, nil
+	}
+	if ok {
+		return get, true, &cachedNotFoundError{label: i.notFound}
+	}
+	return get, false, nil
+}
+
+// get reads the entry from the local cache and then redis like cache.Get, the entry of redis is kept in the local
+// cache. The lookups of each layer are counted in the metrics.
+func (i *cacheIndex[T]) get(ctx context.Context, key string) (T, error) {
+	var get T
+	d := i.c.data
+	local := !i.skipLocal && d.local != nil
+	if local {
+		if b, ok := d.local.Get(key); ok {
+			err := d.cache.Unmarshal(b, &get)
+			observeCacheLookup(i.c.name, i.name, cacheLayerLocal, err)
+			return get, err
+		}
+		observeCacheLookup(i.c.name, i.name, cacheLayerLocal, cache.ErrCacheMiss)
+	}
+	if d.rdCmd == nil {
+		return get, cache.ErrCacheMiss
+	}
+
+	b, err := d.rdCmd.Get(ctx, key).Bytes()
+	switch {
+	case errors.Is(err, redis.Nil):
+		err = cache.ErrCacheMiss
+	case err == nil:
+		if local {
+			d.local.Set(key, b)
+		}
+		err = d.cache.Unmarshal(b, &get)
+	}
+	observeCacheLookup(i.c.name, i.name, cacheLayerRedis, err)
+	return get, err
+}
+
+// loadAndSet loads the entry from the db and caches it, the not found is cached as the negative entry if enabled.
+// The entry is not cached if it is invalidated during the load, since the load may have read the entry before the
+// write. The entry deleted within cacheVersionTTL is loaded from the primary, which the replicas may lag behind.
+func (i *cacheIndex[T]) loadAndSet(ctx context.Context, key string, load func(ctx context.Context) (T, error)) (T, error) {
+	atomic.AddInt64(&i.stats.loads, 1)
+	version, recent, err := i.version(ctx, key)
+	if err != nil {
+		i.c.log.Errorf("cache error: %v", err)
+		return load(ctx)
+	}
+	loadCtx := ctx
+	if recent {
+		loadCtx = replica.WithPrimary(ctx)
+	}
+	get, err := load(loadCtx)
+	if err != nil && (i.notFound == "" || !ent.IsNotFound(err)) {
+		return get, err
+	}
+	if after, _, vErr := i.version(ctx, key); vErr != nil || after != version {
+		if vErr != nil {
+			i.c.log.Errorf("cache error: %v", vErr)
+		}
+		return get, err
+	}
+
+	if err != nil {
+		// the negative entries are kept out of the local cache, of which the ttl is not per entry
+		if ttl := i.c.data.conf.Cache.GetNegativeTtl().AsDuration(); ttl > 0 {
+			if sErr := i.c.data.kv.Set(ctx, key+cacheNegativeSuffix, "1", ttl); sErr != nil {
+				i.c.log.Errorf("cache error: %v", sErr)
+			}
+		}
+		return get, err
+	}
+	if sErr := i.c.data.cache.Set(&cache.Item{
+		Ctx:            ctx,
+		Key:            key,
+		Value:          get,
+		TTL:            i.c.data.conf.Cache.Ttl.AsDuration(),
+		SkipLocalCache: i.skipLocal,
+	}); sErr != nil {
+		i.c.log.Errorf("cache error: %v", sErr)
+	}
+	return get, nil
+}
+
+// version returns the version of the entry changed by the invalidation, which is the versions of the tags of an
+// index with tags, otherwise the version of the key bumped by repoCache.Delete. recent reports whether the key is
+// deleted within cacheVersionTTL.
+func (i *cacheIndex[T]) version(ctx context.Context, key string) (string, bool, error) {
+	if len(i.tags) > 0 {
+		versions, err := i.c.tagVersions(ctx, i.tags...)
+		if err != nil {
+			return "", false, err
+		}
+		return strings.Join(versions, "."), false, nil
+	}
+	v, err := i.c.data.kv.Get(ctx, key+cacheVersionSuffix)
+	switch {
+	case errors.Is(err, redis.Nil):
+		return "", false, nil
+	case err != nil:
+		return "", false, err
+	}
+	return v, true, nil
+}
+
+// loadLocked loads the entry under the lock of the key, so that a hot entry missed on all the instances at the
+// same time is loaded from the db once. The others wait for the entry cached by the holder of the lock, and load
+// it themselves once the lock is released or expired without the entry cached, e.g. the holder failed.
+func (i *cacheIndex[T]) loadLocked(
+	ctx context.Context,
+	key string,
+	ttl time.Duration,
+	load func(ctx context.Context) (T, error),
+) (T, error) {
+	lockKey := key + cacheLockSuffix
+	token := utils.RandString(16, utils.AllCharSet)
+	ok, err := i.c.data.kv.SetNX(ctx, lockKey, token, ttl)
+	if err != nil {
+		i.c.log.Errorf("cache error: %v", err)
+		return i.loadAndSet(ctx, key, load)
+	}
+	if ok {
+		defer func() {
+			// the lock expired and taken by another lookup is kept
+			if rErr := i.c.data.kv.DelIfEqual(ctx, lockKey, token); rErr != nil {
+				i.c.log.Errorf("cache error: %v", rErr)
+			}
+		}()
+		return i.loadAndSet(ctx, key, load)
+	}
+
+	deadline := time.Now().Add(ttl)
+	for wait := 10 * time.Millisecond; time.Now().Before(deadline); {
+		select {
+		case <-ctx.Done():
+			var zero T
+			return zero, ctx.Err()
+		case <-time.After(wait):
+		}
+		get, hit, gErr := i.peek(ctx, key)
+		if hit {
+			atomic.AddInt64(&i.stats.lockWaits, 1)
+			return get, gErr
+		}
+		if held, eErr := i.c.data.kv.Exists(ctx, lockKey); eErr != nil || !held {
+			break
+		}
+		if wait < 100*time.Millisecond {
+			wait *= 2
+		}
+	}
+	return i.loadAndSet(ctx, key, load)
+}
@@ -0,0 +1,211 @@
+package data
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent"
+)
+
+func TestRepoCache(t *testing.T) {
+	helper := log.NewHelper(log.With(log.NewStdLogger(io.Discard)))
+
+	cs := newTestDataConf()
+	for _, c := range cs {
+		d1, d2, cleanup := newTestInstances(t, c)
+
+		t.Run(testName(c), func(t *testing.T) {
+			defer cleanup()
+			ctx := context.TODO()
+
+			c1 := newRepoCache(d1, "test_cache_key_", helper)
+			c2 := newRepoCache(d2, "test_cache_key_", helper)
+			var loads int
+			load := func(v string) func(context.Context) (string, error) {
+				return func(context.Context) (string, error) {
+					loads++
+					return v, nil
+				}
+			}
+			get := func(i *cacheIndex[string], v string) {
+				res, err := i.Get(ctx, "1", load(v))
+				assert.NoError(t, err)
+				assert.Equal(t, v, res)
+			}
+
+			// the entry is loaded once, and loaded again after deleted
+			byId := newCacheIndex[string](c1, "get_test_id", false)
+			get(byId, "a")
+			get(byId, "a")
+			assert.Equal(t, 1, loads)
+			assert.Equal(t, "test_cache_key_get_test_id:1", byId.Key("1"))
+			assert.NoError(t, c1.Delete(ctx, byId.Key("1")))
+			get(byId, "b")
+			assert.Equal(t, 2, loads)
+
+			// the entry invalidated during the load is not cached, and is loaded from the primary for a while
+			loads = 0
+			res, err := byId.Get(ctx, "2", func(context.Context) (string, error) {
+				loads++
+				assert.NoError(t, c2.Delete(ctx, byId.Key("2")))
+				return "stale", nil
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, "stale", res)
+			get2 := func(v string) {
+				res, err = byId.Get(ctx, "2", load(v))
+				assert.NoError(t, err)
+				assert.Equal(t, v, res)
+			}
+			get2("fresh")
+			get2("fresh")
+			assert.Equal(t, 2, loads)
+			_, recent, err := byId.version(ctx, byId.Key("2"))
+			assert.NoError(t, err)
+			assert.True(t, recent)
+			_, recent, err = byId.version(ctx, byId.Key("3"))
+			assert.NoError(t, err)
+			assert.False(t, recent)
+
+			// the tagged entries are invalidated by the tag on any instance, the local caches included
+			list1 := newCacheIndex[string](c1, "list_test", false, "list")
+			other1 := newCacheIndex[string](c1, "list_test_other", false, "other")
+			list2 := newCacheIndex[string](c2, "list_test", false, "list")
+			loads = 0
+			get(list1, "a")
+			get(other1, "a")
+			get(list1, "a")
+			get(list2, "a")
+			assert.Equal(t, 2, loads)
+			assert.NoError(t, c2.Invalidate(ctx, "list"))
+			get(list1, "b")
+			get(list2, "b")
+			get(other1, "a")
+			assert.Equal(t, 3, loads)
+
+			// the tagged entry invalidated during the load is not cached
+			res, err = list1.Get(ctx, "2", func(context.Context) (string, error) {
+				loads++
+				assert.NoError(t, c2.Invalidate(ctx, "list"))
+				return "stale", nil
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, "stale", res)
+			for i := 0; i < 2; i++ {
+				res, err = list1.Get(ctx, "2", load("fresh"))
+				assert.NoError(t, err)
+				assert.Equal(t, "fresh", res)
+			}
+			assert.Equal(t, 5, loads)
+
+			// the entries of a lost version are not read again
+			assert.NoError(t, d1.kv.Del(ctx, c1.tagKey("list")))
+			get(list1, "c")
+			assert.Equal(t, 6, loads)
+			assert.NoError(t, c1.Invalidate(ctx, "list"))
+			get(list1, "d")
+			assert.Equal(t, 7, loads)
+
+			flushTestData(t, d1)
+		})
+	}
+}
+
+func TestRepoCacheNotFound(t *testing.T) {
+	helper := log.NewHelper(log.With(log.NewStdLogger(io.Discard)))
+
+	cs := newTestDataConf()
+	for _, c := range cs {
+		d1, d2, cleanup := newTestInstances(t, c)
+
+		t.Run(testName(c), func(t *testing.T) {
+			defer cleanup()
+			ctx := context.TODO()
+
+			c1 := newRepoCache(d1, "test_cache_key_", helper)
+			c2 := newRepoCache(d2, "test_cache_key_", helper)
+			i1 := newCacheIndex[string](c1, "get_test_name", false).cacheNotFound("test")
+			i2 := newCacheIndex[string](c2, "get_test_name", false).cacheNotFound("test")
+			var loads int32
+			notFound := func(context.Context) (string, error) {
+				atomic.AddInt32(&loads, 1)
+				return "", &ent.NotFoundError{}
+			}
+
+			// the lookups found nothing are served by the negative entry on any instance
+			_, err := i1.Get(ctx, "a", notFound)
+			assert.True(t, ent.IsNotFound(err))
+			_, err = i2.Get(ctx, "a", notFound)
+			assert.True(t, ent.IsNotFound(err))
+			assert.Equal(t, int32(1), loads)
+			assert.Equal(t, CacheStats{NegativeHits: 1, Loads: 1}, sumCacheStats("test_cache_key_get_test_name", d1, d2))
+
+			// the negative entry is deleted with the entry, e.g. on create
+			assert.NoError(t, c2.Delete(ctx, i2.Key("a")))
+			res, err := i1.Get(ctx, "a", func(context.Context) (string, error) { return "a", nil })
+			assert.NoError(t, err)
+			assert.Equal(t, "a", res)
+
+			// the negative entry expires in the negative ttl
+			_, err = i1.Get(ctx, "b", notFound)
+			assert.True(t, ent.IsNotFound(err))
+			time.Sleep(c.Cache.NegativeTtl.AsDuration())
+			_, err = i1.Get(ctx, "b", notFound)
+			assert.True(t, ent.IsNotFound(err))
+			assert.Equal(t, int32(3), loads)
+
+			flushTestData(t, d1)
+		})
+	}
+}
+
+func TestRepoCacheLock(t *testing.T) {
+	helper := log.NewHelper(log.With(log.NewStdLogger(io.Discard)))
+
+	cs := newTestDataConf()
+	for _, c := range cs {
+		d1, d2, cleanup := newTestInstances(t, c)
+
+		t.Run(testName(c), func(t *testing.T) {
+			defer cleanup()
+			ctx := context.TODO()
+
+			// the instances miss the hot entry at the same time, which is loaded once
+			i1 := newCacheIndex[string](newRepoCache(d1, "test_cache_key_", helper), "get_test_hot", true)
+			i2 := newCacheIndex[string](newRepoCache(d2, "test_cache_key_", helper), "get_test_hot", true)
+			var loads int32
+			load := func(context.Context) (string, error) {
+				atomic.AddInt32(&loads, 1)
+				time.Sleep(100 * time.Millisecond)
+				return "a", nil
+			}
+
+			var wg sync.WaitGroup
+			for _, i := range []*cacheIndex[string]{i1, i1, i2, i2} {
+				wg.Add(1)
+				go func(i *cacheIndex[string]) {
+					defer wg.Done()
+					res, err := i.Get(ctx, "1", load)
+					assert.NoError(t, err)
+					assert.Equal(t, "a", res)
+				}(i)
+			}
+			wg.Wait()
+			assert.Equal(t, int32(1), loads)
+
+			s := sumCacheStats("test_cache_key_get_test_hot", d1, d2)
+			assert.Equal(t, int64(1), s.Loads)
+			assert.Equal(t, int64(1), s.LockWaits)
+			assert.Equal(t, int64(2), s.Coalesced)
+
+			flushTestData(t, d1)
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+
+	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
+	"github.com/hominsu/pallas/app/pallas/service/internal/biz"
+	"github.com/hominsu/pallas/app/pallas/service/pkgs/replica"
+	"github.com/hominsu/pallas/pkg/utils"
+)
+
+var _ biz.CronRepo = (*cronRepo)(nil)
+
+// cronJobTable holds a row of each job, which is created by the migration 20261019000000_cron_jobs
+const cronJobTable = "cron_jobs"
+
+type cronRepo struct {
+	data *Data
+	// owner identifies the instance in the leases
+	owner string
+	log   *log.Helper
+}
+
+// NewCronRepo .
+func NewCronRepo(data *Data, logger log.Logger) biz.CronRepo {
+	return &cronRepo{
+		data:  data,
+		owner: utils.RandString(16, utils.AllCharSet),
+		log:   log.NewHelper(log.With(logger, "module", "data/cron")),
+	}
+}
+
+func (r *cronRepo) Claim(ctx context.Context, name string, since time.Time, lease time.Duration) (bool, error) {
+	if err := r.ensure(ctx, name); err != nil {
+		return false, err
+	}
+
+	// the conditional update is the lock, only one of the instances updates the row
+	now := time.Now()
+	res, err := r.data.db.ExecContext(ctx,
+		r.rebind("UPDATE "+cronJobTable+" SET owner = ?, lease_until = ? "+
+			"WHERE name = ? AND lease_until < ? AND last_run_at <= ?"),
+		r.owner, now.Add(lease).UnixMilli(), name, now.UnixMilli(), since.UnixMilli())
+	if err != nil {
+		return false, v1.ErrorUnknown("claim job %s error: %v", name, err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, v1.ErrorUnknown("claim job %s error: %v", name, err)
+	}
+	return n == 1, nil
+}
+
+func (r *cronRepo) Extend(ctx context.Context, name string, lease time.Duration) error {
+	if _, err := r.data.db.ExecContext(ctx,
+		r.rebind("UPDATE "+cronJobTable+" SET lease_until = ? WHERE name = ? AND owner = ?"),
+		time.Now().Add(lease).UnixMilli(), name, r.owner); err != nil {
+		return v1.ErrorUnknown("extend job %s error: %v", name, err)
+	}
+	return nil
+}
+
+func (r *cronRepo) Finish(ctx context.Context, name string, runAt time.Time) error {
+	if _, err := r.data.db.ExecContext(ctx,
+		r.rebind("UPDATE "+cronJobTable+" SET lease_until = 0, last_run_at = ? WHERE name = ? AND owner = ?"),
+		runAt.UnixMilli(), name, r.owner); err != nil {
+		return v1.ErrorUnknown("finish job %s error: %v", name, err)
+	}
+	return nil
+}
+
+// ensure creates the row of the job never run, the insert of the instance losing the race fails on the conflict
+// and is ignored.
+func (r *cronRepo) ensure(ctx context.Context, name string) error {
+	ctx = replica.WithPrimary(ctx)
+	exists, err := r.exists(ctx, name)
+	if err != nil || exists {
+		return err
+	}
+	_, err = r.data.db.ExecContext(ctx,
+		r.rebind("INSERT INTO "+cronJobTable+" (name, owner, lease_until, last_run_at) VALUES (?, '', 0, 0)"), name)
+	if err == nil {
+		return nil
+	}
+	if exists, _ = r.exists(ctx, name); exists {
+		return nil
+	}
+	return v1.ErrorUnknown("create job %s error: %v", name, err)
+}
+
+func (r *cronRepo) exists(ctx context.Context, name string) (bool, error) {
+	rows, err := r.data.db.QueryContext(ctx, r.rebind("SELECT name FROM "+cronJobTable+" WHERE name = ?"), name)
+	if err != nil {
+		return false, v1.ErrorUnknown("get job %s error: %v", name, err)
+	}
+	defer func() { _ = rows.Close() }()
+	return rows.Next(), rows.Err()
+}
+
+func (r *cronRepo) rebind(query string) string {
+	return rebind(r.data.conf.GetDatabase().GetDriver(), query)
+}
@@ -0,0 +1,76 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hominsu/pallas/app/pallas/service/internal/biz"
+)
+
+func TestCronUsecase(t *testing.T) {
+	logger := log.With(log.NewStdLogger(io.Discard))
+
+	cs := newTestDataConf()
+	for _, c := range cs {
+		d, cleanup := newTestData(t, c)
+		// the instances are told apart by the repos
+		uc1 := biz.NewCronUsecase(NewCronRepo(d, logger), logger)
+		uc2 := biz.NewCronUsecase(NewCronRepo(d, logger), logger)
+
+		t.Run(testName(c), func(t *testing.T) {
+			defer cleanup()
+			ctx := context.TODO()
+
+			runs := 0
+			run := func(context.Context) error {
+				runs++
+				return nil
+			}
+
+			// a job never run is due, and runs once in the interval whichever instance polls
+			ran, err := uc1.RunDue(ctx, "test", time.Hour, run)
+			assert.NoError(t, err)
+			assert.True(t, ran)
+			ran, err = uc2.RunDue(ctx, "test", time.Hour, run)
+			assert.NoError(t, err)
+			assert.False(t, ran)
+			assert.Equal(t, 1, runs)
+
+			// the run is recorded even if failed
+			failed := errors.New("failed")
+			ran, err = uc2.RunDue(ctx, "test", 0, func(context.Context) error { return failed })
+			assert.ErrorIs(t, err, failed)
+			assert.True(t, ran)
+			ran, err = uc1.RunDue(ctx, "test", time.Hour, run)
+			assert.NoError(t, err)
+			assert.False(t, ran)
+
+			// the run leased to another instance is not run again until the lease expires
+			r1 := NewCronRepo(d, logger)
+			r2 := NewCronRepo(d, logger)
+			ok, err := r1.Claim(ctx, "leased", time.Now(), time.Hour)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			ok, err = r2.Claim(ctx, "leased", time.Now(), time.Hour)
+			assert.NoError(t, err)
+			assert.False(t, ok)
+			// the lease of another instance is not released by it
+			assert.NoError(t, r2.Finish(ctx, "leased", time.Now().Add(-time.Hour)))
+			ok, err = r2.Claim(ctx, "leased", time.Now(), time.Hour)
+			assert.NoError(t, err)
+			assert.False(t, ok)
+			assert.NoError(t, r1.Extend(ctx, "leased", -time.Second))
+			ok, err = r2.Claim(ctx, "leased", time.Now(), time.Hour)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+
+			flushTestData(t, d)
+		})
+	}
+}
@@ -2,21 +2,28 @@ package data
 
 import (
 	"context"
+	"database/sql"
 	"time"
 
+	"entgo.io/ent/dialect"
+	entsql "entgo.io/ent/dialect/sql"
 	"github.com/go-kratos/kratos/v2/log"
 	"github.com/go-redis/cache/v9"
 	"github.com/google/wire"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/redis/go-redis/v9"
 
+	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
 	"github.com/hominsu/pallas/app/pallas/service/internal/conf"
 	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent"
-	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent/migrate"
+	"github.com/hominsu/pallas/app/pallas/service/pkgs/replica"
+	"github.com/hominsu/pallas/pkg/ratelimit"
 	"github.com/hominsu/pallas/pkg/sessions"
 	"github.com/hominsu/pallas/pkg/srp"
 
 	// driver
 	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/jackc/pgx/v5/stdlib"
 	_ "github.com/mattn/go-sqlite3"
 )
 
@@ -24,19 +31,35 @@ var ProviderSet = wire.NewSet(
 	NewData,
 	NewEntClient,
 	NewRedisCmd,
+	NewLocalCache,
 	NewRedisCache,
-	NewRedisStore,
+	NewSessionStore,
+	NewRateLimiter,
 	NewSRPParams,
 	NewUserRepo,
 	NewGroupRepo,
 	NewSettingRepo,
+	NewIdentityRepo,
+	NewOIDCRepo,
+	NewAccessTokenRepo,
+	NewSessionRepo,
+	NewScoreRepo,
+	NewAuditRepo,
+	NewAvatarRepo,
+	NewStorageRepo,
+	NewCronRepo,
 	Migration,
 )
 
 type Data struct {
-	db    *ent.Client
+	db *ent.Client
+	// rdCmd is nil without redis
 	rdCmd redis.Cmdable
+	kv    kvStore
 	cache *cache.Cache
+	local *LocalCache
+	bus   *cacheBus
+	stats cacheStatsRegistry
 
 	conf *conf.Data
 }
@@ -46,8 +69,9 @@ func NewData(
 	entClient *ent.Client,
 	rdCmd redis.Cmdable,
 	cache *cache.Cache,
+	local *LocalCache,
 	conf *conf.Data,
-	_ *MigrationStatus,
+	status *MigrationStatus,
 	logger log.Logger,
 ) (*Data, func(), error) {
 	// NewData
@@ -56,40 +80,94 @@ func NewData(
 	data := &Data{
 		db:    entClient,
 		rdCmd: rdCmd,
+		kv:    newKVStore(rdCmd),
 		cache: cache,
+		local: local,
+		bus:   newCacheBus(rdCmd, local, logger),
 		conf:  conf,
 	}
+	data.bus.Start()
+	if status.settingsChanged {
+		// the settings reconciled on start are not read from the cache of the previous release
+		c := newRepoCache(data, settingCacheKeyPrefix, helper)
+		if err := c.Invalidate(context.Background(), settingCacheTagAll); err != nil {
+			helper.Warnf("failed invalidating the cached settings: %v", err)
+		}
+	}
+	collector := &dataCollector{data: data}
+	if err := registerCollector(collector); err != nil {
+		helper.Warnf("failed registering the metrics of data: %v", err)
+	}
 	return data, func() {
+		prometheus.Unregister(collector)
+		data.bus.Stop()
 		if err := data.db.Close(); err != nil {
 			helper.Error(err)
 		}
 	}, nil
 }
 
+// CacheStats returns the stats of the cache indexes by the key prefix, e.g. user_cache_key_get_user_email.
+func (d *Data) CacheStats() map[string]CacheStats {
+	return d.stats.snapshot()
+}
+
+// deleteCache deletes the keys from redis and the local caches of all the instances
+func (d *Data) deleteCache(ctx context.Context, key ...string) error {
+	defer d.bus.Publish(ctx, key)
+	for _, k := range key {
+		if err := d.cache.Delete(ctx, k); err != nil {
+			return v1.ErrorCacheOperation("delete cache error: %v", err)
+		}
+	}
+	return nil
+}
+
+// NewEntClient opens the database, the schema is migrated by the Migrator rather than on open. The driver is the
+// dialect of ent: mysql, sqlite3 or postgres, which is opened through pgx. The reads are sent to the replicas if
+// configured, see replica.Driver.
 func NewEntClient(conf *conf.Data, logger log.Logger) *ent.Client {
 	helper := log.NewHelper(log.With(logger, "module", "data/ent"))
 
-	client, err := ent.Open(
-		conf.Database.Driver,
-		conf.Database.Source,
-	)
+	primary, err := openDriver(conf.Database.Driver, conf.Database.Source)
 	if err != nil {
 		helper.Fatalf("failed opening connection to db: %v", err)
 	}
-	// Run the auto migration tool.
-	if err := client.Schema.Create(
-		context.Background(),
-		migrate.WithForeignKeys(true),
-		migrate.WithGlobalUniqueID(true),
-	); err != nil {
-		helper.Fatalf("failed creating schema resources: %v", err)
+	var drv dialect.Driver = primary
+	if len(conf.Database.Replicas) > 0 {
+		replicas := make([]*entsql.Driver, len(conf.Database.Replicas))
+		for i, source := range conf.Database.Replicas {
+			if replicas[i], err = openDriver(conf.Database.Driver, source); err != nil {
+				helper.Fatalf("failed opening connection to replica %d: %v", i, err)
+			}
+		}
+		drv = replica.NewDriver(primary, replicas, conf.Database.HealthCheckInterval.AsDuration(), logger)
 	}
-	return client
+	return ent.NewClient(ent.Driver(&metricsDriver{Driver: drv}))
+}
+
+func openDriver(driver, source string) (*entsql.Driver, error) {
+	driverName := driver
+	if driverName == dialect.Postgres {
+		driverName = "pgx"
+	}
+	db, err := sql.Open(driverName, source)
+	if err != nil {
+		return nil, err
+	}
+	return entsql.OpenDB(driver, db), nil
 }
 
+// NewRedisCmd returns nil if redis is not configured, the instance keeps the caches, the sessions and the
+// handshakes in memory instead, which is for a single instance.
 func NewRedisCmd(conf *conf.Data, logger log.Logger) redis.Cmdable {
 	helper := log.NewHelper(log.With(logger, "module", "data/redis"))
 
+	if conf.GetRedis().GetAddr() == "" {
+		helper.Info("redis is not configured, running as a single instance with the states in memory")
+		return nil
+	}
+
 	client := redis.NewClient(&redis.Options{
 		Addr:         conf.Redis.Addr,
 		Password:     conf.Redis.Password,
@@ -110,27 +188,47 @@ func NewRedisCmd(conf *conf.Data, logger log.Logger) redis.Cmdable {
 	return client
 }
 
-func NewRedisCache(rdCmd redis.Cmdable, conf *conf.Data) *cache.Cache {
-	opts := &cache.Options{
-		Redis: rdCmd,
+// NewRedisCache caches in the local cache only without redis.
+func NewRedisCache(rdCmd redis.Cmdable, local *LocalCache) *cache.Cache {
+	opts := &cache.Options{}
+	if rdCmd != nil {
+		opts.Redis = rdCmd
 	}
-	if conf.Cache.LfuEnable {
-		opts.LocalCache = cache.NewTinyLFU(int(conf.Cache.LfuSize), conf.Cache.Ttl.AsDuration())
+	if local != nil {
+		opts.LocalCache = local
 	}
 
 	return cache.New(opts)
 }
 
-func NewRedisStore(rdCmd redis.Cmdable, conf *conf.Secret, logger log.Logger) *sessions.RedisStore {
-	helper := log.NewHelper(log.With(logger, "module", "data/redis-store"))
+// NewSessionStore keeps the sessions in redis, or in memory without redis.
+func NewSessionStore(rdCmd redis.Cmdable, conf *conf.Secret, logger log.Logger) sessions.ServerStore {
+	helper := log.NewHelper(log.With(logger, "module", "data/session-store"))
 
-	store, err := sessions.NewRedisStore(rdCmd, []byte(conf.Session.GetSessionKey()))
-	store.SetMaxAge(10 * 24 * 3600)
+	var (
+		store sessions.ServerStore
+		err   error
+	)
+	if rdCmd != nil {
+		store, err = sessions.NewRedisStore(rdCmd, []byte(conf.Session.GetSessionKey()))
+	} else {
+		store, err = sessions.NewMemoryStore([]byte(conf.Session.GetSessionKey()))
+	}
 	if err != nil {
-		helper.Fatalf("failed creating redis-store: %v", err)
+		helper.Fatalf("failed creating session store: %v", err)
 	}
+	store.SetMaxAge(10 * 24 * 3600)
 
-	return store
+	return sessions.NewObservedStore(store, observeSessionStore)
+}
+
+// NewRateLimiter returns the limiter shared by the instances, which limits the bandwidth of users. It limits the
+// instance only without redis.
+func NewRateLimiter(rdCmd redis.Cmdable) ratelimit.Limiter {
+	if rdCmd == nil {
+		return ratelimit.NewLocalLimiter()
+	}
+	return ratelimit.NewRedisLimiter(rdCmd)
 }
 
 func NewSRPParams(secret *conf.Secret, logger log.Logger) *srp.Params {
@@ -2,16 +2,12 @@ package data
 
 import "github.com/hominsu/pallas/app/pallas/service/internal/biz"
 
-var defaultSettings = []struct {
-	n string
-	v string
-	t biz.SettingType
-}{
-	{n: string(biz.RegisterEnable), v: "true", t: biz.TypeRegister},
-	{n: string(biz.RegisterDefaultGroup), v: "Anonymous", t: biz.TypeRegister},
-	{n: string(biz.RegisterMailActive), v: "false", t: biz.TypeRegister},
-	{n: string(biz.RegisterMailFilter), v: "off", t: biz.TypeRegister},
-	{n: string(biz.RegisterMailFilterList), v: "126.com,163.com," +
-		"gmail.com,outlook.com,qq.com,foxmail.com,yeah.net,sohu.com,sohu.cn," +
-		"139.com,wo.cn,189.cn,hotmail.com,live.com,live.cn", t: biz.TypeRegister},
-}
+// defaultSettings are inserted on every start if missing, the defaults are kept by the schemas of biz
+var defaultSettings = biz.DefaultSettings()
+
+// renamedSettings maps the previous names of the settings to the current ones, the values under the previous
+// names are kept, e.g. "register_mail_filter_mode": biz.RegisterMailFilter
+var renamedSettings = map[string]biz.SettingName{}
+
+// removedSettings are the names of the settings no longer used, which are deleted on start
+var removedSettings []string
@@ -0,0 +1,60 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+)
+
+// AccessToken holds the schema definition for the AccessToken entity,
+// which is a personal access token of the User, only the hash of the token is stored.
+type AccessToken struct {
+	ent.Schema
+}
+
+// Fields of the AccessToken.
+func (AccessToken) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int64("id"),
+		field.Int64("user_id"),
+		field.String("name"),
+		field.String("token_hash").
+			Unique().
+			Sensitive(),
+		field.Strings("scopes"),
+		field.Time("expire_at").
+			Optional().
+			Nillable(),
+		field.Time("last_used_at").
+			Optional().
+			Nillable(),
+	}
+}
+
+// Mixin of the AccessToken.
+func (AccessToken) Mixin() []ent.Mixin {
+	return []ent.Mixin{
+		CreateTimeMixin{},
+		UpdateTimeMixin{},
+	}
+}
+
+// Edges of the AccessToken.
+func (AccessToken) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("owner", User.Type).
+			Ref("access_tokens").
+			Unique().
+			Required().
+			Field("user_id"),
+	}
+}
+
+// Indexes of the AccessToken
+func (AccessToken) Indexes() []ent.Index {
+	return []ent.Index{
+		index.Fields("token_hash").Unique(),
+		index.Fields("user_id"),
+	}
+}
@@ -0,0 +1,71 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+)
+
+// AuditChange is the value of a field before and after the change.
+type AuditChange struct {
+	Before any `json:"before"`
+	After  any `json:"after"`
+}
+
+// AuditEvent holds the schema definition for the AuditEvent entity,
+// which records a security-relevant or admin action. The events are kept after the actor is deleted.
+type AuditEvent struct {
+	ent.Schema
+}
+
+// Fields of the AuditEvent.
+func (AuditEvent) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int64("id"),
+		// action is the operation of the request, e.g. /pallas.service.v1.AdminService/UpdateUserStatus
+		field.String("action").
+			Immutable(),
+		field.Int64("actor_id").
+			Optional().
+			Nillable().
+			Immutable(),
+		field.String("target_type").
+			Optional().
+			Immutable(),
+		field.String("target_id").
+			Optional().
+			Immutable(),
+		field.String("remote_addr").
+			Optional().
+			Immutable(),
+		field.String("request_id").
+			Optional().
+			Immutable(),
+		field.Bool("success").
+			Immutable(),
+		// reason is the error reason of the failed action
+		field.String("reason").
+			Optional().
+			Immutable(),
+		field.JSON("diff", map[string]*AuditChange{}).
+			Optional().
+			Immutable(),
+	}
+}
+
+// Mixin of the AuditEvent.
+func (AuditEvent) Mixin() []ent.Mixin {
+	return []ent.Mixin{
+		CreateTimeMixin{},
+	}
+}
+
+// Indexes of the AuditEvent
+func (AuditEvent) Indexes() []ent.Index {
+	return []ent.Index{
+		index.Fields("actor_id"),
+		index.Fields("target_type", "target_id"),
+		index.Fields("action"),
+		index.Fields("created_at"),
+	}
+}
@@ -0,0 +1,59 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+)
+
+// Avatar holds the schema definition for the Avatar entity, which is the uploaded avatar
+// of the User resized to one of the avatar_sizes.
+type Avatar struct {
+	ent.Schema
+}
+
+// Fields of the Avatar.
+func (Avatar) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int64("id"),
+		field.Int64("user_id").
+			Immutable(),
+		// size is the width and height in pixels
+		field.Int("size").
+			Positive().
+			Immutable(),
+		// data is the png encoded image
+		field.Bytes("data").
+			MaxLen(1 << 20).
+			Immutable(),
+		field.String("etag").
+			Immutable(),
+	}
+}
+
+// Mixin of the Avatar.
+func (Avatar) Mixin() []ent.Mixin {
+	return []ent.Mixin{
+		CreateTimeMixin{},
+	}
+}
+
+// Edges of the Avatar.
+func (Avatar) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("owner", User.Type).
+			Ref("avatars").
+			Unique().
+			Required().
+			Immutable().
+			Field("user_id"),
+	}
+}
+
+// Indexes of the Avatar
+func (Avatar) Indexes() []ent.Index {
+	return []ent.Index{
+		index.Fields("user_id", "size").Unique(),
+	}
+}
@@ -21,6 +21,9 @@ func (Group) Fields() []ent.Field {
 		field.Uint64("max_storage"),
 		field.Bool("share_enabled"),
 		field.Int64("speed_limit"),
+		// permissions are granted to the users of the group, nil for the groups created before the permissions
+		field.Strings("permissions").
+			Optional(),
 	}
 }
 
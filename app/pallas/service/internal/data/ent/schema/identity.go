@@ -0,0 +1,53 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+)
+
+// Identity holds the schema definition for the Identity entity,
+// which links an external OpenID Connect identity to the User.
+type Identity struct {
+	ent.Schema
+}
+
+// Fields of the Identity.
+func (Identity) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int64("id"),
+		field.Int64("user_id"),
+		field.String("provider"),
+		field.String("subject"),
+		field.String("email").
+			Optional(),
+	}
+}
+
+// Mixin of the Identity.
+func (Identity) Mixin() []ent.Mixin {
+	return []ent.Mixin{
+		CreateTimeMixin{},
+		UpdateTimeMixin{},
+	}
+}
+
+// Edges of the Identity.
+func (Identity) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("owner", User.Type).
+			Ref("identities").
+			Unique().
+			Required().
+			Field("user_id"),
+	}
+}
+
+// Indexes of the Identity
+func (Identity) Indexes() []ent.Index {
+	return []ent.Index{
+		index.Fields("provider", "subject").Unique(),
+		index.Fields("user_id", "provider").Unique(),
+	}
+}
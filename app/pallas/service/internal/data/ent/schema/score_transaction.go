@@ -0,0 +1,71 @@
+package schema
+
+import (
+	"entgo.io/ent"
+	"entgo.io/ent/schema/edge"
+	"entgo.io/ent/schema/field"
+	"entgo.io/ent/schema/index"
+)
+
+// ScoreTransaction holds the schema definition for the ScoreTransaction entity,
+// which is an append-only ledger entry of the score of the User.
+type ScoreTransaction struct {
+	ent.Schema
+}
+
+// Fields of the ScoreTransaction.
+func (ScoreTransaction) Fields() []ent.Field {
+	return []ent.Field{
+		field.Int64("id"),
+		field.Int64("user_id").
+			Immutable(),
+		field.Int64("amount").
+			Immutable(),
+		// balance is the score of the user after the transaction
+		field.Int64("balance").
+			Immutable(),
+		field.Enum("reason").
+			Values("checkin", "grant", "redeem_storage", "redeem_group").
+			Immutable(),
+		field.String("note").
+			Optional().
+			Immutable(),
+		// operator_id is the admin who granted the score
+		field.Int64("operator_id").
+			Optional().
+			Nillable().
+			Immutable(),
+		// idempotency_key makes the transaction happen at most once per user, e.g. the daily check-in
+		field.String("idempotency_key").
+			Optional().
+			Nillable().
+			Immutable(),
+	}
+}
+
+// Mixin of the ScoreTransaction.
+func (ScoreTransaction) Mixin() []ent.Mixin {
+	return []ent.Mixin{
+		CreateTimeMixin{},
+	}
+}
+
+// Edges of the ScoreTransaction.
+func (ScoreTransaction) Edges() []ent.Edge {
+	return []ent.Edge{
+		edge.From("owner", User.Type).
+			Ref("score_transactions").
+			Unique().
+			Required().
+			Immutable().
+			Field("user_id"),
+	}
+}
+
+// Indexes of the ScoreTransaction
+func (ScoreTransaction) Indexes() []ent.Index {
+	return []ent.Index{
+		index.Fields("user_id", "idempotency_key").Unique(),
+		index.Fields("user_id"),
+	}
+}
@@ -33,7 +33,9 @@ func (Setting) Fields() []ent.Field {
 				"score",
 				"task",
 				"auth",
-				"cron"),
+				"cron",
+				"audit",
+				"account"),
 	}
 }
 
@@ -2,6 +2,7 @@ package schema
 
 import (
 	"entgo.io/ent"
+	"entgo.io/ent/dialect/entsql"
 	"entgo.io/ent/schema/edge"
 	"entgo.io/ent/schema/field"
 	"entgo.io/ent/schema/index"
@@ -24,12 +25,43 @@ func (User) Fields() []ent.Field {
 			Sensitive(),
 		field.Bytes("verifier").
 			Sensitive(),
+		// storage is the extra storage redeemed by score or granted, added to the quota
 		field.Uint64("storage"),
+		// storage_quota overrides the max_storage of the group if set
+		field.Uint64("storage_quota").
+			Optional().
+			Nillable(),
+		// used_storage is the bytes of the content stored, updated with the content in a transaction
+		field.Uint64("used_storage").
+			Default(0),
+		// overuse_at is when the user has been over quota since
+		field.Time("overuse_at").
+			Optional().
+			Nillable(),
 		field.Int64("score").
 			Default(0),
 		field.Enum("status").
-			Values("non_activated", "active", "banned", "overuse_baned").
+			Values("non_activated", "active", "banned", "overuse_baned", "pending_deletion").
 			Default("non_activated"),
+		field.String("totp_secret").
+			Optional().
+			Sensitive(),
+		field.Bool("totp_enabled").
+			Default(false),
+		field.Strings("totp_recovery_codes").
+			Optional().
+			Sensitive(),
+		// base_group_id is the group the user returns to when the group upgrade expires
+		field.Int64("base_group_id").
+			Optional().
+			Nillable(),
+		field.Time("group_expire_at").
+			Optional().
+			Nillable(),
+		// delete_at is when the user pending deletion is purged
+		field.Time("delete_at").
+			Optional().
+			Nillable(),
 	}
 }
 
@@ -50,6 +82,14 @@ func (User) Edges() []ent.Edge {
 			// user cannot be created without its group
 			Required().
 			Field("group_id"),
+		edge.To("identities", Identity.Type).
+			Annotations(entsql.Annotation{OnDelete: entsql.Cascade}),
+		edge.To("access_tokens", AccessToken.Type).
+			Annotations(entsql.Annotation{OnDelete: entsql.Cascade}),
+		edge.To("score_transactions", ScoreTransaction.Type).
+			Annotations(entsql.Annotation{OnDelete: entsql.Cascade}),
+		edge.To("avatars", Avatar.Type).
+			Annotations(entsql.Annotation{OnDelete: entsql.Cascade}),
 	}
 }
 
@@ -58,5 +98,7 @@ func (User) Indexes() []ent.Index {
 	return []ent.Index{
 		index.Fields("email").Unique(),
 		index.Fields("group_id"),
+		index.Fields("group_expire_at"),
+		index.Fields("status", "delete_at"),
 	}
 }
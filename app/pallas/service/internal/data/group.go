@@ -3,13 +3,14 @@ package data
 import (
 	"context"
 	"errors"
+	"fmt"
 	"strconv"
 	"strings"
 
+	"entgo.io/ent/dialect/sql"
 	"entgo.io/ent/dialect/sql/sqlgraph"
+	"entgo.io/ent/dialect/sql/sqljson"
 	"github.com/go-kratos/kratos/v2/log"
-	"github.com/go-redis/cache/v9"
-	"golang.org/x/sync/singleflight"
 
 	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
 	"github.com/hominsu/pallas/app/pallas/service/internal/biz"
@@ -17,31 +18,43 @@ import (
 	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent/group"
 	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent/user"
 	"github.com/hominsu/pallas/pkg/pagination"
+	"github.com/hominsu/pallas/pkg/utils"
 )
 
 var _ biz.GroupRepo = (*groupRepo)(nil)
 
 const groupCacheKeyPrefix = "group_cache_key_"
 
+// groupCacheTagList tags all the list pages of groups
+const groupCacheTagList = "list"
+
 type groupRepo struct {
-	data *Data
-	ck   map[string][]string
-	sg   *singleflight.Group
+	data  *Data
+	cache *repoCache
+	// key: group_cache_key_get_group_id:groupId
+	byId *cacheIndex[*ent.Group]
+	// key: group_cache_key_get_group_name:groupName
+	byName *cacheIndex[*ent.Group]
+	// key: group_cache_key_get_group_id_members:groupId, see groupMembersCacheKey
+	members *cacheIndex[*groupMembers]
+	// key: group_cache_key_list_group:pageSize_pageToken@version
+	list *cacheIndex[[]*ent.Group]
 	log  *log.Helper
 }
 
 // NewGroupRepo .
 func NewGroupRepo(data *Data, logger log.Logger) biz.GroupRepo {
-	gr := &groupRepo{
-		data: data,
-		sg:   &singleflight.Group{},
-		log:  log.NewHelper(log.With(logger, "module", "data/group")),
-	}
-	gr.ck = make(map[string][]string)
-	gr.ck["Get"] = []string{"get", "group", "id"}
-	gr.ck["GetByName"] = []string{"get", "group", "name"}
-	gr.ck["List"] = []string{"list", "group"}
-	return gr
+	helper := log.NewHelper(log.With(logger, "module", "data/group"))
+	c := newRepoCache(data, groupCacheKeyPrefix, helper)
+	return &groupRepo{
+		data:    data,
+		cache:   c,
+		byId:    newCacheIndex[*ent.Group](c, "get_group_id", false).cacheNotFound(group.Label),
+		byName:  newCacheIndex[*ent.Group](c, "get_group_name", false).cacheNotFound(group.Label),
+		members: newCacheIndex[*groupMembers](c, "get_group_id_members", false),
+		list:    newCacheIndex[[]*ent.Group](c, "list_group", true, groupCacheTagList),
+		log:     helper,
+	}
 }
 
 func (r *groupRepo) Create(ctx context.Context, group *biz.Group) (*biz.Group, error) {
@@ -49,6 +62,8 @@ func (r *groupRepo) Create(ctx context.Context, group *biz.Group) (*biz.Group, e
 	res, err := m.Save(ctx)
 	switch {
 	case err == nil:
+		// the negative entries of the group are deleted as well
+		r.invalidateCache(ctx, res.ID, res.Name)
 		g, tErr := toGroup(res)
 		if tErr != nil {
 			return nil, v1.ErrorInternal("internal error: %v", tErr)
@@ -64,59 +79,18 @@ func (r *groupRepo) Create(ctx context.Context, group *biz.Group) (*biz.Group, e
 }
 
 func (r *groupRepo) Get(ctx context.Context, groupId int64, groupView biz.GroupView) (*biz.Group, error) {
-	var (
-		err error
-		key string
-		res any
-	)
 	switch groupView {
-	case biz.GroupViewViewUnspecified, biz.GroupViewBasic:
-		// key: group_cache_key_get_group_id:groupId
-		key = r.cacheKey(strconv.FormatInt(groupId, 10), r.ck["Get"]...)
-		res, err, _ = r.sg.Do(key, func() (any, error) {
-			get := &ent.Group{}
-			// get cache
-			cErr := r.data.cache.Get(ctx, key, get)
-			if cErr != nil && errors.Is(cErr, cache.ErrCacheMiss) { // cache miss
-				// get from db
-				get, cErr = r.data.db.Group.Get(ctx, groupId)
-			}
-			return get, cErr
-		})
-	case biz.GroupViewWithEdgeIds:
-		// key: group_cache_key_get_group_id_edge_ids:groupId
-		key = r.cacheKey(strconv.FormatInt(groupId, 10), append(r.ck["Get"], "edge_ids")...)
-		res, err, _ = r.sg.Do(key, func() (any, error) {
-			get := &ent.Group{}
-			// get cache
-			cErr := r.data.cache.Get(ctx, key, get)
-			if cErr != nil && errors.Is(cErr, cache.ErrCacheMiss) { // cache miss
-				// get from db
-				get, cErr = r.data.db.Group.Query().
-					Where(group.ID(groupId)).
-					WithUsers(func(query *ent.UserQuery) {
-						query.Select(user.FieldID)
-						query.Select(user.FieldNickName)
-						query.Select(user.FieldStatus)
-					}).
-					Only(ctx)
-			}
-			return get, cErr
-		})
+	case biz.GroupViewViewUnspecified, biz.GroupViewBasic, biz.GroupViewWithEdgeIds:
 	default:
 		return nil, v1.ErrorInvalidArgument("invalid argument: unknown view")
 	}
+
+	res, err := r.byId.Get(ctx, strconv.FormatInt(groupId, 10), func(ctx context.Context) (*ent.Group, error) {
+		return r.data.db.Group.Get(ctx, groupId)
+	})
 	switch {
-	case err == nil: // db hit, set cache
-		if err = r.data.cache.Set(&cache.Item{
-			Ctx:   ctx,
-			Key:   key,
-			Value: res.(*ent.Group),
-			TTL:   r.data.conf.Cache.Ttl.AsDuration(),
-		}); err != nil {
-			r.log.Errorf("cache error: %v", err)
-		}
-		return toGroup(res.(*ent.Group))
+	case err == nil:
+		return r.toGroupWithView(ctx, res, groupView)
 	case ent.IsNotFound(err): // db miss
 		return nil, v1.ErrorNotFound("group not found: %v", err)
 	default: // db error
@@ -125,61 +99,20 @@ func (r *groupRepo) Get(ctx context.Context, groupId int64, groupView biz.GroupV
 }
 
 func (r *groupRepo) GetByName(ctx context.Context, name string, groupView biz.GroupView) (*biz.Group, error) {
-	var (
-		err error
-		key string
-		res any
-	)
 	switch groupView {
-	case biz.GroupViewViewUnspecified, biz.GroupViewBasic:
-		// key: group_cache_key_get_group_name:groupName
-		key = r.cacheKey(name, r.ck["GetByName"]...)
-		res, err, _ = r.sg.Do(key, func() (any, error) {
-			get := &ent.Group{}
-			// get cache
-			cErr := r.data.cache.Get(ctx, key, get)
-			if cErr != nil && errors.Is(cErr, cache.ErrCacheMiss) { // cache miss
-				// get from db
-				get, cErr = r.data.db.Group.Query().
-					Where(group.NameEQ(name)).
-					Only(ctx)
-			}
-			return get, cErr
-		})
-	case biz.GroupViewWithEdgeIds:
-		// key: group_cache_key_get_group_name_edge_ids:groupName
-		key = r.cacheKey(name, append(r.ck["GetByName"], "edge_ids")...)
-		res, err, _ = r.sg.Do(key, func() (any, error) {
-			get := &ent.Group{}
-			// get cache
-			cErr := r.data.cache.Get(ctx, key, get)
-			if cErr != nil && errors.Is(cErr, cache.ErrCacheMiss) { // cache miss
-				// get from db
-				get, cErr = r.data.db.Group.Query().
-					Where(group.NameEQ(name)).
-					WithUsers(func(query *ent.UserQuery) {
-						query.Select(user.FieldID)
-						query.Select(user.FieldNickName)
-						query.Select(user.FieldStatus)
-					}).
-					Only(ctx)
-			}
-			return get, cErr
-		})
+	case biz.GroupViewViewUnspecified, biz.GroupViewBasic, biz.GroupViewWithEdgeIds:
 	default:
 		return nil, v1.ErrorInvalidArgument("invalid argument: unknown view")
 	}
+
+	res, err := r.byName.Get(ctx, name, func(ctx context.Context) (*ent.Group, error) {
+		return r.data.db.Group.Query().
+			Where(group.NameEQ(name)).
+			Only(ctx)
+	})
 	switch {
-	case err == nil: // db hit, set cache
-		if err = r.data.cache.Set(&cache.Item{
-			Ctx:   ctx,
-			Key:   key,
-			Value: res.(*ent.Group),
-			TTL:   r.data.conf.Cache.Ttl.AsDuration(),
-		}); err != nil {
-			r.log.Errorf("cache error: %v", err)
-		}
-		return toGroup(res.(*ent.Group))
+	case err == nil:
+		return r.toGroupWithView(ctx, res, groupView)
 	case ent.IsNotFound(err): // db miss
 		return nil, v1.ErrorNotFound("group not found: %v", err)
 	default: // db error
@@ -187,52 +120,145 @@ func (r *groupRepo) GetByName(ctx context.Context, name string, groupView biz.Gr
 	}
 }
 
-func (r *groupRepo) Update(ctx context.Context, group *biz.Group) (*biz.Group, error) {
-	m := r.data.db.Group.UpdateOneID(group.Id)
-	m.SetName(group.Name)
-	m.SetMaxStorage(group.MaxStorage)
-	m.SetShareEnabled(group.ShareEnable)
-	m.SetSpeedLimit(group.SpeedLimit)
-	for _, u := range group.Users {
-		m.AddUserIDs(u.Id)
+func (r *groupRepo) Update(ctx context.Context, group *biz.Group, fields ...string) (*biz.Group, error) {
+	tx, err := r.data.db.Tx(ctx)
+	if err != nil {
+		return nil, v1.ErrorInternal("create transactional client error: %v", err)
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			if rErr := tx.Rollback(); rErr != nil {
+				r.log.Warnf("rollback failed, err: %v", rErr)
+			}
+			panic(v)
+		}
+	}()
+
+	res, names, err := r.update(ctx, tx, group, fields...)
+	if err != nil {
+		if rErr := tx.Rollback(); rErr != nil {
+			return nil, v1.ErrorInternal("rollback failed, err: %v",
+				fmt.Errorf("%w: rolling back transaction: %v", err, rErr))
+		}
+		return nil, err
+	}
+	if cErr := tx.Commit(); cErr != nil {
+		return nil, v1.ErrorInternal("failed commits the transaction, err: %v", cErr)
+	}
+
+	r.invalidateCache(ctx, res.ID, append(names, res.Name)...)
+	return toGroup(res)
+}
+
+// update updates the group, and returns the group updated and the previous name if it is renamed
+func (r *groupRepo) update(
+	ctx context.Context,
+	tx *ent.Tx,
+	group *biz.Group,
+	fields ...string,
+) (*ent.Group, []string, error) {
+	all := len(fields) == 0
+	has := func(field string) bool {
+		return all || utils.StringsContain(fields, field)
+	}
+
+	m := tx.Group.UpdateOneID(group.Id)
+	var names []string
+	if has(biz.GroupFieldName) {
+		m.SetName(group.Name)
+		// the entry of the previous name is deleted as well
+		if prev, gErr := tx.Group.Get(ctx, group.Id); gErr == nil && prev.Name != group.Name {
+			names = append(names, prev.Name)
+		}
+	}
+	if has(biz.GroupFieldMaxStorage) {
+		m.SetMaxStorage(group.MaxStorage)
+	}
+	if has(biz.GroupFieldShareEnabled) {
+		m.SetShareEnabled(group.ShareEnable)
+	}
+	if has(biz.GroupFieldSpeedLimit) {
+		m.SetSpeedLimit(group.SpeedLimit)
+	}
+	if has(biz.GroupFieldPermissions) {
+		m.SetPermissions(toEntPermissions(group.Permissions))
+	}
+	if all {
+		for _, u := range group.Users {
+			m.AddUserIDs(u.Id)
+		}
 	}
 
 	// update group
 	res, err := m.Save(ctx)
 	switch {
 	case err == nil:
-		// delete indexed cache
-		if err = r.deleteCache(
-			ctx,
-			// key: group_cache_key_get_group_id:groupId
-			r.cacheKey(strconv.FormatInt(group.Id, 10), r.ck["Get"]...),
-			// key: group_cache_key_get_group_id_edge_ids:groupId
-			r.cacheKey(strconv.FormatInt(group.Id, 10), append(r.ck["Get"], "edge_ids")...),
-			// key: group_cache_key_get_group_name:groupName
-			r.cacheKey(group.Name, r.ck["GetByName"]...),
-			// key: group_cache_key_get_group_name_edge_ids:groupName
-			r.cacheKey(group.Name, append(r.ck["GetByName"], "edge_ids")...),
-		); err != nil {
-			// TODO: delete again using the asynchronous queue
-			r.log.Error(err)
-		}
-		// delete cache by scan redis
-		if err = r.deleteKeysByScanPrefix(ctx,
-			// match key: group_cache_key_list_group:pageSize_pageToken and
-			// key: group_cache_key_list_group_edge_ids:pageSize_pageToken
-			groupCacheKeyPrefix+strings.Join(r.ck["List"], "_"),
-		); err != nil {
-			// TODO: delete again using the asynchronous queue
-			r.log.Error(err)
-		}
-		return toGroup(res)
+	case ent.IsNotFound(err):
+		return nil, nil, v1.ErrorNotFound("group not found: %v", err)
 	case sqlgraph.IsUniqueConstraintError(err):
-		return nil, v1.ErrorConflict("group already exists: %v", err)
+		return nil, nil, v1.ErrorConflict("group already exists: %v", err)
 	case ent.IsConstraintError(err):
-		return nil, v1.ErrorConflict("invalid argument: %v", err)
+		return nil, nil, v1.ErrorConflict("invalid argument: %v", err)
 	default:
-		return nil, v1.ErrorUnknown("unknown error: %v", err)
+		return nil, nil, v1.ErrorUnknown("unknown error: %v", err)
 	}
+
+	if has(biz.GroupFieldPermissions) {
+		if err = checkUsersWriter(ctx, tx); err != nil {
+			return nil, nil, err
+		}
+	}
+	return res, names, nil
+}
+
+// managerStatuses are the statuses of the users who can sign in to manage the users, the overuse banned user is
+// only read-only on the files.
+var managerStatuses = []user.Status{user.StatusActive, user.StatusOveruseBaned}
+
+// checkUsersWriter fails if no user who can sign in is granted PermissionUsersWrite by the group, otherwise nobody
+// is left to manage the users and the groups. It is checked in the transaction changed the permissions.
+func checkUsersWriter(ctx context.Context, tx *ent.Tx) error {
+	ok, err := tx.User.Query().
+		Where(
+			user.StatusIn(managerStatuses...),
+			user.HasOwnerGroupWith(func(s *sql.Selector) {
+				s.Where(sqljson.ValueContains(group.FieldPermissions, biz.PermissionUsersWrite.String()))
+			}),
+		).
+		Exist(ctx)
+	if err != nil {
+		return v1.ErrorUnknown("unknown error: %v", err)
+	}
+	if !ok {
+		return v1.ErrorBadGroupOperation("no user would be granted %s", biz.PermissionUsersWrite)
+	}
+	return nil
+}
+
+// checkMembersKept fails if the group granting PermissionUsersWrite, such as the built-in Admin group, is left
+// without a member who can sign in. It is checked in the transaction moved, banned or deleted the members, so that
+// the concurrent changes can not empty the group together.
+func checkMembersKept(ctx context.Context, tx *ent.Tx, groupId int64) error {
+	g, err := tx.Group.Get(ctx, groupId)
+	switch {
+	case ent.IsNotFound(err):
+		return nil
+	case err != nil:
+		return v1.ErrorUnknown("unknown error: %v", err)
+	case !biz.HasPermission(toPermissions(g.Permissions), biz.PermissionUsersWrite):
+		return nil
+	}
+
+	ok, err := tx.User.Query().
+		Where(user.HasOwnerGroupWith(group.ID(groupId)), user.StatusIn(managerStatuses...)).
+		Exist(ctx)
+	if err != nil {
+		return v1.ErrorUnknown("unknown error: %v", err)
+	}
+	if !ok {
+		return v1.ErrorBadGroupOperation("the group %s can not be emptied", g.Name)
+	}
+	return nil
 }
 
 func (r *groupRepo) Delete(ctx context.Context, groupId int64) error {
@@ -242,34 +268,21 @@ func (r *groupRepo) Delete(ctx context.Context, groupId int64) error {
 		return err
 	}
 
+	// the group upgrades expire into the base group, which is not referenced by a foreign key
+	upgraded, err := r.data.db.User.Query().
+		Where(user.BaseGroupIDEQ(res.Id)).
+		Exist(ctx)
+	if err != nil {
+		return v1.ErrorUnknown("unknown error: %v", err)
+	}
+	if upgraded {
+		return v1.ErrorBadGroupOperation("the group %s is the base group of the upgraded users", res.Name)
+	}
+
 	err = r.data.db.Group.DeleteOneID(res.Id).Exec(ctx)
 	switch {
 	case err == nil:
-		// delete indexed cache
-		if err = r.deleteCache(
-			ctx,
-			// key: group_cache_key_get_group_id:groupId
-			r.cacheKey(strconv.FormatInt(res.Id, 10), r.ck["Get"]...),
-			// key: group_cache_key_get_group_id_edge_ids:groupId
-			r.cacheKey(strconv.FormatInt(res.Id, 10), append(r.ck["Get"], "edge_ids")...),
-			// key: group_cache_key_get_group_name:groupName
-			r.cacheKey(res.Name, r.ck["GetByName"]...),
-			// key: group_cache_key_get_group_name_edge_ids:groupName
-			r.cacheKey(res.Name, append(r.ck["GetByName"], "edge_ids")...),
-		); err != nil {
-			// TODO: delete again using the asynchronous queue
-			r.log.Error(err)
-		}
-		// delete cache by scan redis
-		if err = r.deleteKeysByScanPrefix(
-			ctx,
-			// match key: group_cache_key_list_group:pageSize_pageToken and
-			// key: group_cache_key_list_group_edge_ids:pageSize_pageToken
-			groupCacheKeyPrefix+strings.Join(r.ck["List"], "_"),
-		); err != nil {
-			// TODO: delete again using the asynchronous queue
-			r.log.Error(err)
-		}
+		r.invalidateCache(ctx, res.Id, res.Name)
 		return nil
 	case ent.IsNotFound(err):
 		return v1.ErrorNotFound("group not found: %v", err)
@@ -296,65 +309,19 @@ func (r *groupRepo) List(
 		listQuery = listQuery.Where(group.IDGTE(token))
 	}
 
-	var (
-		err error
-		key string
-		res any
-	)
-
 	switch groupView {
-	case biz.GroupViewViewUnspecified, biz.GroupViewBasic:
-		// key: group_cache_key_list_group:pageSize_pageToken
-		key = r.cacheKey(
-			strings.Join([]string{strconv.FormatInt(int64(pageSize), 10), pageToken}, "_"),
-			r.ck["List"]...,
-		)
-		res, err, _ = r.sg.Do(key, func() (any, error) {
-			var entList []*ent.Group
-			// get cache
-			cErr := r.data.cache.GetSkippingLocalCache(ctx, key, &entList)
-			if cErr != nil && errors.Is(cErr, cache.ErrCacheMiss) { // cache miss
-				// get from db
-				entList, cErr = listQuery.All(ctx)
-			}
-			return entList, cErr
-		})
-	case biz.GroupViewWithEdgeIds:
-		// key: group_cache_key_list_group:pageSize_pageToken
-		key = r.cacheKey(
-			strings.Join([]string{strconv.FormatInt(int64(pageSize), 10), pageToken}, "_"),
-			append(r.ck["List"], "edge_ids")...,
-		)
-		res, err, _ = r.sg.Do(key, func() (any, error) {
-			var entList []*ent.Group
-			// get cache
-			cErr := r.data.cache.GetSkippingLocalCache(ctx, key, &entList)
-			if cErr != nil && errors.Is(cErr, cache.ErrCacheMiss) { // cache miss
-				// get from db
-				entList, cErr = listQuery.
-					WithUsers(func(query *ent.UserQuery) {
-						query.Select(user.FieldID)
-						query.Select(user.FieldNickName)
-						query.Select(user.FieldStatus)
-					}).
-					All(ctx)
-			}
-			return entList, cErr
-		})
+	case biz.GroupViewViewUnspecified, biz.GroupViewBasic, biz.GroupViewWithEdgeIds:
+	default:
+		return nil, v1.ErrorInvalidArgument("invalid argument: unknown view")
 	}
-	switch {
-	case err == nil: // db hit, set cache
-		entList := res.([]*ent.Group)
-		if err = r.data.cache.Set(&cache.Item{
-			Ctx:            ctx,
-			Key:            key,
-			Value:          entList,
-			TTL:            r.data.conf.Cache.Ttl.AsDuration(),
-			SkipLocalCache: true,
-		}); err != nil {
-			r.log.Errorf("cache error: %v", err)
-		}
 
+	// the members are loaded by group, see loadMembers
+	unique := strings.Join([]string{strconv.FormatInt(int64(pageSize), 10), pageToken}, "_")
+	entList, err := r.list.Get(ctx, unique, func(ctx context.Context) ([]*ent.Group, error) {
+		return listQuery.All(ctx)
+	})
+	switch {
+	case err == nil:
 		// generate next page token
 		var nextPageToken string
 		if len(entList) == pageSize+1 {
@@ -369,6 +336,11 @@ func (r *groupRepo) List(
 		if tErr != nil {
 			return nil, v1.ErrorInternal("internal error: %s", tErr)
 		}
+		if groupView == biz.GroupViewWithEdgeIds {
+			if err = r.loadMembers(ctx, groupList...); err != nil {
+				return nil, err
+			}
+		}
 		return &biz.GroupPage{
 			Groups:        groupList,
 			NextPageToken: nextPageToken,
@@ -380,6 +352,62 @@ func (r *groupRepo) List(
 	}
 }
 
+// groupMembers is the first page of the members of group, and the number of the members
+type groupMembers struct {
+	Users []*ent.User
+	Count int
+}
+
+func (r *groupRepo) toGroupWithView(ctx context.Context, e *ent.Group, groupView biz.GroupView) (*biz.Group, error) {
+	g, err := toGroup(e)
+	if err != nil {
+		return nil, v1.ErrorInternal("internal error: %v", err)
+	}
+	if groupView == biz.GroupViewWithEdgeIds {
+		if err = r.loadMembers(ctx, g); err != nil {
+			return nil, err
+		}
+	}
+	return g, nil
+}
+
+// loadMembers loads the first biz.GroupUsersPreviewSize members and the number of the members of the groups, the
+// members are cached by group, so that a group is never cached with all the members.
+func (r *groupRepo) loadMembers(ctx context.Context, groups ...*biz.Group) error {
+	for _, g := range groups {
+		groupId := g.Id
+		members, err := r.members.Get(ctx, strconv.FormatInt(groupId, 10),
+			func(ctx context.Context) (*groupMembers, error) {
+				get := &groupMembers{}
+				query := r.data.db.User.Query().Where(user.GroupID(groupId))
+				var cErr error
+				if get.Count, cErr = query.Clone().Count(ctx); cErr != nil {
+					return nil, cErr
+				}
+				get.Users, cErr = query.
+					Order(ent.Asc(user.FieldID)).
+					Limit(biz.GroupUsersPreviewSize).
+					Select(user.FieldID, user.FieldNickName, user.FieldStatus).
+					All(ctx)
+				return get, cErr
+			})
+		if err != nil {
+			return v1.ErrorUnknown("unknown error: %v", err)
+		}
+
+		g.UserCount = int64(members.Count)
+		g.Users = make([]*biz.User, len(members.Users))
+		for i, u := range members.Users {
+			g.Users[i] = &biz.User{
+				Id:       u.ID,
+				NickName: u.NickName,
+				Status:   toUserStatus(u.Status),
+			}
+		}
+	}
+	return nil
+}
+
 func (r *groupRepo) BatchCreate(ctx context.Context, groups []*biz.Group) ([]*biz.Group, error) {
 	if len(groups) > biz.MaxBatchCreateSize {
 		return nil, v1.ErrorInvalidArgument("batch size cannot be greater than %d", biz.MaxBatchCreateSize)
@@ -391,6 +419,17 @@ func (r *groupRepo) BatchCreate(ctx context.Context, groups []*biz.Group) ([]*bi
 	res, err := r.data.db.Group.CreateBulk(bulk...).Save(ctx)
 	switch {
 	case err == nil:
+		// the negative entries of the groups are deleted as well
+		var keys []string
+		for _, g := range res {
+			unique := strconv.FormatInt(g.ID, 10)
+			keys = append(keys, r.byId.Key(unique), r.byName.Key(g.Name))
+		}
+		if dErr := r.cache.Delete(ctx, keys...); dErr != nil {
+			// TODO: delete again using the asynchronous queue
+			r.log.Error(dErr)
+		}
+		r.invalidateList(ctx)
 		groupList, tErr := toGroupList(res)
 		if tErr != nil {
 			return nil, v1.ErrorInternal("internal error: %s", tErr)
@@ -411,42 +450,38 @@ func (r *groupRepo) createBuilder(group *biz.Group) *ent.GroupCreate {
 	m.SetMaxStorage(group.MaxStorage)
 	m.SetShareEnabled(group.ShareEnable)
 	m.SetSpeedLimit(group.SpeedLimit)
+	m.SetPermissions(toEntPermissions(group.Permissions))
 	for _, u := range group.Users {
 		m.AddUserIDs(u.Id)
 	}
 	return m
 }
 
-func (r *groupRepo) cacheKey(unique string, a ...string) string {
-	s := strings.Join(a, "_")
-	return groupCacheKeyPrefix + s + ":" + unique
+// invalidateCache deletes the entries of the group, and invalidates the list pages, the failure is only logged
+func (r *groupRepo) invalidateCache(ctx context.Context, groupId int64, names ...string) {
+	unique := strconv.FormatInt(groupId, 10)
+	keys := []string{r.byId.Key(unique), r.members.Key(unique)}
+	for _, name := range names {
+		keys = append(keys, r.byName.Key(name))
+	}
+	if err := r.cache.Delete(ctx, keys...); err != nil {
+		// TODO: delete again using the asynchronous queue
+		r.log.Error(err)
+	}
+	r.invalidateList(ctx)
 }
 
-// deleteCache delete the cache both local cache and redis
-func (r *groupRepo) deleteCache(ctx context.Context, key ...string) error {
-	for _, k := range key {
-		if err := r.data.cache.Delete(ctx, k); err != nil {
-			return v1.ErrorCacheOperation("delete cache error: %v", err)
-		}
+// invalidateList invalidates all the list pages of groups, the failure is only logged
+func (r *groupRepo) invalidateList(ctx context.Context) {
+	if err := r.cache.Invalidate(ctx, groupCacheTagList); err != nil {
+		r.log.Error(err)
 	}
-	return nil
 }
 
-// deleteKeysByScanPrefix delete the keys by scan the prefix on redis,
-// notice that this function will not delete the keys on local cache
-func (r *groupRepo) deleteKeysByScanPrefix(ctx context.Context, prefix ...string) error {
-	for _, p := range prefix {
-		iter := r.data.rdCmd.Scan(ctx, 0, p+"*", 0).Iterator()
-		for iter.Next(ctx) {
-			if err := r.data.rdCmd.Del(ctx, iter.Val()).Err(); err != nil {
-				return v1.ErrorCacheOperation("delete group cache keys by scan prefix error: %v", err)
-			}
-		}
-		if err := iter.Err(); err != nil {
-			return v1.ErrorCacheOperation("delete group cache keys by scan prefix error: %v", err)
-		}
-	}
-	return nil
+// groupMembersCacheKey returns the key of the members of group, which is deleted when the members change
+func groupMembersCacheKey(groupId int64) string {
+	// key: group_cache_key_get_group_id_members:groupId
+	return groupCacheKeyPrefix + "get_group_id_members:" + strconv.FormatInt(groupId, 10)
 }
 
 func toGroup(e *ent.Group) (*biz.Group, error) {
@@ -456,6 +491,7 @@ func toGroup(e *ent.Group) (*biz.Group, error) {
 	g.MaxStorage = e.MaxStorage
 	g.ShareEnable = e.ShareEnabled
 	g.SpeedLimit = e.SpeedLimit
+	g.Permissions = toPermissions(e.Permissions)
 	for _, edg := range e.Edges.Users {
 		g.Users = append(g.Users, &biz.User{
 			Id:       edg.ID,
@@ -477,3 +513,23 @@ func toGroupList(e []*ent.Group) ([]*biz.Group, error) {
 	}
 	return groupList, nil
 }
+
+func toPermissions(e []string) []biz.Permission {
+	if e == nil {
+		return nil
+	}
+	list := make([]biz.Permission, len(e))
+	for i, p := range e {
+		list[i] = biz.Permission(p)
+	}
+	return list
+}
+
+func toEntPermissions(p []biz.Permission) []string {
+	// an empty list is stored rather than null, which is left for the groups not migrated yet
+	list := make([]string, len(p))
+	for i, v := range p {
+		list[i] = string(v)
+	}
+	return list
+}
@@ -0,0 +1,290 @@
+package data
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/stretchr/testify/assert"
+
+	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
+	"github.com/hominsu/pallas/app/pallas/service/internal/biz"
+)
+
+func TestGroupUsecase_MoveUsers(t *testing.T) {
+	logger := log.With(log.NewStdLogger(io.Discard))
+
+	cs := newTestDataConf()
+	for _, c := range cs {
+		d, cleanup := newTestData(t, c)
+		ur := NewUserRepo(d, logger)
+		gr := NewGroupRepo(d, logger)
+		uc := biz.NewGroupUsecase(gr, ur, logger)
+
+		t.Run(testName(c), func(t *testing.T) {
+			defer cleanup()
+			ctx := context.TODO()
+
+			admin, err := gr.GetByName(ctx, "Admin", biz.GroupViewBasic)
+			assert.NoError(t, err)
+			operator, err := ur.GetByEmail(ctx, "admin@pallas.icu", biz.UserViewBasic)
+			assert.NoError(t, err)
+			userGroup, err := gr.GetByName(ctx, "User", biz.GroupViewBasic)
+			assert.NoError(t, err)
+			from, err := gr.Create(ctx, &biz.Group{Name: "test-from"})
+			assert.NoError(t, err)
+
+			var ids []int64
+			for i := 0; i < 3; i++ {
+				u, cErr := ur.Create(ctx, &biz.User{
+					Email:      "test-move-" + strconv.Itoa(i) + "@pallas.icu",
+					NickName:   "test-move-" + strconv.Itoa(i),
+					Salt:       []byte("salt"),
+					Verifier:   []byte("verifier"),
+					Status:     biz.StatusActive,
+					OwnerGroup: &biz.Group{Id: from.Id},
+				})
+				assert.NoError(t, cErr)
+				ids = append(ids, u.Id)
+				// cache the user before the move
+				_, cErr = ur.Get(ctx, u.Id, biz.UserViewBasic)
+				assert.NoError(t, cErr)
+			}
+			g, err := gr.Get(ctx, from.Id, biz.GroupViewWithEdgeIds)
+			assert.NoError(t, err)
+			assert.Len(t, g.Users, 3)
+
+			// the users must be the members
+			_, err = uc.MoveUsers(ctx, operator.Id, userGroup.Id, from.Id, ids[:1], false)
+			assert.True(t, v1.IsNotFound(err))
+			_, err = uc.MoveUsers(ctx, operator.Id, from.Id, from.Id, ids[:1], false)
+			assert.True(t, v1.IsBadGroupOperation(err))
+			_, err = uc.MoveUsers(ctx, operator.Id, from.Id, userGroup.Id, nil, false)
+			assert.True(t, v1.IsInvalidArgument(err))
+
+			moved, err := uc.MoveUsers(ctx, operator.Id, from.Id, userGroup.Id, ids[:1], false)
+			assert.NoError(t, err)
+			assert.Equal(t, ids[:1], moved)
+			u, err := ur.Get(ctx, ids[0], biz.UserViewBasic)
+			assert.NoError(t, err)
+			assert.Equal(t, userGroup.Id, u.GroupId)
+			g, err = gr.Get(ctx, from.Id, biz.GroupViewWithEdgeIds)
+			assert.NoError(t, err)
+			assert.Len(t, g.Users, 2)
+
+			// the duplicates are moved once
+			moved, err = uc.MoveUsers(ctx, operator.Id, from.Id, userGroup.Id, []int64{ids[1], ids[1]}, false)
+			assert.NoError(t, err)
+			assert.Equal(t, ids[1:2], moved)
+
+			// the Admin group can never be emptied
+			_, err = uc.MoveUsers(ctx, operator.Id, admin.Id, userGroup.Id, nil, true)
+			assert.True(t, v1.IsBadGroupOperation(err))
+			err = uc.DeleteGroup(ctx, operator.Id, admin.Id, &userGroup.Id)
+			assert.True(t, v1.IsBadGroupOperation(err))
+
+			// nor by the move, the ban or the deletion of the last member
+			_, err = ur.Update(ctx, &biz.User{Id: operator.Id, OwnerGroup: &biz.Group{Id: userGroup.Id}},
+				biz.UserFieldGroupId)
+			assert.True(t, v1.IsBadGroupOperation(err))
+			_, err = ur.Update(ctx, &biz.User{Id: operator.Id, Status: biz.StatusBanned}, biz.UserFieldStatus)
+			assert.True(t, v1.IsBadGroupOperation(err))
+			assert.True(t, v1.IsBadGroupOperation(ur.Delete(ctx, operator.Id)))
+			u, err = ur.Get(ctx, operator.Id, biz.UserViewBasic)
+			assert.NoError(t, err)
+			assert.Equal(t, admin.Id, u.GroupId)
+			assert.Equal(t, biz.StatusActive, u.Status)
+
+			// unless another member is left
+			second, err := ur.Create(ctx, &biz.User{
+				Email:      "test-move-admin@pallas.icu",
+				NickName:   "test-move-admin",
+				Salt:       []byte("salt"),
+				Verifier:   []byte("verifier"),
+				Status:     biz.StatusActive,
+				OwnerGroup: &biz.Group{Id: admin.Id},
+			})
+			assert.NoError(t, err)
+			_, err = ur.Update(ctx, &biz.User{Id: second.Id, Status: biz.StatusBanned}, biz.UserFieldStatus)
+			assert.NoError(t, err)
+			assert.True(t, v1.IsBadGroupOperation(ur.Delete(ctx, operator.Id)))
+			assert.NoError(t, ur.Delete(ctx, second.Id))
+
+			// the batch is bounded
+			_, err = ur.MoveGroup(ctx, from.Id, userGroup.Id, make([]int64, biz.MaxBatchUpdateSize+1))
+			assert.True(t, v1.IsBatchSize(err))
+
+			// all the members are moved in the batches
+			batch, err := gr.Create(ctx, &biz.Group{Name: "test-batch"})
+			assert.NoError(t, err)
+			members := make([]*biz.User, biz.MaxBatchUpdateSize+1)
+			for i := range members {
+				members[i] = &biz.User{
+					Email:      "test-batch-" + strconv.Itoa(i) + "@pallas.icu",
+					NickName:   "test-batch-" + strconv.Itoa(i),
+					Salt:       []byte("salt"),
+					Verifier:   []byte("verifier"),
+					Status:     biz.StatusActive,
+					OwnerGroup: &biz.Group{Id: batch.Id},
+				}
+			}
+			_, err = ur.BatchCreate(ctx, members[:biz.MaxBatchCreateSize])
+			assert.NoError(t, err)
+			_, err = ur.BatchCreate(ctx, members[biz.MaxBatchCreateSize:])
+			assert.NoError(t, err)
+			moved, err = uc.MoveUsers(ctx, operator.Id, batch.Id, userGroup.Id, nil, true)
+			assert.NoError(t, err)
+			assert.Len(t, moved, len(members))
+			count, err := ur.CountByGroup(ctx, batch.Id)
+			assert.NoError(t, err)
+			assert.Zero(t, count)
+			assert.NoError(t, uc.DeleteGroup(ctx, operator.Id, batch.Id, nil))
+
+			// the deletion with the members, the upgrade of the member moved is dropped, and the upgrades based on
+			// the group expire into the group reassigned to
+			assert.NoError(t, d.db.User.UpdateOneID(ids[2]).
+				SetBaseGroupID(userGroup.Id).SetGroupExpireAt(time.Now().Add(time.Hour)).Exec(ctx))
+			assert.NoError(t, d.db.User.UpdateOneID(ids[0]).
+				SetBaseGroupID(from.Id).SetGroupExpireAt(time.Now().Add(time.Hour)).Exec(ctx))
+			err = uc.DeleteGroup(ctx, operator.Id, from.Id, nil)
+			assert.True(t, v1.IsBadGroupOperation(err))
+			assert.NoError(t, uc.DeleteGroup(ctx, operator.Id, from.Id, &userGroup.Id))
+			_, err = gr.Get(ctx, from.Id, biz.GroupViewBasic)
+			assert.True(t, v1.IsNotFound(err))
+			for _, id := range ids {
+				u, err = ur.Get(ctx, id, biz.UserViewBasic)
+				assert.NoError(t, err)
+				assert.Equal(t, userGroup.Id, u.GroupId)
+			}
+			u, err = ur.Get(ctx, ids[2], biz.UserViewBasic)
+			assert.NoError(t, err)
+			assert.Nil(t, u.BaseGroupId)
+			assert.Nil(t, u.GroupExpireAt)
+			u, err = ur.Get(ctx, ids[0], biz.UserViewBasic)
+			assert.NoError(t, err)
+			assert.Equal(t, userGroup.Id, *u.BaseGroupId)
+
+			flushTestData(t, d)
+		})
+	}
+}
+
+func TestGroupUsecase_ListGroupUsers(t *testing.T) {
+	logger := log.With(log.NewStdLogger(io.Discard))
+
+	cs := newTestDataConf()
+	for _, c := range cs {
+		d, cleanup := newTestData(t, c)
+		ur := NewUserRepo(d, logger)
+		gr := NewGroupRepo(d, logger)
+		uc := biz.NewGroupUsecase(gr, ur, logger)
+
+		t.Run(testName(c), func(t *testing.T) {
+			defer cleanup()
+			ctx := context.TODO()
+
+			g, err := gr.Create(ctx, &biz.Group{Name: "test-members"})
+			assert.NoError(t, err)
+
+			total := biz.GroupUsersPreviewSize + 5
+			users := make([]*biz.User, total)
+			for i := range users {
+				status := biz.StatusActive
+				if i%5 == 0 {
+					status = biz.StatusBanned
+				}
+				users[i] = &biz.User{
+					Email:      "test-member-" + strconv.Itoa(i) + "@pallas.icu",
+					NickName:   "test-member-" + strconv.Itoa(i),
+					Salt:       []byte("salt"),
+					Verifier:   []byte("verifier"),
+					Status:     status,
+					OwnerGroup: &biz.Group{Id: g.Id},
+				}
+			}
+			_, err = ur.BatchCreate(ctx, users)
+			assert.NoError(t, err)
+
+			// the edge view carries the count and the first page only
+			res, err := gr.Get(ctx, g.Id, biz.GroupViewWithEdgeIds)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(total), res.UserCount)
+			assert.Len(t, res.Users, biz.GroupUsersPreviewSize)
+			res, err = gr.GetByName(ctx, g.Name, biz.GroupViewWithEdgeIds)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(total), res.UserCount)
+			page, err := gr.List(ctx, 10, "", biz.GroupViewWithEdgeIds)
+			assert.NoError(t, err)
+			for _, v := range page.Groups {
+				if v.Id == g.Id {
+					assert.Equal(t, int64(total), v.UserCount)
+				}
+			}
+			res, err = gr.Get(ctx, g.Id, biz.GroupViewBasic)
+			assert.NoError(t, err)
+			assert.Empty(t, res.Users)
+
+			// the cursor pagination
+			var (
+				listed []*v1.User
+				token  string
+			)
+			for {
+				list, next, lErr := uc.ListGroupUsers(ctx, g.Id, nil, 10, token)
+				assert.NoError(t, lErr)
+				listed = append(listed, list...)
+				if token = next; token == "" {
+					break
+				}
+			}
+			assert.Len(t, listed, total)
+
+			// the filters
+			banned := biz.StatusBanned
+			list, _, err := uc.ListGroupUsers(ctx, g.Id, &biz.UserFilter{Status: &banned}, 100, "")
+			assert.NoError(t, err)
+			assert.Len(t, list, total/5)
+			list, _, err = uc.ListGroupUsers(ctx, g.Id, &biz.UserFilter{Query: "MEMBER-1"}, 100, "")
+			assert.NoError(t, err)
+			// test-member-1 and test-member-10 to test-member-19
+			assert.Len(t, list, 11)
+
+			_, _, err = uc.ListGroupUsers(ctx, g.Id+1000, nil, 10, "")
+			assert.True(t, v1.IsNotFound(err))
+
+			// the count follows the members
+			_, err = ur.Create(ctx, &biz.User{
+				Email:      "test-member-new@pallas.icu",
+				NickName:   "test-member-new",
+				Salt:       []byte("salt"),
+				Verifier:   []byte("verifier"),
+				Status:     biz.StatusActive,
+				OwnerGroup: &biz.Group{Id: g.Id},
+			})
+			assert.NoError(t, err)
+			res, err = gr.Get(ctx, g.Id, biz.GroupViewWithEdgeIds)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(total+1), res.UserCount)
+
+			// the preview follows the nick names and the statuses
+			first := res.Users[0]
+			status := biz.StatusBanned
+			if first.Status == status {
+				status = biz.StatusActive
+			}
+			_, err = ur.Update(ctx, &biz.User{Id: first.Id, NickName: "test-member-renamed", Status: status},
+				biz.UserFieldNickName, biz.UserFieldStatus)
+			assert.NoError(t, err)
+			res, err = gr.Get(ctx, g.Id, biz.GroupViewWithEdgeIds)
+			assert.NoError(t, err)
+			assert.Equal(t, first.Id, res.Users[0].Id)
+			assert.Equal(t, "test-member-renamed", res.Users[0].NickName)
+			assert.Equal(t, status, res.Users[0].Status)
+
+			flushTestData(t, d)
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package data
+
+import (
+	"context"
+
+	"entgo.io/ent/dialect/sql/sqlgraph"
+	"github.com/go-kratos/kratos/v2/log"
+
+	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
+	"github.com/hominsu/pallas/app/pallas/service/internal/biz"
+	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent"
+	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent/identity"
+)
+
+var _ biz.IdentityRepo = (*identityRepo)(nil)
+
+type identityRepo struct {
+	data *Data
+	log  *log.Helper
+}
+
+// NewIdentityRepo .
+func NewIdentityRepo(data *Data, logger log.Logger) biz.IdentityRepo {
+	return &identityRepo{
+		data: data,
+		log:  log.NewHelper(log.With(logger, "module", "data/identity")),
+	}
+}
+
+func (r *identityRepo) Create(ctx context.Context, i *biz.Identity) (*biz.Identity, error) {
+	m := r.data.db.Identity.Create()
+	m.SetUserID(i.UserId)
+	m.SetProvider(i.Provider)
+	m.SetSubject(i.Subject)
+	m.SetEmail(i.Email)
+	res, err := m.Save(ctx)
+	switch {
+	case err == nil:
+		return toIdentity(res), nil
+	case sqlgraph.IsUniqueConstraintError(err):
+		return nil, v1.ErrorConflict("identity already linked: %v", err)
+	case ent.IsConstraintError(err):
+		return nil, v1.ErrorConflict("invalid argument: %v", err)
+	default:
+		return nil, v1.ErrorUnknown("unknown error: %v", err)
+	}
+}
+
+func (r *identityRepo) GetBySubject(ctx context.Context, provider, subject string) (*biz.Identity, error) {
+	res, err := r.data.db.Identity.Query().
+		Where(
+			identity.ProviderEQ(provider),
+			identity.SubjectEQ(subject),
+		).
+		Only(ctx)
+	switch {
+	case err == nil:
+		return toIdentity(res), nil
+	case ent.IsNotFound(err):
+		return nil, v1.ErrorNotFound("identity not found: %v", err)
+	default:
+		return nil, v1.ErrorUnknown("unknown error: %v", err)
+	}
+}
+
+func (r *identityRepo) ListByUser(ctx context.Context, userId int64) ([]*biz.Identity, error) {
+	res, err := r.data.db.Identity.Query().
+		Where(identity.UserIDEQ(userId)).
+		Order(ent.Asc(identity.FieldID)).
+		All(ctx)
+	if err != nil {
+		return nil, v1.ErrorUnknown("unknown error: %v", err)
+	}
+	return toIdentityList(res), nil
+}
+
+func (r *identityRepo) Delete(ctx context.Context, userId int64, provider string) error {
+	n, err := r.data.db.Identity.Delete().
+		Where(
+			identity.UserIDEQ(userId),
+			identity.ProviderEQ(provider),
+		).
+		Exec(ctx)
+	switch {
+	case err != nil:
+		return v1.ErrorUnknown("unknown error: %v", err)
+	case n == 0:
+		return v1.ErrorNotFound("identity not found")
+	default:
+		return nil
+	}
+}
+
+func toIdentity(e *ent.Identity) *biz.Identity {
+	return &biz.Identity{
+		Id:       e.ID,
+		UserId:   e.UserID,
+		Provider: e.Provider,
+		Subject:  e.Subject,
+		Email:    e.Email,
+		CreateAt: e.CreatedAt,
+		UpdateAt: e.UpdatedAt,
+	}
+}
+
+func toIdentityList(e []*ent.Identity) []*biz.Identity {
+	list := make([]*biz.Identity, len(e))
+	for i, entEntity := range e {
+		list[i] = toIdentity(entEntity)
+	}
+	return list
+}
@@ -0,0 +1,284 @@
+package data
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// kvSweepInterval is how often the expired keys of the memory are removed
+const kvSweepInterval = time.Minute
+
+// delIfEqualScript deletes the key only if it still holds the value, e.g. the lock expired and taken by another
+// holder is kept.
+var delIfEqualScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// incrExpireScript increments the key, the ttl is only set when the key is created so that the count is kept in
+// a fixed window.
+var incrExpireScript = redis.NewScript(`
+local n = redis.call('INCR', KEYS[1])
+if n == 1 and tonumber(ARGV[1]) > 0 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return n
+`)
+
+// kvStore keeps the short-lived states shared by the instances, e.g. the handshakes, the locks and the versions
+// of the cache tags. It is redis, or the memory of the instance if redis is not configured. The keys missing are
+// reported as redis.Nil by both, and a ttl of 0 never expires.
+type kvStore interface {
+	Get(ctx context.Context, key string) (string, error)
+	// MGet returns the values of the keys existing
+	MGet(ctx context.Context, keys ...string) (map[string]string, error)
+	GetDel(ctx context.Context, key string) (string, error)
+	Set(ctx context.Context, key string, value string, ttl time.Duration) error
+	SetNX(ctx context.Context, key string, value string, ttl time.Duration) (bool, error)
+	Incr(ctx context.Context, key string) (int64, error)
+	// IncrExpire is Incr whose ttl is set when the key is created, the ttl of the key existing is kept
+	IncrExpire(ctx context.Context, key string, ttl time.Duration) (int64, error)
+	Exists(ctx context.Context, key string) (bool, error)
+	Del(ctx context.Context, keys ...string) error
+	DelIfEqual(ctx context.Context, key string, value string) error
+}
+
+// newKVStore returns the memory store if redis is not configured.
+func newKVStore(rdCmd redis.Cmdable) kvStore {
+	if rdCmd == nil {
+		return newMemoryKV()
+	}
+	return &redisKV{rdCmd: rdCmd}
+}
+
+var _ kvStore = (*redisKV)(nil)
+
+type redisKV struct {
+	rdCmd redis.Cmdable
+}
+
+func (s *redisKV) Get(ctx context.Context, key string) (string, error) {
+	return s.rdCmd.Get(ctx, key).Result()
+}
+
+func (s *redisKV) MGet(ctx context.Context, keys ...string) (map[string]string, error) {
+	values, err := s.rdCmd.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]string, len(keys))
+	for i, v := range values {
+		if v, ok := v.(string); ok {
+			res[keys[i]] = v
+		}
+	}
+	return res, nil
+}
+
+func (s *redisKV) GetDel(ctx context.Context, key string) (string, error) {
+	return s.rdCmd.GetDel(ctx, key).Result()
+}
+
+func (s *redisKV) Set(ctx context.Context, key string, value string, ttl time.Duration) error {
+	return s.rdCmd.Set(ctx, key, value, ttl).Err()
+}
+
+func (s *redisKV) SetNX(ctx context.Context, key string, value string, ttl time.Duration) (bool, error) {
+	return s.rdCmd.SetNX(ctx, key, value, ttl).Result()
+}
+
+func (s *redisKV) Incr(ctx context.Context, key string) (int64, error) {
+	return s.rdCmd.Incr(ctx, key).Result()
+}
+
+func (s *redisKV) IncrExpire(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+	return incrExpireScript.Run(ctx, s.rdCmd, []string{key}, ttl.Milliseconds()).Int64()
+}
+
+func (s *redisKV) Exists(ctx context.Context, key string) (bool, error) {
+	n, err := s.rdCmd.Exists(ctx, key).Result()
+	return n > 0, err
+}
+
+func (s *redisKV) Del(ctx context.Context, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return s.rdCmd.Del(ctx, keys...).Err()
+}
+
+func (s *redisKV) DelIfEqual(ctx context.Context, key string, value string) error {
+	return delIfEqualScript.Run(ctx, s.rdCmd, []string{key}, value).Err()
+}
+
+var _ kvStore = (*memoryKV)(nil)
+
+// memoryKV keeps the keys in the memory of the instance, the expired keys are removed on access and swept
+// periodically on write.
+type memoryKV struct {
+	mu        sync.Mutex
+	items     map[string]*memoryItem
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type memoryItem struct {
+	value string
+	// expireAt is zero if the item never expires
+	expireAt time.Time
+}
+
+func newMemoryKV() *memoryKV {
+	return &memoryKV{
+		items:     make(map[string]*memoryItem),
+		lastSweep: time.Now(),
+		now:       time.Now,
+	}
+}
+
+func (s *memoryKV) Get(_ context.Context, key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.get(key)
+	if !ok {
+		return "", redis.Nil
+	}
+	return item.value, nil
+}
+
+func (s *memoryKV) MGet(_ context.Context, keys ...string) (map[string]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make(map[string]string, len(keys))
+	for _, key := range keys {
+		if item, ok := s.get(key); ok {
+			res[key] = item.value
+		}
+	}
+	return res, nil
+}
+
+func (s *memoryKV) GetDel(_ context.Context, key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.get(key)
+	if !ok {
+		return "", redis.Nil
+	}
+	delete(s.items, key)
+	return item.value, nil
+}
+
+func (s *memoryKV) Set(_ context.Context, key string, value string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.set(key, value, ttl)
+	return nil
+}
+
+func (s *memoryKV) SetNX(_ context.Context, key string, value string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.get(key); ok {
+		return false, nil
+	}
+	s.set(key, value, ttl)
+	return true, nil
+}
+
+func (s *memoryKV) Incr(ctx context.Context, key string) (int64, error) {
+	return s.IncrExpire(ctx, key, 0)
+}
+
+func (s *memoryKV) IncrExpire(_ context.Context, key string, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.get(key)
+	if !ok {
+		s.set(key, "1", ttl)
+		return 1, nil
+	}
+	n, err := strconv.ParseInt(item.value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	n++
+	// the ttl is kept like redis
+	item.value = strconv.FormatInt(n, 10)
+	return n, nil
+}
+
+func (s *memoryKV) Exists(_ context.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.get(key)
+	return ok, nil
+}
+
+func (s *memoryKV) Del(_ context.Context, keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		delete(s.items, key)
+	}
+	return nil
+}
+
+func (s *memoryKV) DelIfEqual(_ context.Context, key string, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if item, ok := s.get(key); ok && item.value == value {
+		delete(s.items, key)
+	}
+	return nil
+}
+
+// Flush deletes all the keys.
+func (s *memoryKV) Flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items = make(map[string]*memoryItem)
+}
+
+// get returns the item not expired, it must be called with the lock held.
+func (s *memoryKV) get(key string) (*memoryItem, bool) {
+	item, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+	if !item.expireAt.IsZero() && !s.now().Before(item.expireAt) {
+		delete(s.items, key)
+		return nil, false
+	}
+	return item, true
+}
+
+// set sets the item, it must be called with the lock held.
+func (s *memoryKV) set(key string, value string, ttl time.Duration) {
+	s.sweep()
+	item := &memoryItem{value: value}
+	if ttl > 0 {
+		item.expireAt = s.now().Add(ttl)
+	}
+	s.items[key] = item
+}
+
+// sweep removes the expired items, it must be called with the lock held.
+func (s *memoryKV) sweep() {
+	now := s.now()
+	if now.Sub(s.lastSweep) < kvSweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for key, item := range s.items {
+		if !item.expireAt.IsZero() && !now.Before(item.expireAt) {
+			delete(s.items, key)
+		}
+	}
+}
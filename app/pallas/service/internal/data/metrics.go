@@ -0,0 +1,282 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"entgo.io/ent/dialect"
+	"github.com/go-redis/cache/v9"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	metricsNamespace = "pallas"
+
+	cacheLayerLocal = "local"
+	cacheLayerRedis = "redis"
+)
+
+var (
+	cacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "cache",
+		Name:      "lookups_total",
+		Help:      "The lookups of the cache indexes by the layer, the local TinyLFU or redis, and the result.",
+	}, []string{"repo", "index", "layer", "result"})
+
+	entQuerySeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "ent",
+		Name:      "query_seconds",
+		Help:      "The latency of the statements sent by the ent client, by the kind of the statement.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5},
+	}, []string{"operation", "result"})
+
+	sessionStoreOperations = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Subsystem: "session_store",
+		Name:      "operation_seconds",
+		Help:      "The latency of the operations of the session store.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"operation", "result"})
+)
+
+var (
+	cacheServedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "cache", "served_total"),
+		"The lookups of the cache indexes by how they were served, see CacheStats.",
+		[]string{"repo", "index", "by"}, nil,
+	)
+	redisPoolHitsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "redis_pool", "hits_total"),
+		"The times a free connection was found in the pool.", nil, nil,
+	)
+	redisPoolMissesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "redis_pool", "misses_total"),
+		"The times a free connection was not found in the pool.", nil, nil,
+	)
+	redisPoolTimeoutsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "redis_pool", "timeouts_total"),
+		"The times a wait for a connection timed out.", nil, nil,
+	)
+	redisPoolConnsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "redis_pool", "conns"),
+		"The connections in the pool by the state, total, idle or stale.", []string{"state"}, nil,
+	)
+)
+
+// metricsResult is the result label of the error
+func metricsResult(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// observeCacheLookup counts the lookup of the layer, the miss is reported as cache.ErrCacheMiss
+func observeCacheLookup(repo, index, layer string, err error) {
+	result := "hit"
+	switch {
+	case errors.Is(err, cache.ErrCacheMiss):
+		result = "miss"
+	case err != nil:
+		result = "error"
+	}
+	cacheLookups.WithLabelValues(repo, index, layer, result).Inc()
+}
+
+// observeSessionStore is the sessions.ObserveFunc of the session store
+func observeSessionStore(operation string, err error, elapsed time.Duration) {
+	sessionStoreOperations.WithLabelValues(operation, metricsResult(err)).Observe(elapsed.Seconds())
+}
+
+// registerCollector registers the collector, the collector of the previous instance is replaced, e.g. the
+// instances created one after another by the tests.
+func registerCollector(c prometheus.Collector) error {
+	err := prometheus.Register(c)
+	var are prometheus.AlreadyRegisteredError
+	if errors.As(err, &are) {
+		prometheus.Unregister(are.ExistingCollector)
+		err = prometheus.Register(c)
+	}
+	return err
+}
+
+var _ prometheus.Collector = (*dataCollector)(nil)
+
+// dataCollector collects the stats of the cache indexes and the pool of redis on scrape.
+type dataCollector struct {
+	data *Data
+}
+
+func (c *dataCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cacheServedDesc
+	ch <- redisPoolHitsDesc
+	ch <- redisPoolMissesDesc
+	ch <- redisPoolTimeoutsDesc
+	ch <- redisPoolConnsDesc
+}
+
+func (c *dataCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, s := range c.data.stats.all() {
+		stats := s.snapshot()
+		for by, v := range map[string]int64{
+			"hit":          stats.Hits,
+			"negative_hit": stats.NegativeHits,
+			"coalesced":    stats.Coalesced,
+			"lock_wait":    stats.LockWaits,
+			"load":         stats.Loads,
+		} {
+			ch <- prometheus.MustNewConstMetric(cacheServedDesc, prometheus.CounterValue, float64(v), s.repo, s.index, by)
+		}
+	}
+
+	pool, ok := c.data.rdCmd.(interface{ PoolStats() *redis.PoolStats })
+	if !ok {
+		return
+	}
+	stats := pool.PoolStats()
+	ch <- prometheus.MustNewConstMetric(redisPoolHitsDesc, prometheus.CounterValue, float64(stats.Hits))
+	ch <- prometheus.MustNewConstMetric(redisPoolMissesDesc, prometheus.CounterValue, float64(stats.Misses))
+	ch <- prometheus.MustNewConstMetric(redisPoolTimeoutsDesc, prometheus.CounterValue, float64(stats.Timeouts))
+	ch <- prometheus.MustNewConstMetric(redisPoolConnsDesc, prometheus.GaugeValue, float64(stats.TotalConns), "total")
+	ch <- prometheus.MustNewConstMetric(redisPoolConnsDesc, prometheus.GaugeValue, float64(stats.IdleConns), "idle")
+	ch <- prometheus.MustNewConstMetric(redisPoolConnsDesc, prometheus.GaugeValue, float64(stats.StaleConns), "stale")
+}
+
+// statementKind is the operation label of the statement, e.g. select
+func statementKind(query string) string {
+	query = strings.TrimSpace(query)
+	if i := strings.IndexAny(query, " \t\n"); i > 0 {
+		query = query[:i]
+	}
+	switch kind := strings.ToLower(query); kind {
+	case "select", "insert", "update", "delete":
+		return kind
+	default:
+		return "other"
+	}
+}
+
+func observeStatement(operation string, start time.Time, err error) {
+	entQuerySeconds.WithLabelValues(operation, metricsResult(err)).Observe(time.Since(start).Seconds())
+}
+
+var _ dialect.Driver = (*metricsDriver)(nil)
+
+// metricsDriver observes the latency of the statements sent by the ent client, including the ones of the
+// transactions.
+type metricsDriver struct {
+	dialect.Driver
+}
+
+func (d *metricsDriver) Exec(ctx context.Context, query string, args, v any) (err error) {
+	defer func(start time.Time) { observeStatement(statementKind(query), start, err) }(time.Now())
+	return d.Driver.Exec(ctx, query, args, v)
+}
+
+func (d *metricsDriver) Query(ctx context.Context, query string, args, v any) (err error) {
+	defer func(start time.Time) { observeStatement(statementKind(query), start, err) }(time.Now())
+	return d.Driver.Query(ctx, query, args, v)
+}
+
+// ExecContext is called by the ExecContext of the ent client.
+func (d *metricsDriver) ExecContext(ctx context.Context, query string, args ...any) (res sql.Result, err error) {
+	defer func(start time.Time) { observeStatement(statementKind(query), start, err) }(time.Now())
+	ex, ok := d.Driver.(interface {
+		ExecContext(context.Context, string, ...any) (sql.Result, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("driver.ExecContext is not supported")
+	}
+	return ex.ExecContext(ctx, query, args...)
+}
+
+// QueryContext is called by the QueryContext of the ent client.
+func (d *metricsDriver) QueryContext(ctx context.Context, query string, args ...any) (rows *sql.Rows, err error) {
+	defer func(start time.Time) { observeStatement(statementKind(query), start, err) }(time.Now())
+	q, ok := d.Driver.(interface {
+		QueryContext(context.Context, string, ...any) (*sql.Rows, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("driver.QueryContext is not supported")
+	}
+	return q.QueryContext(ctx, query, args...)
+}
+
+func (d *metricsDriver) Tx(ctx context.Context) (dialect.Tx, error) {
+	tx, err := d.Driver.Tx(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &metricsTx{Tx: tx}, nil
+}
+
+// BeginTx is called by the BeginTx of the ent client.
+func (d *metricsDriver) BeginTx(ctx context.Context, opts *sql.TxOptions) (dialect.Tx, error) {
+	b, ok := d.Driver.(interface {
+		BeginTx(context.Context, *sql.TxOptions) (dialect.Tx, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("driver.BeginTx is not supported")
+	}
+	tx, err := b.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &metricsTx{Tx: tx}, nil
+}
+
+type metricsTx struct {
+	dialect.Tx
+}
+
+func (tx *metricsTx) Exec(ctx context.Context, query string, args, v any) (err error) {
+	defer func(start time.Time) { observeStatement(statementKind(query), start, err) }(time.Now())
+	return tx.Tx.Exec(ctx, query, args, v)
+}
+
+func (tx *metricsTx) Query(ctx context.Context, query string, args, v any) (err error) {
+	defer func(start time.Time) { observeStatement(statementKind(query), start, err) }(time.Now())
+	return tx.Tx.Query(ctx, query, args, v)
+}
+
+// ExecContext is called by the ExecContext of the transaction of the ent client.
+func (tx *metricsTx) ExecContext(ctx context.Context, query string, args ...any) (res sql.Result, err error) {
+	defer func(start time.Time) { observeStatement(statementKind(query), start, err) }(time.Now())
+	ex, ok := tx.Tx.(interface {
+		ExecContext(context.Context, string, ...any) (sql.Result, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("Tx.ExecContext is not supported")
+	}
+	return ex.ExecContext(ctx, query, args...)
+}
+
+// QueryContext is called by the QueryContext of the transaction of the ent client.
+func (tx *metricsTx) QueryContext(ctx context.Context, query string, args ...any) (rows *sql.Rows, err error) {
+	defer func(start time.Time) { observeStatement(statementKind(query), start, err) }(time.Now())
+	q, ok := tx.Tx.(interface {
+		QueryContext(context.Context, string, ...any) (*sql.Rows, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("Tx.QueryContext is not supported")
+	}
+	return q.QueryContext(ctx, query, args...)
+}
+
+func (tx *metricsTx) Commit() (err error) {
+	defer func(start time.Time) { observeStatement("commit", start, err) }(time.Now())
+	return tx.Tx.Commit()
+}
+
+func (tx *metricsTx) Rollback() (err error) {
+	defer func(start time.Time) { observeStatement("rollback", start, err) }(time.Now())
+	return tx.Tx.Rollback()
+}
@@ -0,0 +1,84 @@
+package data
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheMetrics(t *testing.T) {
+	helper := log.NewHelper(log.With(log.NewStdLogger(io.Discard)))
+
+	cs := newTestDataConf()
+	for _, c := range cs {
+		d, cleanup := newTestData(t, c)
+
+		t.Run(testName(c), func(t *testing.T) {
+			defer cleanup()
+			ctx := context.TODO()
+			redisEnabled := c.GetRedis() != nil
+
+			rc := newRepoCache(d, "metrics_cache_key_", helper)
+			load := func(context.Context) (string, error) { return "a", nil }
+			lookups := func(index, layer, result string) float64 {
+				return testutil.ToFloat64(cacheLookups.WithLabelValues("metrics", index, layer, result))
+			}
+
+			// the lookups are counted by the layer, the entries of redis are kept in the local cache
+			name := "get_metrics_" + testName(c)
+			byId := newCacheIndex[string](rc, name, false)
+			_, err := byId.Get(ctx, "1", load)
+			assert.NoError(t, err)
+			_, err = byId.Get(ctx, "1", load)
+			assert.NoError(t, err)
+			assert.Equal(t, float64(1), lookups(name, cacheLayerLocal, "miss"))
+			assert.Equal(t, float64(1), lookups(name, cacheLayerLocal, "hit"))
+			if redisEnabled {
+				assert.Equal(t, float64(1), lookups(name, cacheLayerRedis, "miss"))
+				d.local.Clear()
+				_, err = byId.Get(ctx, "1", load)
+				assert.NoError(t, err)
+				assert.Equal(t, float64(2), lookups(name, cacheLayerLocal, "miss"))
+				assert.Equal(t, float64(1), lookups(name, cacheLayerRedis, "hit"))
+				_, err = byId.Get(ctx, "1", load)
+				assert.NoError(t, err)
+				assert.Equal(t, float64(2), lookups(name, cacheLayerLocal, "hit"))
+
+				// the entries kept out of the local cache are looked up in redis only
+				name = "list_metrics_" + testName(c)
+				list := newCacheIndex[string](rc, name, true)
+				_, err = list.Get(ctx, "1", load)
+				assert.NoError(t, err)
+				_, err = list.Get(ctx, "1", load)
+				assert.NoError(t, err)
+				assert.Equal(t, float64(1), lookups(name, cacheLayerRedis, "miss"))
+				assert.Equal(t, float64(1), lookups(name, cacheLayerRedis, "hit"))
+				assert.Zero(t, lookups(name, cacheLayerLocal, "miss"))
+			}
+
+			// the stats of the indexes and the pool of redis are collected on scrape
+			collector := &dataCollector{data: d}
+			assert.Equal(t, 5*len(d.stats.all()), testutil.CollectAndCount(collector, "pallas_cache_served_total"))
+			if redisEnabled {
+				assert.Equal(t, 3, testutil.CollectAndCount(collector, "pallas_redis_pool_conns"))
+			} else {
+				assert.Zero(t, testutil.CollectAndCount(collector, "pallas_redis_pool_conns"))
+			}
+			assert.NotZero(t, testutil.CollectAndCount(entQuerySeconds))
+
+			flushTestData(t, d)
+		})
+	}
+}
+
+func TestStatementKind(t *testing.T) {
+	assert.Equal(t, "select", statementKind("SELECT `id` FROM `users`"))
+	assert.Equal(t, "insert", statementKind("\n  INSERT INTO \"users\" (\"email\") VALUES ($1) RETURNING \"id\""))
+	assert.Equal(t, "update", statementKind("update t set a = 1"))
+	assert.Equal(t, "other", statementKind("CREATE TABLE t (id INTEGER)"))
+	assert.Equal(t, "other", statementKind(""))
+}
@@ -2,123 +2,254 @@ package data
 
 import (
 	"context"
+	"fmt"
 	"time"
 
 	"github.com/go-kratos/kratos/v2/log"
 
+	"github.com/hominsu/pallas/app/pallas/service/internal/biz"
+	"github.com/hominsu/pallas/app/pallas/service/internal/conf"
 	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent"
 	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent/group"
 	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent/setting"
 	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent/user"
+	"github.com/hominsu/pallas/app/pallas/service/pkgs/replica"
 	"github.com/hominsu/pallas/pkg/srp"
 	"github.com/hominsu/pallas/pkg/utils"
 )
 
-type MigrationStatus struct{}
+// autoMigrateTimeout bounds the migrations applied on start, including the wait for the lock
+const autoMigrateTimeout = 10 * time.Minute
 
-func Migration(entClient *ent.Client, params *srp.Params, logger log.Logger) (status *MigrationStatus) {
+type MigrationStatus struct {
+	// settingsChanged reports whether the settings are changed by the reconciliation, the settings cached by the
+	// previous release are invalidated by NewData then
+	settingsChanged bool
+}
+
+// Migration checks the versioned migrations are applied, or applies them if auto_migrate, and reconciles the
+// settings. The schema is never migrated on start otherwise, the migrations are applied by the migrate command.
+func Migration(conf *conf.Data, entClient *ent.Client, params *srp.Params, logger log.Logger) (status *MigrationStatus) {
 	helper := log.NewHelper(log.With(logger, "module", "data/migration"))
+	migrator := NewMigrator(entClient, conf.Database.Driver, params, logger)
+
+	if conf.Database.AutoMigrate {
+		// the other instances started at the same time wait for the lock
+		ctx, cancel := context.WithTimeout(context.Background(), autoMigrateTimeout)
+		defer cancel()
+		if _, err := migrator.Up(ctx, 0); err != nil {
+			helper.Fatalf("failed migrating: %v", err)
+		}
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		pending, err := migrator.Pending(ctx)
+		if err != nil {
+			helper.Fatalf("failed checking the migrations: %v", err)
+		}
+		if len(pending) > 0 {
+			helper.Fatalf("%d migrations pending, apply them by the migrate command, or enable auto_migrate",
+				len(pending))
+		}
+	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(replica.WithPrimary(context.Background()), 5*time.Second)
 	defer cancel()
 
-	if !checkMigration(ctx, entClient) {
-		// create default group: Admin, User and Anonymous
-		createDefaultGroup(ctx, entClient, helper)
-
-		// create default user admin@pallas.icu
-		createDefaultUser(ctx, entClient, params, helper)
-
-		// create default settings
-		createDefaultSettings(ctx, entClient, helper)
-
-		// set migration status
-		setMigration(ctx, entClient)
-	}
-	return &MigrationStatus{}
+	// insert the settings added since the installation, and migrate the renamed and removed ones
+	return &MigrationStatus{settingsChanged: reconcileSettings(ctx, entClient, helper)}
 }
 
-func checkMigration(ctx context.Context, client *ent.Client) bool {
-	res, err := client.Setting.Query().Where(setting.NameEQ("migration")).Only(ctx)
-	if err != nil && ent.IsNotFound(err) {
-		return false
+// seedDefaults creates the default groups and the default user. The installations before the versioned
+// migrations are seeded already, which are marked by the migration setting.
+func seedDefaults(ctx context.Context, client *ent.Client, params *srp.Params, helper *log.Helper) error {
+	n, err := client.Setting.Delete().Where(setting.NameEQ("migration")).Exec(ctx)
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
 	}
-	return res.Value == "true"
-}
 
-func setMigration(ctx context.Context, client *ent.Client) {
-	client.Setting.Create().
-		SetName("migration").
-		SetValue("true").
-		SetType(setting.TypeBasic).
-		ExecX(ctx)
+	// create default group: Admin, User and Anonymous
+	if err = createDefaultGroup(ctx, client); err != nil {
+		return err
+	}
+	// create default user admin@pallas.icu
+	return createDefaultUser(ctx, client, params, helper)
 }
 
-func createDefaultGroup(ctx context.Context, client *ent.Client, helper *log.Helper) {
+func createDefaultGroup(ctx context.Context, client *ent.Client) error {
 	var bulk []*ent.GroupCreate
 	bulk = append(bulk,
 		client.Group.Create().
 			SetName("Admin").
 			SetMaxStorage(1*utils.GibiByte).
 			SetShareEnabled(true).
-			SetSpeedLimit(0),
+			SetSpeedLimit(0).
+			SetPermissions(toEntPermissions(biz.AllPermissions)),
 		client.Group.Create().
 			SetName("User").
 			SetMaxStorage(1*utils.GibiByte).
 			SetShareEnabled(true).
-			SetSpeedLimit(0),
+			SetSpeedLimit(0).
+			SetPermissions([]string{}),
 		client.Group.Create().
 			SetName("Anonymous").
 			SetMaxStorage(0).
 			SetShareEnabled(true).
-			SetSpeedLimit(0),
+			SetSpeedLimit(0).
+			SetPermissions([]string{}),
 	)
 
-	err := client.Group.CreateBulk(bulk...).Exec(ctx)
+	if err := client.Group.CreateBulk(bulk...).Exec(ctx); err != nil {
+		return fmt.Errorf("failed creating default groups: %w", err)
+	}
+	return nil
+}
+
+// migratePermissions grants all the permissions to the Admin group, which was the admin by its name, and no
+// permission to the other groups. Only the groups without permissions set are migrated.
+func migratePermissions(ctx context.Context, client *ent.Client) error {
+	if _, err := client.Group.Update().
+		Where(group.NameEQ("Admin"), group.PermissionsIsNil()).
+		SetPermissions(toEntPermissions(biz.AllPermissions)).
+		Save(ctx); err != nil {
+		return fmt.Errorf("failed migrating the permissions of groups: %w", err)
+	}
+	if _, err := client.Group.Update().
+		Where(group.PermissionsIsNil()).
+		SetPermissions([]string{}).
+		Save(ctx); err != nil {
+		return fmt.Errorf("failed migrating the permissions of groups: %w", err)
+	}
+	return nil
+}
+
+// migrateStorage converts the storage of users from the quota of the user to the storage added to the quota of the
+// group, the quota of the users is kept.
+func migrateStorage(ctx context.Context, client *ent.Client) error {
+	groups, err := client.Group.Query().All(ctx)
 	if err != nil {
-		helper.Fatalf("failed creating default groups")
+		return fmt.Errorf("failed migrating the storage of users: %w", err)
 	}
+	for _, g := range groups {
+		// the users within the quota of the group first, the users subtracted are not zeroed then
+		if _, err = client.User.Update().
+			Where(user.GroupID(g.ID), user.StorageLTE(g.MaxStorage)).
+			SetStorage(0).
+			Save(ctx); err != nil {
+			return fmt.Errorf("failed migrating the storage of users: %w", err)
+		}
+		if _, err = client.User.Update().
+			Where(user.GroupID(g.ID), user.StorageGT(g.MaxStorage)).
+			AddStorage(-int64(g.MaxStorage)).
+			Save(ctx); err != nil {
+			return fmt.Errorf("failed migrating the storage of users: %w", err)
+		}
+	}
+	return nil
 }
 
-func createDefaultUser(ctx context.Context, client *ent.Client, params *srp.Params, helper *log.Helper) {
+func createDefaultUser(ctx context.Context, client *ent.Client, params *srp.Params, helper *log.Helper) error {
 	salt := []byte(utils.RandString(20, utils.AllCharSet))
 	email := "admin@pallas.icu"
 	password := []byte(utils.RandString(20, utils.AllCharSet))
 	verifier := srp.ComputeVerifier(params, salt, []byte(email), password)
 
-	res := client.Group.Query().
+	res, err := client.Group.Query().
 		Where(group.NameEQ("Admin")).
-		OnlyX(ctx)
+		Only(ctx)
+	if err != nil {
+		return fmt.Errorf("failed querying the Admin group: %w", err)
+	}
 
-	err := client.User.Create().
+	err = client.User.Create().
 		SetEmail(email).
 		SetNickName("admin").
 		SetSalt(salt).
 		SetVerifier(verifier).
-		SetStorage(1 * utils.GibiByte).
+		SetStorage(0).
 		SetScore(0).
 		SetStatus(user.StatusActive).
 		SetOwnerGroup(res).
 		Exec(ctx)
 	if err != nil {
-		helper.Fatalf("failed creating default user")
+		return fmt.Errorf("failed creating default user: %w", err)
 	}
 
 	helper.Infof("========= default user: %s, password: %s ==========", "admin@pallas.icu", password)
+	return nil
 }
 
-func createDefaultSettings(ctx context.Context, client *ent.Client, helper *log.Helper) {
-	bulk := make([]*ent.SettingCreate, len(defaultSettings))
-	for i, ds := range defaultSettings {
-		m := client.Setting.Create().
-			SetName(ds.n).
-			SetValue(ds.v).
-			SetType(toEntSettingType(ds.t))
-		bulk[i] = m
+// reconcileSettings renames the settings in renamedSettings, deletes the ones in removedSettings, and inserts
+// the defaultSettings missing. The values edited by admin are never overwritten, only the types are corrected.
+// It is idempotent, and the concurrent starts of the instances are safe. It reports whether any setting is changed.
+func reconcileSettings(ctx context.Context, client *ent.Client, helper *log.Helper) bool {
+	changed := false
+	for from, to := range renamedSettings {
+		ok, err := client.Setting.Query().Where(setting.NameEQ(string(to))).Exist(ctx)
+		if err != nil {
+			helper.Fatalf("failed reconciling settings: %v", err)
+		}
+		var n int
+		if ok {
+			// the current one is set already, e.g. by the instances of the new release
+			n, err = client.Setting.Delete().Where(setting.NameEQ(from)).Exec(ctx)
+		} else {
+			n, err = client.Setting.Update().Where(setting.NameEQ(from)).SetName(string(to)).Save(ctx)
+		}
+		if err != nil {
+			helper.Fatalf("failed renaming setting %s to %s: %v", from, to, err)
+		}
+		changed = changed || n > 0
+	}
+	if len(removedSettings) > 0 {
+		n, err := client.Setting.Delete().Where(setting.NameIn(removedSettings...)).Exec(ctx)
+		if err != nil {
+			helper.Fatalf("failed removing settings: %v", err)
+		}
+		changed = changed || n > 0
 	}
 
-	err := client.Setting.CreateBulk(bulk...).Exec(ctx)
+	existing, err := client.Setting.Query().All(ctx)
 	if err != nil {
-		helper.Fatalf("failed creating default settings")
+		helper.Fatalf("failed reconciling settings: %v", err)
+	}
+	types := make(map[string]setting.Type, len(existing))
+	for _, s := range existing {
+		types[s.Name] = s.Type
+	}
+
+	var bulk []*ent.SettingCreate
+	for _, ds := range defaultSettings {
+		t, ok := types[*ds.Name]
+		switch {
+		case !ok:
+			bulk = append(bulk, client.Setting.Create().
+				SetName(*ds.Name).
+				SetValue(*ds.Value).
+				SetType(toEntSettingType(*ds.Type)))
+		case t != toEntSettingType(*ds.Type):
+			if err = client.Setting.Update().
+				Where(setting.NameEQ(*ds.Name)).
+				SetType(toEntSettingType(*ds.Type)).
+				Exec(ctx); err != nil {
+				helper.Fatalf("failed reconciling setting %s: %v", *ds.Name, err)
+			}
+			changed = true
+		}
+	}
+	if len(bulk) == 0 {
+		return changed
+	}
+	// the settings inserted by another instance meanwhile are kept
+	if err = client.Setting.CreateBulk(bulk...).
+		OnConflictColumns(setting.FieldName).
+		Ignore().
+		Exec(ctx); err != nil {
+		helper.Fatalf("failed creating default settings: %v", err)
 	}
+	helper.Infof("%d default settings created", len(bulk))
+	return true
 }
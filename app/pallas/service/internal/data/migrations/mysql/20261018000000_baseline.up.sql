@@ -0,0 +1,11 @@
+-- the schema of the release the versioned migrations introduced in, generated by the diff on an empty database
+CREATE TABLE `audit_events` (`id` bigint NOT NULL AUTO_INCREMENT, `created_at` timestamp NOT NULL, `action` varchar(255) NOT NULL, `actor_id` bigint NULL, `target_type` varchar(255) NULL, `target_id` varchar(255) NULL, `remote_addr` varchar(255) NULL, `request_id` varchar(255) NULL, `success` bool NOT NULL, `reason` varchar(255) NULL, `diff` json NULL, PRIMARY KEY (`id`), INDEX `auditevent_actor_id` (`actor_id`), INDEX `auditevent_target_type_target_id` (`target_type`, `target_id`), INDEX `auditevent_action` (`action`), INDEX `auditevent_created_at` (`created_at`)) CHARSET utf8mb4 COLLATE utf8mb4_bin AUTO_INCREMENT 4294967296;
+CREATE TABLE `groups` (`id` bigint NOT NULL AUTO_INCREMENT, `created_at` timestamp NOT NULL, `updated_at` timestamp NOT NULL, `name` varchar(255) NOT NULL, `max_storage` bigint unsigned NOT NULL, `share_enabled` bool NOT NULL, `speed_limit` bigint NOT NULL, `permissions` json NULL, PRIMARY KEY (`id`), UNIQUE INDEX `name` (`name`), INDEX `group_name` (`name`)) CHARSET utf8mb4 COLLATE utf8mb4_bin AUTO_INCREMENT 12884901888;
+CREATE TABLE `settings` (`id` bigint NOT NULL AUTO_INCREMENT, `created_at` timestamp NOT NULL, `updated_at` timestamp NOT NULL, `name` varchar(255) NOT NULL, `value` varchar(255) NOT NULL, `type` enum('basic','register','login','mail','captcha','pwa','timeout','upload','share','avatar','payment','score','task','auth','cron','audit','account') NOT NULL, PRIMARY KEY (`id`), UNIQUE INDEX `name` (`name`)) CHARSET utf8mb4 COLLATE utf8mb4_bin AUTO_INCREMENT 25769803776;
+CREATE TABLE `ent_types` (`id` bigint unsigned NOT NULL AUTO_INCREMENT, `type` varchar(255) NOT NULL, PRIMARY KEY (`id`), UNIQUE INDEX `type` (`type`)) CHARSET utf8mb4 COLLATE utf8mb4_bin;
+CREATE TABLE `users` (`id` bigint NOT NULL AUTO_INCREMENT, `created_at` timestamp NOT NULL, `updated_at` timestamp NOT NULL, `email` varchar(255) NOT NULL, `nick_name` varchar(255) NOT NULL, `salt` blob NOT NULL, `verifier` blob NOT NULL, `storage` bigint unsigned NOT NULL, `storage_quota` bigint unsigned NULL, `used_storage` bigint unsigned NOT NULL DEFAULT 0, `overuse_at` timestamp NULL, `score` bigint NOT NULL DEFAULT 0, `status` enum('non_activated','active','banned','overuse_baned','pending_deletion') NOT NULL DEFAULT 'non_activated', `totp_secret` varchar(255) NULL, `totp_enabled` bool NOT NULL DEFAULT false, `totp_recovery_codes` json NULL, `base_group_id` bigint NULL, `group_expire_at` timestamp NULL, `delete_at` timestamp NULL, `group_id` bigint NOT NULL, PRIMARY KEY (`id`), UNIQUE INDEX `email` (`email`), UNIQUE INDEX `user_email` (`email`), INDEX `user_group_id` (`group_id`), INDEX `user_group_expire_at` (`group_expire_at`), INDEX `user_status_delete_at` (`status`, `delete_at`), CONSTRAINT `users_groups_users` FOREIGN KEY (`group_id`) REFERENCES `groups` (`id`) ON DELETE NO ACTION) CHARSET utf8mb4 COLLATE utf8mb4_bin AUTO_INCREMENT 30064771072;
+CREATE TABLE `access_tokens` (`id` bigint NOT NULL AUTO_INCREMENT, `created_at` timestamp NOT NULL, `updated_at` timestamp NOT NULL, `name` varchar(255) NOT NULL, `token_hash` varchar(255) NOT NULL, `scopes` json NOT NULL, `expire_at` timestamp NULL, `last_used_at` timestamp NULL, `user_id` bigint NOT NULL, PRIMARY KEY (`id`), UNIQUE INDEX `token_hash` (`token_hash`), UNIQUE INDEX `accesstoken_token_hash` (`token_hash`), INDEX `accesstoken_user_id` (`user_id`), CONSTRAINT `access_tokens_users_access_tokens` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE CASCADE) CHARSET utf8mb4 COLLATE utf8mb4_bin;
+CREATE TABLE `avatars` (`id` bigint NOT NULL AUTO_INCREMENT, `created_at` timestamp NOT NULL, `size` bigint NOT NULL, `data` mediumblob NOT NULL, `etag` varchar(255) NOT NULL, `user_id` bigint NOT NULL, PRIMARY KEY (`id`), UNIQUE INDEX `avatar_user_id_size` (`user_id`, `size`), CONSTRAINT `avatars_users_avatars` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE CASCADE) CHARSET utf8mb4 COLLATE utf8mb4_bin AUTO_INCREMENT 8589934592;
+CREATE TABLE `identities` (`id` bigint NOT NULL AUTO_INCREMENT, `created_at` timestamp NOT NULL, `updated_at` timestamp NOT NULL, `provider` varchar(255) NOT NULL, `subject` varchar(255) NOT NULL, `email` varchar(255) NULL, `user_id` bigint NOT NULL, PRIMARY KEY (`id`), UNIQUE INDEX `identity_provider_subject` (`provider`, `subject`), UNIQUE INDEX `identity_user_id_provider` (`user_id`, `provider`), CONSTRAINT `identities_users_identities` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE CASCADE) CHARSET utf8mb4 COLLATE utf8mb4_bin AUTO_INCREMENT 17179869184;
+CREATE TABLE `score_transactions` (`id` bigint NOT NULL AUTO_INCREMENT, `created_at` timestamp NOT NULL, `amount` bigint NOT NULL, `balance` bigint NOT NULL, `reason` enum('checkin','grant','redeem_storage','redeem_group') NOT NULL, `note` varchar(255) NULL, `operator_id` bigint NULL, `idempotency_key` varchar(255) NULL, `user_id` bigint NOT NULL, PRIMARY KEY (`id`), UNIQUE INDEX `scoretransaction_user_id_idempotency_key` (`user_id`, `idempotency_key`), INDEX `scoretransaction_user_id` (`user_id`), CONSTRAINT `score_transactions_users_score_transactions` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE CASCADE) CHARSET utf8mb4 COLLATE utf8mb4_bin AUTO_INCREMENT 21474836480;
+INSERT INTO `ent_types` (`type`) VALUES ('access_tokens'), ('audit_events'), ('avatars'), ('groups'), ('identities'), ('score_transactions'), ('settings'), ('users');
@@ -0,0 +1,32 @@
+-- the schema of the release the versioned migrations introduced in, generated by the diff on an empty database
+CREATE TABLE "audit_events" ("id" bigint NOT NULL GENERATED BY DEFAULT AS IDENTITY (START WITH 4294967296), "created_at" timestamptz NOT NULL, "action" character varying NOT NULL, "actor_id" bigint NULL, "target_type" character varying NULL, "target_id" character varying NULL, "remote_addr" character varying NULL, "request_id" character varying NULL, "success" boolean NOT NULL, "reason" character varying NULL, "diff" jsonb NULL, PRIMARY KEY ("id"));
+CREATE INDEX "auditevent_actor_id" ON "audit_events" ("actor_id");
+CREATE INDEX "auditevent_target_type_target_id" ON "audit_events" ("target_type", "target_id");
+CREATE INDEX "auditevent_action" ON "audit_events" ("action");
+CREATE INDEX "auditevent_created_at" ON "audit_events" ("created_at");
+CREATE TABLE "groups" ("id" bigint NOT NULL GENERATED BY DEFAULT AS IDENTITY (START WITH 12884901888), "created_at" timestamptz NOT NULL, "updated_at" timestamptz NOT NULL, "name" character varying NOT NULL, "max_storage" bigint NOT NULL, "share_enabled" boolean NOT NULL, "speed_limit" bigint NOT NULL, "permissions" jsonb NULL, PRIMARY KEY ("id"));
+CREATE UNIQUE INDEX "groups_name_key" ON "groups" ("name");
+CREATE INDEX "group_name" ON "groups" ("name");
+CREATE TABLE "settings" ("id" bigint NOT NULL GENERATED BY DEFAULT AS IDENTITY (START WITH 25769803776), "created_at" timestamptz NOT NULL, "updated_at" timestamptz NOT NULL, "name" character varying NOT NULL, "value" character varying NOT NULL, "type" character varying NOT NULL, PRIMARY KEY ("id"));
+CREATE UNIQUE INDEX "settings_name_key" ON "settings" ("name");
+CREATE TABLE "ent_types" ("id" bigint NOT NULL GENERATED BY DEFAULT AS IDENTITY, "type" character varying NOT NULL, PRIMARY KEY ("id"));
+CREATE UNIQUE INDEX "ent_types_type_key" ON "ent_types" ("type");
+CREATE TABLE "users" ("id" bigint NOT NULL GENERATED BY DEFAULT AS IDENTITY (START WITH 30064771072), "created_at" timestamptz NOT NULL, "updated_at" timestamptz NOT NULL, "email" character varying NOT NULL, "nick_name" character varying NOT NULL, "salt" bytea NOT NULL, "verifier" bytea NOT NULL, "storage" bigint NOT NULL, "storage_quota" bigint NULL, "used_storage" bigint NOT NULL DEFAULT 0, "overuse_at" timestamptz NULL, "score" bigint NOT NULL DEFAULT 0, "status" character varying NOT NULL DEFAULT 'non_activated', "totp_secret" character varying NULL, "totp_enabled" boolean NOT NULL DEFAULT false, "totp_recovery_codes" jsonb NULL, "base_group_id" bigint NULL, "group_expire_at" timestamptz NULL, "delete_at" timestamptz NULL, "group_id" bigint NOT NULL, PRIMARY KEY ("id"), CONSTRAINT "users_groups_users" FOREIGN KEY ("group_id") REFERENCES "groups" ("id") ON DELETE NO ACTION);
+CREATE UNIQUE INDEX "users_email_key" ON "users" ("email");
+CREATE UNIQUE INDEX "user_email" ON "users" ("email");
+CREATE INDEX "user_group_id" ON "users" ("group_id");
+CREATE INDEX "user_group_expire_at" ON "users" ("group_expire_at");
+CREATE INDEX "user_status_delete_at" ON "users" ("status", "delete_at");
+CREATE TABLE "access_tokens" ("id" bigint NOT NULL GENERATED BY DEFAULT AS IDENTITY, "created_at" timestamptz NOT NULL, "updated_at" timestamptz NOT NULL, "name" character varying NOT NULL, "token_hash" character varying NOT NULL, "scopes" jsonb NOT NULL, "expire_at" timestamptz NULL, "last_used_at" timestamptz NULL, "user_id" bigint NOT NULL, PRIMARY KEY ("id"), CONSTRAINT "access_tokens_users_access_tokens" FOREIGN KEY ("user_id") REFERENCES "users" ("id") ON DELETE CASCADE);
+CREATE UNIQUE INDEX "access_tokens_token_hash_key" ON "access_tokens" ("token_hash");
+CREATE UNIQUE INDEX "accesstoken_token_hash" ON "access_tokens" ("token_hash");
+CREATE INDEX "accesstoken_user_id" ON "access_tokens" ("user_id");
+CREATE TABLE "avatars" ("id" bigint NOT NULL GENERATED BY DEFAULT AS IDENTITY (START WITH 8589934592), "created_at" timestamptz NOT NULL, "size" bigint NOT NULL, "data" bytea NOT NULL, "etag" character varying NOT NULL, "user_id" bigint NOT NULL, PRIMARY KEY ("id"), CONSTRAINT "avatars_users_avatars" FOREIGN KEY ("user_id") REFERENCES "users" ("id") ON DELETE CASCADE);
+CREATE UNIQUE INDEX "avatar_user_id_size" ON "avatars" ("user_id", "size");
+CREATE TABLE "identities" ("id" bigint NOT NULL GENERATED BY DEFAULT AS IDENTITY (START WITH 17179869184), "created_at" timestamptz NOT NULL, "updated_at" timestamptz NOT NULL, "provider" character varying NOT NULL, "subject" character varying NOT NULL, "email" character varying NULL, "user_id" bigint NOT NULL, PRIMARY KEY ("id"), CONSTRAINT "identities_users_identities" FOREIGN KEY ("user_id") REFERENCES "users" ("id") ON DELETE CASCADE);
+CREATE UNIQUE INDEX "identity_provider_subject" ON "identities" ("provider", "subject");
+CREATE UNIQUE INDEX "identity_user_id_provider" ON "identities" ("user_id", "provider");
+CREATE TABLE "score_transactions" ("id" bigint NOT NULL GENERATED BY DEFAULT AS IDENTITY (START WITH 21474836480), "created_at" timestamptz NOT NULL, "amount" bigint NOT NULL, "balance" bigint NOT NULL, "reason" character varying NOT NULL, "note" character varying NULL, "operator_id" bigint NULL, "idempotency_key" character varying NULL, "user_id" bigint NOT NULL, PRIMARY KEY ("id"), CONSTRAINT "score_transactions_users_score_transactions" FOREIGN KEY ("user_id") REFERENCES "users" ("id") ON DELETE CASCADE);
+CREATE UNIQUE INDEX "scoretransaction_user_id_idempotency_key" ON "score_transactions" ("user_id", "idempotency_key");
+CREATE INDEX "scoretransaction_user_id" ON "score_transactions" ("user_id");
+INSERT INTO "ent_types" ("type") VALUES ('access_tokens'), ('audit_events'), ('avatars'), ('groups'), ('identities'), ('score_transactions'), ('settings'), ('users');
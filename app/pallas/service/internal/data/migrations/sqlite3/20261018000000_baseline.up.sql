@@ -0,0 +1,39 @@
+-- the schema of the release the versioned migrations introduced in, generated by the diff on an empty database
+CREATE TABLE `access_tokens` (`id` integer NOT NULL PRIMARY KEY AUTOINCREMENT, `created_at` datetime NOT NULL, `updated_at` datetime NOT NULL, `name` text NOT NULL, `token_hash` text NOT NULL, `scopes` json NOT NULL, `expire_at` datetime NULL, `last_used_at` datetime NULL, `user_id` integer NOT NULL, CONSTRAINT `access_tokens_users_access_tokens` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE CASCADE);
+CREATE UNIQUE INDEX `access_tokens_token_hash_key` ON `access_tokens` (`token_hash`);
+CREATE UNIQUE INDEX `accesstoken_token_hash` ON `access_tokens` (`token_hash`);
+CREATE INDEX `accesstoken_user_id` ON `access_tokens` (`user_id`);
+CREATE TABLE `audit_events` (`id` integer NOT NULL PRIMARY KEY AUTOINCREMENT, `created_at` datetime NOT NULL, `action` text NOT NULL, `actor_id` integer NULL, `target_type` text NULL, `target_id` text NULL, `remote_addr` text NULL, `request_id` text NULL, `success` bool NOT NULL, `reason` text NULL, `diff` json NULL);
+INSERT INTO sqlite_sequence (name, seq) VALUES ("audit_events", 4294967296);
+CREATE INDEX `auditevent_actor_id` ON `audit_events` (`actor_id`);
+CREATE INDEX `auditevent_target_type_target_id` ON `audit_events` (`target_type`, `target_id`);
+CREATE INDEX `auditevent_action` ON `audit_events` (`action`);
+CREATE INDEX `auditevent_created_at` ON `audit_events` (`created_at`);
+CREATE TABLE `avatars` (`id` integer NOT NULL PRIMARY KEY AUTOINCREMENT, `created_at` datetime NOT NULL, `size` integer NOT NULL, `data` blob NOT NULL, `etag` text NOT NULL, `user_id` integer NOT NULL, CONSTRAINT `avatars_users_avatars` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE CASCADE);
+INSERT INTO sqlite_sequence (name, seq) VALUES ("avatars", 8589934592);
+CREATE UNIQUE INDEX `avatar_user_id_size` ON `avatars` (`user_id`, `size`);
+CREATE TABLE `groups` (`id` integer NOT NULL PRIMARY KEY AUTOINCREMENT, `created_at` datetime NOT NULL, `updated_at` datetime NOT NULL, `name` text NOT NULL, `max_storage` integer NOT NULL, `share_enabled` bool NOT NULL, `speed_limit` integer NOT NULL, `permissions` json NULL);
+INSERT INTO sqlite_sequence (name, seq) VALUES ("groups", 12884901888);
+CREATE UNIQUE INDEX `groups_name_key` ON `groups` (`name`);
+CREATE INDEX `group_name` ON `groups` (`name`);
+CREATE TABLE `identities` (`id` integer NOT NULL PRIMARY KEY AUTOINCREMENT, `created_at` datetime NOT NULL, `updated_at` datetime NOT NULL, `provider` text NOT NULL, `subject` text NOT NULL, `email` text NULL, `user_id` integer NOT NULL, CONSTRAINT `identities_users_identities` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE CASCADE);
+INSERT INTO sqlite_sequence (name, seq) VALUES ("identities", 17179869184);
+CREATE UNIQUE INDEX `identity_provider_subject` ON `identities` (`provider`, `subject`);
+CREATE UNIQUE INDEX `identity_user_id_provider` ON `identities` (`user_id`, `provider`);
+CREATE TABLE `score_transactions` (`id` integer NOT NULL PRIMARY KEY AUTOINCREMENT, `created_at` datetime NOT NULL, `amount` integer NOT NULL, `balance` integer NOT NULL, `reason` text NOT NULL, `note` text NULL, `operator_id` integer NULL, `idempotency_key` text NULL, `user_id` integer NOT NULL, CONSTRAINT `score_transactions_users_score_transactions` FOREIGN KEY (`user_id`) REFERENCES `users` (`id`) ON DELETE CASCADE);
+INSERT INTO sqlite_sequence (name, seq) VALUES ("score_transactions", 21474836480);
+CREATE UNIQUE INDEX `scoretransaction_user_id_idempotency_key` ON `score_transactions` (`user_id`, `idempotency_key`);
+CREATE INDEX `scoretransaction_user_id` ON `score_transactions` (`user_id`);
+CREATE TABLE `settings` (`id` integer NOT NULL PRIMARY KEY AUTOINCREMENT, `created_at` datetime NOT NULL, `updated_at` datetime NOT NULL, `name` text NOT NULL, `value` text NOT NULL, `type` text NOT NULL);
+INSERT INTO sqlite_sequence (name, seq) VALUES ("settings", 25769803776);
+CREATE UNIQUE INDEX `settings_name_key` ON `settings` (`name`);
+CREATE TABLE `users` (`id` integer NOT NULL PRIMARY KEY AUTOINCREMENT, `created_at` datetime NOT NULL, `updated_at` datetime NOT NULL, `email` text NOT NULL, `nick_name` text NOT NULL, `salt` blob NOT NULL, `verifier` blob NOT NULL, `storage` integer NOT NULL, `storage_quota` integer NULL, `used_storage` integer NOT NULL DEFAULT 0, `overuse_at` datetime NULL, `score` integer NOT NULL DEFAULT 0, `status` text NOT NULL DEFAULT 'non_activated', `totp_secret` text NULL, `totp_enabled` bool NOT NULL DEFAULT false, `totp_recovery_codes` json NULL, `base_group_id` integer NULL, `group_expire_at` datetime NULL, `delete_at` datetime NULL, `group_id` integer NOT NULL, CONSTRAINT `users_groups_users` FOREIGN KEY (`group_id`) REFERENCES `groups` (`id`) ON DELETE NO ACTION);
+INSERT INTO sqlite_sequence (name, seq) VALUES ("users", 30064771072);
+CREATE UNIQUE INDEX `users_email_key` ON `users` (`email`);
+CREATE UNIQUE INDEX `user_email` ON `users` (`email`);
+CREATE INDEX `user_group_id` ON `users` (`group_id`);
+CREATE INDEX `user_group_expire_at` ON `users` (`group_expire_at`);
+CREATE INDEX `user_status_delete_at` ON `users` (`status`, `delete_at`);
+CREATE TABLE `ent_types` (`id` integer NOT NULL PRIMARY KEY AUTOINCREMENT, `type` text NOT NULL);
+CREATE UNIQUE INDEX `ent_types_type_key` ON `ent_types` (`type`);
+INSERT INTO `ent_types` (`type`) VALUES ('access_tokens'), ('audit_events'), ('avatars'), ('groups'), ('identities'), ('score_transactions'), ('settings'), ('users');
@@ -0,0 +1,7 @@
+-- the runs of the periodic jobs, see internal/data/cron.go
+CREATE TABLE cron_jobs (
+  name VARCHAR(64) NOT NULL PRIMARY KEY,
+  owner VARCHAR(64) NOT NULL,
+  lease_until BIGINT NOT NULL,
+  last_run_at BIGINT NOT NULL
+);
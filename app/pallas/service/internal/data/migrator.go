@@ -0,0 +1,628 @@
+package data
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"entgo.io/ent/dialect"
+	"github.com/go-kratos/kratos/v2/log"
+
+	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent"
+	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent/migrate"
+	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent/user"
+	"github.com/hominsu/pallas/app/pallas/service/pkgs/replica"
+	"github.com/hominsu/pallas/pkg/srp"
+	"github.com/hominsu/pallas/pkg/utils"
+)
+
+const (
+	// migrationTable is the history of the migrations applied
+	migrationTable = "schema_migrations"
+	// migrationLockTable holds the lock of the migrations, at most one row
+	migrationLockTable = "schema_migration_lock"
+	// baselineVersion is the SQL migration creating the schema of the release the versioned migrations
+	// introduced in
+	baselineVersion = "20261018000000"
+	// migrationLockTTL is how long the lock is held by a migrator without refreshing it, so that the lock of a
+	// crashed migrator is taken over
+	migrationLockTTL = time.Minute
+)
+
+// migrationFiles are the SQL migrations generated from the ent schema, in the directory of the driver, named
+// <version>_<description>.up.sql and <version>_<description>.down.sql
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+// migration is a step of the schema or the data, the steps are applied in the order of the versions.
+type migration struct {
+	Version     string
+	Description string
+	// Data steps run in a transaction, the schema steps do not since the DDL is not transactional in MySQL
+	Data bool
+	Up   func(ctx context.Context, client *ent.Client) error
+	// Down reverts the step, nil if irreversible
+	Down func(ctx context.Context, client *ent.Client) error
+}
+
+// MigrationState is the state of a migration, the applied ones unknown to the release are listed as well.
+type MigrationState struct {
+	Version     string
+	Description string
+	AppliedAt   *time.Time
+	Unknown     bool
+}
+
+// Migrator applies the versioned migrations, and records them in the history table. It reads the primary only,
+// since the replicas may lag behind.
+type Migrator struct {
+	client *ent.Client
+	driver string
+	fsys   fs.FS
+	params *srp.Params
+	owner  string
+	log    *log.Helper
+}
+
+func NewMigrator(client *ent.Client, driver string, params *srp.Params, logger log.Logger) *Migrator {
+	sub, _ := fs.Sub(migrationFiles, "migrations")
+	return newMigrator(client, driver, sub, params, logger)
+}
+
+func newMigrator(client *ent.Client, driver string, fsys fs.FS, params *srp.Params, logger log.Logger) *Migrator {
+	return &Migrator{
+		client: client,
+		driver: driver,
+		fsys:   fsys,
+		params: params,
+		owner:  utils.RandString(16, utils.AllCharSet),
+		log:    log.NewHelper(log.With(logger, "module", "data/migrator")),
+	}
+}
+
+// goMigrations are the steps in Go, the data steps following the baseline SQL files.
+func (m *Migrator) goMigrations() []*migration {
+	return []*migration{
+		{
+			Version:     "20261018000001",
+			Description: "default groups and user",
+			Data:        true,
+			Up: func(ctx context.Context, client *ent.Client) error {
+				return seedDefaults(ctx, client, m.params, m.log)
+			},
+		},
+		{
+			Version:     "20261018000002",
+			Description: "permissions of groups",
+			Data:        true,
+			Up:          migratePermissions,
+		},
+		{
+			Version:     "20261018000003",
+			Description: "storage of users",
+			Data:        true,
+			Up:          migrateStorage,
+		},
+	}
+}
+
+// migrations returns the steps in Go and the SQL files of the driver, ordered by version.
+func (m *Migrator) migrations() ([]*migration, error) {
+	steps := m.goMigrations()
+
+	entries, err := fs.ReadDir(m.fsys, m.driver)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	files := make(map[string]*migration)
+	for _, e := range entries {
+		name := e.Name()
+		var (
+			base string
+			up   bool
+		)
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			base, up = strings.TrimSuffix(name, ".up.sql"), true
+		case strings.HasSuffix(name, ".down.sql"):
+			base = strings.TrimSuffix(name, ".down.sql")
+		default:
+			continue
+		}
+		version, description, ok := strings.Cut(base, "_")
+		if !ok || version == "" {
+			return nil, fmt.Errorf("invalid migration file name: %s", name)
+		}
+		mi, found := files[version]
+		if !found {
+			mi = &migration{Version: version, Description: description}
+			files[version] = mi
+			steps = append(steps, mi)
+		}
+		stmts, rErr := m.readStatements(path.Join(m.driver, name))
+		if rErr != nil {
+			return nil, rErr
+		}
+		if up {
+			mi.Up = execStatements(stmts)
+		} else {
+			mi.Down = execStatements(stmts)
+		}
+	}
+
+	sort.SliceStable(steps, func(i, j int) bool { return steps[i].Version < steps[j].Version })
+	for i, s := range steps {
+		if s.Up == nil {
+			return nil, fmt.Errorf("migration %s has no up file", s.Version)
+		}
+		if i > 0 && steps[i-1].Version == s.Version {
+			return nil, fmt.Errorf("duplicate migration version %s", s.Version)
+		}
+	}
+	return steps, nil
+}
+
+// readStatements splits the file into statements, one statement ends with the line ended with a semicolon.
+func (m *Migrator) readStatements(name string) ([]string, error) {
+	b, err := fs.ReadFile(m.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		stmts []string
+		stmt  strings.Builder
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "--") {
+			continue
+		}
+		if stmt.Len() > 0 {
+			stmt.WriteByte('\n')
+		}
+		stmt.WriteString(line)
+		if strings.HasSuffix(line, ";") {
+			stmts = append(stmts, stmt.String())
+			stmt.Reset()
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	if stmt.Len() > 0 {
+		stmts = append(stmts, stmt.String())
+	}
+	return stmts, nil
+}
+
+func execStatements(stmts []string) func(ctx context.Context, client *ent.Client) error {
+	return func(ctx context.Context, client *ent.Client) error {
+		for _, stmt := range stmts {
+			if _, err := client.ExecContext(ctx, stmt); err != nil {
+				return fmt.Errorf("%w: %s", err, stmt)
+			}
+		}
+		return nil
+	}
+}
+
+// init creates the history table and the lock table.
+func (m *Migrator) init(ctx context.Context) error {
+	for _, stmt := range []string{
+		"CREATE TABLE IF NOT EXISTS " + migrationTable + " (" +
+			"version VARCHAR(64) NOT NULL PRIMARY KEY, " +
+			"description VARCHAR(255) NOT NULL, " +
+			"applied_at BIGINT NOT NULL)",
+		"CREATE TABLE IF NOT EXISTS " + migrationLockTable + " (" +
+			"id INTEGER NOT NULL PRIMARY KEY, " +
+			"owner VARCHAR(64) NOT NULL, " +
+			"expire_at BIGINT NOT NULL)",
+	} {
+		if _, err := m.client.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("failed creating the migration tables: %w", err)
+		}
+	}
+	return nil
+}
+
+// applied returns the applied_at of the applied versions.
+func (m *Migrator) applied(ctx context.Context) (map[string]*MigrationState, error) {
+	rows, err := m.client.QueryContext(ctx, "SELECT version, description, applied_at FROM "+migrationTable)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	res := make(map[string]*MigrationState)
+	for rows.Next() {
+		var (
+			s  MigrationState
+			at int64
+		)
+		if err = rows.Scan(&s.Version, &s.Description, &at); err != nil {
+			return nil, err
+		}
+		t := time.UnixMilli(at)
+		s.AppliedAt = &t
+		res[s.Version] = &s
+	}
+	return res, rows.Err()
+}
+
+// Status returns the state of the migrations ordered by version.
+func (m *Migrator) Status(ctx context.Context) ([]*MigrationState, error) {
+	ctx = replica.WithPrimary(ctx)
+	if err := m.init(ctx); err != nil {
+		return nil, err
+	}
+	steps, err := m.migrations()
+	if err != nil {
+		return nil, err
+	}
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*MigrationState, 0, len(steps))
+	for _, s := range steps {
+		state := &MigrationState{Version: s.Version, Description: s.Description}
+		if a, ok := applied[s.Version]; ok {
+			state.AppliedAt = a.AppliedAt
+			delete(applied, s.Version)
+		}
+		res = append(res, state)
+	}
+	// applied by a newer release
+	for _, a := range applied {
+		a.Unknown = true
+		res = append(res, a)
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Version < res[j].Version })
+	return res, nil
+}
+
+// Pending returns the versions not applied yet.
+func (m *Migrator) Pending(ctx context.Context) ([]string, error) {
+	states, err := m.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var pending []string
+	for _, s := range states {
+		if s.AppliedAt == nil {
+			pending = append(pending, s.Version)
+		}
+	}
+	return pending, nil
+}
+
+// Up applies at most n pending migrations in order, all of them if n <= 0, and returns the number applied.
+// It holds the lock, the instances started at the same time wait for the one migrating.
+func (m *Migrator) Up(ctx context.Context, n int) (int, error) {
+	ctx = replica.WithPrimary(ctx)
+	if err := m.init(ctx); err != nil {
+		return 0, err
+	}
+	unlock, err := m.lock(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	steps, err := m.migrations()
+	if err != nil {
+		return 0, err
+	}
+	// read after locked, the migrations applied by the previous holder are skipped
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	for _, s := range steps {
+		if n > 0 && count >= n {
+			break
+		}
+		if _, ok := applied[s.Version]; ok {
+			continue
+		}
+		up := s.Up
+		if s.Version == baselineVersion {
+			migrated, mErr := m.autoMigrated(ctx)
+			if mErr != nil {
+				return count, mErr
+			}
+			if migrated {
+				m.log.Infof("migration %s %s upgrading the schema auto migrated", s.Version, s.Description)
+				up = upgradeAutoMigrated
+			}
+		}
+		if err = m.run(ctx, s, up, func(ctx context.Context, client *ent.Client) error {
+			_, eErr := client.ExecContext(ctx,
+				m.rebind("INSERT INTO "+migrationTable+" (version, description, applied_at) VALUES (?, ?, ?)"),
+				s.Version, s.Description, time.Now().UnixMilli())
+			return eErr
+		}); err != nil {
+			return count, fmt.Errorf("failed applying migration %s %s: %w", s.Version, s.Description, err)
+		}
+		m.log.Infof("migration %s %s applied", s.Version, s.Description)
+		count++
+	}
+	return count, nil
+}
+
+// Down reverts the last n applied migrations in the reverse order, and returns the number reverted.
+func (m *Migrator) Down(ctx context.Context, n int) (int, error) {
+	ctx = replica.WithPrimary(ctx)
+	if err := m.init(ctx); err != nil {
+		return 0, err
+	}
+	unlock, err := m.lock(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer unlock()
+
+	steps, err := m.migrations()
+	if err != nil {
+		return 0, err
+	}
+	index := make(map[string]*migration, len(steps))
+	for _, s := range steps {
+		index[s.Version] = s
+	}
+	applied, err := m.applied(ctx)
+	if err != nil {
+		return 0, err
+	}
+	versions := make([]string, 0, len(applied))
+	for v := range applied {
+		versions = append(versions, v)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(versions)))
+
+	var count int
+	for _, v := range versions {
+		if count >= n {
+			break
+		}
+		s, ok := index[v]
+		switch {
+		case !ok:
+			return count, fmt.Errorf("migration %s is unknown to the release, revert it with the release applied it", v)
+		case s.Down == nil:
+			return count, fmt.Errorf("migration %s %s is irreversible", s.Version, s.Description)
+		}
+		if err = m.run(ctx, s, s.Down, func(ctx context.Context, client *ent.Client) error {
+			_, eErr := client.ExecContext(ctx, m.rebind("DELETE FROM "+migrationTable+" WHERE version = ?"), s.Version)
+			return eErr
+		}); err != nil {
+			return count, fmt.Errorf("failed reverting migration %s %s: %w", s.Version, s.Description, err)
+		}
+		m.log.Infof("migration %s %s reverted", s.Version, s.Description)
+		count++
+	}
+	return count, nil
+}
+
+// upgradeAutoMigrated brings the schema auto migrated by the releases before the versioned migrations up to the
+// baseline. The schema is migrated by ent once rather than by a SQL diff, since the ranges of the ids allocated to
+// the types added follow the types recorded in ent_types of the database. The ent schema must be the one of the
+// baseline, the releases changing the ent schema freeze the tables of the baseline here.
+func upgradeAutoMigrated(ctx context.Context, client *ent.Client) error {
+	return client.Schema.Create(ctx,
+		migrate.WithForeignKeys(true),
+		migrate.WithGlobalUniqueID(true),
+	)
+}
+
+// autoMigrated reports whether the schema was auto migrated on start by the releases before the versioned
+// migrations, which lacks the tables and the columns added since.
+func (m *Migrator) autoMigrated(ctx context.Context) (bool, error) {
+	var query string
+	switch m.driver {
+	case dialect.SQLite:
+		query = "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?"
+	case dialect.Postgres:
+		query = "SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = CURRENT_SCHEMA() AND table_name = ?"
+	default:
+		query = "SELECT COUNT(*) FROM INFORMATION_SCHEMA.TABLES WHERE TABLE_SCHEMA = (SELECT DATABASE()) AND TABLE_NAME = ?"
+	}
+	rows, err := m.client.QueryContext(ctx, m.rebind(query), user.Table)
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	var n int
+	if rows.Next() {
+		if err = rows.Scan(&n); err != nil {
+			return false, err
+		}
+	}
+	return n > 0, rows.Err()
+}
+
+// run runs the step and records it, in a transaction for the data steps.
+func (m *Migrator) run(ctx context.Context, s *migration, step, record func(context.Context, *ent.Client) error) error {
+	if !s.Data {
+		if err := step(ctx, m.client); err != nil {
+			return err
+		}
+		return record(ctx, m.client)
+	}
+
+	tx, err := m.client.Tx(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			if rErr := tx.Rollback(); rErr != nil {
+				m.log.Warnf("rollback failed, err: %v", rErr)
+			}
+			panic(v)
+		}
+	}()
+
+	if err = step(ctx, tx.Client()); err == nil {
+		err = record(ctx, tx.Client())
+	}
+	if err != nil {
+		if rErr := tx.Rollback(); rErr != nil {
+			return fmt.Errorf("%w: rolling back transaction: %v", err, rErr)
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// Diff writes the statements bringing the database up to date with the ent schema into a new up file under dir,
+// and returns the path of the file, empty if the database is up to date. The database must have all the
+// migrations applied, the down file is left to be written by hand.
+func (m *Migrator) Diff(ctx context.Context, dir, name string) (string, error) {
+	ctx = replica.WithPrimary(ctx)
+	pending, err := m.Pending(ctx)
+	if err != nil {
+		return "", err
+	}
+	if len(pending) > 0 {
+		return "", fmt.Errorf("%d migrations pending, apply them before the diff", len(pending))
+	}
+
+	var b bytes.Buffer
+	if err = m.client.Schema.WriteTo(ctx, &b,
+		migrate.WithForeignKeys(true),
+		migrate.WithGlobalUniqueID(true),
+	); err != nil {
+		return "", err
+	}
+	if !hasChanges(b.String()) {
+		return "", nil
+	}
+
+	if err = os.MkdirAll(filepath.Join(dir, m.driver), 0o755); err != nil {
+		return "", err
+	}
+	file := filepath.Join(dir, m.driver,
+		fmt.Sprintf("%s_%s.up.sql", time.Now().UTC().Format("20060102150405"), name))
+	return file, os.WriteFile(file, b.Bytes(), 0o644)
+}
+
+// rebind numbers the placeholders of the query as $1, $2... for postgres, the other drivers take ?.
+func (m *Migrator) rebind(query string) string {
+	return rebind(m.driver, query)
+}
+
+func rebind(driver, query string) string {
+	if driver != dialect.Postgres {
+		return query
+	}
+	var (
+		b strings.Builder
+		n int
+	)
+	for _, c := range query {
+		if c != '?' {
+			b.WriteRune(c)
+			continue
+		}
+		n++
+		b.WriteString("$" + strconv.Itoa(n))
+	}
+	return b.String()
+}
+
+// hasChanges reports whether the statements written by the ent schema change anything, the sqlite dialect
+// wraps the changes with the pragmas even if there is none.
+func hasChanges(stmts string) bool {
+	for _, line := range strings.Split(stmts, "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "PRAGMA ") {
+			return true
+		}
+	}
+	return false
+}
+
+// lock acquires the lock of the migrations, waits for the holder until ctx done. The lock is refreshed until
+// unlocked, and is taken over once expired.
+func (m *Migrator) lock(ctx context.Context) (func(), error) {
+	for waiting := false; ; {
+		now := time.Now()
+		if _, err := m.client.ExecContext(ctx,
+			m.rebind("DELETE FROM "+migrationLockTable+" WHERE id = 1 AND expire_at < ?"), now.UnixMilli()); err != nil {
+			return nil, err
+		}
+		_, err := m.client.ExecContext(ctx,
+			m.rebind("INSERT INTO "+migrationLockTable+" (id, owner, expire_at) VALUES (1, ?, ?)"),
+			m.owner, now.Add(migrationLockTTL).UnixMilli())
+		if err == nil {
+			break
+		}
+		// the insert fails on the conflict with the holder, otherwise it is an error
+		rows, qErr := m.client.QueryContext(ctx, "SELECT owner FROM "+migrationLockTable+" WHERE id = 1")
+		if qErr != nil {
+			return nil, qErr
+		}
+		held := rows.Next()
+		_ = rows.Close()
+		if !held {
+			return nil, fmt.Errorf("failed acquiring the migration lock: %w", err)
+		}
+
+		if !waiting {
+			m.log.Info("waiting for the migration lock held by another instance")
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("failed acquiring the migration lock: %w", ctx.Err())
+		case <-time.After(time.Second):
+		}
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(migrationLockTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if _, err := m.client.ExecContext(context.Background(),
+					m.rebind("UPDATE "+migrationLockTable+" SET expire_at = ? WHERE id = 1 AND owner = ?"),
+					time.Now().Add(migrationLockTTL).UnixMilli(), m.owner); err != nil {
+					m.log.Warnf("failed refreshing the migration lock: %v", err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+		if _, err := m.client.ExecContext(context.Background(),
+			m.rebind("DELETE FROM "+migrationLockTable+" WHERE id = 1 AND owner = ?"), m.owner); err != nil {
+			m.log.Warnf("failed releasing the migration lock: %v", err)
+		}
+	}, nil
+}
@@ -0,0 +1,266 @@
+package data
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/hominsu/pallas/app/pallas/service/internal/biz"
+	"github.com/hominsu/pallas/app/pallas/service/internal/conf"
+	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent/group"
+	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent/setting"
+	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent/user"
+	"github.com/hominsu/pallas/pkg/srp"
+	"github.com/hominsu/pallas/pkg/utils"
+)
+
+func TestMigrator(t *testing.T) {
+	logger := log.With(log.NewStdLogger(io.Discard))
+	params, err := srp.GetParams(2048)
+	assert.NoError(t, err)
+
+	cs := newTestDataConf()
+	for _, c := range cs {
+		d, cleanup := newTestData(t, c)
+
+		t.Run(testName(c), func(t *testing.T) {
+			defer cleanup()
+			ctx := context.TODO()
+			driver := c.Database.Driver
+
+			// applied by newTestData
+			pending, err := NewMigrator(d.db, driver, params, logger).Pending(ctx)
+			assert.NoError(t, err)
+			assert.Empty(t, pending)
+
+			// the ids of each type are allocated in a range of their own
+			gid, err := d.db.Group.Query().FirstID(ctx)
+			assert.NoError(t, err)
+			uid, err := d.db.User.Query().FirstID(ctx)
+			assert.NoError(t, err)
+			assert.NotEqual(t, gid>>32, uid>>32)
+
+			// the SQL files are applied after the steps in Go, and reverted in the reverse order
+			m := newMigrator(d.db, driver, fstest.MapFS{
+				driver + "/20990101000000_test_table.up.sql": {Data: []byte(
+					"-- generated\nCREATE TABLE test_migrator (\n  id INTEGER NOT NULL\n);\n" +
+						"INSERT INTO test_migrator (id) VALUES (1);\n")},
+				driver + "/20990101000000_test_table.down.sql": {Data: []byte("DROP TABLE test_migrator;\n")},
+				driver + "/README.md":                          {Data: []byte("ignored")},
+			}, params, logger)
+			pending, err = m.Pending(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"20990101000000"}, pending)
+
+			n, err := m.Up(ctx, 0)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, n)
+			n, err = m.Up(ctx, 0)
+			assert.NoError(t, err)
+			assert.Zero(t, n)
+			_, err = d.db.ExecContext(ctx, "SELECT id FROM test_migrator")
+			assert.NoError(t, err)
+
+			// the migrations applied by a newer release are listed
+			states, err := NewMigrator(d.db, driver, params, logger).Status(ctx)
+			assert.NoError(t, err)
+			last := states[len(states)-1]
+			assert.Equal(t, "20990101000000", last.Version)
+			assert.True(t, last.Unknown)
+			assert.NotNil(t, last.AppliedAt)
+
+			n, err = m.Down(ctx, 1)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, n)
+			_, err = d.db.ExecContext(ctx, "SELECT id FROM test_migrator")
+			assert.Error(t, err)
+
+			// the migrations unknown to the migrator are not reverted by it
+			n, err = m.Down(ctx, 1)
+			assert.Error(t, err)
+			assert.Zero(t, n)
+
+			// the SQL files of the release are reversible, and the data steps are not
+			m0 := NewMigrator(d.db, driver, params, logger)
+			n, err = m0.Down(ctx, 2)
+			assert.Error(t, err)
+			assert.Equal(t, 1, n)
+			n, err = m0.Up(ctx, 0)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, n)
+
+			// the instances wait for the holder of the lock
+			m1 := NewMigrator(d.db, driver, params, logger)
+			m2 := NewMigrator(d.db, driver, params, logger)
+			unlock, err := m1.lock(ctx)
+			assert.NoError(t, err)
+			timeout, cancel := context.WithTimeout(ctx, 1500*time.Millisecond)
+			_, err = m2.Up(timeout, 0)
+			cancel()
+			assert.Error(t, err)
+			unlock()
+			unlock, err = m2.lock(ctx)
+			assert.NoError(t, err)
+			unlock()
+
+			// the lock of a crashed migrator is taken over once expired
+			_, err = d.db.ExecContext(ctx,
+				rebind(driver, "INSERT INTO "+migrationLockTable+" (id, owner, expire_at) VALUES (1, ?, ?)"),
+				"crashed", time.Now().Add(-time.Second).UnixMilli())
+			assert.NoError(t, err)
+			unlock, err = m1.lock(ctx)
+			assert.NoError(t, err)
+			unlock()
+
+			// the installations seeded before the versioned migrations are not seeded again
+			for _, s := range m.goMigrations() {
+				if s.Data {
+					_, err = d.db.ExecContext(ctx, rebind(driver, "DELETE FROM "+migrationTable+" WHERE version = ?"), s.Version)
+					assert.NoError(t, err)
+				}
+			}
+			assert.NoError(t, d.db.Setting.Create().
+				SetName("migration").SetValue("true").SetType(setting.TypeBasic).
+				Exec(ctx))
+			n, err = m1.Up(ctx, 0)
+			assert.NoError(t, err)
+			assert.Equal(t, 3, n)
+			count, err := d.db.Group.Query().Where(group.NameEQ("Admin")).Count(ctx)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, count)
+			ok, err := d.db.Setting.Query().Where(setting.NameEQ("migration")).Exist(ctx)
+			assert.NoError(t, err)
+			assert.False(t, ok)
+
+			// the storage of users is converted to the storage added to the quota of the group
+			userGroup, err := d.db.Group.Query().Where(group.NameEQ("User")).Only(ctx)
+			assert.NoError(t, err)
+			var storages []uint64
+			for i, storage := range []uint64{userGroup.MaxStorage, 3 * userGroup.MaxStorage} {
+				u, cErr := d.db.User.Create().
+					SetEmail("test-migrate-" + strconv.Itoa(i) + "@pallas.icu").
+					SetNickName("test-migrate").
+					SetSalt([]byte("salt")).
+					SetVerifier([]byte("verifier")).
+					SetStorage(storage).
+					SetOwnerGroup(userGroup).
+					Save(ctx)
+				assert.NoError(t, cErr)
+				assert.NoError(t, migrateStorage(ctx, d.db))
+				u, cErr = d.db.User.Get(ctx, u.ID)
+				assert.NoError(t, cErr)
+				storages = append(storages, u.Storage)
+			}
+			assert.Equal(t, []uint64{0, 2 * userGroup.MaxStorage}, storages)
+
+			// the baseline upgrades the schema existing, up to date here, see TestMigratorAutoMigrated
+			_, err = d.db.ExecContext(ctx, rebind(driver, "DELETE FROM "+migrationTable+" WHERE version = ?"), baselineVersion)
+			assert.NoError(t, err)
+			n, err = m1.Up(ctx, 0)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, n)
+			pending, err = m1.Pending(ctx)
+			assert.NoError(t, err)
+			assert.Empty(t, pending)
+
+			flushTestData(t, d)
+		})
+	}
+}
+
+func TestRebind(t *testing.T) {
+	query := "UPDATE t SET a = ? WHERE id = ? AND b = ?"
+	assert.Equal(t, query, rebind("mysql", query))
+	assert.Equal(t, "UPDATE t SET a = $1 WHERE id = $2 AND b = $3", rebind("postgres", query))
+}
+
+// the schema auto migrated by the release before the versioned migrations, of sqlite3
+var autoMigratedSchema = []string{
+	"CREATE TABLE `groups` (`id` integer NOT NULL PRIMARY KEY AUTOINCREMENT, `created_at` datetime NOT NULL, " +
+		"`updated_at` datetime NOT NULL, `name` text NOT NULL, `max_storage` integer NOT NULL, " +
+		"`share_enabled` bool NOT NULL, `speed_limit` integer NOT NULL)",
+	"CREATE UNIQUE INDEX `groups_name_key` ON `groups` (`name`)",
+	"CREATE INDEX `group_name` ON `groups` (`name`)",
+	"CREATE TABLE `settings` (`id` integer NOT NULL PRIMARY KEY AUTOINCREMENT, `created_at` datetime NOT NULL, " +
+		"`updated_at` datetime NOT NULL, `name` text NOT NULL, `value` text NOT NULL, `type` text NOT NULL)",
+	"INSERT INTO sqlite_sequence (name, seq) VALUES ('settings', 4294967296)",
+	"CREATE UNIQUE INDEX `settings_name_key` ON `settings` (`name`)",
+	"CREATE TABLE `users` (`id` integer NOT NULL PRIMARY KEY AUTOINCREMENT, `created_at` datetime NOT NULL, " +
+		"`updated_at` datetime NOT NULL, `email` text NOT NULL, `nick_name` text NOT NULL, `salt` blob NOT NULL, " +
+		"`verifier` blob NOT NULL, `storage` integer NOT NULL, `score` integer NOT NULL DEFAULT 0, " +
+		"`status` text NOT NULL DEFAULT 'non_activated', `group_id` integer NOT NULL, " +
+		"CONSTRAINT `users_groups_users` FOREIGN KEY (`group_id`) REFERENCES `groups` (`id`) ON DELETE NO ACTION)",
+	"INSERT INTO sqlite_sequence (name, seq) VALUES ('users', 8589934592)",
+	"CREATE UNIQUE INDEX `users_email_key` ON `users` (`email`)",
+	"CREATE UNIQUE INDEX `user_email` ON `users` (`email`)",
+	"CREATE INDEX `user_group_id` ON `users` (`group_id`)",
+	"CREATE TABLE `ent_types` (`id` integer NOT NULL PRIMARY KEY AUTOINCREMENT, `type` text NOT NULL)",
+	"CREATE UNIQUE INDEX `ent_types_type_key` ON `ent_types` (`type`)",
+	"INSERT INTO `ent_types` (`type`) VALUES ('groups'), ('settings'), ('users')",
+}
+
+func TestMigratorAutoMigrated(t *testing.T) {
+	logger := log.With(log.NewStdLogger(io.Discard))
+	params, err := srp.GetParams(2048)
+	assert.NoError(t, err)
+	ctx := context.TODO()
+
+	// a database of its own, the databases of the other tests are migrated already
+	client := NewEntClient(&conf.Data{Database: &conf.Data_Database{
+		Driver: "sqlite3",
+		Source: "file:ent_auto_migrated?mode=memory&cache=shared&_fk=1",
+	}}, logger)
+	defer func() { _ = client.Close() }()
+	for _, stmt := range autoMigratedSchema {
+		_, err = client.ExecContext(ctx, stmt)
+		assert.NoError(t, err)
+	}
+	// seeded by the release as well
+	_, err = client.ExecContext(ctx, "INSERT INTO `groups` (`created_at`, `updated_at`, `name`, `max_storage`, "+
+		"`share_enabled`, `speed_limit`) VALUES (?, ?, 'Admin', ?, true, 0), (?, ?, 'User', ?, true, 0), "+
+		"(?, ?, 'Anonymous', 0, false, 0)",
+		time.Now(), time.Now(), utils.GibiByte, time.Now(), time.Now(), utils.GibiByte, time.Now(), time.Now())
+	assert.NoError(t, err)
+	_, err = client.ExecContext(ctx, "INSERT INTO `users` (`created_at`, `updated_at`, `email`, `nick_name`, "+
+		"`salt`, `verifier`, `storage`, `status`, `group_id`) VALUES (?, ?, 'admin@pallas.icu', 'admin', "+
+		"'salt', 'verifier', ?, 'active', (SELECT `id` FROM `groups` WHERE `name` = 'Admin'))",
+		time.Now(), time.Now(), utils.GibiByte)
+	assert.NoError(t, err)
+	_, err = client.ExecContext(ctx, "INSERT INTO `settings` (`created_at`, `updated_at`, `name`, `value`, `type`) "+
+		"VALUES (?, ?, 'migration', 'true', 'basic')", time.Now(), time.Now())
+	assert.NoError(t, err)
+
+	// the schema is upgraded to the baseline rather than created again
+	m := NewMigrator(client, "sqlite3", params, logger)
+	_, err = m.Up(ctx, 0)
+	assert.NoError(t, err)
+	pending, err := m.Pending(ctx)
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+	file, err := m.Diff(ctx, t.TempDir(), "test")
+	assert.NoError(t, err)
+	assert.Empty(t, file)
+
+	admin, err := client.User.Query().Where(user.EmailEQ("admin@pallas.icu")).Only(ctx)
+	assert.NoError(t, err)
+	assert.Zero(t, admin.Storage)
+	g, err := client.Group.Get(ctx, admin.GroupID)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, toEntPermissions(biz.AllPermissions), g.Permissions)
+	count, err := client.Group.Query().Count(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, count)
+
+	// the types added are allocated in the ranges following the types recorded
+	token, err := client.AccessToken.Create().
+		SetName("test").SetTokenHash("hash").SetScopes([]string{}).SetUserID(admin.ID).
+		Save(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), token.ID>>32)
+}
@@ -0,0 +1,234 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/oauth2"
+
+	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
+	"github.com/hominsu/pallas/app/pallas/service/internal/biz"
+	"github.com/hominsu/pallas/app/pallas/service/internal/conf"
+)
+
+var _ biz.OIDCRepo = (*oidcRepo)(nil)
+
+const (
+	oidcCacheKeyPrefix = "oidc_cache_key_"
+
+	// oidcAuthRequestTTL is how long the user has to complete the authorization on the provider
+	oidcAuthRequestTTL = 10 * time.Minute
+)
+
+var oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+type oidcRepo struct {
+	data      *Data
+	providers map[string]*oidcProvider
+	// names keeps the order of the providers in config
+	names []string
+	log   *log.Helper
+}
+
+// oidcProvider discovers the provider lazily, so that an unavailable provider does not stop the server
+type oidcProvider struct {
+	conf *conf.Auth_OIDC
+
+	mu       sync.Mutex
+	oauth2   *oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// NewOIDCRepo .
+func NewOIDCRepo(auth *conf.Auth, data *Data, logger log.Logger) biz.OIDCRepo {
+	helper := log.NewHelper(log.With(logger, "module", "data/oidc"))
+
+	r := &oidcRepo{
+		data:      data,
+		providers: make(map[string]*oidcProvider),
+		log:       helper,
+	}
+	for _, c := range auth.GetOidc() {
+		if _, ok := r.providers[c.GetName()]; ok {
+			helper.Fatalf("duplicate oidc provider: %s", c.GetName())
+		}
+		r.providers[c.GetName()] = &oidcProvider{conf: c}
+		r.names = append(r.names, c.GetName())
+	}
+	return r
+}
+
+func (r *oidcRepo) ListProviders(_ context.Context) []*biz.OIDCProvider {
+	res := make([]*biz.OIDCProvider, len(r.names))
+	for i, name := range r.names {
+		res[i] = toOIDCProvider(r.providers[name].conf)
+	}
+	return res
+}
+
+func (r *oidcRepo) GetProvider(_ context.Context, name string) (*biz.OIDCProvider, error) {
+	p, ok := r.providers[name]
+	if !ok {
+		return nil, v1.ErrorNotFound("oidc provider not found: %s", name)
+	}
+	return toOIDCProvider(p.conf), nil
+}
+
+func (r *oidcRepo) AuthCodeURL(ctx context.Context, req *biz.OIDCAuthRequest) (string, error) {
+	p, err := r.discover(ctx, req.Provider)
+	if err != nil {
+		return "", err
+	}
+
+	// PKCE, see https://www.rfc-editor.org/rfc/rfc7636#section-4.2
+	challenge := sha256.Sum256([]byte(req.CodeVerifier))
+	return p.oauth2.AuthCodeURL(
+		req.State,
+		oidc.Nonce(req.Nonce),
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	), nil
+}
+
+func (r *oidcRepo) Exchange(ctx context.Context, req *biz.OIDCAuthRequest, code string) (*biz.OIDCClaims, error) {
+	p, err := r.discover(ctx, req.Provider)
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := p.oauth2.Exchange(ctx, code, oauth2.SetAuthURLParam("code_verifier", req.CodeVerifier))
+	if err != nil {
+		return nil, v1.ErrorOidcOperation("exchange code error: %v", err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, v1.ErrorOidcOperation("missing id token")
+	}
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, v1.ErrorOidcOperation("verify id token error: %v", err)
+	}
+	if idToken.Nonce != req.Nonce {
+		return nil, v1.ErrorOidcOperation("nonce mismatch")
+	}
+
+	claims := make(map[string]any)
+	if err = idToken.Claims(&claims); err != nil {
+		return nil, v1.ErrorOidcOperation("decode claims error: %v", err)
+	}
+	return mapOIDCClaims(p.conf.GetClaims(), idToken.Subject, claims), nil
+}
+
+func (r *oidcRepo) SaveAuthRequest(ctx context.Context, req *biz.OIDCAuthRequest) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return v1.ErrorInternal("marshal auth request error: %v", err)
+	}
+	// key: oidc_cache_key_auth_request:state
+	if err = r.data.kv.Set(ctx, r.cacheKey(req.State, "auth", "request"), string(b), oidcAuthRequestTTL); err != nil {
+		return v1.ErrorCacheOperation("cache auth request error: %v", err)
+	}
+	return nil
+}
+
+func (r *oidcRepo) TakeAuthRequest(ctx context.Context, state string) (*biz.OIDCAuthRequest, error) {
+	// key: oidc_cache_key_auth_request:state
+	b, err := r.data.kv.GetDel(ctx, r.cacheKey(state, "auth", "request"))
+	switch {
+	case errors.Is(err, redis.Nil):
+		return nil, v1.ErrorOidcOperation("auth request expired or not found")
+	case err != nil:
+		return nil, v1.ErrorCacheOperation("get auth request error: %v", err)
+	}
+
+	req := &biz.OIDCAuthRequest{}
+	if err = json.Unmarshal([]byte(b), req); err != nil {
+		return nil, v1.ErrorInternal("unmarshal auth request error: %v", err)
+	}
+	return req, nil
+}
+
+// discover fetch the discovery document of provider on the first use, and retry on the next use if failed
+func (r *oidcRepo) discover(_ context.Context, name string) (*oidcProvider, error) {
+	p, ok := r.providers[name]
+	if !ok {
+		return nil, v1.ErrorNotFound("oidc provider not found: %s", name)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.oauth2 != nil {
+		return p, nil
+	}
+
+	issuer := strings.TrimSuffix(p.conf.GetDiscoveryUrl(), "/.well-known/openid-configuration")
+	// the context is kept by the remote key set for fetching keys later, so it must not be canceled
+	provider, err := oidc.NewProvider(oidc.ClientContext(context.Background(), oidcHTTPClient), issuer)
+	if err != nil {
+		r.log.Errorf("discover oidc provider %s error: %v", name, err)
+		return nil, v1.ErrorOidcOperation("oidc provider unavailable: %s", name)
+	}
+
+	scopes := p.conf.GetScopes()
+	if len(scopes) == 0 {
+		scopes = []string{oidc.ScopeOpenID, "email", "profile"}
+	}
+	p.oauth2 = &oauth2.Config{
+		ClientID:     p.conf.GetClientId(),
+		ClientSecret: p.conf.GetClientSecret(),
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  p.conf.GetRedirectUrl(),
+		Scopes:       scopes,
+	}
+	p.verifier = provider.Verifier(&oidc.Config{ClientID: p.conf.GetClientId()})
+	return p, nil
+}
+
+func (r *oidcRepo) cacheKey(unique string, a ...string) string {
+	s := strings.Join(a, "_")
+	return oidcCacheKeyPrefix + s + ":" + unique
+}
+
+// mapOIDCClaims maps the claims by the claim names in config
+func mapOIDCClaims(c *conf.Auth_OIDC_Claims, subject string, claims map[string]any) *biz.OIDCClaims {
+	name := func(v, def string) string {
+		if v == "" {
+			return def
+		}
+		return v
+	}
+
+	res := &biz.OIDCClaims{Subject: subject}
+	res.Email, _ = claims[name(c.GetEmail(), "email")].(string)
+	res.NickName, _ = claims[name(c.GetNickName(), "name")].(string)
+	switch v := claims[name(c.GetEmailVerified(), "email_verified")].(type) {
+	case bool:
+		res.EmailVerified = v
+	case string: // some providers return the flag as string
+		res.EmailVerified = v == "true"
+	}
+	return res
+}
+
+func toOIDCProvider(c *conf.Auth_OIDC) *biz.OIDCProvider {
+	displayName := c.GetDisplayName()
+	if displayName == "" {
+		displayName = c.GetName()
+	}
+	return &biz.OIDCProvider{
+		Name:          c.GetName(),
+		DisplayName:   displayName,
+		AutoProvision: c.GetAutoProvision(),
+		LinkByEmail:   c.GetLinkByEmail(),
+	}
+}
@@ -0,0 +1,276 @@
+package data
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/stretchr/testify/assert"
+
+	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
+	"github.com/hominsu/pallas/app/pallas/service/internal/biz"
+	"github.com/hominsu/pallas/app/pallas/service/internal/conf"
+	"github.com/hominsu/pallas/pkg/srp"
+)
+
+const testOIDCClientId = "pallas"
+
+// mockOIDCServer is an in-process OpenID Connect provider, which issues a code for the claims of the next
+// authorization, and checks the PKCE verifier on redeeming the code
+type mockOIDCServer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu     sync.Mutex
+	claims map[string]any
+	codes  map[string]mockOIDCGrant
+}
+
+type mockOIDCGrant struct {
+	challenge string
+	nonce     string
+	claims    map[string]any
+}
+
+func newMockOIDCServer(t *testing.T) *mockOIDCServer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+
+	s := &mockOIDCServer{key: key, codes: make(map[string]mockOIDCGrant)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{
+			"issuer":                                s.URL,
+			"authorization_endpoint":                s.URL + "/authorize",
+			"token_endpoint":                        s.URL + "/token",
+			"jwks_uri":                              s.URL + "/jwks",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{"keys": []map[string]any{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": "test",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		grant, ok := s.codes[r.PostForm.Get("code")]
+		delete(s.codes, r.PostForm.Get("code"))
+		s.mu.Unlock()
+
+		sum := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != grant.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			writeJSON(w, map[string]any{"error": "invalid_grant"})
+			return
+		}
+
+		claims := map[string]any{
+			"iss":   s.URL,
+			"aud":   testOIDCClientId,
+			"iat":   time.Now().Unix(),
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nonce": grant.nonce,
+		}
+		for k, v := range grant.claims {
+			claims[k] = v
+		}
+		writeJSON(w, map[string]any{
+			"access_token": "access-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     s.sign(t, claims),
+		})
+	})
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// authorize simulates the user agent approving on the authorization endpoint, and returns the code
+func (s *mockOIDCServer) authorize(t *testing.T, authURL string, claims map[string]any) (state, code string) {
+	u, err := url.Parse(authURL)
+	assert.NoError(t, err)
+	q := u.Query()
+	assert.Equal(t, s.URL+"/authorize", u.Scheme+"://"+u.Host+u.Path)
+	assert.Equal(t, "S256", q.Get("code_challenge_method"))
+	assert.Equal(t, testOIDCClientId, q.Get("client_id"))
+
+	code = q.Get("state") + "-code"
+	s.mu.Lock()
+	s.codes[code] = mockOIDCGrant{challenge: q.Get("code_challenge"), nonce: q.Get("nonce"), claims: claims}
+	s.mu.Unlock()
+	return q.Get("state"), code
+}
+
+func (s *mockOIDCServer) sign(t *testing.T, claims map[string]any) string {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "kid": "test", "typ": "JWT"})
+	assert.NoError(t, err)
+	payload, err := json.Marshal(claims)
+	assert.NoError(t, err)
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, sum[:])
+	assert.NoError(t, err)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func TestOIDCUsecase_Signin(t *testing.T) {
+	mock := newMockOIDCServer(t)
+	defer mock.Close()
+
+	auth := &conf.Auth{Oidc: []*conf.Auth_OIDC{
+		{
+			Name:          "mock",
+			DiscoveryUrl:  mock.URL + "/.well-known/openid-configuration",
+			ClientId:      testOIDCClientId,
+			ClientSecret:  "secret",
+			RedirectUrl:   "http://localhost/signin/oidc/mock",
+			Claims:        &conf.Auth_OIDC_Claims{NickName: "preferred_username"},
+			AutoProvision: true,
+			LinkByEmail:   true,
+		},
+		{
+			Name:         "closed",
+			DiscoveryUrl: mock.URL,
+			ClientId:     testOIDCClientId,
+		},
+	}}
+
+	params, err := srp.GetParams(2048)
+	assert.NoError(t, err)
+	logger := log.With(log.NewStdLogger(io.Discard))
+
+	cs := newTestDataConf()
+	for _, c := range cs {
+		d, cleanup := newTestData(t, c)
+		uc := biz.NewOIDCUsecase(
+			NewIdentityRepo(d, logger),
+			NewOIDCRepo(auth, d, logger),
+			NewUserRepo(d, logger),
+			NewGroupRepo(d, logger),
+			NewSettingRepo(d, logger),
+			params,
+			logger,
+		)
+
+		t.Run(testName(c), func(t *testing.T) {
+			defer cleanup()
+			ctx := context.TODO()
+
+			signin := func(provider string, linkUserId int64, claims map[string]any) (*biz.User, error) {
+				authURL, binding, bErr := uc.BeginAuth(ctx, provider, linkUserId)
+				assert.NoError(t, bErr)
+				state, code := mock.authorize(t, authURL, claims)
+				return uc.Signin(ctx, provider, state, code, binding, linkUserId)
+			}
+
+			// auto provision
+			provisioned, err := signin("mock", 0, map[string]any{
+				"sub": "sub-1", "email": "oidc-1@pallas.icu", "email_verified": true, "preferred_username": "oidc",
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, "oidc-1@pallas.icu", provisioned.Email)
+			assert.Equal(t, "oidc", provisioned.NickName)
+			assert.Equal(t, biz.StatusActive, provisioned.Status)
+
+			// the linked identity signs in to the same user
+			res, err := signin("mock", 0, map[string]any{"sub": "sub-1", "email": "changed@pallas.icu"})
+			assert.NoError(t, err)
+			assert.Equal(t, provisioned.Id, res.Id)
+
+			// link by verified email
+			admin, err := NewUserRepo(d, logger).GetByEmail(ctx, "admin@pallas.icu", biz.UserViewBasic)
+			assert.NoError(t, err)
+			res, err = signin("mock", 0, map[string]any{
+				"sub": "sub-admin", "email": "admin@pallas.icu", "email_verified": true,
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, admin.Id, res.Id)
+
+			// an unverified email is not linked, and the provisioning conflicts with the existing user
+			_, err = signin("mock", 0, map[string]any{"sub": "sub-2", "email": "admin@pallas.icu"})
+			assert.True(t, v1.IsEmailExisted(err))
+
+			// link to the signed-in user
+			res, err = signin("closed", provisioned.Id, map[string]any{"sub": "sub-3"})
+			assert.NoError(t, err)
+			assert.Equal(t, provisioned.Id, res.Id)
+			identities, err := uc.ListIdentities(ctx, provisioned.Id)
+			assert.NoError(t, err)
+			assert.Len(t, identities, 2)
+
+			// an identity cannot be linked to another user, and a user has one identity of each provider
+			_, err = signin("closed", admin.Id, map[string]any{"sub": "sub-3"})
+			assert.True(t, v1.IsConflict(err))
+			_, err = signin("mock", provisioned.Id, map[string]any{"sub": "sub-5"})
+			assert.True(t, v1.IsConflict(err))
+
+			// no provisioning or email linking on provider without them
+			_, err = signin("closed", 0, map[string]any{
+				"sub": "sub-4", "email": "admin@pallas.icu", "email_verified": true,
+			})
+			assert.True(t, v1.IsOidcOperation(err))
+
+			// the state can only be used once, and the code requires the PKCE verifier
+			authURL, binding, err := uc.BeginAuth(ctx, "mock", 0)
+			assert.NoError(t, err)
+			state, code := mock.authorize(t, authURL, map[string]any{"sub": "sub-1"})
+			_, err = uc.Signin(ctx, "mock", state, code, binding, 0)
+			assert.NoError(t, err)
+			_, err = uc.Signin(ctx, "mock", state, code, binding, 0)
+			assert.True(t, v1.IsOidcOperation(err))
+
+			// the flow is completed by the user agent started it only
+			authURL, _, err = uc.BeginAuth(ctx, "mock", 0)
+			assert.NoError(t, err)
+			state, code = mock.authorize(t, authURL, map[string]any{"sub": "sub-1"})
+			_, err = uc.Signin(ctx, "mock", state, code, "", 0)
+			assert.True(t, v1.IsOidcOperation(err))
+
+			// the identity is linked in the session of the linking user only
+			authURL, binding, err = uc.BeginAuth(ctx, "closed", admin.Id)
+			assert.NoError(t, err)
+			state, code = mock.authorize(t, authURL, map[string]any{"sub": "sub-6"})
+			_, err = uc.Signin(ctx, "closed", state, code, binding, provisioned.Id)
+			assert.True(t, v1.IsOidcOperation(err))
+
+			// unknown provider
+			_, _, err = uc.BeginAuth(ctx, "unknown", 0)
+			assert.True(t, v1.IsNotFound(err))
+
+			// unlink
+			assert.NoError(t, uc.UnlinkIdentity(ctx, provisioned.Id, "mock"))
+			assert.True(t, v1.IsNotFound(uc.UnlinkIdentity(ctx, provisioned.Id, "mock")))
+
+			flushTestData(t, d)
+		})
+	}
+}
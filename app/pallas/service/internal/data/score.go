@@ -0,0 +1,227 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"entgo.io/ent/dialect/sql/sqlgraph"
+	"github.com/go-kratos/kratos/v2/log"
+
+	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
+	"github.com/hominsu/pallas/app/pallas/service/internal/biz"
+	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent"
+	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent/scoretransaction"
+	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent/user"
+	"github.com/hominsu/pallas/pkg/pagination"
+)
+
+var _ biz.ScoreRepo = (*scoreRepo)(nil)
+
+type scoreRepo struct {
+	data *Data
+	// users invalidates the cache of the users changed by the transactions
+	users *userRepo
+	log   *log.Helper
+}
+
+// NewScoreRepo .
+func NewScoreRepo(data *Data, logger log.Logger) biz.ScoreRepo {
+	return &scoreRepo{
+		data:  data,
+		users: NewUserRepo(data, logger).(*userRepo),
+		log:   log.NewHelper(log.With(logger, "module", "data/score")),
+	}
+}
+
+func (r *scoreRepo) Apply(
+	ctx context.Context,
+	t *biz.ScoreTransaction,
+	effect *biz.ScoreEffect,
+) (*biz.ScoreTransaction, error) {
+	tx, err := r.data.db.Tx(ctx)
+	if err != nil {
+		return nil, v1.ErrorInternal("create transactional client error: %v", err)
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			if rErr := tx.Rollback(); rErr != nil {
+				r.log.Warnf("rollback failed, err: %v", rErr)
+			}
+			panic(v)
+		}
+	}()
+
+	res, u, err := r.apply(ctx, tx, t, effect)
+	if err != nil {
+		if rErr := tx.Rollback(); rErr != nil {
+			return nil, v1.ErrorInternal("rollback failed, err: %v",
+				fmt.Errorf("%w: rolling back transaction: %v", err, rErr))
+		}
+		return nil, err
+	}
+	if cErr := tx.Commit(); cErr != nil {
+		return nil, v1.ErrorInternal("failed commits the transaction, err: %v", cErr)
+	}
+
+	r.users.invalidateCache(ctx, u.ID, u.Email)
+	if effect != nil && effect.Group != nil {
+		r.users.invalidateMembers(ctx, effect.Group.BaseGroupId, effect.Group.GroupId)
+	}
+	return toScoreTransaction(res), nil
+}
+
+func (r *scoreRepo) apply(
+	ctx context.Context,
+	tx *ent.Tx,
+	t *biz.ScoreTransaction,
+	effect *biz.ScoreEffect,
+) (*ent.ScoreTransaction, *ent.User, error) {
+	// the conditional update keeps the score non-negative without locking the user
+	m := tx.User.Update().
+		Where(user.ID(t.UserId), user.ScoreGTE(-t.Amount)).
+		AddScore(t.Amount)
+	if effect != nil {
+		if effect.Storage > 0 {
+			m.AddStorage(int64(effect.Storage))
+		}
+		if g := effect.Group; g != nil {
+			m.SetGroupID(g.GroupId)
+			m.SetBaseGroupID(g.BaseGroupId)
+			m.SetGroupExpireAt(g.ExpireAt)
+		}
+	}
+	n, err := m.Save(ctx)
+	if err != nil {
+		return nil, nil, v1.ErrorUnknown("unknown error: %v", err)
+	}
+	if n == 0 {
+		ok, eErr := tx.User.Query().Where(user.ID(t.UserId)).Exist(ctx)
+		switch {
+		case eErr != nil:
+			return nil, nil, v1.ErrorUnknown("unknown error: %v", eErr)
+		case !ok:
+			return nil, nil, v1.ErrorNotFound("user not found")
+		default:
+			return nil, nil, v1.ErrorScoreInsufficient("score insufficient")
+		}
+	}
+
+	u, err := tx.User.Get(ctx, t.UserId)
+	if err != nil {
+		return nil, nil, v1.ErrorUnknown("unknown error: %v", err)
+	}
+
+	c := tx.ScoreTransaction.Create().
+		SetUserID(t.UserId).
+		SetAmount(t.Amount).
+		SetBalance(u.Score).
+		SetReason(scoretransaction.Reason(t.Reason)).
+		SetNote(t.Note).
+		SetNillableOperatorID(t.OperatorId).
+		SetNillableIdempotencyKey(t.IdempotencyKey)
+	res, err := c.Save(ctx)
+	switch {
+	case err == nil:
+		return res, u, nil
+	case sqlgraph.IsUniqueConstraintError(err):
+		return nil, nil, v1.ErrorConflict("score transaction already exists: %v", err)
+	case ent.IsConstraintError(err):
+		return nil, nil, v1.ErrorConflict("invalid argument: %v", err)
+	default:
+		return nil, nil, v1.ErrorUnknown("unknown error: %v", err)
+	}
+}
+
+func (r *scoreRepo) List(
+	ctx context.Context,
+	userId int64,
+	pageSize int,
+	pageToken string,
+) (*biz.ScoreTransactionPage, error) {
+	// the latest first
+	listQuery := r.data.db.ScoreTransaction.Query().
+		Where(scoretransaction.UserID(userId)).
+		Order(ent.Desc(scoretransaction.FieldID)).
+		Limit(pageSize + 1)
+	if pageToken != "" {
+		token, pErr := pagination.DecodePageToken(pageToken)
+		if pErr != nil {
+			return nil, v1.ErrorInternal("decode page token err: %v", pErr)
+		}
+		listQuery = listQuery.Where(scoretransaction.IDLTE(token))
+	}
+
+	entList, err := listQuery.All(ctx)
+	if err != nil {
+		return nil, v1.ErrorUnknown("unknown error: %v", err)
+	}
+
+	// generate next page token
+	var nextPageToken string
+	if len(entList) == pageSize+1 {
+		nextPageToken, err = pagination.EncodePageToken(entList[len(entList)-1].ID)
+		if err != nil {
+			return nil, v1.ErrorInternal("encode page token error: %v", err)
+		}
+		entList = entList[:len(entList)-1]
+	}
+
+	return &biz.ScoreTransactionPage{
+		Transactions:  toScoreTransactionList(entList),
+		NextPageToken: nextPageToken,
+	}, nil
+}
+
+func (r *scoreRepo) ExpireGroupUpgrades(ctx context.Context, t time.Time) (int, error) {
+	expired, err := r.data.db.User.Query().
+		Where(user.GroupExpireAtLTE(t), user.BaseGroupIDNotNil()).
+		All(ctx)
+	if err != nil {
+		return 0, v1.ErrorUnknown("unknown error: %v", err)
+	}
+
+	count := 0
+	for _, u := range expired {
+		// the upgrade may be extended in the meantime
+		n, uErr := r.data.db.User.Update().
+			Where(user.ID(u.ID), user.GroupExpireAtLTE(t)).
+			SetGroupID(*u.BaseGroupID).
+			ClearBaseGroupID().
+			ClearGroupExpireAt().
+			Save(ctx)
+		if uErr != nil {
+			// the others expire regardless of the user failed
+			r.log.Errorf("failed expiring the group upgrade of user %d: %v", u.ID, uErr)
+			continue
+		}
+		if n > 0 {
+			r.users.invalidateCache(ctx, u.ID, u.Email)
+			r.users.invalidateMembers(ctx, u.GroupID, *u.BaseGroupID)
+			count++
+		}
+	}
+	return count, nil
+}
+
+func toScoreTransaction(e *ent.ScoreTransaction) *biz.ScoreTransaction {
+	return &biz.ScoreTransaction{
+		Id:             e.ID,
+		UserId:         e.UserID,
+		Amount:         e.Amount,
+		Balance:        e.Balance,
+		Reason:         biz.ScoreReason(e.Reason),
+		Note:           e.Note,
+		OperatorId:     e.OperatorID,
+		IdempotencyKey: e.IdempotencyKey,
+		CreateAt:       e.CreatedAt,
+	}
+}
+
+func toScoreTransactionList(e []*ent.ScoreTransaction) []*biz.ScoreTransaction {
+	list := make([]*biz.ScoreTransaction, len(e))
+	for i, entEntity := range e {
+		list[i] = toScoreTransaction(entEntity)
+	}
+	return list
+}
@@ -0,0 +1,137 @@
+package data
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/stretchr/testify/assert"
+
+	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
+	"github.com/hominsu/pallas/app/pallas/service/internal/biz"
+	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent/group"
+	"github.com/hominsu/pallas/pkg/srp"
+	"github.com/hominsu/pallas/pkg/utils"
+)
+
+func TestScoreUsecase(t *testing.T) {
+	logger := log.With(log.NewStdLogger(io.Discard))
+
+	cs := newTestDataConf()
+	for _, c := range cs {
+		d, cleanup := newTestData(t, c)
+		ur := NewUserRepo(d, logger)
+		scr := NewScoreRepo(d, logger)
+		uc := biz.NewScoreUsecase(scr, ur, NewGroupRepo(d, logger), NewSettingRepo(d, logger), logger)
+
+		t.Run(testName(c), func(t *testing.T) {
+			defer cleanup()
+			ctx := context.TODO()
+
+			params, err := srp.GetParams(2048)
+			assert.NoError(t, err)
+			baseGroup, err := d.db.Group.Query().Where(group.NameEQ("Anonymous")).Only(ctx)
+			assert.NoError(t, err)
+			upgradeGroup, err := d.db.Group.Query().Where(group.NameEQ("User")).Only(ctx)
+			assert.NoError(t, err)
+
+			email := "test-score@pallas.icu"
+			salt := []byte(utils.RandString(20, utils.AllCharSet))
+			password := []byte(utils.RandString(20, utils.AllCharSet))
+			u, err := ur.Create(ctx, &biz.User{
+				Email:      email,
+				NickName:   "test-score",
+				Salt:       salt,
+				Verifier:   srp.ComputeVerifier(params, salt, []byte(email), password),
+				Storage:    utils.GibiByte,
+				Status:     biz.StatusActive,
+				OwnerGroup: &biz.Group{Id: baseGroup.ID},
+			})
+			assert.NoError(t, err)
+			admin, err := ur.GetByEmail(ctx, "admin@pallas.icu", biz.UserViewBasic)
+			assert.NoError(t, err)
+
+			// check in once a day
+			res, err := uc.Checkin(ctx, u.Id)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(10), res.Amount)
+			assert.Equal(t, int64(10), res.Balance)
+			_, err = uc.Checkin(ctx, u.Id)
+			assert.True(t, v1.IsConflict(err))
+
+			// the score can not be negative
+			_, err = uc.RedeemStorage(ctx, u.Id, 1)
+			assert.True(t, v1.IsScoreInsufficient(err))
+			_, err = uc.Grant(ctx, admin.Id, u.Id, -100, "")
+			assert.True(t, v1.IsScoreInsufficient(err))
+
+			res, err = uc.Grant(ctx, admin.Id, u.Id, 490, "welcome")
+			assert.NoError(t, err)
+			assert.Equal(t, int64(500), res.Balance)
+			assert.Equal(t, admin.Id, *res.OperatorId)
+
+			res, err = uc.RedeemStorage(ctx, u.Id, 2)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(-200), res.Amount)
+			assert.Equal(t, int64(300), res.Balance)
+			got, err := ur.Get(ctx, u.Id, biz.UserViewBasic)
+			assert.NoError(t, err)
+			assert.Equal(t, 3*utils.GibiByte, got.Storage)
+			assert.Equal(t, int64(300), got.Score)
+
+			// the group upgrade is extended by redeeming again
+			_, err = uc.RedeemGroup(ctx, u.Id, 1)
+			assert.NoError(t, err)
+			_, err = uc.RedeemGroup(ctx, u.Id, 2)
+			assert.NoError(t, err)
+			got, err = ur.Get(ctx, u.Id, biz.UserViewBasic)
+			assert.NoError(t, err)
+			assert.Equal(t, upgradeGroup.ID, got.GroupId)
+			assert.Equal(t, baseGroup.ID, *got.BaseGroupId)
+			assert.WithinDuration(t, time.Now().Add(72*time.Hour), *got.GroupExpireAt, time.Minute)
+			assert.Equal(t, int64(150), got.Score)
+
+			_, err = uc.RedeemGroup(ctx, admin.Id, 1)
+			assert.True(t, v1.IsInvalidArgument(err))
+
+			// the upgrades expire into the base group, which can not be deleted
+			err = NewGroupRepo(d, logger).Delete(ctx, baseGroup.ID)
+			assert.True(t, v1.IsBadGroupOperation(err))
+
+			// nothing expired yet
+			n, err := scr.ExpireGroupUpgrades(ctx, time.Now())
+			assert.NoError(t, err)
+			assert.Equal(t, 0, n)
+			n, err = scr.ExpireGroupUpgrades(ctx, time.Now().Add(73*time.Hour))
+			assert.NoError(t, err)
+			assert.Equal(t, 1, n)
+			got, err = ur.Get(ctx, u.Id, biz.UserViewBasic)
+			assert.NoError(t, err)
+			assert.Equal(t, baseGroup.ID, got.GroupId)
+			assert.Nil(t, got.BaseGroupId)
+			assert.Nil(t, got.GroupExpireAt)
+
+			// set the score by a grant of the difference
+			res, err = uc.SetScore(ctx, admin.Id, u.Id, 1000)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(850), res.Amount)
+
+			// the latest first
+			list, token, err := uc.ListTransactions(ctx, u.Id, 4, "")
+			assert.NoError(t, err)
+			assert.Len(t, list, 4)
+			assert.NotEmpty(t, token)
+			assert.Equal(t, v1.ScoreTransaction_GRANT, list[0].Reason)
+			assert.Equal(t, int64(1000), list[0].Balance)
+			list, token, err = uc.ListTransactions(ctx, u.Id, 4, token)
+			assert.NoError(t, err)
+			assert.Len(t, list, 2)
+			assert.Empty(t, token)
+			assert.Equal(t, v1.ScoreTransaction_CHECKIN, list[1].Reason)
+
+			flushTestData(t, d)
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+
+	"github.com/go-kratos/kratos/v2/log"
+
+	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
+	"github.com/hominsu/pallas/app/pallas/service/internal/biz"
+	"github.com/hominsu/pallas/pkg/sessions"
+)
+
+var _ biz.SessionRepo = (*sessionRepo)(nil)
+
+type sessionRepo struct {
+	store sessions.ServerStore
+	log   *log.Helper
+}
+
+// NewSessionRepo .
+func NewSessionRepo(store sessions.ServerStore, logger log.Logger) biz.SessionRepo {
+	return &sessionRepo{
+		store: store,
+		log:   log.NewHelper(log.With(logger, "module", "data/session")),
+	}
+}
+
+func (r *sessionRepo) List(ctx context.Context, userId int64) ([]*biz.Session, error) {
+	tracked, err := r.store.List(ctx, strconv.FormatInt(userId, 10))
+	if err != nil {
+		return nil, v1.ErrorCacheOperation("list sessions error: %v", err)
+	}
+	res := make([]*biz.Session, 0, len(tracked))
+	for _, t := range tracked {
+		s := &biz.Session{}
+		if len(t.Info) > 0 {
+			if err = json.Unmarshal(t.Info, s); err != nil {
+				r.log.Warnf("invalid session info: %v", err)
+			}
+		}
+		s.Id = sessionFingerprint(t.ID)
+		s.ExpireAt = t.ExpireAt
+		res = append(res, s)
+	}
+	return res, nil
+}
+
+func (r *sessionRepo) RevokeAll(ctx context.Context, userId int64) error {
+	if err := r.store.RevokeAll(ctx, strconv.FormatInt(userId, 10)); err != nil {
+		return v1.ErrorCacheOperation("revoke sessions error: %v", err)
+	}
+	return nil
+}
+
+// sessionFingerprint identifies the session without exposing the session id, which is a bearer credential
+func sessionFingerprint(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,113 @@
+package data
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"testing"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/stretchr/testify/assert"
+
+	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
+	"github.com/hominsu/pallas/app/pallas/service/internal/biz"
+	"github.com/hominsu/pallas/app/pallas/service/internal/conf"
+	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent/group"
+	"github.com/hominsu/pallas/pkg/sessions"
+	"github.com/hominsu/pallas/pkg/srp"
+	"github.com/hominsu/pallas/pkg/utils"
+)
+
+func TestUserUsecase_UpdateUserStatus(t *testing.T) {
+	logger := log.With(log.NewStdLogger(io.Discard))
+
+	cs := newTestDataConf()
+	for _, c := range cs {
+		d, cleanup := newTestData(t, c)
+		params, err := srp.GetParams(2048)
+		assert.NoError(t, err)
+		store := NewSessionStore(d.rdCmd, &conf.Secret{Session: &conf.Secret_Session{SessionKey: "test"}}, logger)
+		ur := NewUserRepo(d, logger)
+		uc := biz.NewUserUsecase(
+			ur,
+			NewGroupRepo(d, logger),
+			NewSettingRepo(d, logger),
+			NewSessionRepo(store, logger),
+			params,
+			logger,
+		)
+
+		t.Run(testName(c), func(t *testing.T) {
+			defer cleanup()
+			ctx := context.TODO()
+
+			targetGroup, err := d.db.Group.Query().Where(group.NameEQ("User")).Only(ctx)
+			assert.NoError(t, err)
+
+			email := "test-status@pallas.icu"
+			salt := []byte(utils.RandString(20, utils.AllCharSet))
+			password := []byte(utils.RandString(20, utils.AllCharSet))
+			u, err := ur.Create(ctx, &biz.User{
+				Email:      email,
+				NickName:   "test-status",
+				Salt:       salt,
+				Verifier:   srp.ComputeVerifier(params, salt, []byte(email), password),
+				Status:     biz.StatusActive,
+				OwnerGroup: &biz.Group{Id: targetGroup.ID},
+			})
+			assert.NoError(t, err)
+			admin, err := ur.GetByEmail(ctx, "admin@pallas.icu", biz.UserViewBasic)
+			assert.NoError(t, err)
+
+			track := func(owner int64, id string) {
+				session := sessions.NewSession(store, "pallas-session")
+				session.ID = id
+				assert.NoError(t, store.Persist(ctx, session))
+				assert.NoError(t, store.Track(ctx, strconv.FormatInt(owner, 10), session, nil))
+			}
+			exists := func(owner int64, id string) bool {
+				tracked, err := store.List(ctx, strconv.FormatInt(owner, 10))
+				assert.NoError(t, err)
+				for _, s := range tracked {
+					if s.ID == id {
+						return true
+					}
+				}
+				return false
+			}
+			track(u.Id, "user-a")
+			track(u.Id, "user-b")
+			track(admin.Id, "admin")
+
+			_, err = uc.GetUserSalt(ctx, email)
+			assert.NoError(t, err)
+
+			// the sessions of the banned user are revoked
+			_, err = uc.UpdateUserStatus(ctx, u.Id, biz.StatusBanned)
+			assert.NoError(t, err)
+			assert.False(t, exists(u.Id, "user-a"))
+			assert.False(t, exists(u.Id, "user-b"))
+			assert.True(t, exists(admin.Id, "admin"))
+
+			status, err := uc.GetUserStatus(ctx, u.Id)
+			assert.NoError(t, err)
+			assert.Equal(t, biz.StatusBanned, status)
+			_, err = uc.GetUserSalt(ctx, email)
+			assert.True(t, v1.IsUserBanned(err))
+
+			// the overuse banned user can still sign in
+			_, err = uc.UpdateUserStatus(ctx, u.Id, biz.StatusOveruseBaned)
+			assert.NoError(t, err)
+			_, err = uc.GetUserSalt(ctx, email)
+			assert.NoError(t, err)
+
+			_, err = uc.UpdateUserStatus(ctx, u.Id, biz.StatusNonActivated)
+			assert.NoError(t, err)
+			_, err = uc.GetUserSalt(ctx, email)
+			assert.True(t, v1.IsEmailNotActivated(err))
+
+			assert.NoError(t, uc.DeleteUser(ctx, u.Id))
+			flushTestData(t, d)
+		})
+	}
+}
@@ -2,15 +2,11 @@ package data
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"strconv"
-	"strings"
 
 	"entgo.io/ent/dialect/sql/sqlgraph"
 	"github.com/go-kratos/kratos/v2/log"
-	"github.com/go-redis/cache/v9"
-	"golang.org/x/sync/singleflight"
 
 	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
 	"github.com/hominsu/pallas/app/pallas/service/internal/biz"
@@ -22,33 +18,45 @@ var _ biz.SettingRepo = (*settingRepo)(nil)
 
 const settingCacheKeyPrefix = "setting_cache_key_"
 
+// settingCacheTagAll tags all the entries of settings, the settings are few and written rarely, so a write
+// invalidates them all
+const settingCacheTagAll = "all"
+
 type settingRepo struct {
-	data *Data
-	ck   map[string][]string
-	sg   *singleflight.Group
-	log  *log.Helper
+	data  *Data
+	cache *repoCache
+	// key: setting_cache_key_get_setting_id:settingId@version
+	byId *cacheIndex[*ent.Setting]
+	// key: setting_cache_key_get_setting_name:settingName@version
+	byName *cacheIndex[*ent.Setting]
+	// key: setting_cache_key_list_setting:all@version
+	list *cacheIndex[[]*ent.Setting]
+	// key: setting_cache_key_list_setting_type:settingType@version
+	listByType *cacheIndex[[]*ent.Setting]
+	log        *log.Helper
 }
 
 // NewSettingRepo .
 func NewSettingRepo(data *Data, logger log.Logger) biz.SettingRepo {
-	sr := &settingRepo{
-		data: data,
-		sg:   &singleflight.Group{},
-		log:  log.NewHelper(log.With(logger, "module", "data/setting")),
+	helper := log.NewHelper(log.With(logger, "module", "data/setting"))
+	c := newRepoCache(data, settingCacheKeyPrefix, helper)
+	return &settingRepo{
+		data:       data,
+		cache:      c,
+		byId:       newCacheIndex[*ent.Setting](c, "get_setting_id", true, settingCacheTagAll),
+		byName:     newCacheIndex[*ent.Setting](c, "get_setting_name", true, settingCacheTagAll),
+		list:       newCacheIndex[[]*ent.Setting](c, "list_setting", true, settingCacheTagAll),
+		listByType: newCacheIndex[[]*ent.Setting](c, "list_setting_type", true, settingCacheTagAll),
+		log:        helper,
 	}
-	sr.ck = make(map[string][]string)
-	sr.ck["Get"] = []string{"get", "setting", "id"}
-	sr.ck["GetByName"] = []string{"get", "setting", "name"}
-	sr.ck["List"] = []string{"list", "group"}
-	sr.ck["ListByType"] = []string{"list", "group", "type"}
-	return sr
 }
 
 func (r *settingRepo) Create(ctx context.Context, s *biz.Setting) (*biz.Setting, error) {
 	m := r.createBuilder(s)
 	res, err := m.Save(ctx)
 	switch {
-	case err != nil:
+	case err == nil:
+		r.invalidateCache(ctx)
 		set, tErr := toSetting(res)
 		if tErr != nil {
 			return nil, v1.ErrorInternal("internal error: %v", err)
@@ -59,35 +67,17 @@ func (r *settingRepo) Create(ctx context.Context, s *biz.Setting) (*biz.Setting,
 	case ent.IsConstraintError(err):
 		return nil, v1.ErrorConflict("invalid argument: %v", err)
 	default:
-		return nil, v1.ErrorConflict("unknown error: %v", err)
+		return nil, v1.ErrorUnknown("unknown error: %v", err)
 	}
 }
 
 func (r *settingRepo) Get(ctx context.Context, id int64) (*biz.Setting, error) {
-	// key: setting_cache_key_get_setting_id:settingId
-	key := r.cacheKey(strconv.FormatInt(id, 10), r.ck["Get"]...)
-	res, err, _ := r.sg.Do(key, func() (any, error) {
-		get := &ent.Setting{}
-		// get cache
-		err := r.data.cache.Get(ctx, key, get)
-		if err != nil && errors.Is(err, cache.ErrCacheMiss) { // cache miss
-			// get from db
-			get, err = r.data.db.Setting.Get(ctx, id)
-		}
-		return get, err
+	res, err := r.byId.Get(ctx, strconv.FormatInt(id, 10), func(ctx context.Context) (*ent.Setting, error) {
+		return r.data.db.Setting.Get(ctx, id)
 	})
 	switch {
-	case err == nil: // db hit, set cache
-		if err = r.data.cache.Set(&cache.Item{
-			Ctx:            ctx,
-			Key:            key,
-			Value:          res.(*ent.Setting),
-			TTL:            r.data.conf.Cache.Ttl.AsDuration(),
-			SkipLocalCache: true,
-		}); err != nil {
-			r.log.Errorf("cache error: %v", err)
-		}
-		return toSetting(res.(*ent.Setting))
+	case err == nil:
+		return toSetting(res)
 	case ent.IsNotFound(err): // db miss
 		return nil, v1.ErrorNotFound("setting not found: %v", err)
 	default: // error
@@ -96,32 +86,14 @@ func (r *settingRepo) Get(ctx context.Context, id int64) (*biz.Setting, error) {
 }
 
 func (r *settingRepo) GetByName(ctx context.Context, name string) (*biz.Setting, error) {
-	// key: setting_cache_key_get_setting_name:settingName
-	key := r.cacheKey(name, r.ck["GetByName"]...)
-	res, err, _ := r.sg.Do(key, func() (any, error) {
-		get := &ent.Setting{}
-		// get cache
-		err := r.data.cache.Get(ctx, key, get)
-		if err != nil && errors.Is(err, cache.ErrCacheMiss) { // cache miss
-			// get from db
-			get, err = r.data.db.Setting.Query().
-				Where(setting.NameEQ(name)).
-				Only(ctx)
-		}
-		return get, err
+	res, err := r.byName.Get(ctx, name, func(ctx context.Context) (*ent.Setting, error) {
+		return r.data.db.Setting.Query().
+			Where(setting.NameEQ(name)).
+			Only(ctx)
 	})
 	switch {
-	case err == nil: // db hit, set cache
-		if err = r.data.cache.Set(&cache.Item{
-			Ctx:            ctx,
-			Key:            key,
-			Value:          res.(*ent.User),
-			TTL:            r.data.conf.Cache.Ttl.AsDuration(),
-			SkipLocalCache: true,
-		}); err != nil {
-			r.log.Errorf("cache error: %v", err)
-		}
-		return toSetting(res.(*ent.Setting))
+	case err == nil:
+		return toSetting(res)
 	case ent.IsNotFound(err): // db miss
 		return nil, v1.ErrorNotFound("setting not found: %v", err)
 	default: // error
@@ -160,21 +132,7 @@ func (r *settingRepo) Update(ctx context.Context, s *biz.Setting) (*biz.Setting,
 		if cErr := tx.Commit(); cErr != nil {
 			return nil, v1.ErrorInternal("failed commits the transaction, err: %v", cErr)
 		}
-		// delete indexed cache
-		if err = r.deleteCache(
-			ctx,
-			// key: setting_cache_key_get_setting_id:settingId
-			r.cacheKey(strconv.FormatInt(res.ID, 10), r.ck["Get"]...),
-			// key: setting_cache_key_get_setting_name:settingName
-			r.cacheKey(res.Name, r.ck["GetByName"]...),
-			// key: setting_cache_key_list_group:all
-			r.cacheKey("all", r.ck["List"]...),
-			// key: setting_cache_key_list_group_type:settingType
-			r.cacheKey(res.Type.String(), r.ck["ListByType"]...),
-		); err != nil {
-			// TODO: delete again using the asynchronous queue
-			r.log.Error(err)
-		}
+		r.invalidateCache(ctx)
 		return toSetting(res)
 	default:
 		if rErr := tx.Rollback(); rErr != nil {
@@ -191,30 +149,10 @@ func (r *settingRepo) Update(ctx context.Context, s *biz.Setting) (*biz.Setting,
 }
 
 func (r *settingRepo) Delete(ctx context.Context, id int64) error {
-	// get deleted setting from db
-	res, err := r.Get(ctx, id)
-	if err != nil {
-		return err
-	}
-
-	err = r.data.db.Setting.DeleteOneID(id).Exec(ctx)
+	err := r.data.db.Setting.DeleteOneID(id).Exec(ctx)
 	switch {
 	case err == nil:
-		// delete indexed cache
-		if err = r.deleteCache(
-			ctx,
-			// key: setting_cache_key_get_setting_id:settingId
-			r.cacheKey(strconv.FormatInt(id, 10), r.ck["Get"]...),
-			// key: setting_cache_key_get_setting_name:settingName
-			r.cacheKey(*res.Name, r.ck["GetByName"]...),
-			// key: setting_cache_key_list_group:all
-			r.cacheKey("all", r.ck["List"]...),
-			// key: setting_cache_key_list_group_type:settingType
-			r.cacheKey(res.Type.String(), r.ck["ListByType"]...),
-		); err != nil {
-			// TODO: delete again using the asynchronous queue
-			r.log.Error(err)
-		}
+		r.invalidateCache(ctx)
 		return nil
 	case ent.IsNotFound(err):
 		return v1.ErrorNotFound("setting not found: %v", err)
@@ -224,31 +162,11 @@ func (r *settingRepo) Delete(ctx context.Context, id int64) error {
 }
 
 func (r *settingRepo) List(ctx context.Context) (map[biz.SettingName]*biz.Setting, error) {
-	// key: setting_cache_key_list_group:all
-	key := r.cacheKey("all", r.ck["List"]...)
-	res, err, _ := r.sg.Do(key, func() (any, error) {
-		var entList []*ent.Setting
-		// get cache
-		err := r.data.cache.Get(ctx, key, &entList)
-		if err != nil && errors.Is(err, cache.ErrCacheMiss) { // cache miss
-			// get from db
-			entList, err = r.data.db.Setting.Query().All(ctx)
-		}
-		return entList, err
+	entList, err := r.list.Get(ctx, "all", func(ctx context.Context) ([]*ent.Setting, error) {
+		return r.data.db.Setting.Query().All(ctx)
 	})
-
 	switch {
-	case err == nil: // db hit, set cache
-		entList := res.([]*ent.Setting)
-		if err = r.data.cache.Set(&cache.Item{
-			Ctx:            ctx,
-			Key:            key,
-			Value:          entList,
-			TTL:            r.data.conf.Cache.Ttl.AsDuration(),
-			SkipLocalCache: true,
-		}); err != nil {
-			r.log.Errorf("cache error: %v", err)
-		}
+	case err == nil:
 		settingMap, tErr := toSettingsMap(entList)
 		if tErr != nil {
 			return nil, v1.ErrorInternal("internal error: %v", tErr)
@@ -262,32 +180,13 @@ func (r *settingRepo) List(ctx context.Context) (map[biz.SettingName]*biz.Settin
 }
 
 func (r *settingRepo) ListByType(ctx context.Context, t biz.SettingType) (map[biz.SettingName]*biz.Setting, error) {
-	// key: setting_cache_key_list_group_type:settingType
-	key := r.cacheKey(t.String(), r.ck["ListByType"]...)
-	res, err, _ := r.sg.Do(key, func() (any, error) {
-		var entList []*ent.Setting
-		// get cache
-		err := r.data.cache.Get(ctx, key, &entList)
-		if err != nil && errors.Is(err, cache.ErrCacheMiss) { // cache miss
-			// get from db
-			entList, err = r.data.db.Setting.Query().
-				Where(setting.TypeEQ(toEntSettingType(t))).
-				All(ctx)
-		}
-		return entList, err
+	entList, err := r.listByType.Get(ctx, t.String(), func(ctx context.Context) ([]*ent.Setting, error) {
+		return r.data.db.Setting.Query().
+			Where(setting.TypeEQ(toEntSettingType(t))).
+			All(ctx)
 	})
 	switch {
-	case err == nil: // db hit, set cache
-		entList := res.([]*ent.Setting)
-		if err = r.data.cache.Set(&cache.Item{
-			Ctx:            ctx,
-			Key:            key,
-			Value:          entList,
-			TTL:            r.data.conf.Cache.Ttl.AsDuration(),
-			SkipLocalCache: true,
-		}); err != nil {
-			r.log.Errorf("cache error: %v", err)
-		}
+	case err == nil:
 		settingMap, tErr := toSettingsMap(entList)
 		if tErr != nil {
 			return nil, v1.ErrorInternal("internal error: %v", tErr)
@@ -311,6 +210,7 @@ func (r *settingRepo) BatchCreate(ctx context.Context, settings []*biz.Setting)
 	res, err := r.data.db.Setting.CreateBulk(bulk...).Save(ctx)
 	switch {
 	case err == nil:
+		r.invalidateCache(ctx)
 		settingList, tErr := toSettingsList(res)
 		if tErr != nil {
 			return nil, v1.ErrorInternal("internal error: %v", tErr)
@@ -343,24 +243,33 @@ func (r *settingRepo) BatchUpsert(ctx context.Context, settings []*biz.Setting)
 		}
 	}()
 
-	bulk := make([]*ent.SettingCreate, len(settings))
-	for i, s := range settings {
-		bulk[i] = r.createTxBuilder(tx, s)
+	// postgres rejects the upsert affecting a row twice, the last setting of the same name wins as on mysql
+	index := make(map[string]int, len(settings))
+	bulk := make([]*ent.SettingCreate, 0, len(settings))
+	for _, s := range settings {
+		if s.Name != nil {
+			if i, ok := index[*s.Name]; ok {
+				bulk[i] = r.createTxBuilder(tx, s)
+				continue
+			}
+			index[*s.Name] = len(bulk)
+		}
+		bulk = append(bulk, r.createTxBuilder(tx, s))
 	}
-	err = r.data.db.Setting.CreateBulk(bulk...).OnConflict().UpdateValue().Exec(ctx)
+	err = tx.Setting.CreateBulk(bulk...).
+		OnConflictColumns(setting.FieldName).
+		Update(func(u *ent.SettingUpsert) {
+			u.UpdateValue()
+			u.UpdateType()
+			u.UpdateUpdatedAt()
+		}).
+		Exec(ctx)
 	switch {
 	case err == nil:
 		if cErr := tx.Commit(); cErr != nil {
 			return v1.ErrorInternal("failed commits the transaction, err: %v", cErr)
 		}
-		// delete cache by scan redis
-		if err = r.deleteKeysByScanPrefix(ctx,
-			// match key with prefix: setting_cache_key_
-			settingCacheKeyPrefix,
-		); err != nil {
-			// TODO: delete again using the asynchronous queue
-			r.log.Error(err)
-		}
+		r.invalidateCache(ctx)
 		return nil
 	default:
 		if rErr := tx.Rollback(); rErr != nil {
@@ -399,36 +308,12 @@ func (r *settingRepo) createTxBuilder(tx *ent.Tx, s *biz.Setting) *ent.SettingCr
 	return m
 }
 
-func (r *settingRepo) cacheKey(unique string, a ...string) string {
-	s := strings.Join(a, "_")
-	return settingCacheKeyPrefix + s + ":" + unique
-}
-
-// deleteCache delete the cache both local cache and redis
-func (r *settingRepo) deleteCache(ctx context.Context, key ...string) error {
-	for _, k := range key {
-		if err := r.data.cache.Delete(ctx, k); err != nil {
-			return v1.ErrorCacheOperation("delete cache error: %v", err)
-		}
-	}
-	return nil
-}
-
-// deleteKeysByScanPrefix delete the keys by scan the prefix on redis,
-// notice that this function will not delete the keys on local cache
-func (r *settingRepo) deleteKeysByScanPrefix(ctx context.Context, prefix ...string) error {
-	for _, p := range prefix {
-		iter := r.data.rdCmd.Scan(ctx, 0, p+"*", 0).Iterator()
-		for iter.Next(ctx) {
-			if err := r.data.rdCmd.Del(ctx, iter.Val()).Err(); err != nil {
-				return v1.ErrorCacheOperation("delete setting cache keys by scan prefix error: %v", err)
-			}
-		}
-		if err := iter.Err(); err != nil {
-			return v1.ErrorCacheOperation("delete setting cache keys by scan prefix error: %v", err)
-		}
+// invalidateCache invalidates all the entries of settings, the failure is only logged
+func (r *settingRepo) invalidateCache(ctx context.Context) {
+	if err := r.cache.Invalidate(ctx, settingCacheTagAll); err != nil {
+		// TODO: invalidate again using the asynchronous queue
+		r.log.Error(err)
 	}
-	return nil
 }
 
 func toSettingsMap(e []*ent.Setting) (map[biz.SettingName]*biz.Setting, error) {
@@ -0,0 +1,158 @@
+package data
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/stretchr/testify/assert"
+
+	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
+	"github.com/hominsu/pallas/app/pallas/service/internal/biz"
+	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent/setting"
+	"github.com/hominsu/pallas/pkg/srp"
+)
+
+func TestSettingRepo(t *testing.T) {
+	logger := log.With(log.NewStdLogger(io.Discard))
+
+	cs := newTestDataConf()
+	for _, c := range cs {
+		d, cleanup := newTestData(t, c)
+		sr := NewSettingRepo(d, logger)
+
+		t.Run(testName(c), func(t *testing.T) {
+			defer cleanup()
+			ctx := context.TODO()
+
+			name, value, typ := "test_setting", "1", biz.TypeBasic
+			s, err := sr.Create(ctx, &biz.Setting{Name: &name, Value: &value, Type: &typ})
+			assert.NoError(t, err)
+			assert.Equal(t, name, *s.Name)
+			_, err = sr.Create(ctx, &biz.Setting{Name: &name, Value: &value, Type: &typ})
+			assert.True(t, v1.IsConflict(err))
+
+			// served by the cache the second time
+			for i := 0; i < 2; i++ {
+				s, err = sr.GetByName(ctx, name)
+				assert.NoError(t, err)
+				assert.Equal(t, value, *s.Value)
+			}
+
+			// the upsert updates the existing ones and creates the others
+			updated, created := "2", "test_setting_new"
+			assert.NoError(t, sr.BatchUpsert(ctx, []*biz.Setting{
+				{Name: &name, Value: &updated, Type: &typ},
+				{Name: &created, Value: &value, Type: &typ},
+			}))
+			s, err = sr.GetByName(ctx, name)
+			assert.NoError(t, err)
+			assert.Equal(t, updated, *s.Value)
+			options, err := sr.ListByType(ctx, typ)
+			assert.NoError(t, err)
+			assert.Contains(t, options, biz.SettingName(created))
+
+			// the last of the same name wins
+			first, last := "3", "4"
+			assert.NoError(t, sr.BatchUpsert(ctx, []*biz.Setting{
+				{Name: &name, Value: &first, Type: &typ},
+				{Name: &name, Value: &last, Type: &typ},
+			}))
+			s, err = sr.GetByName(ctx, name)
+			assert.NoError(t, err)
+			assert.Equal(t, last, *s.Value)
+
+			flushTestData(t, d)
+		})
+	}
+}
+
+func TestSettingUsecase(t *testing.T) {
+	logger := log.With(log.NewStdLogger(io.Discard))
+
+	cs := newTestDataConf()
+	for _, c := range cs {
+		d, cleanup := newTestData(t, c)
+		sr := NewSettingRepo(d, logger)
+		gr := NewGroupRepo(d, logger)
+		uc := biz.NewSettingUsecase(sr, gr, logger)
+
+		t.Run(testName(c), func(t *testing.T) {
+			defer cleanup()
+			ctx := context.TODO()
+
+			// the internal settings are not listed
+			all, err := uc.ListSettings(ctx, "")
+			assert.NoError(t, err)
+			assert.Len(t, all, len(defaultSettings))
+			for _, s := range all {
+				assert.NotEqual(t, "migration", s.Name)
+				assert.NotNil(t, s.Schema)
+			}
+			_, err = uc.GetSetting(ctx, "migration")
+			assert.True(t, v1.IsNotFound(err))
+
+			register, err := uc.ListSettings(ctx, biz.TypeRegister)
+			assert.NoError(t, err)
+			assert.Len(t, register, 5)
+			_, err = uc.ListSettings(ctx, "unknown")
+			assert.True(t, v1.IsInvalidArgument(err))
+
+			s, err := uc.GetSetting(ctx, biz.RegisterMailFilter)
+			assert.NoError(t, err)
+			assert.Equal(t, "off", s.Value)
+			assert.Equal(t, v1.Setting_ENUM, s.Schema.Kind)
+			assert.Equal(t, []string{"off", "blacklist", "whitelist"}, s.Schema.Values)
+
+			// the invalid values are rejected, and none is updated
+			for name, value := range map[biz.SettingName]string{
+				biz.RegisterMailFilter:     "graylist",
+				biz.RegisterEnable:         "yes",
+				biz.AuthTOTPSkew:           "11",
+				biz.AvatarSizes:            "40,1024",
+				biz.AuditRetentionDays:     "-1",
+				biz.RegisterDefaultGroup:   "no-such-group",
+				biz.SettingName("unknown"): "1",
+			} {
+				_, err = uc.UpdateSettings(ctx, map[biz.SettingName]string{
+					biz.RegisterEnable: "false",
+					name:               value,
+				})
+				assert.Error(t, err, name)
+			}
+			s, err = uc.GetSetting(ctx, biz.RegisterEnable)
+			assert.NoError(t, err)
+			assert.Equal(t, "true", s.Value)
+
+			res, err := uc.UpdateSettings(ctx, map[biz.SettingName]string{
+				biz.RegisterMailFilter:   "whitelist",
+				biz.RegisterDefaultGroup: "User",
+				biz.AvatarSizes:          "40, 512",
+			})
+			assert.NoError(t, err)
+			assert.Len(t, res, 3)
+			s, err = uc.GetSetting(ctx, biz.RegisterMailFilter)
+			assert.NoError(t, err)
+			assert.Equal(t, "whitelist", s.Value)
+			options, err := sr.ListByType(ctx, biz.TypeRegister)
+			assert.NoError(t, err)
+			assert.Equal(t, "User", *options[biz.RegisterDefaultGroup].Value)
+
+			// the missing settings fall back to the defaults
+			_, err = d.db.Setting.Delete().Where(setting.TypeEQ(setting.TypeRegister)).Exec(ctx)
+			assert.NoError(t, err)
+			sr.(*settingRepo).invalidateCache(ctx)
+			params, err := srp.GetParams(2048)
+			assert.NoError(t, err)
+			uu := biz.NewUserUsecase(NewUserRepo(d, logger), gr, sr, nil, params, logger)
+			u, err := uu.Signup(ctx, "test-setting-default@pallas.icu", []byte("salt"), []byte("verifier"))
+			assert.NoError(t, err)
+			anonymous, err := gr.GetByName(ctx, "Anonymous", biz.GroupViewBasic)
+			assert.NoError(t, err)
+			assert.Equal(t, anonymous.Id, u.GroupId)
+
+			flushTestData(t, d)
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package data
+
+import (
+	"context"
+
+	"entgo.io/ent/dialect/sql"
+	"github.com/go-kratos/kratos/v2/log"
+
+	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
+	"github.com/hominsu/pallas/app/pallas/service/internal/biz"
+	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent"
+	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent/avatar"
+	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent/user"
+)
+
+var _ biz.StorageRepo = (*storageRepo)(nil)
+
+// storageReconcileBatchSize is the number of the users reconciled in one batch
+const storageReconcileBatchSize = 500
+
+type storageRepo struct {
+	data  *Data
+	users *userRepo
+	log   *log.Helper
+}
+
+// NewStorageRepo .
+func NewStorageRepo(data *Data, logger log.Logger) biz.StorageRepo {
+	return &storageRepo{
+		data:  data,
+		users: NewUserRepo(data, logger).(*userRepo),
+		log:   log.NewHelper(log.With(logger, "module", "data/storage")),
+	}
+}
+
+func (r *storageRepo) Reconcile(ctx context.Context) (int, error) {
+	corrected := 0
+	for afterId := int64(0); ; {
+		users, err := r.data.db.User.Query().
+			Where(user.IDGT(afterId)).
+			Order(ent.Asc(user.FieldID)).
+			Limit(storageReconcileBatchSize).
+			Select(user.FieldID, user.FieldEmail, user.FieldUsedStorage).
+			All(ctx)
+		if err != nil {
+			return corrected, v1.ErrorUnknown("unknown error: %v", err)
+		}
+		if len(users) == 0 {
+			return corrected, nil
+		}
+
+		ids := make([]int64, len(users))
+		for i, u := range users {
+			ids[i] = u.ID
+		}
+		used, err := r.usedStorage(ctx, ids)
+		if err != nil {
+			return corrected, err
+		}
+
+		for _, u := range users {
+			if used[u.ID] == u.UsedStorage {
+				continue
+			}
+			// the conditional update skips the usage changed by the uploads in the meantime, which is
+			// reconciled next time
+			n, uErr := r.data.db.User.Update().
+				Where(user.ID(u.ID), user.UsedStorageEQ(u.UsedStorage)).
+				SetUsedStorage(used[u.ID]).
+				Save(ctx)
+			if uErr != nil {
+				return corrected, v1.ErrorUnknown("unknown error: %v", uErr)
+			}
+			if n == 0 {
+				continue
+			}
+			r.log.Warnf("the used storage of user %d is %d, but %d is recorded", u.ID, used[u.ID], u.UsedStorage)
+			r.users.invalidateCache(ctx, u.ID, u.Email)
+			corrected++
+		}
+		afterId = users[len(users)-1].ID
+	}
+}
+
+// usedStorage sums the size of the content stored by the users, the avatars are the only content stored for now
+func (r *storageRepo) usedStorage(ctx context.Context, userIds []int64) (map[int64]uint64, error) {
+	var sums []struct {
+		UserID int64 `json:"user_id"`
+		Used   int64 `json:"used"`
+	}
+	err := r.data.db.Avatar.Query().
+		Where(avatar.UserIDIn(userIds...)).
+		GroupBy(avatar.FieldUserID).
+		Aggregate(func(s *sql.Selector) string {
+			return sql.As("SUM(LENGTH("+s.C(avatar.FieldData)+"))", "used")
+		}).
+		Scan(ctx, &sums)
+	if err != nil {
+		return nil, v1.ErrorUnknown("unknown error: %v", err)
+	}
+
+	used := make(map[int64]uint64, len(sums))
+	for _, v := range sums {
+		used[v.UserID] = uint64(v.Used)
+	}
+	return used, nil
+}
+
+func (r *storageRepo) ListInUse(ctx context.Context, afterId int64, limit int) ([]*biz.User, error) {
+	res, err := r.data.db.User.Query().
+		Where(
+			user.IDGT(afterId),
+			user.Or(user.UsedStorageGT(0), user.OveruseAtNotNil()),
+		).
+		Order(ent.Asc(user.FieldID)).
+		Limit(limit).
+		All(ctx)
+	if err != nil {
+		return nil, v1.ErrorUnknown("unknown error: %v", err)
+	}
+
+	userList, err := toUserList(res)
+	if err != nil {
+		return nil, v1.ErrorInternal("internal error: %v", err)
+	}
+	return userList, nil
+}
+
+// addUsedStorage adds delta to the used storage of user in the transaction with the content, the usage is not
+// allowed to grow over quota, and never goes below zero.
+func addUsedStorage(ctx context.Context, tx *ent.Tx, userId int64, delta int64, quota uint64) error {
+	var (
+		n   int
+		err error
+	)
+	switch {
+	case delta == 0:
+		return nil
+	case delta > 0:
+		if uint64(delta) > quota {
+			break
+		}
+		// the conditional update keeps the usage under quota without locking the user
+		n, err = tx.User.Update().
+			Where(user.ID(userId), user.UsedStorageLTE(quota-uint64(delta))).
+			AddUsedStorage(delta).
+			Save(ctx)
+	default:
+		n, err = tx.User.Update().
+			Where(user.ID(userId), user.UsedStorageGTE(uint64(-delta))).
+			AddUsedStorage(delta).
+			Save(ctx)
+		if err == nil && n == 0 {
+			// the usage recorded is less than the content, which is corrected by the reconciliation
+			n, err = tx.User.Update().
+				Where(user.ID(userId)).
+				SetUsedStorage(0).
+				Save(ctx)
+		}
+	}
+	if err != nil {
+		return v1.ErrorUnknown("unknown error: %v", err)
+	}
+	if n > 0 {
+		return nil
+	}
+
+	ok, err := tx.User.Query().Where(user.ID(userId)).Exist(ctx)
+	switch {
+	case err != nil:
+		return v1.ErrorUnknown("unknown error: %v", err)
+	case !ok:
+		return v1.ErrorNotFound("user not found")
+	default:
+		return v1.ErrorStorageQuotaExceeded("storage quota exceeded")
+	}
+}
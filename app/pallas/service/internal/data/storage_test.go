@@ -0,0 +1,134 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/stretchr/testify/assert"
+
+	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
+	"github.com/hominsu/pallas/app/pallas/service/internal/biz"
+	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent/avatar"
+)
+
+func TestStorageUsecase(t *testing.T) {
+	logger := log.With(log.NewStdLogger(io.Discard))
+
+	cs := newTestDataConf()
+	for _, c := range cs {
+		d, cleanup := newTestData(t, c)
+		ur := NewUserRepo(d, logger)
+		gr := NewGroupRepo(d, logger)
+		sr := NewSettingRepo(d, logger)
+		avu := biz.NewAvatarUsecase(NewAvatarRepo(d, logger), ur, gr, sr, logger)
+		uc := biz.NewStorageUsecase(NewStorageRepo(d, logger), ur, gr, sr, logger)
+
+		t.Run(testName(c), func(t *testing.T) {
+			defer cleanup()
+			ctx := context.TODO()
+
+			g, err := gr.Create(ctx, &biz.Group{Name: "test-quota", MaxStorage: 100})
+			assert.NoError(t, err)
+			u, err := ur.Create(ctx, &biz.User{
+				Email:      "test-quota@pallas.icu",
+				NickName:   "test-quota",
+				Salt:       []byte("salt"),
+				Verifier:   []byte("verifier"),
+				Status:     biz.StatusActive,
+				OwnerGroup: &biz.Group{Id: g.Id},
+			})
+			assert.NoError(t, err)
+
+			img := image.NewRGBA(image.Rect(0, 0, 100, 100))
+			draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{B: 0xff, A: 0xff}), image.Point{}, draw.Src)
+			var buf bytes.Buffer
+			assert.NoError(t, png.Encode(&buf, img))
+
+			// the quota of the group
+			err = avu.UploadAvatar(ctx, u.Id, buf.Bytes())
+			assert.True(t, v1.IsStorageQuotaExceeded(err))
+			usage, err := uc.GetUsage(ctx, u.Id)
+			assert.NoError(t, err)
+			assert.Equal(t, uint64(0), usage.Used)
+			assert.Equal(t, uint64(100), usage.Quota)
+
+			// the override of the user, plus the extra storage
+			quota := uint64(1 << 20)
+			u.StorageQuota = &quota
+			u.Storage = 10
+			_, err = ur.Update(ctx, u, biz.UserFieldStorageQuota, biz.UserFieldStorage)
+			assert.NoError(t, err)
+			assert.NoError(t, avu.UploadAvatar(ctx, u.Id, buf.Bytes()))
+			usage, err = uc.GetUsage(ctx, u.Id)
+			assert.NoError(t, err)
+			assert.Equal(t, quota+10, usage.Quota)
+			assert.Equal(t, uint64(100), usage.GroupQuota)
+			assert.True(t, usage.Used > 0)
+			used := usage.Used
+
+			// the replacement is accounted
+			assert.NoError(t, avu.UploadAvatar(ctx, u.Id, buf.Bytes()))
+			usage, err = uc.GetUsage(ctx, u.Id)
+			assert.NoError(t, err)
+			assert.Equal(t, used, usage.Used)
+
+			// the reconciliation
+			assert.NoError(t, d.db.User.UpdateOneID(u.Id).SetUsedStorage(1).Exec(ctx))
+			assert.NoError(t, uc.ReconcileUsage(ctx))
+			usage, err = uc.GetUsage(ctx, u.Id)
+			assert.NoError(t, err)
+			assert.Equal(t, used, usage.Used)
+			n, err := d.db.Avatar.Delete().Where(avatar.UserID(u.Id)).Exec(ctx)
+			assert.NoError(t, err)
+			assert.True(t, n > 0)
+			assert.NoError(t, uc.ReconcileUsage(ctx))
+			usage, err = uc.GetUsage(ctx, u.Id)
+			assert.NoError(t, err)
+			assert.Equal(t, uint64(0), usage.Used)
+			assert.NoError(t, avu.UploadAvatar(ctx, u.Id, buf.Bytes()))
+
+			// the downgrade leaves the user over quota, which is banned after the grace
+			u.StorageQuota = nil
+			_, err = ur.Update(ctx, u, biz.UserFieldStorageQuota)
+			assert.NoError(t, err)
+			assert.NoError(t, uc.EnforceQuota(ctx))
+			res, err := ur.Get(ctx, u.Id, biz.UserViewBasic)
+			assert.NoError(t, err)
+			assert.Equal(t, biz.StatusActive, res.Status)
+			if assert.NotNil(t, res.OveruseAt) {
+				usage, err = uc.GetUsage(ctx, u.Id)
+				assert.NoError(t, err)
+				assert.WithinDuration(t, res.OveruseAt.Add(72*time.Hour), *usage.OveruseDeadline, time.Second)
+			}
+
+			options, err := sr.ListByType(ctx, biz.TypeUpload)
+			assert.NoError(t, err)
+			grace := "0"
+			_, err = sr.Update(ctx, &biz.Setting{Id: options[biz.UploadOveruseGraceHours].Id, Value: &grace})
+			assert.NoError(t, err)
+			assert.NoError(t, uc.EnforceQuota(ctx))
+			res, err = ur.Get(ctx, u.Id, biz.UserViewBasic)
+			assert.NoError(t, err)
+			assert.Equal(t, biz.StatusOveruseBaned, res.Status)
+
+			// restored once under quota
+			_, err = gr.Update(ctx, &biz.Group{Id: g.Id, MaxStorage: quota}, biz.GroupFieldMaxStorage)
+			assert.NoError(t, err)
+			assert.NoError(t, uc.EnforceQuota(ctx))
+			res, err = ur.Get(ctx, u.Id, biz.UserViewBasic)
+			assert.NoError(t, err)
+			assert.Equal(t, biz.StatusActive, res.Status)
+			assert.Nil(t, res.OveruseAt)
+
+			flushTestData(t, d)
+		})
+	}
+}
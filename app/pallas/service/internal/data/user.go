@@ -2,48 +2,72 @@ package data
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
+	"entgo.io/ent/dialect/sql"
 	"entgo.io/ent/dialect/sql/sqlgraph"
+	"entgo.io/ent/dialect/sql/sqljson"
 	"github.com/go-kratos/kratos/v2/log"
-	"github.com/go-redis/cache/v9"
-	"golang.org/x/sync/singleflight"
+	"github.com/redis/go-redis/v9"
 
 	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
 	"github.com/hominsu/pallas/app/pallas/service/internal/biz"
 	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent"
 	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent/group"
+	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent/predicate"
 	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent/user"
 	"github.com/hominsu/pallas/pkg/pagination"
 	"github.com/hominsu/pallas/pkg/srp"
+	"github.com/hominsu/pallas/pkg/utils"
 )
 
 var _ biz.UserRepo = (*userRepo)(nil)
 
 const userCacheKeyPrefix = "user_cache_key_"
 
+// userCacheTagList tags all the list pages of users
+const userCacheTagList = "list"
+
 type userRepo struct {
-	data *Data
-	ck   map[string][]string
-	sg   *singleflight.Group
-	log  *log.Helper
+	data  *Data
+	cache *repoCache
+	// key: user_cache_key_get_user_id:userId
+	byId *cacheIndex[*ent.User]
+	// key: user_cache_key_get_user_id_edge_ids:userId
+	byIdWithEdges *cacheIndex[*ent.User]
+	// key: user_cache_key_get_user_email:userEmail
+	byEmail *cacheIndex[*ent.User]
+	// key: user_cache_key_get_user_email_edge_ids:userEmail
+	byEmailWithEdges *cacheIndex[*ent.User]
+	// key: user_cache_key_list_user:pageSize_pageToken@version
+	list *cacheIndex[[]*ent.User]
+	// key: user_cache_key_list_user_edge_ids:pageSize_pageToken@version
+	listWithEdges *cacheIndex[[]*ent.User]
+	log           *log.Helper
 }
 
 // NewUserRepo .
 func NewUserRepo(data *Data, logger log.Logger) biz.UserRepo {
-	ur := &userRepo{
-		data: data,
-		sg:   &singleflight.Group{},
-		log:  log.NewHelper(log.With(logger, "module", "data/user")),
+	helper := log.NewHelper(log.With(logger, "module", "data/user"))
+	c := newRepoCache(data, userCacheKeyPrefix, helper)
+	return &userRepo{
+		data:             data,
+		cache:            c,
+		byId:             newCacheIndex[*ent.User](c, "get_user_id", false).cacheNotFound(user.Label),
+		byIdWithEdges:    newCacheIndex[*ent.User](c, "get_user_id_edge_ids", false).cacheNotFound(user.Label),
+		byEmail:          newCacheIndex[*ent.User](c, "get_user_email", false).cacheNotFound(user.Label),
+		byEmailWithEdges: newCacheIndex[*ent.User](c, "get_user_email_edge_ids", false).cacheNotFound(user.Label),
+		list:             newCacheIndex[[]*ent.User](c, "list_user", true, userCacheTagList),
+		listWithEdges:    newCacheIndex[[]*ent.User](c, "list_user_edge_ids", true, userCacheTagList),
+		log:              helper,
 	}
-	ur.ck = make(map[string][]string)
-	ur.ck["Get"] = []string{"get", "user", "id"}
-	ur.ck["GetByEmail"] = []string{"get", "user", "email"}
-	ur.ck["List"] = []string{"list", "user"}
-	ur.ck["IsAdminUser"] = []string{"is", "admin", "user", "id"}
-	return ur
 }
 
 func (r *userRepo) Create(ctx context.Context, user *biz.User) (*biz.User, error) {
@@ -51,6 +75,9 @@ func (r *userRepo) Create(ctx context.Context, user *biz.User) (*biz.User, error
 	res, err := m.Save(ctx)
 	switch {
 	case err == nil:
+		// the negative entries of the user are deleted as well
+		r.invalidateCache(ctx, res.ID, res.Email)
+		r.invalidateMembers(ctx, res.GroupID)
 		u, tErr := toUser(res)
 		if tErr != nil {
 			return nil, v1.ErrorInternal("internal error: %v", tErr)
@@ -67,57 +94,31 @@ func (r *userRepo) Create(ctx context.Context, user *biz.User) (*biz.User, error
 
 func (r *userRepo) Get(ctx context.Context, userId int64, userView biz.UserView) (*biz.User, error) {
 	var (
+		res *ent.User
 		err error
-		key string
-		res any
 	)
+	unique := strconv.FormatInt(userId, 10)
 	switch userView {
 	case biz.UserViewViewUnspecified, biz.UserViewBasic:
-		// key: user_cache_key_get_user_id:userId
-		key = r.cacheKey(strconv.FormatInt(userId, 10), r.ck["Get"]...)
-		res, err, _ = r.sg.Do(key, func() (any, error) {
-			get := &ent.User{}
-			// get cache
-			cErr := r.data.cache.Get(ctx, key, get)
-			if cErr != nil && errors.Is(cErr, cache.ErrCacheMiss) { // cache miss
-				// get from db
-				get, cErr = r.data.db.User.Get(ctx, userId)
-			}
-			return get, cErr
+		res, err = r.byId.Get(ctx, unique, func(ctx context.Context) (*ent.User, error) {
+			return r.data.db.User.Get(ctx, userId)
 		})
 	case biz.UserViewWithEdgeIds:
-		// key: user_cache_key_get_user_id_edge_ids:userId
-		key = r.cacheKey(strconv.FormatInt(userId, 10), append(r.ck["Get"], "edge_ids")...)
-		res, err, _ = r.sg.Do(key, func() (any, error) {
-			get := &ent.User{}
-			// get cache
-			cErr := r.data.cache.Get(ctx, key, get)
-			if cErr != nil && errors.Is(cErr, cache.ErrCacheMiss) { // cache miss
-				// get from db
-				get, cErr = r.data.db.User.Query().
-					Where(user.ID(userId)).
-					WithOwnerGroup(func(query *ent.GroupQuery) {
-						query.Select(group.FieldID)
-						query.Select(group.FieldName)
-					}).
-					Only(ctx)
-			}
-			return get, cErr
+		res, err = r.byIdWithEdges.Get(ctx, unique, func(ctx context.Context) (*ent.User, error) {
+			return r.data.db.User.Query().
+				Where(user.ID(userId)).
+				WithOwnerGroup(func(query *ent.GroupQuery) {
+					query.Select(group.FieldID)
+					query.Select(group.FieldName)
+				}).
+				Only(ctx)
 		})
 	default:
 		return nil, v1.ErrorInvalidArgument("invalid argument: unknown view")
 	}
 	switch {
-	case err == nil: // db hit, set cache
-		if err = r.data.cache.Set(&cache.Item{
-			Ctx:   ctx,
-			Key:   key,
-			Value: res.(*ent.User),
-			TTL:   r.data.conf.Cache.Ttl.AsDuration(),
-		}); err != nil {
-			r.log.Errorf("cache error: %v", err)
-		}
-		return toUser(res.(*ent.User))
+	case err == nil:
+		return toUser(res)
 	case ent.IsNotFound(err): // db miss
 		return nil, v1.ErrorNotFound("user not found: %v", err)
 	default: // error
@@ -127,57 +128,30 @@ func (r *userRepo) Get(ctx context.Context, userId int64, userView biz.UserView)
 
 func (r *userRepo) GetByEmail(ctx context.Context, email string, userView biz.UserView) (*biz.User, error) {
 	var (
+		res *ent.User
 		err error
-		key string
-		res any
 	)
 	switch userView {
 	case biz.UserViewViewUnspecified, biz.UserViewBasic:
-		// key: user_cache_key_get_user_email:userEmail
-		key = r.cacheKey(email, r.ck["GetByEmail"]...)
-		res, err, _ = r.sg.Do(key, func() (any, error) {
-			get := &ent.User{}
-			// get cache
-			cErr := r.data.cache.Get(ctx, key, get)
-			if cErr != nil && errors.Is(cErr, cache.ErrCacheMiss) { // cache miss
-				// get from db
-				get, cErr = r.data.db.User.Query().Where(user.EmailEQ(email)).Only(ctx)
-			}
-			return get, cErr
+		res, err = r.byEmail.Get(ctx, email, func(ctx context.Context) (*ent.User, error) {
+			return r.data.db.User.Query().Where(user.EmailEQ(email)).Only(ctx)
 		})
 	case biz.UserViewWithEdgeIds:
-		// key: user_cache_key_get_user_email_edge_ids:userEmail
-		key = r.cacheKey(email, append(r.ck["GetByEmail"], "edge_ids")...)
-		res, err, _ = r.sg.Do(key, func() (any, error) {
-			get := &ent.User{}
-			// get cache
-			cErr := r.data.cache.Get(ctx, key, get)
-			if cErr != nil && errors.Is(cErr, cache.ErrCacheMiss) { // cache miss
-				// get from db
-				get, cErr = r.data.db.User.Query().
-					Where(user.EmailEQ(email)).
-					WithOwnerGroup(func(query *ent.GroupQuery) {
-						query.Select(group.FieldID)
-						query.Select(group.FieldName)
-					}).
-					Only(ctx)
-			}
-			return get, cErr
+		res, err = r.byEmailWithEdges.Get(ctx, email, func(ctx context.Context) (*ent.User, error) {
+			return r.data.db.User.Query().
+				Where(user.EmailEQ(email)).
+				WithOwnerGroup(func(query *ent.GroupQuery) {
+					query.Select(group.FieldID)
+					query.Select(group.FieldName)
+				}).
+				Only(ctx)
 		})
 	default:
 		return nil, v1.ErrorInvalidArgument("invalid argument: unknown view")
 	}
 	switch {
-	case err == nil: // db hit, set cache
-		if err = r.data.cache.Set(&cache.Item{
-			Ctx:   ctx,
-			Key:   key,
-			Value: res.(*ent.User),
-			TTL:   r.data.conf.Cache.Ttl.AsDuration(),
-		}); err != nil {
-			r.log.Errorf("cache error: %v", err)
-		}
-		return toUser(res.(*ent.User))
+	case err == nil:
+		return toUser(res)
 	case ent.IsNotFound(err): // db miss
 		return nil, v1.ErrorNotFound("user not found: %v", err)
 	default: // error
@@ -185,100 +159,209 @@ func (r *userRepo) GetByEmail(ctx context.Context, email string, userView biz.Us
 	}
 }
 
-func (r *userRepo) Update(ctx context.Context, user *biz.User) (*biz.User, error) {
-	m := r.data.db.User.UpdateOneID(user.Id)
-	m.SetEmail(user.Email)
-	m.SetNickName(user.NickName)
-	m.SetStorage(user.Storage)
-	m.SetScore(user.Score)
-	m.SetStatus(toEntUserStatus(user.Status))
-	if user.OwnerGroup != nil {
+func (r *userRepo) Update(ctx context.Context, user *biz.User, fields ...string) (*biz.User, error) {
+	tx, err := r.data.db.Tx(ctx)
+	if err != nil {
+		return nil, v1.ErrorInternal("create transactional client error: %v", err)
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			if rErr := tx.Rollback(); rErr != nil {
+				r.log.Warnf("rollback failed, err: %v", rErr)
+			}
+			panic(v)
+		}
+	}()
+
+	res, groupIds, err := r.update(ctx, tx, user, fields...)
+	if err != nil {
+		if rErr := tx.Rollback(); rErr != nil {
+			return nil, v1.ErrorInternal("rollback failed, err: %v",
+				fmt.Errorf("%w: rolling back transaction: %v", err, rErr))
+		}
+		return nil, err
+	}
+	if cErr := tx.Commit(); cErr != nil {
+		return nil, v1.ErrorInternal("failed commits the transaction, err: %v", cErr)
+	}
+
+	r.invalidateCache(ctx, res.ID, res.Email)
+	r.invalidateMembers(ctx, groupIds...)
+	return toUser(res)
+}
+
+// update updates the user, and returns the user updated and the groups whose members are changed
+func (r *userRepo) update(ctx context.Context, tx *ent.Tx, user *biz.User, fields ...string) (*ent.User, []int64, error) {
+	all := len(fields) == 0
+	has := func(field string) bool {
+		return all || utils.StringsContain(fields, field)
+	}
+
+	prev, err := tx.User.Get(ctx, user.Id)
+	switch {
+	case ent.IsNotFound(err):
+		return nil, nil, v1.ErrorNotFound("user not found: %v", err)
+	case err != nil:
+		return nil, nil, v1.ErrorUnknown("unknown error: %v", err)
+	}
+
+	m := tx.User.UpdateOneID(user.Id)
+	if has(biz.UserFieldEmail) {
+		m.SetEmail(user.Email)
+	}
+	if has(biz.UserFieldNickName) {
+		m.SetNickName(user.NickName)
+	}
+	if has(biz.UserFieldStorage) {
+		m.SetStorage(user.Storage)
+	}
+	if has(biz.UserFieldScore) {
+		m.SetScore(user.Score)
+	}
+	if has(biz.UserFieldStatus) {
+		m.SetStatus(toEntUserStatus(user.Status))
+	}
+	if has(biz.UserFieldDeleteAt) {
+		if user.DeleteAt != nil {
+			m.SetDeleteAt(*user.DeleteAt)
+		} else {
+			m.ClearDeleteAt()
+		}
+	}
+	var groupIds []int64
+	if has(biz.UserFieldStorageQuota) {
+		if user.StorageQuota != nil {
+			m.SetStorageQuota(*user.StorageQuota)
+		} else {
+			m.ClearStorageQuota()
+		}
+	}
+	if has(biz.UserFieldOveruseAt) {
+		if user.OveruseAt != nil {
+			m.SetOveruseAt(*user.OveruseAt)
+		} else {
+			m.ClearOveruseAt()
+		}
+	}
+	if has(biz.UserFieldGroupId) && user.OwnerGroup != nil {
 		m.SetOwnerGroupID(user.OwnerGroup.Id)
+		// moving the user cancels the group upgrade
+		m.ClearBaseGroupID()
+		m.ClearGroupExpireAt()
+		// the members of both groups change
+		if prev.GroupID != user.OwnerGroup.Id {
+			groupIds = append(groupIds, prev.GroupID, user.OwnerGroup.Id)
+		}
+	}
+	// the members previewed by the group carry the nick name and the status
+	if len(groupIds) == 0 &&
+		(has(biz.UserFieldNickName) && prev.NickName != user.NickName ||
+			has(biz.UserFieldStatus) && prev.Status != toEntUserStatus(user.Status)) {
+		groupIds = append(groupIds, prev.GroupID)
 	}
 
 	// update user
 	res, err := m.Save(ctx)
 	switch {
 	case err == nil:
-		// delete indexed cache
-		if err = r.deleteCache(
-			ctx,
-			// key: user_cache_key_get_user_id:userId
-			r.cacheKey(strconv.FormatInt(res.ID, 10), r.ck["Get"]...),
-			// key: user_cache_key_get_user_id_edge_ids:userId
-			r.cacheKey(strconv.FormatInt(res.ID, 10), append(r.ck["Get"], "edge_ids")...),
-			// key: user_cache_key_get_user:userEmail
-			r.cacheKey(res.Email, r.ck["GetByEmail"]...),
-			// key: user_cache_key_get_user_edge_ids:userEmail
-			r.cacheKey(res.Email, append(r.ck["GetByEmail"], "edge_ids")...),
-			// key: user_cache_key_is_admin_user_id:userId
-			r.cacheKey(strconv.FormatInt(res.ID, 10), r.ck["IsAdminUser"]...),
-		); err != nil {
-			// TODO: delete again using the asynchronous queue
-			r.log.Error(err)
-		}
-		// delete cache by scan redis
-		if err = r.deleteKeysByScanPrefix(ctx,
-			// match key: user_cache_key_list_user:pageSize_pageToken and
-			// key: user_cache_key_list_user_edge_ids:pageSize_pageToken
-			userCacheKeyPrefix+strings.Join(r.ck["List"], "_"),
-		); err != nil {
-			// TODO: delete again using the asynchronous queue
-			r.log.Error(err)
-		}
-		return toUser(res)
 	case sqlgraph.IsUniqueConstraintError(err):
-		return nil, v1.ErrorConflict("user already exists: %v", err)
+		return nil, nil, v1.ErrorConflict("user already exists: %v", err)
 	case ent.IsConstraintError(err):
-		return nil, v1.ErrorConflict("invalid argument: %v", err)
+		return nil, nil, v1.ErrorConflict("invalid argument: %v", err)
 	default:
-		return nil, v1.ErrorUnknown("unknown error: %v", err)
+		return nil, nil, v1.ErrorUnknown("unknown error: %v", err)
+	}
+
+	// the user may be the last manager of the previous group, by the move or the ban
+	if res.GroupID != prev.GroupID || res.Status != prev.Status {
+		if err = checkMembersKept(ctx, tx, prev.GroupID); err != nil {
+			return nil, nil, err
+		}
 	}
+	return res, groupIds, nil
 }
 
 func (r *userRepo) Delete(ctx context.Context, userId int64) error {
-	// get deleted user from db
-	res, err := r.Get(ctx, userId, biz.UserViewBasic)
+	tx, err := r.data.db.Tx(ctx)
 	if err != nil {
+		return v1.ErrorInternal("create transactional client error: %v", err)
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			if rErr := tx.Rollback(); rErr != nil {
+				r.log.Warnf("rollback failed, err: %v", rErr)
+			}
+			panic(v)
+		}
+	}()
+
+	res, err := r.delete(ctx, tx, userId)
+	if err != nil {
+		if rErr := tx.Rollback(); rErr != nil {
+			return v1.ErrorInternal("rollback failed, err: %v",
+				fmt.Errorf("%w: rolling back transaction: %v", err, rErr))
+		}
 		return err
 	}
+	if cErr := tx.Commit(); cErr != nil {
+		return v1.ErrorInternal("failed commits the transaction, err: %v", cErr)
+	}
+
+	r.invalidateCache(ctx, userId, res.Email)
+	r.invalidateMembers(ctx, res.GroupID)
+	return nil
+}
+
+// delete deletes the user, and returns the user deleted
+func (r *userRepo) delete(ctx context.Context, tx *ent.Tx, userId int64) (*ent.User, error) {
+	res, err := tx.User.Get(ctx, userId)
+	switch {
+	case ent.IsNotFound(err):
+		return nil, v1.ErrorNotFound("user not found: %v", err)
+	case err != nil:
+		return nil, v1.ErrorUnknown("unknown error: %v", err)
+	}
 
 	// delete user
-	err = r.data.db.User.DeleteOneID(userId).Exec(ctx)
+	err = tx.User.DeleteOneID(userId).Exec(ctx)
 	switch {
 	case err == nil:
-		// delete indexed cache
-		if err = r.deleteCache(
-			ctx,
-			// key: user_cache_key_get_user_id:userId
-			r.cacheKey(strconv.FormatInt(userId, 10), r.ck["Get"]...),
-			// key: user_cache_key_get_user_id_edge_ids:userId
-			r.cacheKey(strconv.FormatInt(userId, 10), append(r.ck["Get"], "edge_ids")...),
-			// key: user_cache_key_get_user:userEmail
-			r.cacheKey(res.Email, r.ck["GetByEmail"]...),
-			// key: user_cache_key_get_user_edge_ids:userEmail
-			r.cacheKey(res.Email, append(r.ck["GetByEmail"], "edge_ids")...),
-			// key: user_cache_key_is_admin_user_id:userId
-			r.cacheKey(strconv.FormatInt(userId, 10), r.ck["IsAdminUser"]...),
-		); err != nil {
-			// TODO: delete again using the asynchronous queue
-			r.log.Error(err)
-		}
-		// delete cache by scan redis
-		if err = r.deleteKeysByScanPrefix(ctx,
-			// match key: user_cache_key_list_user:pageSize_pageToken and
-			// key: user_cache_key_list_user_edge_ids:pageSize_pageToken
-			userCacheKeyPrefix+strings.Join(r.ck["List"], "_"),
-		); err != nil {
-			// TODO: delete again using the asynchronous queue
-			r.log.Error(err)
-		}
-		return nil
 	case ent.IsNotFound(err):
-		return v1.ErrorNotFound("user not found: %v", err)
+		return nil, v1.ErrorNotFound("user not found: %v", err)
 	default:
-		return v1.ErrorUnknown("unknown error: %v", err)
+		return nil, v1.ErrorUnknown("unknown error: %v", err)
+	}
+
+	if err = checkMembersKept(ctx, tx, res.GroupID); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (r *userRepo) PurgeDeleted(ctx context.Context, t time.Time) ([]int64, error) {
+	pending, err := r.data.db.User.Query().
+		Where(user.StatusEQ(user.StatusPendingDeletion), user.DeleteAtLTE(t)).
+		All(ctx)
+	if err != nil {
+		return nil, v1.ErrorUnknown("unknown error: %v", err)
+	}
+
+	purged := make([]int64, 0, len(pending))
+	for _, u := range pending {
+		// the user may be restored in the meantime, the owned rows are deleted by cascade
+		n, dErr := r.data.db.User.Delete().
+			Where(user.ID(u.ID), user.StatusEQ(user.StatusPendingDeletion), user.DeleteAtLTE(t)).
+			Exec(ctx)
+		if dErr != nil {
+			return purged, v1.ErrorUnknown("unknown error: %v", dErr)
+		}
+		if n > 0 {
+			r.invalidateCache(ctx, u.ID, u.Email)
+			r.invalidateMembers(ctx, u.GroupID)
+			purged = append(purged, u.ID)
+		}
 	}
+	return purged, nil
 }
 
 func (r *userRepo) List(
@@ -300,63 +383,27 @@ func (r *userRepo) List(
 	}
 
 	var (
-		err error
-		key string
-		res any
+		entList []*ent.User
+		err     error
 	)
-
+	unique := strings.Join([]string{strconv.FormatInt(int64(pageSize), 10), pageToken}, "_")
 	switch userView {
 	case biz.UserViewViewUnspecified, biz.UserViewBasic:
-		// key: user_cache_key_list_user:pageSize_pageToken
-		key = r.cacheKey(
-			strings.Join([]string{strconv.FormatInt(int64(pageSize), 10), pageToken}, "_"),
-			r.ck["List"]...,
-		)
-		res, err, _ = r.sg.Do(key, func() (any, error) {
-			var entList []*ent.User
-			// get cache
-			cErr := r.data.cache.GetSkippingLocalCache(ctx, key, &entList)
-			if cErr != nil && errors.Is(cErr, cache.ErrCacheMiss) { // cache miss
-				// get from db
-				entList, cErr = listQuery.All(ctx)
-			}
-			return entList, cErr
+		entList, err = r.list.Get(ctx, unique, func(ctx context.Context) ([]*ent.User, error) {
+			return listQuery.All(ctx)
 		})
 	case biz.UserViewWithEdgeIds:
-		// key: user_cache_key_list_user_edge_ids:pageSize_pageToken
-		key = r.cacheKey(
-			strings.Join([]string{strconv.FormatInt(int64(pageSize), 10), pageToken}, "_"),
-			append(r.ck["List"], "edge_ids")...,
-		)
-		res, err, _ = r.sg.Do(key, func() (any, error) {
-			var entList []*ent.User
-			// get cache
-			cErr := r.data.cache.GetSkippingLocalCache(ctx, key, &entList)
-			if cErr != nil && errors.Is(cErr, cache.ErrCacheMiss) { // cache miss
-				// get from db
-				entList, cErr = listQuery.WithOwnerGroup(func(query *ent.GroupQuery) {
-					query.Select(group.FieldID)
-					query.Select(group.FieldName)
-				}).All(ctx)
-			}
-			return entList, cErr
+		entList, err = r.listWithEdges.Get(ctx, unique, func(ctx context.Context) ([]*ent.User, error) {
+			return listQuery.WithOwnerGroup(func(query *ent.GroupQuery) {
+				query.Select(group.FieldID)
+				query.Select(group.FieldName)
+			}).All(ctx)
 		})
 	default:
 		return nil, v1.ErrorInvalidArgument("invalid argument: unknown view")
 	}
 	switch {
-	case err == nil: // db hit, set cache
-		entList := res.([]*ent.User)
-		if err = r.data.cache.Set(&cache.Item{
-			Ctx:            ctx,
-			Key:            key,
-			Value:          entList,
-			TTL:            r.data.conf.Cache.Ttl.AsDuration(),
-			SkipLocalCache: true,
-		}); err != nil {
-			r.log.Errorf("cache error: %v", err)
-		}
-
+	case err == nil:
 		// generate next page token
 		var nextPageToken string
 		if len(entList) == pageSize+1 {
@@ -393,6 +440,19 @@ func (r *userRepo) BatchCreate(ctx context.Context, users []*biz.User) ([]*biz.U
 	res, err := r.data.db.User.CreateBulk(bulk...).Save(ctx)
 	switch {
 	case err == nil:
+		groupIds := make([]int64, len(res))
+		var keys []string
+		for i, u := range res {
+			groupIds[i] = u.GroupID
+			keys = append(keys, r.cacheKeys(u.ID, u.Email)...)
+		}
+		// the negative entries of the users are deleted as well
+		if dErr := r.cache.Delete(ctx, keys...); dErr != nil {
+			// TODO: delete again using the asynchronous queue
+			r.log.Error(dErr)
+		}
+		r.invalidateMembers(ctx, groupIds...)
+		r.invalidateList(ctx)
 		userList, tErr := toUserList(res)
 		if tErr != nil {
 			return nil, v1.ErrorInternal("internal error: %v", tErr)
@@ -407,6 +467,252 @@ func (r *userRepo) BatchCreate(ctx context.Context, users []*biz.User) ([]*biz.U
 	}
 }
 
+func (r *userRepo) ListByGroup(
+	ctx context.Context,
+	groupId int64,
+	filter *biz.UserFilter,
+	pageSize int,
+	pageToken string,
+) (*biz.UserPage, error) {
+	listQuery := r.data.db.User.Query().
+		Where(user.GroupID(groupId)).
+		Order(ent.Asc(user.FieldID)).
+		Limit(pageSize + 1)
+	if pageToken != "" {
+		token, pErr := pagination.DecodePageToken(pageToken)
+		if pErr != nil {
+			return nil, v1.ErrorInternal("decode page token err: %v", pErr)
+		}
+		listQuery = listQuery.Where(user.IDGTE(token))
+	}
+	if filter != nil {
+		if filter.Status != nil {
+			listQuery = listQuery.Where(user.StatusEQ(toEntUserStatus(*filter.Status)))
+		}
+		if filter.Query != "" {
+			listQuery = listQuery.Where(user.Or(
+				user.EmailContainsFold(filter.Query),
+				user.NickNameContainsFold(filter.Query),
+			))
+		}
+	}
+
+	entList, err := listQuery.All(ctx)
+	if err != nil {
+		return nil, v1.ErrorUnknown("unknown error: %v", err)
+	}
+
+	// generate next page token
+	var nextPageToken string
+	if len(entList) == pageSize+1 {
+		nextPageToken, err = pagination.EncodePageToken(entList[len(entList)-1].ID)
+		if err != nil {
+			return nil, v1.ErrorInternal("encode page token error: %v", err)
+		}
+		entList = entList[:len(entList)-1]
+	}
+
+	userList, err := toUserList(entList)
+	if err != nil {
+		return nil, v1.ErrorInternal("internal error: %v", err)
+	}
+	return &biz.UserPage{
+		Users:         userList,
+		NextPageToken: nextPageToken,
+	}, nil
+}
+
+func (r *userRepo) CountByGroup(ctx context.Context, groupId int64) (int, error) {
+	count, err := r.data.db.User.Query().
+		Where(user.HasOwnerGroupWith(group.ID(groupId))).
+		Count(ctx)
+	if err != nil {
+		return 0, v1.ErrorUnknown("unknown error: %v", err)
+	}
+	return count, nil
+}
+
+func (r *userRepo) MoveGroup(ctx context.Context, fromGroupId, toGroupId int64, userIds []int64) ([]int64, error) {
+	if len(userIds) > biz.MaxBatchUpdateSize {
+		return nil, v1.ErrorBatchSize("batch size cannot be greater than %d", biz.MaxBatchUpdateSize)
+	}
+	if userIds != nil {
+		seen := make(map[int64]bool, len(userIds))
+		unique := make([]int64, 0, len(userIds))
+		for _, id := range userIds {
+			if !seen[id] {
+				seen[id] = true
+				unique = append(unique, id)
+			}
+		}
+		userIds = unique
+	}
+
+	// all the members are moved by the batches in the transactions of their own, so that the locks are held for
+	// a batch at most, the members moved are no longer matched
+	var ids []int64
+	for {
+		moved, err := r.moveGroupTx(ctx, fromGroupId, toGroupId, userIds)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range moved {
+			ids = append(ids, u.ID)
+		}
+		if userIds != nil || len(moved) < biz.MaxBatchUpdateSize {
+			return ids, nil
+		}
+	}
+}
+
+// moveGroupTx moves the users, or a batch of all the members if userIds is nil, in a transaction, and returns the
+// users moved
+func (r *userRepo) moveGroupTx(ctx context.Context, fromGroupId, toGroupId int64, userIds []int64) ([]*ent.User, error) {
+	tx, err := r.data.db.Tx(ctx)
+	if err != nil {
+		return nil, v1.ErrorInternal("create transactional client error: %v", err)
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			if rErr := tx.Rollback(); rErr != nil {
+				r.log.Warnf("rollback failed, err: %v", rErr)
+			}
+			panic(v)
+		}
+	}()
+
+	moved, err := r.moveGroup(ctx, tx, fromGroupId, toGroupId, userIds)
+	if err != nil {
+		if rErr := tx.Rollback(); rErr != nil {
+			return nil, v1.ErrorInternal("rollback failed, err: %v",
+				fmt.Errorf("%w: rolling back transaction: %v", err, rErr))
+		}
+		return nil, err
+	}
+	if cErr := tx.Commit(); cErr != nil {
+		return nil, v1.ErrorInternal("failed commits the transaction, err: %v", cErr)
+	}
+
+	for _, u := range moved {
+		r.invalidateCache(ctx, u.ID, u.Email)
+	}
+	if len(moved) > 0 {
+		r.invalidateMembers(ctx, fromGroupId, toGroupId)
+	}
+	return moved, nil
+}
+
+// moveGroup moves the users, or a batch of all the members if userIds is nil, and returns the users moved
+func (r *userRepo) moveGroup(
+	ctx context.Context,
+	tx *ent.Tx,
+	fromGroupId, toGroupId int64,
+	userIds []int64,
+) ([]*ent.User, error) {
+	groups, err := tx.Group.Query().
+		Where(group.IDIn(fromGroupId, toGroupId)).
+		All(ctx)
+	if err != nil {
+		return nil, v1.ErrorUnknown("unknown error: %v", err)
+	}
+	if len(groups) != 2 {
+		return nil, v1.ErrorNotFound("group not found")
+	}
+
+	var moved []*ent.User
+	if userIds != nil {
+		moved, err = r.moveBatch(ctx, tx, fromGroupId, toGroupId, user.IDIn(userIds...))
+		if err != nil {
+			return nil, err
+		}
+		if len(moved) != len(userIds) {
+			return nil, v1.ErrorNotFound("user not found in group %d", fromGroupId)
+		}
+	} else {
+		// moving all the members empties the group, refused before the batches committed
+		for _, g := range groups {
+			if g.ID == fromGroupId && biz.HasPermission(toPermissions(g.Permissions), biz.PermissionUsersWrite) {
+				return nil, v1.ErrorBadGroupOperation("the group %s can not be emptied", g.Name)
+			}
+		}
+		moved, err = r.moveBatch(ctx, tx, fromGroupId, toGroupId)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(moved) == 0 {
+		return moved, nil
+	}
+
+	if err = checkMembersKept(ctx, tx, fromGroupId); err != nil {
+		return nil, err
+	}
+	return moved, nil
+}
+
+// MoveBaseGroup rewrites the base group of the users upgraded from fromGroupId to toGroupId
+func (r *userRepo) MoveBaseGroup(ctx context.Context, fromGroupId, toGroupId int64) error {
+	upgraded, err := r.data.db.User.Query().
+		Where(user.BaseGroupIDEQ(fromGroupId)).
+		Select(user.FieldID, user.FieldEmail).
+		All(ctx)
+	if err != nil {
+		return v1.ErrorUnknown("unknown error: %v", err)
+	}
+	if len(upgraded) == 0 {
+		return nil
+	}
+
+	if err = r.data.db.User.Update().
+		Where(user.BaseGroupIDEQ(fromGroupId)).
+		SetBaseGroupID(toGroupId).
+		Exec(ctx); err != nil {
+		return v1.ErrorUnknown("unknown error: %v", err)
+	}
+	for _, u := range upgraded {
+		r.invalidateCache(ctx, u.ID, u.Email)
+	}
+	return nil
+}
+
+// moveBatch moves at most biz.MaxBatchUpdateSize members of fromGroupId matched the predicates, and returns the
+// users moved
+func (r *userRepo) moveBatch(
+	ctx context.Context,
+	tx *ent.Tx,
+	fromGroupId, toGroupId int64,
+	ps ...predicate.User,
+) ([]*ent.User, error) {
+	moved, err := tx.User.Query().
+		Where(user.HasOwnerGroupWith(group.ID(fromGroupId))).
+		Where(ps...).
+		Order(ent.Asc(user.FieldID)).
+		Limit(biz.MaxBatchUpdateSize).
+		Select(user.FieldID, user.FieldEmail).
+		All(ctx)
+	if err != nil {
+		return nil, v1.ErrorUnknown("unknown error: %v", err)
+	}
+	if len(moved) == 0 {
+		return moved, nil
+	}
+
+	ids := make([]int64, len(moved))
+	for i, u := range moved {
+		ids[i] = u.ID
+	}
+	// the group upgrades of the users moved are dropped, see update
+	if err = tx.User.Update().
+		Where(user.IDIn(ids...)).
+		SetOwnerGroupID(toGroupId).
+		ClearBaseGroupID().
+		ClearGroupExpireAt().
+		Exec(ctx); err != nil {
+		return nil, v1.ErrorUnknown("unknown error: %v", err)
+	}
+	return moved, nil
+}
+
 func (r *userRepo) createBuilder(user *biz.User) *ent.UserCreate {
 	m := r.data.db.User.Create()
 	m.SetEmail(user.Email)
@@ -422,43 +728,11 @@ func (r *userRepo) createBuilder(user *biz.User) *ent.UserCreate {
 	return m
 }
 
-func (r *userRepo) IsAdminUser(ctx context.Context, userId int64) (bool, error) {
-	// key: user_cache_key_is_admin_user_id:userId
-	key := r.cacheKey(strconv.FormatInt(userId, 10), r.ck["IsAdminUser"]...)
-	var res bool
-	// get cache
-	err := r.data.cache.Get(ctx, key, res)
-	if err != nil && errors.Is(err, cache.ErrCacheMiss) { // cache miss
-		// get from db
-		res, err = r.data.db.User.Query().
-			Where(user.ID(userId)).
-			Where(user.HasOwnerGroupWith(group.NameEQ("Admin"))).
-			Exist(ctx)
-	}
-
-	switch {
-	case err == nil: // db hit, set cache
-		if err = r.data.cache.Set(&cache.Item{
-			Ctx:   ctx,
-			Key:   key,
-			Value: res,
-			TTL:   r.data.conf.Cache.Ttl.AsDuration(),
-		}); err != nil {
-			r.log.Errorf("cache error: %v", err)
-		}
-		return res, nil
-	default: // error
-		return false, v1.ErrorUnknown("unknown error: %v", err)
-	}
-}
-
 func (r *userRepo) CacheSRPServer(ctx context.Context, email string, server *srp.Server) error {
-	err := r.data.cache.Set(&cache.Item{
-		Ctx:   ctx,
-		Key:   email,
-		Value: server,
-		TTL:   r.data.conf.Cache.SrpTtl.AsDuration(),
-	})
+	b, err := r.data.cache.Marshal(server)
+	if err == nil {
+		err = r.data.kv.Set(ctx, email, string(b), r.data.conf.Cache.SrpTtl.AsDuration())
+	}
 	if err != nil {
 		r.log.Errorf("cache error: %v", err)
 		return v1.ErrorCacheOperation("cache srp error")
@@ -469,45 +743,265 @@ func (r *userRepo) CacheSRPServer(ctx context.Context, email string, server *srp
 func (r *userRepo) GetSRPServer(ctx context.Context, email string) (*srp.Server, error) {
 	get := &srp.Server{}
 	// get cache
-	err := r.data.cache.Get(ctx, email, get)
-	if err != nil && errors.Is(err, cache.ErrCacheMiss) { // cache miss
+	b, err := r.data.kv.Get(ctx, email)
+	switch {
+	case errors.Is(err, redis.Nil): // cache miss
 		return nil, v1.ErrorCacheOperation("srp cache expired")
+	case err != nil:
+		r.log.Errorf("cache error: %v", err)
+		return nil, v1.ErrorCacheOperation("get srp error")
+	}
+	if err = r.data.cache.Unmarshal([]byte(b), get); err != nil {
+		return nil, v1.ErrorCacheOperation("get srp error: %v", err)
 	}
 	return get, nil
 }
 
-func (r *userRepo) cacheKey(unique string, a ...string) string {
-	s := strings.Join(a, "_")
-	return userCacheKeyPrefix + s + ":" + unique
+func (r *userRepo) UpdateVerifier(ctx context.Context, userId int64, salt, verifier []byte) error {
+	res, err := r.data.db.User.UpdateOneID(userId).
+		SetSalt(salt).
+		SetVerifier(verifier).
+		Save(ctx)
+	switch {
+	case err == nil:
+		r.invalidateCache(ctx, res.ID, res.Email)
+		return nil
+	case ent.IsNotFound(err):
+		return v1.ErrorNotFound("user not found: %v", err)
+	default:
+		return v1.ErrorUnknown("unknown error: %v", err)
+	}
 }
 
-// deleteCache delete the cache both local cache and redis
-func (r *userRepo) deleteCache(ctx context.Context, key ...string) error {
-	for _, k := range key {
-		if err := r.data.cache.Delete(ctx, k); err != nil {
-			return v1.ErrorCacheOperation("delete cache error: %v", err)
-		}
+func (r *userRepo) CacheInvite(ctx context.Context, token string, userId int64, ttl time.Duration) error {
+	// key: user_cache_key_invite_token:sha256(token)
+	key := r.cache.key("invite_token", hashToken(token))
+	if err := r.data.kv.Set(ctx, key, strconv.FormatInt(userId, 10), ttl); err != nil {
+		return v1.ErrorCacheOperation("cache invite error: %v", err)
 	}
 	return nil
 }
 
-// deleteKeysByScanPrefix delete the keys by scan the prefix on redis,
-// notice that this function will not delete the keys on local cache
-func (r *userRepo) deleteKeysByScanPrefix(ctx context.Context, prefix ...string) error {
-	for _, p := range prefix {
-		iter := r.data.rdCmd.Scan(ctx, 0, p+"*", 0).Iterator()
-		for iter.Next(ctx) {
-			if err := r.data.rdCmd.Del(ctx, iter.Val()).Err(); err != nil {
-				return v1.ErrorCacheOperation("delete user cache keys by scan prefix error: %v", err)
+func (r *userRepo) TakeInvite(ctx context.Context, token string) (int64, error) {
+	// key: user_cache_key_invite_token:sha256(token)
+	key := r.cache.key("invite_token", hashToken(token))
+	v, err := r.data.kv.GetDel(ctx, key)
+	switch {
+	case err == nil:
+		userId, pErr := strconv.ParseInt(v, 10, 64)
+		if pErr != nil {
+			return 0, v1.ErrorCacheOperation("get invite error: %v", pErr)
+		}
+		return userId, nil
+	case errors.Is(err, redis.Nil):
+		return 0, v1.ErrorNotFound("invite not found or expired")
+	default:
+		return 0, v1.ErrorCacheOperation("get invite error: %v", err)
+	}
+}
+
+func (r *userRepo) UpdateTOTP(ctx context.Context, userId int64, totp *biz.TOTP) error {
+	m := r.data.db.User.UpdateOneID(userId)
+	m.SetTotpEnabled(totp.Enabled)
+	if totp.Secret != "" {
+		m.SetTotpSecret(totp.Secret)
+	} else {
+		m.ClearTotpSecret()
+	}
+	if len(totp.RecoveryCodes) != 0 {
+		m.SetTotpRecoveryCodes(totp.RecoveryCodes)
+	} else {
+		m.ClearTotpRecoveryCodes()
+	}
+
+	res, err := m.Save(ctx)
+	switch {
+	case err == nil:
+		r.invalidateCache(ctx, res.ID, res.Email)
+		return nil
+	case ent.IsNotFound(err):
+		return v1.ErrorNotFound("user not found: %v", err)
+	default:
+		return v1.ErrorUnknown("unknown error: %v", err)
+	}
+}
+
+func (r *userRepo) MarkTOTPUsed(ctx context.Context, userId int64, counter int64, ttl time.Duration) (bool, error) {
+	// key: user_cache_key_totp_used_id:userId_counter
+	key := r.cache.key("totp_used_id",
+		strings.Join([]string{strconv.FormatInt(userId, 10), strconv.FormatInt(counter, 10)}, "_"),
+	)
+	ok, err := r.data.kv.SetNX(ctx, key, "1", ttl)
+	if err != nil {
+		return false, v1.ErrorCacheOperation("mark totp used error: %v", err)
+	}
+	return ok, nil
+}
+
+func (r *userRepo) ConsumeRecoveryCode(ctx context.Context, userId int64, hashed string) (bool, error) {
+	tx, err := r.data.db.Tx(ctx)
+	if err != nil {
+		return false, v1.ErrorInternal("create transactional client error: %v", err)
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			if rErr := tx.Rollback(); rErr != nil {
+				r.log.Warnf("rollback failed, err: %v", rErr)
 			}
+			panic(v)
+		}
+	}()
+
+	u, err := r.consumeRecoveryCode(ctx, tx, userId, hashed)
+	if err != nil {
+		if rErr := tx.Rollback(); rErr != nil {
+			return false, v1.ErrorInternal("rollback failed, err: %v",
+				fmt.Errorf("%w: rolling back transaction: %v", err, rErr))
 		}
-		if err := iter.Err(); err != nil {
-			return v1.ErrorCacheOperation("delete user cache keys by scan prefix error: %v", err)
+		return false, err
+	}
+	if cErr := tx.Commit(); cErr != nil {
+		return false, v1.ErrorInternal("failed commits the transaction, err: %v", cErr)
+	}
+	if u == nil {
+		return false, nil
+	}
+
+	r.invalidateCache(ctx, u.ID, u.Email)
+	return true, nil
+}
+
+// consumeRecoveryCode removes the code from the stored list, and returns the user updated, or nil if the code is
+// not found
+func (r *userRepo) consumeRecoveryCode(ctx context.Context, tx *ent.Tx, userId int64, hashed string) (*ent.User, error) {
+	u, err := tx.User.Query().
+		Where(user.ID(userId)).
+		Select(user.FieldID, user.FieldEmail, user.FieldTotpRecoveryCodes).
+		Only(ctx)
+	switch {
+	case ent.IsNotFound(err):
+		return nil, v1.ErrorNotFound("user not found: %v", err)
+	case err != nil:
+		return nil, v1.ErrorUnknown("unknown error: %v", err)
+	}
+
+	i := -1
+	for j, c := range u.TotpRecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(c), []byte(hashed)) == 1 {
+			i = j
 		}
 	}
+	if i < 0 {
+		return nil, nil
+	}
+	remain := make([]string, 0, len(u.TotpRecoveryCodes)-1)
+	remain = append(remain, u.TotpRecoveryCodes[:i]...)
+	remain = append(remain, u.TotpRecoveryCodes[i+1:]...)
+
+	// the codes are only ever removed, so the list still holding the code with the length read is the list read,
+	// and the concurrent consumption of the same code updates nothing
+	m := tx.User.Update().
+		Where(
+			user.ID(userId),
+			func(s *sql.Selector) {
+				s.Where(sqljson.ValueContains(user.FieldTotpRecoveryCodes, hashed))
+			},
+			func(s *sql.Selector) {
+				s.Where(sqljson.LenEQ(user.FieldTotpRecoveryCodes, len(u.TotpRecoveryCodes)))
+			},
+		)
+	if len(remain) != 0 {
+		m.SetTotpRecoveryCodes(remain)
+	} else {
+		m.ClearTotpRecoveryCodes()
+	}
+	n, err := m.Save(ctx)
+	if err != nil {
+		return nil, v1.ErrorUnknown("unknown error: %v", err)
+	}
+	if n == 0 {
+		return nil, nil
+	}
+	return u, nil
+}
+
+func (r *userRepo) CountTOTPFailure(ctx context.Context, userId int64, window time.Duration) (int64, error) {
+	// key: user_cache_key_totp_failures_id:userId
+	n, err := r.data.kv.IncrExpire(ctx, r.cache.key("totp_failures_id", strconv.FormatInt(userId, 10)), window)
+	if err != nil {
+		return 0, v1.ErrorCacheOperation("count totp failure error: %v", err)
+	}
+	return n, nil
+}
+
+func (r *userRepo) TOTPFailures(ctx context.Context, userId int64) (int64, error) {
+	v, err := r.data.kv.Get(ctx, r.cache.key("totp_failures_id", strconv.FormatInt(userId, 10)))
+	switch {
+	case err == nil:
+		n, pErr := strconv.ParseInt(v, 10, 64)
+		if pErr != nil {
+			return 0, v1.ErrorCacheOperation("get totp failures error: %v", pErr)
+		}
+		return n, nil
+	case errors.Is(err, redis.Nil):
+		return 0, nil
+	default:
+		return 0, v1.ErrorCacheOperation("get totp failures error: %v", err)
+	}
+}
+
+func (r *userRepo) ClearTOTPFailures(ctx context.Context, userId int64) error {
+	if err := r.data.kv.Del(ctx, r.cache.key("totp_failures_id", strconv.FormatInt(userId, 10))); err != nil {
+		return v1.ErrorCacheOperation("clear totp failures error: %v", err)
+	}
 	return nil
 }
 
+// invalidateCache deletes the entries of the user, and invalidates the list pages, the failure is only logged
+func (r *userRepo) invalidateCache(ctx context.Context, userId int64, email string) {
+	if err := r.cache.Delete(ctx, r.cacheKeys(userId, email)...); err != nil {
+		// TODO: delete again using the asynchronous queue
+		r.log.Error(err)
+	}
+	r.invalidateList(ctx)
+}
+
+// cacheKeys returns the keys of the entries of the user
+func (r *userRepo) cacheKeys(userId int64, email string) []string {
+	unique := strconv.FormatInt(userId, 10)
+	return []string{
+		r.byId.Key(unique),
+		r.byIdWithEdges.Key(unique),
+		r.byEmail.Key(email),
+		r.byEmailWithEdges.Key(email),
+	}
+}
+
+// invalidateList invalidates all the list pages of users, the failure is only logged
+func (r *userRepo) invalidateList(ctx context.Context) {
+	if err := r.cache.Invalidate(ctx, userCacheTagList); err != nil {
+		r.log.Error(err)
+	}
+}
+
+// invalidateMembers deletes the members cached by the groups
+func (r *userRepo) invalidateMembers(ctx context.Context, groupIds ...int64) {
+	keys := make([]string, len(groupIds))
+	for i, groupId := range groupIds {
+		keys[i] = groupMembersCacheKey(groupId)
+	}
+	if err := r.cache.Delete(ctx, keys...); err != nil {
+		// TODO: delete again using the asynchronous queue
+		r.log.Error(err)
+	}
+}
+
+// hashToken keeps the plaintext token out of the cache keys
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 func toUserStatus(e user.Status) biz.UserStatus { return biz.UserStatus(e) }
 
 func toEntUserStatus(u biz.UserStatus) user.Status { return user.Status(u) }
@@ -523,6 +1017,17 @@ func toUser(e *ent.User) (*biz.User, error) {
 	u.Storage = e.Storage
 	u.Score = e.Score
 	u.Status = toUserStatus(e.Status)
+	u.TOTP = biz.TOTP{
+		Secret:        e.TotpSecret,
+		Enabled:       e.TotpEnabled,
+		RecoveryCodes: e.TotpRecoveryCodes,
+	}
+	u.BaseGroupId = e.BaseGroupID
+	u.GroupExpireAt = e.GroupExpireAt
+	u.DeleteAt = e.DeleteAt
+	u.StorageQuota = e.StorageQuota
+	u.UsedStorage = e.UsedStorage
+	u.OveruseAt = e.OveruseAt
 	u.CreateAt = e.CreatedAt
 	u.UpdateAt = e.UpdatedAt
 	if edg := e.Edges.OwnerGroup; edg != nil {
@@ -6,11 +6,15 @@ import (
 	"io"
 	"regexp"
 	"testing"
+	"time"
 
+	"github.com/go-kratos/kratos/v2/errors"
 	"github.com/go-kratos/kratos/v2/log"
 	"github.com/stretchr/testify/assert"
 
+	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
 	"github.com/hominsu/pallas/app/pallas/service/internal/biz"
+	"github.com/hominsu/pallas/app/pallas/service/internal/conf"
 	"github.com/hominsu/pallas/app/pallas/service/internal/data/ent/group"
 	"github.com/hominsu/pallas/pkg/srp"
 	"github.com/hominsu/pallas/pkg/utils"
@@ -50,7 +54,7 @@ func TestUserRepo_Create(t *testing.T) {
 	}
 
 	for _, d := range ds {
-		t.Run(d.data.conf.Database.Driver, func(t *testing.T) {
+		t.Run(testName(d.data.conf), func(t *testing.T) {
 			defer d.cleanup()
 			for _, tt := range userTestSuite {
 				t.Run(tt.user.NickName, func(t *testing.T) {
@@ -93,7 +97,7 @@ func TestUserRepo_Get(t *testing.T) {
 	}
 
 	for _, d := range ds {
-		t.Run(d.data.conf.Database.Driver, func(t *testing.T) {
+		t.Run(testName(d.data.conf), func(t *testing.T) {
 			defer d.cleanup()
 			for _, tt := range userTestSuite {
 				t.Run(tt.user.NickName, func(t *testing.T) {
@@ -154,7 +158,7 @@ func TestUserRepo_GetByEmail(t *testing.T) {
 	}
 
 	for _, d := range ds {
-		t.Run(d.data.conf.Database.Driver, func(t *testing.T) {
+		t.Run(testName(d.data.conf), func(t *testing.T) {
 			defer d.cleanup()
 			for _, tt := range userTestSuite {
 				t.Run(tt.name, func(t *testing.T) {
@@ -210,7 +214,7 @@ func TestUserRepo_Update(t *testing.T) {
 	}
 
 	for _, d := range ds {
-		t.Run(d.data.conf.Database.Driver, func(t *testing.T) {
+		t.Run(testName(d.data.conf), func(t *testing.T) {
 			defer d.cleanup()
 			for _, tt := range userTestSuite {
 				t.Run(tt.name, func(t *testing.T) {
@@ -254,6 +258,89 @@ func TestUserRepo_Update(t *testing.T) {
 	}
 }
 
+func TestUserUsecase_UpdateUser(t *testing.T) {
+	logger := log.With(log.NewStdLogger(io.Discard))
+
+	cs := newTestDataConf()
+	for _, c := range cs {
+		d, cleanup := newTestData(t, c)
+		params, err := srp.GetParams(2048)
+		assert.NoError(t, err)
+		ur := NewUserRepo(d, logger)
+		store := NewSessionStore(d.rdCmd, &conf.Secret{Session: &conf.Secret_Session{SessionKey: "test"}}, logger)
+		uc := biz.NewUserUsecase(
+			ur,
+			NewGroupRepo(d, logger),
+			NewSettingRepo(d, logger),
+			NewSessionRepo(store, logger),
+			params,
+			logger,
+		)
+
+		t.Run(testName(c), func(t *testing.T) {
+			defer cleanup()
+			ctx := context.TODO()
+
+			userGroup, err := d.db.Group.Query().Where(group.NameEQ("User")).Only(ctx)
+			assert.NoError(t, err)
+			adminGroup, err := d.db.Group.Query().Where(group.NameEQ("Admin")).Only(ctx)
+			assert.NoError(t, err)
+
+			email := "test-mask@pallas.icu"
+			salt := []byte(utils.RandString(20, utils.AllCharSet))
+			password := []byte(utils.RandString(20, utils.AllCharSet))
+			u, err := ur.Create(ctx, &biz.User{
+				Email:      email,
+				NickName:   "test-mask",
+				Salt:       salt,
+				Verifier:   srp.ComputeVerifier(params, salt, []byte(email), password),
+				Storage:    utils.GibiByte,
+				Status:     biz.StatusActive,
+				OwnerGroup: &biz.Group{Id: userGroup.ID},
+			})
+			assert.NoError(t, err)
+			admin, err := ur.GetByEmail(ctx, "admin@pallas.icu", biz.UserViewBasic)
+			assert.NoError(t, err)
+
+			// the fields out of the mask are left unchanged
+			res, err := uc.UpdateUser(ctx, u.Id, &biz.User{Id: u.Id, NickName: "renamed"}, []string{"nick_name"})
+			assert.NoError(t, err)
+			assert.Equal(t, "renamed", res.NickName)
+			assert.Equal(t, email, res.Email)
+			assert.Equal(t, utils.GibiByte, res.Storage)
+			assert.Equal(t, v1.User_ACTIVE, res.Status)
+
+			// user can only update nick_name
+			_, err = uc.UpdateUser(
+				ctx, u.Id, &biz.User{Id: u.Id, Storage: utils.TebiByte, GroupId: adminGroup.ID},
+				[]string{"storage", "group_id", "unknown"},
+			)
+			assert.True(t, v1.IsInvalidArgument(err))
+			md := errors.FromError(err).GetMetadata()
+			assert.Equal(t, "field is not writable: storage", md["update_mask.paths[0]"])
+			assert.Equal(t, "field is not writable: group_id", md["update_mask.paths[1]"])
+			assert.Equal(t, "unknown field: unknown", md["update_mask.paths[2]"])
+
+			_, err = uc.UpdateUser(ctx, u.Id, &biz.User{Id: u.Id}, nil)
+			assert.True(t, v1.IsInvalidArgument(err))
+
+			// admin can also update storage and group_id, but not status and score
+			res, err = uc.UpdateUser(
+				ctx, admin.Id, &biz.User{Id: admin.Id, Storage: utils.TebiByte, GroupId: adminGroup.ID},
+				[]string{"storage", "group_id"},
+			)
+			assert.NoError(t, err)
+			assert.Equal(t, utils.TebiByte, res.Storage)
+			_, err = uc.UpdateUser(ctx, admin.Id, &biz.User{Id: admin.Id}, []string{"status"})
+			assert.True(t, v1.IsInvalidArgument(err))
+			_, err = uc.UpdateUser(ctx, admin.Id, &biz.User{Id: admin.Id}, []string{"score"})
+			assert.True(t, v1.IsInvalidArgument(err))
+
+			flushTestData(t, d)
+		})
+	}
+}
+
 func TestUserRepo_Delete(t *testing.T) {
 	ds := newTestUserDataSuite(t)
 
@@ -267,7 +354,7 @@ func TestUserRepo_Delete(t *testing.T) {
 	}
 
 	for _, d := range ds {
-		t.Run(d.data.conf.Database.Driver, func(t *testing.T) {
+		t.Run(testName(d.data.conf), func(t *testing.T) {
 			defer d.cleanup()
 			for _, tt := range userTestSuite {
 				t.Run(tt.name, func(t *testing.T) {
@@ -308,6 +395,164 @@ func TestUserRepo_Delete(t *testing.T) {
 	}
 }
 
+func TestUserRepo_TOTP(t *testing.T) {
+	ds := newTestUserDataSuite(t)
+
+	for _, d := range ds {
+		t.Run(testName(d.data.conf), func(t *testing.T) {
+			defer d.cleanup()
+
+			params, err := srp.GetParams(2048)
+			assert.NoError(t, err)
+
+			targetGroup, err := d.data.db.Group.Query().Where(group.NameEQ("Anonymous")).Only(context.TODO())
+			assert.NoError(t, err)
+
+			email := "test-totp@pallas.icu"
+			salt := []byte(utils.RandString(20, utils.AllCharSet))
+			password := []byte(utils.RandString(20, utils.AllCharSet))
+			verifier := srp.ComputeVerifier(params, salt, []byte(email), password)
+
+			res, err := d.repo.Create(context.TODO(), &biz.User{
+				Email:      email,
+				NickName:   "test-totp",
+				Salt:       salt,
+				Verifier:   verifier,
+				Status:     biz.StatusActive,
+				OwnerGroup: &biz.Group{Id: targetGroup.ID},
+			})
+			assert.NoError(t, err)
+			assert.False(t, res.TOTP.Enabled)
+
+			// warm up the cache, which must be invalidated by the update
+			_, err = d.repo.Get(context.TODO(), res.Id, biz.UserViewBasic)
+			assert.NoError(t, err)
+
+			totp := &biz.TOTP{Secret: "JBSWY3DPEHPK3PXP", Enabled: true, RecoveryCodes: []string{"a", "b"}}
+			assert.NoError(t, d.repo.UpdateTOTP(context.TODO(), res.Id, totp))
+
+			target, err := d.repo.Get(context.TODO(), res.Id, biz.UserViewBasic)
+			assert.NoError(t, err)
+			assert.Equal(t, *totp, target.TOTP)
+
+			// a recovery code is consumed once, and the rest are kept
+			ok, err := d.repo.ConsumeRecoveryCode(context.TODO(), res.Id, "a")
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			ok, err = d.repo.ConsumeRecoveryCode(context.TODO(), res.Id, "a")
+			assert.NoError(t, err)
+			assert.False(t, ok)
+			target, err = d.repo.Get(context.TODO(), res.Id, biz.UserViewBasic)
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"b"}, target.TOTP.RecoveryCodes)
+			ok, err = d.repo.ConsumeRecoveryCode(context.TODO(), res.Id, "b")
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			target, err = d.repo.Get(context.TODO(), res.Id, biz.UserViewBasic)
+			assert.NoError(t, err)
+			assert.Empty(t, target.TOTP.RecoveryCodes)
+
+			assert.NoError(t, d.repo.UpdateTOTP(context.TODO(), res.Id, &biz.TOTP{}))
+			target, err = d.repo.Get(context.TODO(), res.Id, biz.UserViewBasic)
+			assert.NoError(t, err)
+			assert.False(t, target.TOTP.Enabled)
+			assert.Empty(t, target.TOTP.Secret)
+			assert.Empty(t, target.TOTP.RecoveryCodes)
+
+			// a time step counter can only be used once
+			ok, err = d.repo.MarkTOTPUsed(context.TODO(), res.Id, 1, time.Minute)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			ok, err = d.repo.MarkTOTPUsed(context.TODO(), res.Id, 1, time.Minute)
+			assert.NoError(t, err)
+			assert.False(t, ok)
+
+			// the misses are counted until cleared
+			n, err := d.repo.TOTPFailures(context.TODO(), res.Id)
+			assert.NoError(t, err)
+			assert.Zero(t, n)
+			for i := int64(1); i <= 3; i++ {
+				n, err = d.repo.CountTOTPFailure(context.TODO(), res.Id, time.Minute)
+				assert.NoError(t, err)
+				assert.Equal(t, i, n)
+			}
+			n, err = d.repo.TOTPFailures(context.TODO(), res.Id)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(3), n)
+			assert.NoError(t, d.repo.ClearTOTPFailures(context.TODO(), res.Id))
+			n, err = d.repo.TOTPFailures(context.TODO(), res.Id)
+			assert.NoError(t, err)
+			assert.Zero(t, n)
+
+			flushTestData(t, d.data)
+		})
+	}
+}
+
+func TestUserRepo_Invite(t *testing.T) {
+	ds := newTestUserDataSuite(t)
+
+	for _, d := range ds {
+		t.Run(testName(d.data.conf), func(t *testing.T) {
+			defer d.cleanup()
+
+			params, err := srp.GetParams(2048)
+			assert.NoError(t, err)
+
+			targetGroup, err := d.data.db.Group.Query().Where(group.NameEQ("User")).Only(context.TODO())
+			assert.NoError(t, err)
+
+			email := "test-invite@pallas.icu"
+			salt := []byte(utils.RandString(20, utils.AllCharSet))
+			verifier := srp.ComputeVerifier(params, salt, []byte(email), []byte(utils.RandString(20, utils.AllCharSet)))
+
+			res, err := d.repo.Create(context.TODO(), &biz.User{
+				Email:      email,
+				NickName:   "test-invite",
+				Salt:       salt,
+				Verifier:   verifier,
+				Status:     biz.StatusNonActivated,
+				OwnerGroup: &biz.Group{Id: targetGroup.ID},
+			})
+			assert.NoError(t, err)
+
+			assert.NoError(t, d.repo.CacheInvite(context.TODO(), "invite-token", res.Id, time.Minute))
+			userId, err := d.repo.TakeInvite(context.TODO(), "invite-token")
+			assert.NoError(t, err)
+			assert.Equal(t, res.Id, userId)
+			// an invite can only be taken once
+			_, err = d.repo.TakeInvite(context.TODO(), "invite-token")
+			assert.Error(t, err)
+
+			// warm up the cache, which must be invalidated by the update
+			_, err = d.repo.GetByEmail(context.TODO(), email, biz.UserViewBasic)
+			assert.NoError(t, err)
+
+			newSalt := []byte(utils.RandString(20, utils.AllCharSet))
+			newVerifier := srp.ComputeVerifier(params, newSalt, []byte(email), []byte("password"))
+			assert.NoError(t, d.repo.UpdateVerifier(context.TODO(), res.Id, newSalt, newVerifier))
+
+			target, err := d.repo.GetByEmail(context.TODO(), email, biz.UserViewBasic)
+			assert.NoError(t, err)
+			assert.Equal(t, newSalt, target.Salt)
+			assert.Equal(t, newVerifier, target.Verifier)
+
+			// the invite is kept if the password is missing
+			logger := log.With(log.NewStdLogger(io.Discard))
+			uc := biz.NewUserUsecase(d.repo, NewGroupRepo(d.data, logger), NewSettingRepo(d.data, logger), nil, params, logger)
+			assert.NoError(t, d.repo.CacheInvite(context.TODO(), "invite-token", res.Id, time.Minute))
+			err = uc.AcceptInvite(context.TODO(), "invite-token", newSalt, nil)
+			assert.True(t, v1.IsInvalidArgument(err))
+			assert.NoError(t, uc.AcceptInvite(context.TODO(), "invite-token", newSalt, newVerifier))
+			target, err = d.repo.GetByEmail(context.TODO(), email, biz.UserViewBasic)
+			assert.NoError(t, err)
+			assert.Equal(t, biz.StatusActive, target.Status)
+
+			flushTestData(t, d.data)
+		})
+	}
+}
+
 func TestUserRepo_List(t *testing.T) {
 	ds := newTestUserDataSuite(t)
 
@@ -322,7 +567,7 @@ func TestUserRepo_List(t *testing.T) {
 	}
 
 	for _, d := range ds {
-		t.Run(d.data.conf.Database.Driver, func(t *testing.T) {
+		t.Run(testName(d.data.conf), func(t *testing.T) {
 			defer d.cleanup()
 			nextPageToken := ""
 			for i, tt := range userTestSuite {
@@ -417,7 +662,7 @@ func TestUserRepo_BatchCreate(t *testing.T) {
 	}
 
 	for _, d := range ds {
-		t.Run(d.data.conf.Database.Driver, func(t *testing.T) {
+		t.Run(testName(d.data.conf), func(t *testing.T) {
 			defer d.cleanup()
 			for i, tt := range userTestSuite {
 				t.Run(fmt.Sprintf("batch-%d", i), func(t *testing.T) {
@@ -452,48 +697,157 @@ func TestUserRepo_BatchCreate(t *testing.T) {
 }
 */
 
-func TestUserRepo_IsAdminUser(t *testing.T) {
+func TestUserUsecase_Permissions(t *testing.T) {
 	ds := newTestUserDataSuite(t)
+	logger := log.With(log.NewStdLogger(io.Discard))
 
 	userTestSuite := []struct {
 		user       biz.User
 		ownerGroup string
-		assertion  assert.BoolAssertionFunc
+		expected   []biz.Permission
 	}{
-		{user: biz.User{NickName: "test-1"}, ownerGroup: "Admin", assertion: assert.True},
-		{user: biz.User{NickName: "test-2"}, ownerGroup: "User", assertion: assert.False},
-		{user: biz.User{NickName: "test-3"}, ownerGroup: "Anonymous", assertion: assert.False},
+		{user: biz.User{NickName: "test-1"}, ownerGroup: "Admin", expected: biz.AllPermissions},
+		{user: biz.User{NickName: "test-2"}, ownerGroup: "User", expected: []biz.Permission{}},
+		{user: biz.User{NickName: "test-3"}, ownerGroup: "Anonymous", expected: []biz.Permission{}},
 	}
 
 	for _, d := range ds {
-		t.Run(d.data.conf.Database.Driver, func(t *testing.T) {
+		params, err := srp.GetParams(2048)
+		assert.NoError(t, err)
+		gr := NewGroupRepo(d.data, logger)
+		gu := biz.NewGroupUsecase(gr, d.repo, logger)
+		uc := biz.NewUserUsecase(d.repo, gr, NewSettingRepo(d.data, logger), nil, params, logger)
+
+		t.Run(testName(d.data.conf), func(t *testing.T) {
 			defer d.cleanup()
+			ctx := context.TODO()
+			users := make(map[string]*biz.User)
 			for _, tt := range userTestSuite {
 				t.Run(tt.user.NickName, func(t *testing.T) {
-					params, err := srp.GetParams(2048)
+					targetGroup, err := d.data.db.Group.Query().Where(group.NameEQ(tt.ownerGroup)).Only(ctx)
 					assert.NoError(t, err)
 
-					targetGroup, err := d.data.db.Group.Query().Where(group.NameEQ(tt.ownerGroup)).Only(context.TODO())
-					assert.NoError(t, err)
-
-					salt := []byte(utils.RandString(20, utils.AllCharSet))
-					password := []byte(utils.RandString(20, utils.AllCharSet))
-					verifier := srp.ComputeVerifier(params, salt, []byte(tt.user.Email), password)
-
 					tt.user.Status = biz.StatusActive
 					tt.user.Email = tt.user.NickName + "@pallas.icu"
 					tt.user.OwnerGroup = &biz.Group{Id: targetGroup.ID}
-					tt.user.Salt = salt
-					tt.user.Verifier = verifier
+					tt.user.Salt = []byte("salt")
+					tt.user.Verifier = []byte("verifier")
+					target, err := d.repo.Create(ctx, &tt.user)
+					assert.NoError(t, err)
+					users[tt.ownerGroup] = target
 
-					target, err := d.repo.Create(context.TODO(), &tt.user)
+					res, err := uc.Permissions(ctx, target.Id)
 					assert.NoError(t, err)
+					assert.Equal(t, tt.expected, res)
 
-					res, err := d.repo.IsAdminUser(context.TODO(), target.Id)
+					admin, err := uc.IsAdminUser(ctx, target.Id)
 					assert.NoError(t, err)
-					tt.assertion(t, res)
+					assert.Equal(t, len(tt.expected) > 0, admin)
 				})
 			}
+
+			// the permissions are not bound to the group name
+			adminGroup, err := gr.GetByName(ctx, "Admin", biz.GroupViewBasic)
+			assert.NoError(t, err)
+			_, err = gu.UpdateGroup(ctx, users["Admin"].Id, &biz.Group{Id: adminGroup.Id, Name: "Root"}, []string{biz.GroupFieldName})
+			assert.NoError(t, err)
+			ok, err := uc.HasPermission(ctx, users["Admin"].Id, biz.PermissionSettingsWrite)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+
+			// the change of the group applies at once
+			userGroup, err := gr.GetByName(ctx, "User", biz.GroupViewBasic)
+			assert.NoError(t, err)
+			ok, err = uc.HasPermission(ctx, users["User"].Id, biz.PermissionUsersRead)
+			assert.NoError(t, err)
+			assert.False(t, ok)
+			_, err = gu.UpdateGroup(ctx, users["Admin"].Id, &biz.Group{
+				Id:          userGroup.Id,
+				Permissions: []biz.Permission{biz.PermissionUsersRead},
+			}, []string{biz.GroupFieldPermissions})
+			assert.NoError(t, err)
+			ok, err = uc.HasPermission(ctx, users["User"].Id, biz.PermissionUsersRead)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			ok, err = uc.HasPermission(ctx, users["User"].Id, biz.PermissionUsersWrite)
+			assert.NoError(t, err)
+			assert.False(t, ok)
+
+			_, err = gu.UpdateGroup(ctx, users["Admin"].Id, &biz.Group{
+				Id:          userGroup.Id,
+				Permissions: []biz.Permission{"users.delete"},
+			}, []string{biz.GroupFieldPermissions})
+			assert.True(t, v1.IsInvalidArgument(err))
+
+			member := func(name string, groupId int64) *biz.User {
+				u, cErr := d.repo.Create(ctx, &biz.User{
+					Email:      name + "@pallas.icu",
+					NickName:   name,
+					Salt:       []byte("salt"),
+					Verifier:   []byte("verifier"),
+					Status:     biz.StatusActive,
+					OwnerGroup: &biz.Group{Id: groupId},
+				})
+				assert.NoError(t, cErr)
+				return u
+			}
+
+			// the operator can only grant the permissions held by it
+			editors, err := gu.CreateGroup(ctx, users["Admin"].Id, &biz.Group{
+				Name:        "Editors",
+				Permissions: []biz.Permission{biz.PermissionGroupsRead, biz.PermissionGroupsWrite},
+			})
+			assert.NoError(t, err)
+			editor := member("test-editor", editors.Id)
+			_, err = gu.UpdateGroup(ctx, editor.Id, &biz.Group{
+				Id: editors.Id,
+				Permissions: []biz.Permission{
+					biz.PermissionGroupsRead, biz.PermissionGroupsWrite, biz.PermissionUsersWrite,
+				},
+			}, []string{biz.GroupFieldPermissions})
+			assert.True(t, v1.IsBadGroupOperation(err))
+			_, err = gu.CreateGroup(ctx, editor.Id, &biz.Group{
+				Name:        "Escalated",
+				Permissions: []biz.Permission{biz.PermissionSettingsWrite},
+			})
+			assert.True(t, v1.IsBadGroupOperation(err))
+			_, err = gu.UpdateGroup(ctx, editor.Id, &biz.Group{
+				Id:          editors.Id,
+				Permissions: []biz.Permission{biz.PermissionGroupsWrite},
+			}, []string{biz.GroupFieldPermissions})
+			assert.NoError(t, err)
+
+			// the operator can not be moved to a group granting more
+			managers, err := gu.CreateGroup(ctx, users["Admin"].Id, &biz.Group{
+				Name:        "Managers",
+				Permissions: []biz.Permission{biz.PermissionUsersRead, biz.PermissionUsersWrite},
+			})
+			assert.NoError(t, err)
+			manager := member("test-manager", managers.Id)
+			_, err = uc.UpdateUserGroup(ctx, manager.Id, manager.Id, adminGroup.Id)
+			assert.True(t, v1.IsBadGroupOperation(err))
+			_, err = uc.UpdateUser(
+				ctx, manager.Id, &biz.User{Id: manager.Id, GroupId: adminGroup.Id}, []string{biz.UserFieldGroupId},
+			)
+			assert.True(t, v1.IsBadGroupOperation(err))
+			_, err = uc.UpdateUserGroup(ctx, manager.Id, users["User"].Id, managers.Id)
+			assert.NoError(t, err)
+
+			// some user is always granted users.write
+			_, err = gu.UpdateGroup(ctx, users["Admin"].Id, &biz.Group{
+				Id:          adminGroup.Id,
+				Permissions: []biz.Permission{biz.PermissionUsersRead},
+			}, []string{biz.GroupFieldPermissions})
+			assert.NoError(t, err)
+			_, err = gu.UpdateGroup(ctx, manager.Id, &biz.Group{
+				Id:          managers.Id,
+				Permissions: []biz.Permission{biz.PermissionUsersRead},
+			}, []string{biz.GroupFieldPermissions})
+			assert.True(t, v1.IsBadGroupOperation(err))
+			ok, err = uc.HasPermission(ctx, manager.Id, biz.PermissionUsersWrite)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+
 			flushTestData(t, d.data)
 		})
 	}
@@ -510,7 +864,7 @@ func TestUserRepo_SRPServer(t *testing.T) {
 	}
 
 	for _, d := range ds {
-		t.Run(d.data.conf.Database.Driver, func(t *testing.T) {
+		t.Run(testName(d.data.conf), func(t *testing.T) {
 			defer d.cleanup()
 
 			params, _ := srp.GetParams(1024)
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/go-kratos/kratos/v2/transport"
+
+	"github.com/hominsu/pallas/app/pallas/service/internal/biz"
+	"github.com/hominsu/pallas/app/pallas/service/pkgs/replica"
+)
+
+var _ transport.Server = (*CronServer)(nil)
+
+// cronPollInterval is how often the jobs of longer intervals are checked if due, so that a job is not delayed by
+// the restarts of the instance
+const cronPollInterval = time.Minute
+
+type cronJob struct {
+	name     string
+	interval time.Duration
+	run      func(ctx context.Context) error
+}
+
+// CronServer runs the periodic jobs, each job runs in its own goroutine until the server stops. A job runs on one of
+// the instances in each interval, see biz.CronUsecase.
+type CronServer struct {
+	jobs []cronJob
+	cu   *biz.CronUsecase
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	log    *log.Helper
+}
+
+func NewCronServer(
+	scu *biz.ScoreUsecase,
+	au *biz.AuditUsecase,
+	acu *biz.AccountUsecase,
+	stu *biz.StorageUsecase,
+	cu *biz.CronUsecase,
+	logger log.Logger,
+) *CronServer {
+	return &CronServer{
+		cu: cu,
+		jobs: []cronJob{
+			{name: "expire_group_upgrades", interval: time.Minute, run: scu.ExpireGroupUpgrades},
+			{name: "purge_audit_events", interval: time.Hour, run: au.Purge},
+			{name: "purge_deleted_users", interval: time.Hour, run: acu.PurgeDeletedUsers},
+			{name: "enforce_storage_quota", interval: time.Hour, run: stu.EnforceQuota},
+			{name: "reconcile_storage_usage", interval: 24 * time.Hour, run: stu.ReconcileUsage},
+		},
+		log: log.NewHelper(log.With(logger, "module", "server/cron")),
+	}
+}
+
+func (s *CronServer) Start(ctx context.Context) error {
+	ctx, s.cancel = context.WithCancel(ctx)
+	for _, job := range s.jobs {
+		s.wg.Add(1)
+		go s.loop(ctx, job)
+	}
+	s.log.Infof("[cron] server started with %d jobs", len(s.jobs))
+	return nil
+}
+
+func (s *CronServer) Stop(_ context.Context) error {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	s.wg.Wait()
+	s.log.Info("[cron] server stopping")
+	return nil
+}
+
+func (s *CronServer) loop(ctx context.Context, job cronJob) {
+	defer s.wg.Done()
+
+	poll := job.interval
+	if poll > cronPollInterval {
+		poll = cronPollInterval
+	}
+	ticker := time.NewTicker(poll)
+	defer ticker.Stop()
+	for {
+		// each run reads what it has written, like a request
+		if _, err := s.cu.RunDue(replica.WithReadYourWrites(ctx), job.name, job.interval, job.run); err != nil {
+			s.log.Errorf("[cron] job %s failed: %v", job.name, err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -2,13 +2,16 @@ package server
 
 import (
 	"context"
+	stdhttp "net/http"
 	"strings"
 
 	"github.com/go-kratos/kratos/v2/log"
 	"github.com/go-kratos/kratos/v2/middleware/logging"
+	"github.com/go-kratos/kratos/v2/middleware/metrics"
 	"github.com/go-kratos/kratos/v2/middleware/recovery"
 	"github.com/go-kratos/kratos/v2/middleware/selector"
 	"github.com/go-kratos/kratos/v2/middleware/validate"
+	"github.com/go-kratos/kratos/v2/transport"
 	"github.com/go-kratos/kratos/v2/transport/http"
 	"github.com/gorilla/handlers"
 
@@ -17,6 +20,7 @@ import (
 	"github.com/hominsu/pallas/app/pallas/service/internal/conf"
 	"github.com/hominsu/pallas/app/pallas/service/internal/service"
 	"github.com/hominsu/pallas/app/pallas/service/pkgs/middleware"
+	"github.com/hominsu/pallas/pkg/ratelimit"
 	"github.com/hominsu/pallas/pkg/sessions"
 )
 
@@ -24,7 +28,14 @@ func NewSkipSessionMatcher() selector.MatchFunc {
 	skipList := make(map[string]struct{})
 	skipList["/pallas.service.v1.SiteService/Ping"] = struct{}{}
 	skipList["/pallas.service.v1.UserService/Signup"] = struct{}{}
-	skipList["/pallas.service.v1.UserService/Signin"] = struct{}{}
+	skipList["/pallas.service.v1.UserService/AcceptInvite"] = struct{}{}
+	skipList["/pallas.service.v1.UserService/SigninS"] = struct{}{}
+	skipList["/pallas.service.v1.UserService/SigninA"] = struct{}{}
+	skipList["/pallas.service.v1.UserService/SigninM"] = struct{}{}
+	skipList["/pallas.service.v1.UserService/ListOIDCProviders"] = struct{}{}
+	skipList["/pallas.service.v1.UserService/SigninOIDCAuth"] = struct{}{}
+	skipList["/pallas.service.v1.UserService/SigninOIDC"] = struct{}{}
+	skipList[service.OperationUserServiceGetAvatar] = struct{}{}
 
 	return func(ctx context.Context, operation string) bool {
 		if _, ok := skipList[operation]; ok {
@@ -34,35 +45,141 @@ func NewSkipSessionMatcher() selector.MatchFunc {
 	}
 }
 
+func NewSkipSecondFactorMatcher() selector.MatchFunc {
+	skipSession := NewSkipSessionMatcher()
+	skipList := make(map[string]struct{})
+	skipList["/pallas.service.v1.UserService/SigninTOTP"] = struct{}{}
+	skipList["/pallas.service.v1.UserService/SignOut"] = struct{}{}
+
+	return func(ctx context.Context, operation string) bool {
+		if _, ok := skipList[operation]; ok {
+			return false
+		}
+		return skipSession(ctx, operation)
+	}
+}
+
+// NewAuditMatcher matches the security-relevant operations, and the mutations of AdminService.
+func NewAuditMatcher() selector.MatchFunc {
+	auditList := make(map[string]struct{})
+	auditList["/pallas.service.v1.UserService/AcceptInvite"] = struct{}{}
+	auditList["/pallas.service.v1.UserService/SigninM"] = struct{}{}
+	auditList["/pallas.service.v1.UserService/SigninTOTP"] = struct{}{}
+	auditList["/pallas.service.v1.UserService/SigninOIDC"] = struct{}{}
+	auditList["/pallas.service.v1.UserService/SignOut"] = struct{}{}
+	auditList["/pallas.service.v1.UserService/UpdateUser"] = struct{}{}
+	auditList["/pallas.service.v1.UserService/DeleteUser"] = struct{}{}
+	auditList["/pallas.service.v1.UserService/RestoreUser"] = struct{}{}
+	auditList["/pallas.service.v1.UserService/ConfirmTOTP"] = struct{}{}
+	auditList["/pallas.service.v1.UserService/DisableTOTP"] = struct{}{}
+	auditList["/pallas.service.v1.UserService/UnlinkIdentity"] = struct{}{}
+	auditList["/pallas.service.v1.UserService/CreateAccessToken"] = struct{}{}
+	auditList["/pallas.service.v1.UserService/DeleteAccessToken"] = struct{}{}
+
+	return func(ctx context.Context, operation string) bool {
+		if _, ok := auditList[operation]; ok {
+			return true
+		}
+		if !strings.HasPrefix(operation, "/pallas.service.v1.AdminService/") {
+			return false
+		}
+		// the reads of admin are not audited
+		if ht, ok := transport.FromServerContext(ctx); ok {
+			if ht, ok := ht.(*http.Transport); ok {
+				return ht.Request().Method != "GET"
+			}
+		}
+		return true
+	}
+}
+
 func NewAdminMatcher() selector.MatchFunc {
 	return func(ctx context.Context, operation string) bool {
-		return strings.HasPrefix("/pallas.service.v1.AdminService/", operation)
+		return strings.HasPrefix(operation, "/pallas.service.v1.AdminService/")
+	}
+}
+
+// NewBandwidthMatcher matches the uploads and the downloads limited by the Bandwidth filter, the path is matched
+// rather than the operation since the filters run before the routing.
+func NewBandwidthMatcher() func(r *stdhttp.Request) bool {
+	return func(r *stdhttp.Request) bool {
+		// GET and POST /v1/users/{id}/avatar
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) != 4 || parts[0] != "v1" || parts[1] != "users" || parts[3] != "avatar" {
+			return false
+		}
+		return r.Method == stdhttp.MethodGet || r.Method == stdhttp.MethodPost
 	}
 }
 
+// NewAdminPermissions returns the permission required by each operation of AdminService, an operation missed
+// here is denied by the Admin middleware.
+func NewAdminPermissions() map[string]biz.Permission {
+	permissions := make(map[string]biz.Permission)
+	permissions["/pallas.service.v1.AdminService/ListUsers"] = biz.PermissionUsersRead
+	permissions["/pallas.service.v1.AdminService/GetUser"] = biz.PermissionUsersRead
+	permissions["/pallas.service.v1.AdminService/ListUserScoreTransactions"] = biz.PermissionUsersRead
+	permissions["/pallas.service.v1.AdminService/ListGroupUsers"] = biz.PermissionUsersRead
+	permissions["/pallas.service.v1.AdminService/CreateUser"] = biz.PermissionUsersWrite
+	permissions["/pallas.service.v1.AdminService/UpdateUserStatus"] = biz.PermissionUsersWrite
+	permissions["/pallas.service.v1.AdminService/UpdateUserGroup"] = biz.PermissionUsersWrite
+	permissions["/pallas.service.v1.AdminService/AdjustUser"] = biz.PermissionUsersWrite
+	permissions["/pallas.service.v1.AdminService/DeleteUser"] = biz.PermissionUsersWrite
+	permissions["/pallas.service.v1.AdminService/GrantScore"] = biz.PermissionUsersWrite
+	permissions["/pallas.service.v1.AdminService/MoveUsers"] = biz.PermissionUsersWrite
+	permissions["/pallas.service.v1.AdminService/GetGroup"] = biz.PermissionGroupsRead
+	permissions["/pallas.service.v1.AdminService/ListGroups"] = biz.PermissionGroupsRead
+	permissions["/pallas.service.v1.AdminService/CreateGroup"] = biz.PermissionGroupsWrite
+	permissions["/pallas.service.v1.AdminService/UpdateGroup"] = biz.PermissionGroupsWrite
+	permissions["/pallas.service.v1.AdminService/DeleteGroup"] = biz.PermissionGroupsWrite
+	permissions["/pallas.service.v1.AdminService/ListSettings"] = biz.PermissionSettingsRead
+	permissions["/pallas.service.v1.AdminService/GetSetting"] = biz.PermissionSettingsRead
+	permissions["/pallas.service.v1.AdminService/UpdateSettings"] = biz.PermissionSettingsWrite
+	permissions["/pallas.service.v1.AdminService/ListAuditEvents"] = biz.PermissionAuditEventRead
+	return permissions
+}
+
 func NewHTTPServer(
 	c *conf.Server,
 	ss *service.SiteService,
 	us *service.UserService,
 	as *service.AdminService,
 	uu *biz.UserUsecase,
-	store *sessions.RedisStore,
+	tu *biz.AccessTokenUsecase,
+	au *biz.AuditUsecase,
+	store sessions.ServerStore,
+	limiter ratelimit.Limiter,
 	logger log.Logger,
 ) *http.Server {
 	// server options
 	opts := []http.ServerOption{
 		http.Middleware(
 			recovery.Recovery(),
+			metrics.Server(
+				metrics.WithRequests(&counter{cv: serverRequests}),
+				metrics.WithSeconds(&histogram{hv: serverSeconds}),
+			),
 			logging.Server(logger),
 			validate.Validator(),
 			middleware.Info(),
+			middleware.ReadYourWrites(),
 			selector.Server(
-				middleware.Session(store, "pallas-session", logger),
+				middleware.Session(store, uu, tu, "pallas-session", logger),
 			).
 				Match(NewSkipSessionMatcher()).
 				Build(),
 			selector.Server(
-				middleware.Admin(uu, logger),
+				middleware.SecondFactor(),
+			).
+				Match(NewSkipSecondFactorMatcher()).
+				Build(),
+			selector.Server(
+				middleware.Audit(au),
+			).
+				Match(NewAuditMatcher()).
+				Build(),
+			selector.Server(
+				middleware.Admin(uu, NewAdminPermissions(), logger),
 			).
 				Match(NewAdminMatcher()).
 				Build(),
@@ -73,6 +190,7 @@ func NewHTTPServer(
 				handlers.AllowedMethods([]string{"GET", "POST", "PUT", "HEAD", "OPTIONS"}),
 				handlers.AllowedOrigins([]string{"*"}),
 			),
+			middleware.Bandwidth(store, uu, tu, limiter, "pallas-session", NewBandwidthMatcher(), logger),
 		),
 	}
 
@@ -90,6 +208,7 @@ func NewHTTPServer(
 	v1.RegisterSiteServiceHTTPServer(srv, ss)
 	v1.RegisterUserServiceHTTPServer(srv, us)
 	v1.RegisterAdminServiceHTTPServer(srv, as)
+	service.RegisterAvatarHTTPServer(srv, us)
 
 	return srv
 }
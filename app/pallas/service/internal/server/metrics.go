@@ -0,0 +1,60 @@
+package server
+
+import (
+	"github.com/go-kratos/kratos/v2/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	serverRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "pallas",
+		Subsystem: "server",
+		Name:      "requests_code_total",
+		Help:      "The requests of the operations by the code and the reason of the reply.",
+	}, []string{"kind", "operation", "code", "reason"})
+
+	serverSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "pallas",
+		Subsystem: "server",
+		Name:      "requests_seconds",
+		Help:      "The latency of the requests of the operations.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"kind", "operation"})
+)
+
+var _ metrics.Counter = (*counter)(nil)
+
+// counter adapts the counter of prometheus to the metrics middleware of kratos
+type counter struct {
+	cv  *prometheus.CounterVec
+	lvs []string
+}
+
+func (c *counter) With(lvs ...string) metrics.Counter {
+	return &counter{cv: c.cv, lvs: lvs}
+}
+
+func (c *counter) Inc() {
+	c.cv.WithLabelValues(c.lvs...).Inc()
+}
+
+func (c *counter) Add(delta float64) {
+	c.cv.WithLabelValues(c.lvs...).Add(delta)
+}
+
+var _ metrics.Observer = (*histogram)(nil)
+
+// histogram adapts the histogram of prometheus to the metrics middleware of kratos
+type histogram struct {
+	hv  *prometheus.HistogramVec
+	lvs []string
+}
+
+func (h *histogram) With(lvs ...string) metrics.Observer {
+	return &histogram{hv: h.hv, lvs: lvs}
+}
+
+func (h *histogram) Observe(value float64) {
+	h.hv.WithLabelValues(h.lvs...).Observe(value)
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/go-kratos/kratos/v2/transport"
+	"github.com/go-kratos/kratos/v2/transport/http"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/hominsu/pallas/app/pallas/service/internal/conf"
+)
+
+var _ transport.Server = (*MetricsServer)(nil)
+
+// MetricsServer serves the metrics at /metrics on an address of its own, so that they are kept off the api served
+// to the public. The metrics are not served unless the address is configured.
+type MetricsServer struct {
+	srv *http.Server
+	log *log.Helper
+}
+
+func NewMetricsServer(c *conf.Server, logger log.Logger) *MetricsServer {
+	s := &MetricsServer{log: log.NewHelper(log.With(logger, "module", "server/metrics"))}
+	if c.GetMetrics().GetAddr() == "" {
+		return s
+	}
+
+	opts := []http.ServerOption{
+		http.Address(c.Metrics.Addr),
+	}
+	if c.Metrics.Network != "" {
+		opts = append(opts, http.Network(c.Metrics.Network))
+	}
+	s.srv = http.NewServer(opts...)
+	s.srv.Handle("/metrics", promhttp.Handler())
+	return s
+}
+
+func (s *MetricsServer) Start(ctx context.Context) error {
+	if s.srv == nil {
+		s.log.Info("[metrics] server disabled, no address configured")
+		return nil
+	}
+	return s.srv.Start(ctx)
+}
+
+func (s *MetricsServer) Stop(ctx context.Context) error {
+	if s.srv == nil {
+		return nil
+	}
+	return s.srv.Stop(ctx)
+}
@@ -25,12 +25,112 @@ func (s *AdminService) ListUsers(ctx context.Context, req *v1.ListUsersRequest)
 	}, nil
 }
 
+func (s *AdminService) CreateUser(ctx context.Context, req *v1.CreateUserRequest) (*v1.CreateUserReply, error) {
+	user, password, inviteToken, err := s.uu.CreateUser(
+		ctx,
+		req.GetEmail(),
+		req.GetNickName(),
+		req.GetGroupId(),
+		req.GetInvite(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &v1.CreateUserReply{
+		User:        user,
+		Password:    password,
+		InviteToken: inviteToken,
+	}, nil
+}
+
+func (s *AdminService) GetUser(ctx context.Context, req *v1.GetUserRequest) (*v1.User, error) {
+	res, err := s.uu.GetUser(ctx, req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *AdminService) UpdateUserStatus(ctx context.Context, req *v1.UpdateUserStatusRequest) (*v1.User, error) {
+	res, err := s.uu.UpdateUserStatus(ctx, req.GetId(), biz.ToUserStatus(req.GetStatus()))
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *AdminService) UpdateUserGroup(ctx context.Context, req *v1.UpdateUserGroupRequest) (*v1.User, error) {
+	operatorId, err := getUserId(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.uu.UpdateUserGroup(ctx, operatorId, req.GetId(), req.GetGroupId())
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *AdminService) AdjustUser(ctx context.Context, req *v1.AdjustUserRequest) (*v1.User, error) {
+	if req.Score != nil {
+		operatorId, err := getUserId(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = s.scu.SetScore(ctx, operatorId, req.GetId(), req.GetScore()); err != nil {
+			return nil, err
+		}
+	}
+	res, err := s.uu.AdjustUser(ctx, req.GetId(), req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *AdminService) GrantScore(ctx context.Context, req *v1.GrantScoreRequest) (*v1.ScoreTransaction, error) {
+	operatorId, err := getUserId(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.scu.Grant(ctx, operatorId, req.GetId(), req.GetAmount(), req.GetNote())
+	if err != nil {
+		return nil, err
+	}
+	return biz.ToProtoScoreTransaction(res), nil
+}
+
+func (s *AdminService) ListUserScoreTransactions(
+	ctx context.Context,
+	req *v1.ListScoreTransactionsRequest,
+) (*v1.ListScoreTransactionsReply, error) {
+	res, nextPageToken, err := s.scu.ListTransactions(ctx, req.GetId(), int(req.GetPageSize()), req.GetPageToken())
+	if err != nil {
+		return nil, err
+	}
+	return &v1.ListScoreTransactionsReply{
+		Transactions:  res,
+		NextPageToken: nextPageToken,
+	}, nil
+}
+
+func (s *AdminService) DeleteUser(ctx context.Context, req *v1.DeleteUserRequest) (*emptypb.Empty, error) {
+	if err := s.uu.DeleteUser(ctx, req.GetId()); err != nil {
+		return nil, err
+	}
+	return &emptypb.Empty{}, nil
+}
+
 func (s *AdminService) CreateGroup(ctx context.Context, req *v1.CreateGroupRequest) (*v1.Group, error) {
 	group, err := biz.ToGroup(req.GetGroup())
 	if err != nil {
 		return nil, err
 	}
-	res, err := s.gu.CreateGroup(ctx, group)
+	operatorId, err := getUserId(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.gu.CreateGroup(ctx, operatorId, group)
 	if err != nil {
 		return nil, err
 	}
@@ -51,7 +151,11 @@ func (s *AdminService) UpdateGroup(ctx context.Context, req *v1.UpdateGroupReque
 		return nil, err
 	}
 
-	res, err := s.gu.UpdateGroup(ctx, group)
+	operatorId, err := getUserId(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.gu.UpdateGroup(ctx, operatorId, group, req.GetUpdateMask().GetPaths())
 	if err != nil {
 		return nil, err
 	}
@@ -60,13 +164,28 @@ func (s *AdminService) UpdateGroup(ctx context.Context, req *v1.UpdateGroupReque
 }
 
 func (s *AdminService) DeleteGroup(ctx context.Context, req *v1.DeleteGroupRequest) (*emptypb.Empty, error) {
-	err := s.gu.DeleteGroup(ctx, req.GetId())
+	operatorId, err := getUserId(ctx)
 	if err != nil {
 		return nil, err
 	}
+	if err = s.gu.DeleteGroup(ctx, operatorId, req.GetId(), req.ReassignTo); err != nil {
+		return nil, err
+	}
 	return &emptypb.Empty{}, nil
 }
 
+func (s *AdminService) MoveUsers(ctx context.Context, req *v1.MoveUsersRequest) (*v1.MoveUsersReply, error) {
+	operatorId, err := getUserId(ctx)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.gu.MoveUsers(ctx, operatorId, req.GetFromGroupId(), req.GetToGroupId(), req.GetUserIds(), req.GetAll())
+	if err != nil {
+		return nil, err
+	}
+	return &v1.MoveUsersReply{UserIds: res}, nil
+}
+
 func (s *AdminService) ListGroups(ctx context.Context, req *v1.ListGroupsRequest) (*v1.ListGroupsReply, error) {
 	res, nextPageToken, err := s.gu.ListGroups(
 		ctx,
@@ -82,3 +201,85 @@ func (s *AdminService) ListGroups(ctx context.Context, req *v1.ListGroupsRequest
 		NextPageToken: nextPageToken,
 	}, nil
 }
+
+func (s *AdminService) ListGroupUsers(
+	ctx context.Context,
+	req *v1.ListGroupUsersRequest,
+) (*v1.ListGroupUsersReply, error) {
+	filter := &biz.UserFilter{Query: req.GetQuery()}
+	if req.Status != nil {
+		status := biz.ToUserStatus(req.GetStatus())
+		filter.Status = &status
+	}
+	res, nextPageToken, err := s.gu.ListGroupUsers(
+		ctx,
+		req.GetId(),
+		filter,
+		int(req.GetPageSize()),
+		req.GetPageToken(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &v1.ListGroupUsersReply{
+		Users:         res,
+		NextPageToken: nextPageToken,
+	}, nil
+}
+
+func (s *AdminService) ListSettings(ctx context.Context, req *v1.ListSettingsRequest) (*v1.ListSettingsReply, error) {
+	res, err := s.su.ListSettings(ctx, biz.SettingType(req.GetType()))
+	if err != nil {
+		return nil, err
+	}
+	return &v1.ListSettingsReply{Settings: res}, nil
+}
+
+func (s *AdminService) GetSetting(ctx context.Context, req *v1.GetSettingRequest) (*v1.Setting, error) {
+	return s.su.GetSetting(ctx, biz.SettingName(req.GetName()))
+}
+
+func (s *AdminService) UpdateSettings(
+	ctx context.Context,
+	req *v1.UpdateSettingsRequest,
+) (*v1.UpdateSettingsReply, error) {
+	values := make(map[biz.SettingName]string, len(req.GetValues()))
+	for name, value := range req.GetValues() {
+		values[biz.SettingName(name)] = value
+	}
+	res, err := s.su.UpdateSettings(ctx, values)
+	if err != nil {
+		return nil, err
+	}
+	return &v1.UpdateSettingsReply{Settings: res}, nil
+}
+
+func (s *AdminService) ListAuditEvents(
+	ctx context.Context,
+	req *v1.ListAuditEventsRequest,
+) (*v1.ListAuditEventsReply, error) {
+	filter := &biz.AuditFilter{
+		ActorId:    req.ActorId,
+		Action:     req.GetAction(),
+		TargetType: req.GetTargetType(),
+		TargetId:   req.GetTargetId(),
+		Success:    req.Success,
+	}
+	if req.GetStartTime() != nil {
+		since := req.GetStartTime().AsTime()
+		filter.Since = &since
+	}
+	if req.GetEndTime() != nil {
+		until := req.GetEndTime().AsTime()
+		filter.Until = &until
+	}
+
+	res, nextPageToken, err := s.au.ListEvents(ctx, filter, int(req.GetPageSize()), req.GetPageToken())
+	if err != nil {
+		return nil, err
+	}
+	return &v1.ListAuditEventsReply{
+		Events:        res,
+		NextPageToken: nextPageToken,
+	}, nil
+}
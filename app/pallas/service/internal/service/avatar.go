@@ -0,0 +1,73 @@
+package service
+
+import (
+	"context"
+	stdhttp "net/http"
+	"strconv"
+
+	"github.com/go-kratos/kratos/v2/transport/http"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
+	"github.com/hominsu/pallas/app/pallas/service/internal/biz"
+)
+
+// OperationUserServiceGetAvatar is the operation of GET /v1/users/{id}/avatar, which is not defined in the
+// proto since the reply is the image rather than a message.
+const OperationUserServiceGetAvatar = "/pallas.service.v1.UserService/GetAvatar"
+
+// avatarMaxAge is the max-age of the avatar in the browsers, the ETag revalidates it afterwards.
+const avatarMaxAge = "public, max-age=3600"
+
+// RegisterAvatarHTTPServer registers the route serving the avatars.
+func RegisterAvatarHTTPServer(s *http.Server, srv *UserService) {
+	r := s.Route("/")
+	r.GET("/v1/users/{id}/avatar", srv.getAvatar)
+}
+
+func (s *UserService) UploadAvatar(ctx context.Context, req *v1.UploadAvatarRequest) (*emptypb.Empty, error) {
+	if err := checkUserId(ctx, req.GetId()); err != nil {
+		return nil, err
+	}
+	if err := s.avu.UploadAvatar(ctx, req.GetId(), req.GetImage()); err != nil {
+		return nil, err
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (s *UserService) getAvatar(ctx http.Context) error {
+	http.SetOperation(ctx, OperationUserServiceGetAvatar)
+	id, err := strconv.ParseInt(ctx.Vars().Get("id"), 10, 64)
+	if err != nil {
+		return v1.ErrorInvalidArgument("invalid argument: id")
+	}
+	var size int
+	if v := ctx.Query().Get("size"); v != "" {
+		if size, err = strconv.Atoi(v); err != nil || size < 0 {
+			return v1.ErrorInvalidArgument("invalid argument: size")
+		}
+	}
+
+	h := ctx.Middleware(func(ctx context.Context, _ any) (any, error) {
+		return s.avu.GetAvatar(ctx, id, size, s.signedInUser(ctx) != 0)
+	})
+	out, err := h(ctx, nil)
+	if err != nil {
+		return err
+	}
+	res := out.(*biz.AvatarImage)
+
+	w, r := ctx.Response(), ctx.Request()
+	if res.RedirectURL != "" {
+		stdhttp.Redirect(w, r, res.RedirectURL, stdhttp.StatusFound)
+		return nil
+	}
+	etag := strconv.Quote(res.ETag)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", avatarMaxAge)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(stdhttp.StatusNotModified)
+		return nil
+	}
+	return ctx.Blob(stdhttp.StatusOK, res.ContentType, res.Data)
+}
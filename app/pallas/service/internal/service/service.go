@@ -33,15 +33,37 @@ func NewSiteService(version string, logger log.Logger) *SiteService {
 type UserService struct {
 	v1.UnimplementedUserServiceServer
 
-	store *sessions.RedisStore
+	store sessions.ServerStore
 	uu    *biz.UserUsecase
+	ou    *biz.OIDCUsecase
+	tu    *biz.AccessTokenUsecase
+	scu   *biz.ScoreUsecase
+	avu   *biz.AvatarUsecase
+	acu   *biz.AccountUsecase
+	stu   *biz.StorageUsecase
 	log   *log.Helper
 }
 
-func NewUserService(store *sessions.RedisStore, uu *biz.UserUsecase, logger log.Logger) *UserService {
+func NewUserService(
+	store sessions.ServerStore,
+	uu *biz.UserUsecase,
+	ou *biz.OIDCUsecase,
+	tu *biz.AccessTokenUsecase,
+	scu *biz.ScoreUsecase,
+	avu *biz.AvatarUsecase,
+	acu *biz.AccountUsecase,
+	stu *biz.StorageUsecase,
+	logger log.Logger,
+) *UserService {
 	return &UserService{
 		store: store,
 		uu:    uu,
+		ou:    ou,
+		tu:    tu,
+		scu:   scu,
+		avu:   avu,
+		acu:   acu,
+		stu:   stu,
 		log:   log.NewHelper(log.With(logger, "module", "service/user")),
 	}
 }
@@ -49,17 +71,31 @@ func NewUserService(store *sessions.RedisStore, uu *biz.UserUsecase, logger log.
 type AdminService struct {
 	v1.UnimplementedAdminServiceServer
 
-	store *sessions.RedisStore
+	store sessions.ServerStore
 	gu    *biz.GroupUsecase
 	uu    *biz.UserUsecase
+	scu   *biz.ScoreUsecase
+	au    *biz.AuditUsecase
+	su    *biz.SettingUsecase
 	log   *log.Helper
 }
 
-func NewAdminService(store *sessions.RedisStore, gu *biz.GroupUsecase, uu *biz.UserUsecase, logger log.Logger) *AdminService {
+func NewAdminService(
+	store sessions.ServerStore,
+	gu *biz.GroupUsecase,
+	uu *biz.UserUsecase,
+	scu *biz.ScoreUsecase,
+	au *biz.AuditUsecase,
+	su *biz.SettingUsecase,
+	logger log.Logger,
+) *AdminService {
 	return &AdminService{
 		store: store,
 		gu:    gu,
 		uu:    uu,
+		scu:   scu,
+		au:    au,
+		su:    su,
 		log:   log.NewHelper(log.With(logger, "module", "service/admin")),
 	}
 }
@@ -2,6 +2,9 @@ package service
 
 import (
 	"context"
+	"encoding/json"
+	"strconv"
+	"time"
 
 	"github.com/go-kratos/kratos/v2/transport"
 	"github.com/go-kratos/kratos/v2/transport/http"
@@ -10,6 +13,7 @@ import (
 	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
 	"github.com/hominsu/pallas/app/pallas/service/internal/biz"
 	"github.com/hominsu/pallas/app/pallas/service/pkgs/middleware"
+	"github.com/hominsu/pallas/pkg/sessions"
 )
 
 func (s *UserService) Signup(ctx context.Context, req *v1.SignupRequest) (*emptypb.Empty, error) {
@@ -20,6 +24,13 @@ func (s *UserService) Signup(ctx context.Context, req *v1.SignupRequest) (*empty
 	return &emptypb.Empty{}, nil
 }
 
+func (s *UserService) AcceptInvite(ctx context.Context, req *v1.AcceptInviteRequest) (*emptypb.Empty, error) {
+	if err := s.uu.AcceptInvite(ctx, req.GetToken(), req.GetSalt(), req.GetVerifier()); err != nil {
+		return nil, err
+	}
+	return &emptypb.Empty{}, nil
+}
+
 func (s *UserService) SigninS(ctx context.Context, req *v1.SigninSRequest) (*v1.SigninSReply, error) {
 	salt, err := s.uu.GetUserSalt(ctx, req.GetEmail())
 	if err != nil {
@@ -45,17 +56,45 @@ func (s *UserService) SigninA(ctx context.Context, req *v1.SigninARequest) (*v1.
 func (s *UserService) SigninM(ctx context.Context, req *v1.SigninMRequest) (*emptypb.Empty, error) {
 	if tr, ok := transport.FromServerContext(ctx); ok {
 		if ht, ok := tr.(*http.Transport); ok {
-			userid, k, err := s.uu.SigninM(ctx, req.GetEmail(), req.GetM1())
+			userid, k, secondFactor, err := s.uu.SigninM(ctx, req.GetEmail(), req.GetM1())
 			if err != nil {
 				return nil, err
 			}
 
+			if err = s.saveSession(ctx, ht, userid, k, secondFactor); err != nil {
+				return nil, err
+			}
+			return &emptypb.Empty{}, nil
+		}
+	}
+	return nil, v1.ErrorInternal("transport error")
+}
+
+func (s *UserService) SigninTOTP(ctx context.Context, req *v1.SigninTOTPRequest) (*emptypb.Empty, error) {
+	if tr, ok := transport.FromServerContext(ctx); ok {
+		if ht, ok := tr.(*http.Transport); ok {
+			userid, ok := ctx.Value(middleware.ContextKeyPendingUserId).(int64)
+			if !ok {
+				return nil, v1.ErrorSigninOperation("second factor is not pending or has expired")
+			}
 			session, err := s.store.Get(ht, "pallas-session")
 			if err != nil {
 				return nil, v1.ErrorInternal("get session error: %v", err)
 			}
-			session.Values[string(middleware.SessionKeyUserId)] = userid
-			session.Values[string(middleware.SessionKeyUserK)] = k
+			if err = s.uu.SigninSecondFactor(ctx, userid, req.GetCode()); err != nil {
+				if v1.IsSigninOperation(err) {
+					// too many misses, the pending signin is abandoned and the password is required again
+					session.Options.MaxAge = -1
+					if sErr := session.Save(ht); sErr != nil {
+						return nil, v1.ErrorInternal("save session error: %v", sErr)
+					}
+				}
+				return nil, err
+			}
+
+			delete(session.Values, string(middleware.SessionKeySecondFactor))
+			// the signin completes with the second factor
+			session.Values[string(middleware.SessionKeySigninAt)] = time.Now().Unix()
 			if err = session.Save(ht); err != nil {
 				return nil, v1.ErrorInternal("save session error: %v", err)
 			}
@@ -66,6 +105,47 @@ func (s *UserService) SigninM(ctx context.Context, req *v1.SigninMRequest) (*emp
 	return nil, v1.ErrorInternal("transport error")
 }
 
+func (s *UserService) ListOIDCProviders(ctx context.Context, _ *emptypb.Empty) (*v1.ListOIDCProvidersReply, error) {
+	providers := s.ou.ListProviders(ctx)
+	reply := &v1.ListOIDCProvidersReply{Providers: make([]*v1.OIDCProvider, len(providers))}
+	for i, p := range providers {
+		reply.Providers[i] = &v1.OIDCProvider{
+			Name:        p.Name,
+			DisplayName: p.DisplayName,
+		}
+	}
+	return reply, nil
+}
+
+func (s *UserService) SigninOIDCAuth(ctx context.Context, req *v1.SigninOIDCAuthRequest) (*v1.OIDCAuthReply, error) {
+	return s.beginOIDCAuth(ctx, req.GetProvider(), 0)
+}
+
+func (s *UserService) SigninOIDC(ctx context.Context, req *v1.SigninOIDCRequest) (*emptypb.Empty, error) {
+	if tr, ok := transport.FromServerContext(ctx); ok {
+		if ht, ok := tr.(*http.Transport); ok {
+			session, err := s.store.Get(ht, "pallas-session")
+			if err != nil {
+				return nil, v1.ErrorInternal("get session error: %v", err)
+			}
+			binding, _ := session.Values[string(middleware.SessionKeyOIDCBinding)].(string)
+			delete(session.Values, string(middleware.SessionKeyOIDCBinding))
+
+			u, err := s.ou.Signin(ctx, req.GetProvider(), req.GetState(), req.GetCode(), binding, sessionUserId(session))
+			if err != nil {
+				return nil, err
+			}
+
+			// no srp session key for the external identity
+			if err = s.saveSession(ctx, ht, u.Id, nil, u.TOTP.Enabled); err != nil {
+				return nil, err
+			}
+			return &emptypb.Empty{}, nil
+		}
+	}
+	return nil, v1.ErrorInternal("transport error")
+}
+
 func (s *UserService) SignOut(ctx context.Context, _ *emptypb.Empty) (*emptypb.Empty, error) {
 	if tr, ok := transport.FromServerContext(ctx); ok {
 		if ht, ok := tr.(*http.Transport); ok {
@@ -102,23 +182,305 @@ func (s *UserService) UpdateUser(ctx context.Context, req *v1.UpdateUserRequest)
 	if err != nil {
 		return nil, err
 	}
-	res, err := s.uu.UpdateUser(ctx, user)
+	res, err := s.uu.UpdateUser(ctx, user.Id, user, req.GetUpdateMask().GetPaths())
 	if err != nil {
 		return nil, err
 	}
 	return res, nil
 }
 
-func (s *UserService) DeleteUser(ctx context.Context, req *v1.DeleteUserRequest) (*emptypb.Empty, error) {
+func (s *UserService) DeleteUser(ctx context.Context, req *v1.DeleteAccountRequest) (*v1.User, error) {
 	if err := checkUserId(ctx, req.GetId()); err != nil {
 		return nil, err
 	}
-	if err := s.uu.DeleteUser(ctx, req.GetId()); req != nil {
+	// the access tokens have no signin time, so that they can never delete the account
+	var signinAt *time.Time
+	if t, ok := ctx.Value(middleware.ContextKeySigninAt).(time.Time); ok {
+		signinAt = &t
+	}
+	return s.acu.RequestDeletion(ctx, req.GetId(), signinAt, req.GetCode())
+}
+
+func (s *UserService) RestoreUser(ctx context.Context, req *v1.RestoreUserRequest) (*v1.User, error) {
+	if err := checkUserId(ctx, req.GetId()); err != nil {
+		return nil, err
+	}
+	return s.acu.RestoreUser(ctx, req.GetId())
+}
+
+func (s *UserService) ExportUser(ctx context.Context, req *v1.ExportUserRequest) (*v1.UserExport, error) {
+	if err := checkUserId(ctx, req.GetId()); err != nil {
+		return nil, err
+	}
+	res, err := s.acu.ExportUser(ctx, req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	return biz.ToProtoUserExport(res)
+}
+
+func (s *UserService) GetMyUsage(ctx context.Context, req *v1.GetMyUsageRequest) (*v1.Usage, error) {
+	if err := checkUserId(ctx, req.GetId()); err != nil {
+		return nil, err
+	}
+	res, err := s.stu.GetUsage(ctx, req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	return biz.ToProtoUsage(res), nil
+}
+
+func (s *UserService) EnrollTOTP(ctx context.Context, req *v1.EnrollTOTPRequest) (*v1.EnrollTOTPReply, error) {
+	if err := checkUserId(ctx, req.GetId()); err != nil {
+		return nil, err
+	}
+	res, err := s.uu.EnrollTOTP(ctx, req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	return &v1.EnrollTOTPReply{
+		Secret:          res.Secret,
+		ProvisioningUri: res.ProvisioningURI,
+		RecoveryCodes:   res.RecoveryCodes,
+	}, nil
+}
+
+func (s *UserService) ConfirmTOTP(ctx context.Context, req *v1.ConfirmTOTPRequest) (*emptypb.Empty, error) {
+	if err := checkUserId(ctx, req.GetId()); err != nil {
+		return nil, err
+	}
+	if err := s.uu.ConfirmTOTP(ctx, req.GetId(), req.GetCode()); err != nil {
 		return nil, err
 	}
 	return &emptypb.Empty{}, nil
 }
 
+func (s *UserService) DisableTOTP(ctx context.Context, req *v1.DisableTOTPRequest) (*emptypb.Empty, error) {
+	if err := checkUserId(ctx, req.GetId()); err != nil {
+		return nil, err
+	}
+	if err := s.uu.DisableTOTP(ctx, req.GetId(), req.GetCode()); err != nil {
+		return nil, err
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (s *UserService) LinkIdentity(ctx context.Context, req *v1.LinkIdentityRequest) (*v1.OIDCAuthReply, error) {
+	if err := checkUserId(ctx, req.GetId()); err != nil {
+		return nil, err
+	}
+	return s.beginOIDCAuth(ctx, req.GetProvider(), req.GetId())
+}
+
+func (s *UserService) ListIdentities(ctx context.Context, req *v1.ListIdentitiesRequest) (*v1.ListIdentitiesReply, error) {
+	if err := checkUserId(ctx, req.GetId()); err != nil {
+		return nil, err
+	}
+	res, err := s.ou.ListIdentities(ctx, req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	return &v1.ListIdentitiesReply{Identities: biz.ToProtoIdentityList(res)}, nil
+}
+
+func (s *UserService) UnlinkIdentity(ctx context.Context, req *v1.UnlinkIdentityRequest) (*emptypb.Empty, error) {
+	if err := checkUserId(ctx, req.GetId()); err != nil {
+		return nil, err
+	}
+	if err := s.ou.UnlinkIdentity(ctx, req.GetId(), req.GetProvider()); err != nil {
+		return nil, err
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (s *UserService) CreateAccessToken(
+	ctx context.Context,
+	req *v1.CreateAccessTokenRequest,
+) (*v1.CreateAccessTokenReply, error) {
+	if err := checkUserId(ctx, req.GetId()); err != nil {
+		return nil, err
+	}
+	token, res, err := s.tu.CreateAccessToken(
+		ctx,
+		req.GetId(),
+		req.GetName(),
+		biz.ToTokenScopeList(req.GetScopes()),
+		req.GetExpiresIn().AsDuration(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &v1.CreateAccessTokenReply{
+		Token:       token,
+		AccessToken: biz.ToProtoAccessToken(res),
+	}, nil
+}
+
+func (s *UserService) ListAccessTokens(
+	ctx context.Context,
+	req *v1.ListAccessTokensRequest,
+) (*v1.ListAccessTokensReply, error) {
+	if err := checkUserId(ctx, req.GetId()); err != nil {
+		return nil, err
+	}
+	res, err := s.tu.ListAccessTokens(ctx, req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	return &v1.ListAccessTokensReply{AccessTokens: res}, nil
+}
+
+func (s *UserService) DeleteAccessToken(ctx context.Context, req *v1.DeleteAccessTokenRequest) (*emptypb.Empty, error) {
+	if err := checkUserId(ctx, req.GetId()); err != nil {
+		return nil, err
+	}
+	if err := s.tu.DeleteAccessToken(ctx, req.GetId(), req.GetTokenId()); err != nil {
+		return nil, err
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (s *UserService) Checkin(ctx context.Context, req *v1.CheckinRequest) (*v1.ScoreTransaction, error) {
+	if err := checkUserId(ctx, req.GetId()); err != nil {
+		return nil, err
+	}
+	res, err := s.scu.Checkin(ctx, req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	return biz.ToProtoScoreTransaction(res), nil
+}
+
+func (s *UserService) RedeemScore(ctx context.Context, req *v1.RedeemScoreRequest) (*v1.ScoreTransaction, error) {
+	if err := checkUserId(ctx, req.GetId()); err != nil {
+		return nil, err
+	}
+	var (
+		res *biz.ScoreTransaction
+		err error
+	)
+	switch req.GetTarget() {
+	case v1.RedeemScoreRequest_STORAGE:
+		res, err = s.scu.RedeemStorage(ctx, req.GetId(), req.GetQuantity())
+	case v1.RedeemScoreRequest_GROUP:
+		res, err = s.scu.RedeemGroup(ctx, req.GetId(), req.GetQuantity())
+	default:
+		return nil, v1.ErrorInvalidArgument("invalid argument: unknown target")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return biz.ToProtoScoreTransaction(res), nil
+}
+
+func (s *UserService) ListScoreTransactions(
+	ctx context.Context,
+	req *v1.ListScoreTransactionsRequest,
+) (*v1.ListScoreTransactionsReply, error) {
+	if err := checkUserId(ctx, req.GetId()); err != nil {
+		return nil, err
+	}
+	res, nextPageToken, err := s.scu.ListTransactions(ctx, req.GetId(), int(req.GetPageSize()), req.GetPageToken())
+	if err != nil {
+		return nil, err
+	}
+	return &v1.ListScoreTransactionsReply{
+		Transactions:  res,
+		NextPageToken: nextPageToken,
+	}, nil
+}
+
+// signedInUser returns the user signed in by the session of the request, zero if none. It is for the operations
+// skipping the session middleware, which are served to the users not signed in as well.
+func (s *UserService) signedInUser(ctx context.Context) int64 {
+	if tr, ok := transport.FromServerContext(ctx); ok {
+		if ht, ok := tr.(*http.Transport); ok {
+			session, err := s.store.Get(ht, "pallas-session")
+			if err != nil {
+				return 0
+			}
+			return sessionUserId(session)
+		}
+	}
+	return 0
+}
+
+// sessionUserId returns the user signed in by the session, zero if none or the second factor is pending
+func sessionUserId(session *sessions.Session) int64 {
+	if _, pending := session.Values[string(middleware.SessionKeySecondFactor)]; pending {
+		return 0
+	}
+	userId, _ := session.Values[string(middleware.SessionKeyUserId)].(int64)
+	return userId
+}
+
+// beginOIDCAuth starts the oidc flow, the binding of the flow is kept in the session of the user agent
+func (s *UserService) beginOIDCAuth(ctx context.Context, provider string, linkUserId int64) (*v1.OIDCAuthReply, error) {
+	if tr, ok := transport.FromServerContext(ctx); ok {
+		if ht, ok := tr.(*http.Transport); ok {
+			authURL, binding, err := s.ou.BeginAuth(ctx, provider, linkUserId)
+			if err != nil {
+				return nil, err
+			}
+
+			session, err := s.store.Get(ht, "pallas-session")
+			if err != nil {
+				return nil, v1.ErrorInternal("get session error: %v", err)
+			}
+			session.Values[string(middleware.SessionKeyOIDCBinding)] = binding
+			if err = session.Save(ht); err != nil {
+				return nil, v1.ErrorInternal("save session error: %v", err)
+			}
+			return &v1.OIDCAuthReply{AuthUrl: authURL}, nil
+		}
+	}
+	return nil, v1.ErrorInternal("transport error")
+}
+
+// saveSession signs the user in, the session is pending until SigninTOTP if secondFactor is required
+func (s *UserService) saveSession(
+	ctx context.Context,
+	ht *http.Transport,
+	userid int64,
+	k []byte,
+	secondFactor bool,
+) error {
+	session, err := s.store.Get(ht, "pallas-session")
+	if err != nil {
+		return v1.ErrorInternal("get session error: %v", err)
+	}
+	now := time.Now()
+	session.Values[string(middleware.SessionKeyUserId)] = userid
+	session.Values[string(middleware.SessionKeySigninAt)] = now.Unix()
+	if k != nil {
+		session.Values[string(middleware.SessionKeyUserK)] = k
+	} else {
+		delete(session.Values, string(middleware.SessionKeyUserK))
+	}
+	if secondFactor {
+		session.Values[string(middleware.SessionKeySecondFactor)] = now.Unix()
+	} else {
+		delete(session.Values, string(middleware.SessionKeySecondFactor))
+	}
+	if err = session.Save(ht); err != nil {
+		return v1.ErrorInternal("save session error: %v", err)
+	}
+	// tracked by user, so that the sessions can be listed, and revoked when the user is banned
+	remoteAddr, _ := ctx.Value(middleware.ContextKeyRemoteAddr).(string)
+	info, err := json.Marshal(&biz.Session{
+		SigninAt:   now,
+		RemoteAddr: remoteAddr,
+		UserAgent:  ht.RequestHeader().Get("User-Agent"),
+	})
+	if err != nil {
+		return v1.ErrorInternal("marshal session error: %v", err)
+	}
+	if err = s.store.Track(ht.Request().Context(), strconv.FormatInt(userid, 10), session, info); err != nil {
+		return v1.ErrorCacheOperation("track session error: %v", err)
+	}
+	return nil
+}
+
 func getUserId(ctx context.Context) (int64, error) {
 	v := ctx.Value(middleware.ContextKeyUserId)
 	if v == nil {
@@ -6,17 +6,20 @@ import (
 	"github.com/go-kratos/kratos/v2/errors"
 	"github.com/go-kratos/kratos/v2/log"
 	"github.com/go-kratos/kratos/v2/middleware"
+	"github.com/go-kratos/kratos/v2/transport"
 
 	"github.com/hominsu/pallas/app/pallas/service/internal/biz"
 )
 
 var (
-	ErrNotAdminUser   = errors.Unauthorized(unauthorized, "not admin user")
-	ErrMissingUserId  = errors.Unauthorized(unauthorized, "missing userid")
-	ErrInternalServer = errors.InternalServer(unauthorized, "internal server error")
+	ErrPermissionDenied = errors.Forbidden(forbidden, "permission denied")
+	ErrMissingUserId    = errors.Unauthorized(unauthorized, "missing userid")
+	ErrInternalServer   = errors.InternalServer(unauthorized, "internal server error")
 )
 
-func Admin(uu *biz.UserUsecase, logger log.Logger) middleware.Middleware {
+// Admin checks the permission required by the operation against the permissions of user, the operations
+// without a required permission in permissions are denied.
+func Admin(uu *biz.UserUsecase, permissions map[string]biz.Permission, logger log.Logger) middleware.Middleware {
 	helper := log.NewHelper(log.With(logger, "module", "middleware/admin"))
 
 	return func(handler middleware.Handler) middleware.Handler {
@@ -32,13 +35,23 @@ func Admin(uu *biz.UserUsecase, logger log.Logger) middleware.Middleware {
 				return nil, ErrInternalServer
 			}
 
-			ok, err := uu.IsAdminUser(ctx, id)
+			tr, ok := transport.FromServerContext(ctx)
+			if !ok {
+				return nil, ErrInternalServer
+			}
+			required, ok := permissions[tr.Operation()]
+			if !ok {
+				helper.Warnf("no permission is required by the operation %s, denied", tr.Operation())
+				return nil, ErrPermissionDenied
+			}
+
+			ok, err := uu.HasPermission(ctx, id, required)
 			if err != nil {
-				helper.Warnf("failed to check user if is admin user, err: %v", err)
+				helper.Warnf("failed to check the permission of user, err: %v", err)
 				return nil, ErrInternalServer
 			}
 			if !ok {
-				return nil, ErrNotAdminUser
+				return nil, ErrPermissionDenied
 			}
 
 			return handler(ctx, req)
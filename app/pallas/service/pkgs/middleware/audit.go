@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"context"
+
+	"github.com/go-kratos/kratos/v2/errors"
+	"github.com/go-kratos/kratos/v2/middleware"
+	"github.com/go-kratos/kratos/v2/transport"
+
+	"github.com/hominsu/pallas/app/pallas/service/internal/biz"
+)
+
+// Audit records the request as an audit event, with the actor from the session and the target and
+// changes collected by the usecases.
+func Audit(au *biz.AuditUsecase) middleware.Middleware {
+	return func(handler middleware.Handler) middleware.Handler {
+		return func(ctx context.Context, req any) (any, error) {
+			tr, ok := transport.FromServerContext(ctx)
+			if !ok {
+				return handler(ctx, req)
+			}
+
+			ctx, record := biz.NewAuditContext(ctx)
+			reply, err := handler(ctx, req)
+
+			event := &biz.AuditEvent{
+				Action:  tr.Operation(),
+				Success: err == nil,
+			}
+			if id, ok := ctx.Value(ContextKeyUserId).(int64); ok {
+				event.ActorId = &id
+			} else if id, ok := ctx.Value(ContextKeyPendingUserId).(int64); ok {
+				event.ActorId = &id
+			}
+			event.RemoteAddr, _ = ctx.Value(ContextKeyRemoteAddr).(string)
+			event.RequestId, _ = ctx.Value(ContextKeyRequestId).(string)
+			if err != nil {
+				event.Reason = errors.FromError(err).GetReason()
+			}
+			record.Fill(event)
+			au.Record(ctx, event)
+
+			return reply, err
+		}
+	}
+}
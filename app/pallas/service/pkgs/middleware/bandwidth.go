@@ -0,0 +1,147 @@
+package middleware
+
+import (
+	"context"
+	"io"
+	stdhttp "net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-kratos/kratos/v2/log"
+
+	"github.com/hominsu/pallas/app/pallas/service/internal/biz"
+	"github.com/hominsu/pallas/pkg/ratelimit"
+	"github.com/hominsu/pallas/pkg/sessions"
+)
+
+// bandwidthRefresh is how often the speed limit of a request in flight is refreshed, so that the change of
+// the group applies to the long downloads and uploads
+const bandwidthRefresh = time.Second
+
+// Bandwidth limits the request and response bodies of the requests matched by match, e.g. the uploads and the
+// downloads, to the speed_limit of the group of user, in bytes per second and zero is unlimited. The requests of
+// user share the limit of each direction, and the anonymous requests are not limited. It is an http filter rather
+// than a middleware since the request body is read before the middlewares.
+func Bandwidth(
+	store sessions.ServerStore,
+	uu *biz.UserUsecase,
+	tu *biz.AccessTokenUsecase,
+	limiter ratelimit.Limiter,
+	name string,
+	match func(r *stdhttp.Request) bool,
+	logger log.Logger,
+) func(stdhttp.Handler) stdhttp.Handler {
+	helper := log.NewHelper(log.With(logger, "module", "middleware/bandwidth"))
+
+	return func(next stdhttp.Handler) stdhttp.Handler {
+		return stdhttp.HandlerFunc(func(w stdhttp.ResponseWriter, r *stdhttp.Request) {
+			if !match(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			r, userId, ok := bandwidthUser(r, store, tu, name)
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			ctx := r.Context()
+			rate := &bandwidthRate{uu: uu, userId: userId, log: helper}
+			key := strconv.FormatInt(userId, 10)
+			if r.Body != nil && r.Body != stdhttp.NoBody {
+				r.Body = &limitedBody{
+					Reader: ratelimit.NewReader(ctx, r.Body, limiter, key+":up", rate.get),
+					Closer: r.Body,
+				}
+			}
+			next.ServeHTTP(&limitedResponseWriter{
+				ResponseWriter: w,
+				w:              ratelimit.NewWriter(ctx, w, limiter, key+":down", rate.get),
+			}, r)
+		})
+	}
+}
+
+// bandwidthUser returns the user of the access token or the session cookie, the sessions pending the second
+// factor are anonymous. The credentials are checked by the Session middleware later, which reuses the access
+// token authenticated and the session loaded here by the request returned, so that they are resolved once.
+func bandwidthUser(
+	r *stdhttp.Request,
+	store sessions.ServerStore,
+	tu *biz.AccessTokenUsecase,
+	name string,
+) (*stdhttp.Request, int64, bool) {
+	if authorization := r.Header.Get("Authorization"); authorization != "" {
+		token, err := authenticateToken(r.Context(), tu, authorization)
+		if err != nil {
+			return r, 0, false
+		}
+		return r.WithContext(context.WithValue(r.Context(), contextKeyAccessToken, token)), token.UserId, true
+	}
+
+	session, err := store.Load(r, name)
+	if err != nil {
+		return r, 0, false
+	}
+	r = sessions.Register(r, session)
+	if _, ok := session.Values[string(SessionKeySecondFactor)]; ok {
+		return r, 0, false
+	}
+	id, ok := session.Values[string(SessionKeyUserId)].(int64)
+	return r, id, ok
+}
+
+// bandwidthRate caches the speed limit of user for bandwidthRefresh.
+type bandwidthRate struct {
+	uu     *biz.UserUsecase
+	userId int64
+	log    *log.Helper
+
+	mu   sync.Mutex
+	rate int64
+	at   time.Time
+}
+
+func (b *bandwidthRate) get() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.at.IsZero() && time.Since(b.at) < bandwidthRefresh {
+		return b.rate
+	}
+	// the request must not fail on the limit, the last one is kept
+	rate, err := b.uu.SpeedLimit(context.Background(), b.userId)
+	if err != nil {
+		b.log.Warnf("failed to get the speed limit of user %d: %v", b.userId, err)
+	} else {
+		b.rate = rate
+	}
+	b.at = time.Now()
+	return b.rate
+}
+
+type limitedBody struct {
+	io.Reader
+	io.Closer
+}
+
+type limitedResponseWriter struct {
+	stdhttp.ResponseWriter
+	w *ratelimit.Writer
+}
+
+func (w *limitedResponseWriter) Write(p []byte) (int, error) {
+	return w.w.Write(p)
+}
+
+func (w *limitedResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(stdhttp.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (w *limitedResponseWriter) Unwrap() stdhttp.ResponseWriter {
+	return w.ResponseWriter
+}
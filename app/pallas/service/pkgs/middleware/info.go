@@ -2,12 +2,18 @@ package middleware
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 
 	"github.com/go-kratos/kratos/v2/middleware"
 	"github.com/go-kratos/kratos/v2/transport"
 	"github.com/go-kratos/kratos/v2/transport/http"
 )
 
+// HeaderRequestId is the header of the request id, it is taken from the request, e.g. set by the
+// reverse proxy, or generated, and returned in the response.
+const HeaderRequestId = "X-Request-Id"
+
 func Info() middleware.Middleware {
 	return func(handler middleware.Handler) middleware.Handler {
 		return func(ctx context.Context, req any) (any, error) {
@@ -15,8 +21,23 @@ func Info() middleware.Middleware {
 				if ht, ok := tr.(*http.Transport); ok {
 					ctx = context.WithValue(ctx, ContextKeyRemoteAddr, ht.Request().RemoteAddr)
 				}
+
+				requestId := tr.RequestHeader().Get(HeaderRequestId)
+				if requestId == "" {
+					requestId = newRequestId()
+				}
+				tr.ReplyHeader().Set(HeaderRequestId, requestId)
+				ctx = context.WithValue(ctx, ContextKeyRequestId, requestId)
 			}
 			return handler(ctx, req)
 		}
 	}
 }
+
+func newRequestId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,19 @@
+package middleware
+
+import (
+	"context"
+
+	"github.com/go-kratos/kratos/v2/middleware"
+
+	"github.com/hominsu/pallas/app/pallas/service/pkgs/replica"
+)
+
+// ReadYourWrites sends the reads of the request to the primary once it has written, so that the request reads
+// what it has just written regardless of the lag of the replicas
+func ReadYourWrites() middleware.Middleware {
+	return func(handler middleware.Handler) middleware.Handler {
+		return func(ctx context.Context, req any) (any, error) {
+			return handler(replica.WithReadYourWrites(ctx), req)
+		}
+	}
+}
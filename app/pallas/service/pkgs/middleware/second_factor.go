@@ -0,0 +1,22 @@
+package middleware
+
+import (
+	"context"
+
+	"github.com/go-kratos/kratos/v2/errors"
+	"github.com/go-kratos/kratos/v2/middleware"
+)
+
+var ErrSecondFactorRequired = errors.Unauthorized(unauthorized, "second factor required")
+
+// SecondFactor rejects the requests of sessions which passed the srp signin but not the second factor
+func SecondFactor() middleware.Middleware {
+	return func(handler middleware.Handler) middleware.Handler {
+		return func(ctx context.Context, req any) (any, error) {
+			if v := ctx.Value(ContextKeyPendingUserId); v != nil {
+				return nil, ErrSecondFactorRequired
+			}
+			return handler(ctx, req)
+		}
+	}
+}
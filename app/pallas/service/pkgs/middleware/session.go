@@ -2,6 +2,8 @@ package middleware
 
 import (
 	"context"
+	"strings"
+	"time"
 
 	"github.com/go-kratos/kratos/v2/errors"
 	"github.com/go-kratos/kratos/v2/log"
@@ -9,19 +11,29 @@ import (
 	"github.com/go-kratos/kratos/v2/transport"
 	"github.com/go-kratos/kratos/v2/transport/http"
 
+	v1 "github.com/hominsu/pallas/api/pallas/service/v1"
+	"github.com/hominsu/pallas/app/pallas/service/internal/biz"
 	"github.com/hominsu/pallas/pkg/sessions"
 )
 
 const (
 	unauthorized string = "UNAUTHORIZED"
+	forbidden    string = "FORBIDDEN"
 )
 
 type ContextKey string
 
 const (
-	ContextKeyUserId     ContextKey = "userid"
-	ContextKeyUserK      ContextKey = "user-srp-k"
-	ContextKeyRemoteAddr ContextKey = "remote-addr"
+	ContextKeyUserId        ContextKey = "userid"
+	ContextKeyUserK         ContextKey = "user-srp-k"
+	ContextKeyRemoteAddr    ContextKey = "remote-addr"
+	ContextKeyRequestId     ContextKey = "request-id"
+	ContextKeyPendingUserId ContextKey = "pending-userid"
+	ContextKeyTokenScopes   ContextKey = "token-scopes"
+	// ContextKeySigninAt holds the time the session signed in, absent for the access tokens
+	ContextKeySigninAt ContextKey = "signin-at"
+	// contextKeyAccessToken holds the access token authenticated by the Bandwidth filter
+	contextKeyAccessToken ContextKey = "access-token"
 )
 
 type SessionKey string
@@ -29,32 +41,154 @@ type SessionKey string
 const (
 	SessionKeyUserId SessionKey = "userid"
 	SessionKeyUserK  SessionKey = "user-srp-k"
+	// SessionKeySecondFactor holds the unix time the srp signin succeeded while the second factor is still pending
+	SessionKeySecondFactor SessionKey = "second-factor"
+	// SessionKeySigninAt holds the unix time the session signed in, including the second factor
+	SessionKeySigninAt SessionKey = "signin-at"
+	// SessionKeyOIDCBinding holds the binding of the oidc flow started by the session, see biz.OIDCUsecase.BeginAuth
+	SessionKeyOIDCBinding SessionKey = "oidc-binding"
 )
 
-var ErrGetSessionStoreFail = errors.Unauthorized(unauthorized, "get session error")
+// SecondFactorTimeout is how long a session may wait for the second factor after the srp signin
+const SecondFactorTimeout = 5 * time.Minute
+
+var (
+	ErrGetSessionStoreFail = errors.Unauthorized(unauthorized, "get session error")
+	ErrInvalidAccessToken  = errors.Unauthorized(unauthorized, "invalid access token")
+	ErrInsufficientScope   = errors.Forbidden(forbidden, "insufficient access token scope")
+	ErrSessionRequired     = errors.Forbidden(forbidden, "the operation requires a signed-in session")
+	ErrGetUserStatusFail   = errors.Unauthorized(unauthorized, "get user status error")
+)
+
+// Session puts the user of the session cookie into the context, a personal access token
+// presented as 'Authorization: Bearer <token>' is accepted as an alternative to the cookie.
+// The status of the user is checked on every request, see checkUserStatus.
+func Session(
+	store sessions.ServerStore,
+	uu *biz.UserUsecase,
+	tu *biz.AccessTokenUsecase,
+	name string,
+	logger log.Logger,
+) middleware.Middleware {
+	helper := log.NewHelper(log.With(logger, "module", "middleware/session"))
 
-func Session(store *sessions.RedisStore, name string, _ log.Logger) middleware.Middleware {
 	return func(handler middleware.Handler) middleware.Handler {
 		return func(ctx context.Context, req any) (any, error) {
 			if tr, ok := transport.FromServerContext(ctx); ok {
 				if ht, ok := tr.(*http.Transport); ok {
+					next := func(ctx context.Context, userId int64) (any, error) {
+						if err := checkUserStatus(ctx, uu, ht, userId); err != nil {
+							return nil, err
+						}
+						return handler(ctx, req)
+					}
+
+					if authorization := ht.RequestHeader().Get("Authorization"); authorization != "" {
+						token, ok := ctx.Value(contextKeyAccessToken).(*biz.AccessToken)
+						if !ok {
+							var err error
+							if token, err = authenticateToken(ctx, tu, authorization); err != nil {
+								helper.Debugf("failed to authenticate access token, err: %v", err)
+								return nil, ErrInvalidAccessToken
+							}
+						}
+						if _, ok := sessionOnlyOperations[ht.Operation()]; ok {
+							return nil, ErrSessionRequired
+						}
+						if !allowedByScopes(ht, token.Scopes) {
+							return nil, ErrInsufficientScope
+						}
+						ctx = context.WithValue(ctx, ContextKeyUserId, token.UserId)
+						ctx = context.WithValue(ctx, ContextKeyTokenScopes, token.Scopes)
+						return next(ctx, token.UserId)
+					}
+
 					session, err := store.Get(ht, name)
 					if err != nil {
 						return nil, ErrGetSessionStoreFail
 					}
-					if userId, ok := session.Values[string(SessionKeyUserId)]; ok {
-						if id, ok := userId.(int64); ok {
-							ctx = context.WithValue(ctx, ContextKeyUserId, id)
+					id, ok := session.Values[string(SessionKeyUserId)].(int64)
+					if !ok {
+						return handler(ctx, req)
+					}
+					if since, ok := session.Values[string(SessionKeySecondFactor)]; ok {
+						// the second factor is pending, only the signin of second factor is allowed
+						if unix, ok := since.(int64); ok && time.Since(time.Unix(unix, 0)) < SecondFactorTimeout {
+							ctx = context.WithValue(ctx, ContextKeyPendingUserId, id)
+							return next(ctx, id)
 						}
+						return handler(ctx, req)
+					}
+					ctx = context.WithValue(ctx, ContextKeyUserId, id)
+					if unix, ok := session.Values[string(SessionKeySigninAt)].(int64); ok {
+						ctx = context.WithValue(ctx, ContextKeySigninAt, time.Unix(unix, 0))
 					}
 					if userK, ok := session.Values[string(SessionKeyUserK)]; ok {
 						if k, ok := userK.([]byte); ok {
 							ctx = context.WithValue(ctx, ContextKeyUserK, k)
 						}
 					}
+					return next(ctx, id)
 				}
 			}
 			return handler(ctx, req)
 		}
 	}
 }
+
+// checkUserStatus rejects the banned and not activated users, the overuse banned users are read-only,
+// which can only send GET requests and sign out. The users pending deletion can restore the account as well.
+func checkUserStatus(ctx context.Context, uu *biz.UserUsecase, ht *http.Transport, userId int64) error {
+	status, err := uu.GetUserStatus(ctx, userId)
+	if err != nil {
+		return ErrGetUserStatusFail
+	}
+	switch status {
+	case biz.StatusOveruseBaned:
+		if ht.Request().Method == "GET" || ht.Operation() == "/pallas.service.v1.UserService/SignOut" {
+			return nil
+		}
+		return v1.ErrorUserOveruseBanned("user is overuse banned, read-only")
+	case biz.StatusPendingDeletion:
+		if ht.Request().Method == "GET" ||
+			ht.Operation() == "/pallas.service.v1.UserService/SignOut" ||
+			ht.Operation() == "/pallas.service.v1.UserService/RestoreUser" {
+			return nil
+		}
+		return v1.ErrorUserPendingDeletion("user is pending deletion, restore the account first")
+	default:
+		return biz.CheckSigninStatus(status)
+	}
+}
+
+func authenticateToken(ctx context.Context, tu *biz.AccessTokenUsecase, authorization string) (*biz.AccessToken, error) {
+	scheme, raw, ok := strings.Cut(authorization, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return nil, ErrInvalidAccessToken
+	}
+	return tu.Authenticate(ctx, strings.TrimSpace(raw))
+}
+
+// sessionOnlyOperations manage the credentials of the user, which are never allowed to the access tokens whatever
+// the scopes, so that a leaked token cannot mint other tokens or take over the account.
+var sessionOnlyOperations = map[string]struct{}{
+	"/pallas.service.v1.UserService/CreateAccessToken": {},
+	"/pallas.service.v1.UserService/DeleteAccessToken": {},
+	"/pallas.service.v1.UserService/EnrollTOTP":        {},
+	"/pallas.service.v1.UserService/ConfirmTOTP":       {},
+	"/pallas.service.v1.UserService/DisableTOTP":       {},
+	"/pallas.service.v1.UserService/LinkIdentity":      {},
+	"/pallas.service.v1.UserService/UnlinkIdentity":    {},
+}
+
+// allowedByScopes reports whether the request is allowed by the scopes of access token,
+// the admin service requires the admin scope, and read-only scope only allows GET requests.
+func allowedByScopes(ht *http.Transport, scopes []biz.TokenScope) bool {
+	if strings.HasPrefix(ht.Operation(), "/pallas.service.v1.AdminService/") {
+		return biz.HasScope(scopes, biz.ScopeAdmin)
+	}
+	if biz.HasScope(scopes, biz.ScopeUser) {
+		return true
+	}
+	return ht.Request().Method == "GET" && biz.HasScope(scopes, biz.ScopeReadOnly)
+}
@@ -0,0 +1,229 @@
+package replica
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"entgo.io/ent/dialect"
+	entsql "entgo.io/ent/dialect/sql"
+	"github.com/go-kratos/kratos/v2/log"
+)
+
+const (
+	// DefaultHealthCheckInterval is how often the replicas are checked if the interval is not set
+	DefaultHealthCheckInterval = 5 * time.Second
+	// pingTimeout is how long a replica is waited for by the check
+	pingTimeout = 2 * time.Second
+)
+
+type contextKey int
+
+const (
+	contextKeyPrimary contextKey = iota
+	contextKeyWrites
+)
+
+// writes records whether the context has written to the primary
+type writes struct {
+	wrote int32
+}
+
+// WithReadYourWrites returns the context whose reads go to the primary once it has written, e.g. the context of a
+// request, so that the request reads what it has just written regardless of the lag of the replicas.
+func WithReadYourWrites(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(contextKeyWrites).(*writes); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, contextKeyWrites, &writes{})
+}
+
+// WithPrimary returns the context whose reads always go to the primary, e.g. the migrations.
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, contextKeyPrimary, true)
+}
+
+// usePrimary reports whether the reads of the context must go to the primary
+func usePrimary(ctx context.Context) bool {
+	if v, _ := ctx.Value(contextKeyPrimary).(bool); v {
+		return true
+	}
+	w, ok := ctx.Value(contextKeyWrites).(*writes)
+	return ok && atomic.LoadInt32(&w.wrote) == 1
+}
+
+// markWrite records the write of the context
+func markWrite(ctx context.Context) {
+	if w, ok := ctx.Value(contextKeyWrites).(*writes); ok {
+		atomic.StoreInt32(&w.wrote, 1)
+	}
+}
+
+// isRead reports whether the statement only reads, the statements locking rows and the inserts returning the ids
+// of postgres are sent to the primary.
+func isRead(query string) bool {
+	q := strings.ToUpper(strings.TrimSpace(query))
+	if !strings.HasPrefix(q, "SELECT") {
+		return false
+	}
+	for _, lock := range []string{" FOR UPDATE", " FOR SHARE", " FOR NO KEY UPDATE", " LOCK IN SHARE MODE"} {
+		if strings.Contains(q, lock) {
+			return false
+		}
+	}
+	return true
+}
+
+var _ dialect.Driver = (*Driver)(nil)
+
+// Driver sends the reads to the healthy replicas in turn, and the writes and the transactions to the primary. The
+// reads go to the primary if no replica is healthy, or the context requires it, see WithReadYourWrites and
+// WithPrimary.
+type Driver struct {
+	primary  *entsql.Driver
+	replicas []*replica
+	next     uint32
+	interval time.Duration
+
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+	log     *log.Helper
+}
+
+type replica struct {
+	drv     *entsql.Driver
+	healthy int32
+}
+
+// NewDriver checks the replicas and returns the driver, the replicas are checked every interval until closed.
+func NewDriver(primary *entsql.Driver, replicas []*entsql.Driver, interval time.Duration, logger log.Logger) *Driver {
+	if interval <= 0 {
+		interval = DefaultHealthCheckInterval
+	}
+	d := &Driver{
+		primary:  primary,
+		replicas: make([]*replica, len(replicas)),
+		interval: interval,
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		log:      log.NewHelper(log.With(logger, "module", "replica")),
+	}
+	for i, drv := range replicas {
+		d.replicas[i] = &replica{drv: drv, healthy: 1}
+	}
+	d.check()
+	go d.run()
+	return d
+}
+
+// Healthy returns the number of the replicas in rotation.
+func (d *Driver) Healthy() int {
+	n := 0
+	for _, r := range d.replicas {
+		if atomic.LoadInt32(&r.healthy) == 1 {
+			n++
+		}
+	}
+	return n
+}
+
+func (d *Driver) Exec(ctx context.Context, query string, args, v any) error {
+	markWrite(ctx)
+	return d.primary.Exec(ctx, query, args, v)
+}
+
+func (d *Driver) Query(ctx context.Context, query string, args, v any) error {
+	return d.route(ctx, query).Query(ctx, query, args, v)
+}
+
+// ExecContext is called by the ExecContext of the ent client.
+func (d *Driver) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	markWrite(ctx)
+	return d.primary.ExecContext(ctx, query, args...)
+}
+
+// QueryContext is called by the QueryContext of the ent client.
+func (d *Driver) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return d.route(ctx, query).QueryContext(ctx, query, args...)
+}
+
+func (d *Driver) Tx(ctx context.Context) (dialect.Tx, error) {
+	markWrite(ctx)
+	return d.primary.Tx(ctx)
+}
+
+// BeginTx is called by the BeginTx of the ent client.
+func (d *Driver) BeginTx(ctx context.Context, opts *sql.TxOptions) (dialect.Tx, error) {
+	markWrite(ctx)
+	return d.primary.BeginTx(ctx, opts)
+}
+
+func (d *Driver) Dialect() string {
+	return d.primary.Dialect()
+}
+
+// Close stops the health checks and closes the primary and the replicas.
+func (d *Driver) Close() error {
+	d.once.Do(func() {
+		close(d.done)
+		<-d.stopped
+	})
+	for _, r := range d.replicas {
+		if err := r.drv.Close(); err != nil {
+			d.log.Warnf("failed closing replica: %v", err)
+		}
+	}
+	return d.primary.Close()
+}
+
+// route returns the driver the statement is sent to
+func (d *Driver) route(ctx context.Context, query string) *entsql.Driver {
+	if !isRead(query) {
+		markWrite(ctx)
+		return d.primary
+	}
+	if usePrimary(ctx) {
+		return d.primary
+	}
+	n := len(d.replicas)
+	start := int(atomic.AddUint32(&d.next, 1))
+	for i := 0; i < n; i++ {
+		if r := d.replicas[(start+i)%n]; atomic.LoadInt32(&r.healthy) == 1 {
+			return r.drv
+		}
+	}
+	return d.primary
+}
+
+func (d *Driver) run() {
+	defer close(d.stopped)
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-d.done:
+			return
+		case <-ticker.C:
+			d.check()
+		}
+	}
+}
+
+// check pings the replicas, the replicas failed are taken out of rotation until they pass again
+func (d *Driver) check() {
+	for i, r := range d.replicas {
+		ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+		err := r.drv.DB().PingContext(ctx)
+		cancel()
+		switch {
+		case err != nil && atomic.CompareAndSwapInt32(&r.healthy, 1, 0):
+			d.log.Warnf("replica %d is taken out of rotation: %v", i, err)
+		case err == nil && atomic.CompareAndSwapInt32(&r.healthy, 0, 1):
+			d.log.Infof("replica %d is back in rotation", i)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package replica
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"entgo.io/ent/dialect"
+	entsql "entgo.io/ent/dialect/sql"
+	"github.com/go-kratos/kratos/v2/log"
+	"github.com/stretchr/testify/assert"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func openTestDriver(t *testing.T, name string) *entsql.Driver {
+	drv, err := entsql.Open(dialect.SQLite, "file:"+name+"?mode=memory&cache=shared")
+	assert.NoError(t, err)
+	_, err = drv.ExecContext(context.Background(), "CREATE TABLE t (id INTEGER NOT NULL)")
+	assert.NoError(t, err)
+	return drv
+}
+
+func count(t *testing.T, ctx context.Context, d *Driver) int {
+	rows, err := d.QueryContext(ctx, "SELECT COUNT(*) FROM t")
+	assert.NoError(t, err)
+	defer func() { _ = rows.Close() }()
+	n := 0
+	assert.True(t, rows.Next())
+	assert.NoError(t, rows.Scan(&n))
+	return n
+}
+
+func TestDriver(t *testing.T) {
+	logger := log.With(log.NewStdLogger(io.Discard))
+	primary := openTestDriver(t, "replica_primary")
+	r1 := openTestDriver(t, "replica_1")
+	r2 := openTestDriver(t, "replica_2")
+	d := NewDriver(primary, []*entsql.Driver{r1, r2}, time.Hour, logger)
+	defer func() { _ = d.Close() }()
+	assert.Equal(t, dialect.SQLite, d.Dialect())
+	assert.Equal(t, 2, d.Healthy())
+
+	// the writes go to the primary, and the reads to the replicas
+	_, err := d.ExecContext(context.Background(), "INSERT INTO t (id) VALUES (1)")
+	assert.NoError(t, err)
+	assert.Zero(t, count(t, context.Background(), d))
+	assert.Equal(t, 1, count(t, WithPrimary(context.Background()), d))
+
+	// the request reads the primary once it has written
+	ctx := WithReadYourWrites(context.Background())
+	assert.Zero(t, count(t, ctx, d))
+	_, err = d.ExecContext(ctx, "INSERT INTO t (id) VALUES (2)")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count(t, ctx, d))
+	assert.Equal(t, 2, count(t, WithReadYourWrites(ctx), d))
+	assert.Zero(t, count(t, context.Background(), d))
+
+	// the transactions are on the primary
+	ctx = WithReadYourWrites(context.Background())
+	tx, err := d.Tx(ctx)
+	assert.NoError(t, err)
+	assert.NoError(t, tx.Rollback())
+	assert.Equal(t, 2, count(t, ctx, d))
+
+	// the replicas failed are out of rotation, the reads fall back to the primary without any
+	assert.NoError(t, r1.Close())
+	d.check()
+	assert.Equal(t, 1, d.Healthy())
+	for i := 0; i < 4; i++ {
+		assert.Zero(t, count(t, context.Background(), d))
+	}
+	assert.NoError(t, r2.Close())
+	d.check()
+	assert.Zero(t, d.Healthy())
+	assert.Equal(t, 2, count(t, context.Background(), d))
+}
+
+func TestIsRead(t *testing.T) {
+	assert.True(t, isRead("SELECT `id` FROM `users` WHERE `email` = ?"))
+	assert.True(t, isRead("  select 1"))
+	assert.False(t, isRead("INSERT INTO \"users\" (\"email\") VALUES ($1) RETURNING \"id\""))
+	assert.False(t, isRead("UPDATE `users` SET `score` = ?"))
+	assert.False(t, isRead("SELECT `id` FROM `users` WHERE `id` = ? FOR UPDATE"))
+	assert.False(t, isRead("SELECT \"id\" FROM \"users\" WHERE \"id\" = $1 FOR SHARE"))
+}
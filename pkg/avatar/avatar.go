@@ -0,0 +1,201 @@
+package avatar
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	_ "image/gif"  // register the gif decoder
+	_ "image/jpeg" // register the jpeg decoder
+	"image/png"
+	"io"
+	"math"
+)
+
+var (
+	ErrTooLarge          = errors.New("avatar: image too large")
+	ErrDimensionTooLarge = errors.New("avatar: image dimension too large")
+	ErrUnsupportedFormat = errors.New("avatar: unsupported image format")
+)
+
+// Decode reads at most maxBytes from r and decodes the image, the dimension is checked against
+// maxDimension before decoding, so that a small file can not expand to a huge image in memory.
+// The formats supported are png, jpeg and gif, only the first frame of gif is decoded.
+func Decode(r io.Reader, maxBytes int64, maxDimension int) (image.Image, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, ErrTooLarge
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	switch {
+	case errors.Is(err, image.ErrFormat):
+		return nil, ErrUnsupportedFormat
+	case err != nil:
+		return nil, err
+	}
+	if format != "png" && format != "jpeg" && format != "gif" {
+		return nil, ErrUnsupportedFormat
+	}
+	if config.Width <= 0 || config.Height <= 0 {
+		return nil, ErrUnsupportedFormat
+	}
+	if config.Width > maxDimension || config.Height > maxDimension {
+		return nil, ErrDimensionTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+// CropSquare returns the largest square in the center of img.
+func CropSquare(img image.Image) image.Image {
+	b := img.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	x0 := b.Min.X + (b.Dx()-side)/2
+	y0 := b.Min.Y + (b.Dy()-side)/2
+	rect := image.Rect(x0, y0, x0+side, y0+side)
+
+	if sub, ok := img.(interface {
+		SubImage(r image.Rectangle) image.Image
+	}); ok {
+		return sub.SubImage(rect)
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, side, side))
+	draw.Draw(dst, dst.Bounds(), img, rect.Min, draw.Src)
+	return dst
+}
+
+// Thumbnail crops the center square of img and resizes it to size x size.
+func Thumbnail(img image.Image, size int) *image.RGBA {
+	return Resize(CropSquare(img), size, size)
+}
+
+// Resize scales img to width x height. Shrinking averages the source pixels covered by each target pixel,
+// and enlarging interpolates bilinearly, both are done on the premultiplied colors, so the transparent
+// pixels do not bleed into the edges.
+func Resize(img image.Image, width, height int) *image.RGBA {
+	b := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+
+	sw, sh := b.Dx(), b.Dy()
+	xw := weights(sw, width)
+	yw := weights(sh, height)
+
+	// horizontal pass, sh rows of width pixels
+	tmp := make([]float64, width*sh*4)
+	for y := 0; y < sh; y++ {
+		row := src.Pix[y*src.Stride:]
+		for x, ws := range xw {
+			var r, g, bl, a float64
+			for _, w := range ws {
+				p := row[w.index*4:]
+				r += float64(p[0]) * w.weight
+				g += float64(p[1]) * w.weight
+				bl += float64(p[2]) * w.weight
+				a += float64(p[3]) * w.weight
+			}
+			t := tmp[(y*width+x)*4:]
+			t[0], t[1], t[2], t[3] = r, g, bl, a
+		}
+	}
+
+	// vertical pass
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y, ws := range yw {
+		row := dst.Pix[y*dst.Stride:]
+		for x := 0; x < width; x++ {
+			var r, g, bl, a float64
+			for _, w := range ws {
+				t := tmp[(w.index*width+x)*4:]
+				r += t[0] * w.weight
+				g += t[1] * w.weight
+				bl += t[2] * w.weight
+				a += t[3] * w.weight
+			}
+			p := row[x*4:]
+			p[0], p[1], p[2], p[3] = clamp(r), clamp(g), clamp(bl), clamp(a)
+		}
+	}
+	return dst
+}
+
+// EncodePNG encodes img as png.
+func EncodePNG(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.BestCompression}
+	if err := encoder.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+type weight struct {
+	index  int
+	weight float64
+}
+
+// weights returns the source pixels and their weights of each target pixel, when scaling n pixels to m.
+func weights(n, m int) [][]weight {
+	res := make([][]weight, m)
+	scale := float64(n) / float64(m)
+
+	if scale > 1 {
+		// area averaging, the target pixel i covers the source interval [i*scale, (i+1)*scale)
+		for i := range res {
+			start, end := float64(i)*scale, float64(i+1)*scale
+			for j := int(start); j < n && float64(j) < end; j++ {
+				cover := math.Min(end, float64(j+1)) - math.Max(start, float64(j))
+				if cover > 0 {
+					res[i] = append(res[i], weight{index: j, weight: cover / scale})
+				}
+			}
+		}
+		return res
+	}
+
+	// bilinear, the center of the target pixel i is mapped to the source
+	for i := range res {
+		center := (float64(i)+0.5)*scale - 0.5
+		j := int(math.Floor(center))
+		f := center - float64(j)
+		lo, hi := clampIndex(j, n), clampIndex(j+1, n)
+		if lo == hi || f == 0 {
+			res[i] = []weight{{index: lo, weight: 1}}
+			continue
+		}
+		res[i] = []weight{{index: lo, weight: 1 - f}, {index: hi, weight: f}}
+	}
+	return res
+}
+
+func clampIndex(i, n int) int {
+	if i < 0 {
+		return 0
+	}
+	if i >= n {
+		return n - 1
+	}
+	return i
+}
+
+func clamp(v float64) uint8 {
+	v = math.Round(v)
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v)
+}
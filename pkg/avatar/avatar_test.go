@@ -0,0 +1,96 @@
+package avatar
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func encode(t *testing.T, img image.Image) []byte {
+	var buf bytes.Buffer
+	assert.NoError(t, png.Encode(&buf, img))
+	return buf.Bytes()
+}
+
+func TestDecode(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 64, 32))
+	data := encode(t, img)
+
+	res, err := Decode(bytes.NewReader(data), int64(len(data)), 64)
+	assert.NoError(t, err)
+	assert.Equal(t, img.Bounds(), res.Bounds())
+
+	_, err = Decode(bytes.NewReader(data), int64(len(data))-1, 64)
+	assert.ErrorIs(t, err, ErrTooLarge)
+	_, err = Decode(bytes.NewReader(data), int64(len(data)), 63)
+	assert.ErrorIs(t, err, ErrDimensionTooLarge)
+	_, err = Decode(strings.NewReader("<svg></svg>"), 1024, 64)
+	assert.ErrorIs(t, err, ErrUnsupportedFormat)
+}
+
+func TestThumbnail(t *testing.T) {
+	// the left and right quarters are cropped, the center half is red on top and blue at the bottom
+	img := image.NewRGBA(image.Rect(0, 0, 400, 200))
+	draw.Draw(img, image.Rect(0, 0, 400, 100), image.NewUniform(color.RGBA{R: 0xff, A: 0xff}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(0, 100, 400, 200), image.NewUniform(color.RGBA{B: 0xff, A: 0xff}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(0, 0, 100, 200), image.NewUniform(color.RGBA{G: 0xff, A: 0xff}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(300, 0, 400, 200), image.NewUniform(color.RGBA{G: 0xff, A: 0xff}), image.Point{}, draw.Src)
+
+	for _, size := range []int{40, 100, 256} {
+		res := Thumbnail(img, size)
+		assert.Equal(t, image.Rect(0, 0, size, size), res.Bounds())
+		assert.Equal(t, color.RGBA{R: 0xff, A: 0xff}, res.RGBAAt(0, 0))
+		assert.Equal(t, color.RGBA{B: 0xff, A: 0xff}, res.RGBAAt(size-1, size-1))
+		// the boundary is blended
+		mid := res.RGBAAt(size/2, size/2-1)
+		assert.NotZero(t, mid.R)
+	}
+}
+
+func TestResizeUniform(t *testing.T) {
+	c := color.RGBA{R: 0x12, G: 0x34, B: 0x56, A: 0xff}
+	img := image.NewRGBA(image.Rect(0, 0, 37, 53))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+
+	for _, size := range [][2]int{{10, 10}, {37, 53}, {100, 7}} {
+		res := Resize(img, size[0], size[1])
+		for y := 0; y < size[1]; y++ {
+			for x := 0; x < size[0]; x++ {
+				assert.Equal(t, c, res.RGBAAt(x, y))
+			}
+		}
+	}
+}
+
+func TestIdenticon(t *testing.T) {
+	a := Identicon([]byte("1"), 100)
+	assert.Equal(t, image.Rect(0, 0, 100, 100), a.Bounds())
+	assert.Equal(t, encode(t, a), encode(t, Identicon([]byte("1"), 100)))
+	assert.NotEqual(t, encode(t, a), encode(t, Identicon([]byte("2"), 100)))
+
+	// mirrored horizontally
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 50; x++ {
+			assert.Equal(t, a.NRGBAAt(x, y), a.NRGBAAt(99-x, y))
+		}
+	}
+	assert.Equal(t, identiconBackground, a.NRGBAAt(0, 0))
+}
+
+func TestGravatarURL(t *testing.T) {
+	// https://docs.gravatar.com/general/hash/
+	assert.Equal(t,
+		"https://www.gravatar.com/avatar/0bc83cb571cd1c50ba6f3e8a78ef1346?d=identicon&s=80",
+		GravatarURL("", " MyEmailAddress@example.com ", 80, "identicon"),
+	)
+	assert.Equal(t,
+		"https://cravatar.cn/avatar/0bc83cb571cd1c50ba6f3e8a78ef1346?s=40",
+		GravatarURL("https://cravatar.cn/avatar", "myemailaddress@example.com", 40, ""),
+	)
+}
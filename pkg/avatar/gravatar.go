@@ -0,0 +1,31 @@
+package avatar
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// DefaultGravatarServer is the public Gravatar server.
+const DefaultGravatarServer = "https://www.gravatar.com/avatar/"
+
+// GravatarURL returns the url of the Gravatar of email on server, fallback is the image shown when there
+// is no Gravatar, e.g. identicon, see https://docs.gravatar.com/general/images/ for details
+func GravatarURL(server, email string, size int, fallback string) string {
+	if server == "" {
+		server = DefaultGravatarServer
+	}
+	if !strings.HasSuffix(server, "/") {
+		server += "/"
+	}
+	sum := md5.Sum([]byte(strings.ToLower(strings.TrimSpace(email))))
+
+	query := url.Values{}
+	query.Set("s", strconv.Itoa(size))
+	if fallback != "" {
+		query.Set("d", fallback)
+	}
+	return server + hex.EncodeToString(sum[:]) + "?" + query.Encode()
+}
@@ -0,0 +1,91 @@
+package avatar
+
+import (
+	"crypto/sha256"
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+const (
+	// identiconGrid is the number of cells in a row of the identicon
+	identiconGrid = 5
+	// identiconMargin is the margin around the cells, in cells
+	identiconMargin = 0.5
+)
+
+var identiconBackground = color.NRGBA{R: 0xf0, G: 0xf0, B: 0xf0, A: 0xff}
+
+// Identicon generates a size x size identicon of seed, the same seed always generates the same image.
+// The 5x5 cells are mirrored horizontally and colored by the hash of seed, like the GitHub identicons.
+func Identicon(seed []byte, size int) *image.NRGBA {
+	sum := sha256.Sum256(seed)
+
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), image.NewUniform(identiconBackground), image.Point{}, draw.Src)
+
+	fg := image.NewUniform(identiconColor(sum))
+	cell := float64(size) / (identiconGrid + 2*identiconMargin)
+	offset := cell * identiconMargin
+	half := (identiconGrid + 1) / 2
+	for row := 0; row < identiconGrid; row++ {
+		for col := 0; col < half; col++ {
+			// one bit per cell of the left half and the middle column
+			bit := row*half + col
+			if sum[bit/8]>>(bit%8)&1 == 0 {
+				continue
+			}
+			r := image.Rect(
+				int(offset+float64(col)*cell), int(offset+float64(row)*cell),
+				int(offset+float64(col+1)*cell), int(offset+float64(row+1)*cell),
+			)
+			draw.Draw(img, r, fg, image.Point{}, draw.Src)
+			// mirror by the pixels rather than the cells, so that the rounding is symmetric too
+			mirror := image.Rect(size-r.Max.X, r.Min.Y, size-r.Min.X, r.Max.Y)
+			draw.Draw(img, mirror, fg, image.Point{}, draw.Src)
+		}
+	}
+	return img
+}
+
+// identiconColor picks a saturated color by the hue in the last bytes of the hash.
+func identiconColor(sum [sha256.Size]byte) color.NRGBA {
+	hue := (float64(sum[sha256.Size-2])*256 + float64(sum[sha256.Size-1])) / 65536 * 360
+	lightness := 0.45 + float64(sum[sha256.Size-3]%20)/100
+	return hsl(hue, 0.6, lightness)
+}
+
+// hsl converts the hue in degrees, the saturation and the lightness in [0, 1] to rgb.
+func hsl(h, s, l float64) color.NRGBA {
+	c := (1 - abs(2*l-1)) * s
+	hp := h / 60
+	x := c * (1 - abs(mod2(hp)-1))
+	var r, g, b float64
+	switch {
+	case hp < 1:
+		r, g = c, x
+	case hp < 2:
+		r, g = x, c
+	case hp < 3:
+		g, b = c, x
+	case hp < 4:
+		g, b = x, c
+	case hp < 5:
+		r, b = x, c
+	default:
+		r, b = c, x
+	}
+	m := l - c/2
+	return color.NRGBA{R: clamp((r + m) * 255), G: clamp((g + m) * 255), B: clamp((b + m) * 255), A: 0xff}
+}
+
+func abs(v float64) float64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func mod2(v float64) float64 {
+	return v - 2*float64(int(v/2))
+}
@@ -0,0 +1,82 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// localSweepInterval is how often the idle buckets are removed
+const localSweepInterval = time.Minute
+
+var _ Limiter = (*LocalLimiter)(nil)
+
+// LocalLimiter keeps the buckets in memory, it limits the streams of a single instance.
+type LocalLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	rate   int64
+	last   time.Time
+}
+
+func NewLocalLimiter() *LocalLimiter {
+	return &LocalLimiter{
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+		now:       time.Now,
+	}
+}
+
+func (l *LocalLimiter) Reserve(_ context.Context, key string, n int, rate int64) (time.Duration, error) {
+	if rate <= 0 {
+		return 0, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(rate), last: now}
+		l.buckets[key] = b
+	}
+	return b.take(now, n, rate), nil
+}
+
+// take refills the bucket at rate since the last take, and takes n tokens.
+func (b *bucket) take(now time.Time, n int, rate int64) time.Duration {
+	burst := float64(rate)
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(burst, b.tokens+elapsed.Seconds()*burst)
+	} else {
+		b.tokens = math.Min(burst, b.tokens)
+	}
+	b.rate, b.last = rate, now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / burst * float64(time.Second))
+}
+
+// sweep removes the buckets refilled to full, which are the same as the absent ones.
+func (l *LocalLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < localSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*float64(b.rate) >= float64(b.rate) {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+// Package ratelimit implements the token bucket limiting of the byte streams. The buckets are keyed, e.g. by
+// user, so that the concurrent streams of a key share the rate, and the rate is given on every reservation,
+// so that a change of the rate applies to the streams in flight.
+package ratelimit
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Limiter is a keyed token bucket, which holds at most a second of the rate.
+type Limiter interface {
+	// Reserve takes n tokens from the bucket of key refilled at rate tokens per second, and returns how long
+	// to wait before the tokens can be used. The bucket goes into debt if there are not enough tokens, so n
+	// must not exceed rate, and a rate not greater than zero is unlimited.
+	Reserve(ctx context.Context, key string, n int, rate int64) (time.Duration, error)
+}
+
+// RateFunc returns the current rate in bytes per second, a rate not greater than zero is unlimited.
+type RateFunc func() int64
+
+// WaitN waits until n tokens of key can be used.
+func WaitN(ctx context.Context, l Limiter, key string, n int, rate int64) error {
+	d, err := l.Reserve(ctx, key, n, rate)
+	if err != nil {
+		return err
+	}
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// wait is WaitN failing open, the stream is not limited if the limiter is unavailable, only the cancellation
+// of ctx is returned.
+func wait(ctx context.Context, l Limiter, key string, n int, rate int64) error {
+	if err := WaitN(ctx, l, key, n, rate); err != nil && ctx.Err() != nil {
+		return err
+	}
+	return nil
+}
+
+// Reader limits the reading of an io.Reader.
+type Reader struct {
+	ctx  context.Context
+	r    io.Reader
+	l    Limiter
+	key  string
+	rate RateFunc
+}
+
+func NewReader(ctx context.Context, r io.Reader, l Limiter, key string, rate RateFunc) *Reader {
+	return &Reader{ctx: ctx, r: r, l: l, key: key, rate: rate}
+}
+
+// Read reads at most a second of the rate, and waits for the bytes read.
+func (r *Reader) Read(p []byte) (int, error) {
+	rate := r.rate()
+	if rate <= 0 {
+		return r.r.Read(p)
+	}
+	if int64(len(p)) > rate {
+		p = p[:rate]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if wErr := wait(r.ctx, r.l, r.key, n, rate); wErr != nil {
+			return n, wErr
+		}
+	}
+	return n, err
+}
+
+// Writer limits the writing to an io.Writer.
+type Writer struct {
+	ctx  context.Context
+	w    io.Writer
+	l    Limiter
+	key  string
+	rate RateFunc
+}
+
+func NewWriter(ctx context.Context, w io.Writer, l Limiter, key string, rate RateFunc) *Writer {
+	return &Writer{ctx: ctx, w: w, l: l, key: key, rate: rate}
+}
+
+// Write writes p in chunks of at most a second of the rate, and waits before writing each chunk.
+func (w *Writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		rate := w.rate()
+		if rate <= 0 {
+			n, err := w.w.Write(p)
+			return written + n, err
+		}
+		chunk := p
+		if int64(len(chunk)) > rate {
+			chunk = chunk[:rate]
+		}
+		if err := wait(w.ctx, w.l, w.key, len(chunk), rate); err != nil {
+			return written, err
+		}
+		n, err := w.w.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,117 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := NewLocalLimiter()
+	l.now = func() time.Time { return now }
+	l.lastSweep = now
+	ctx := context.Background()
+
+	// the bucket starts full
+	d, err := l.Reserve(ctx, "a", 1000, 1000)
+	assert.NoError(t, err)
+	assert.Zero(t, d)
+	// and goes into debt
+	d, _ = l.Reserve(ctx, "a", 500, 1000)
+	assert.Equal(t, 500*time.Millisecond, d)
+	// the other keys are not affected
+	d, _ = l.Reserve(ctx, "b", 1000, 1000)
+	assert.Zero(t, d)
+
+	// refilled at the rate
+	now = now.Add(time.Second)
+	d, _ = l.Reserve(ctx, "a", 500, 1000)
+	assert.Zero(t, d)
+	// never over a second of the rate
+	now = now.Add(time.Hour)
+	d, _ = l.Reserve(ctx, "a", 1000, 1000)
+	assert.Zero(t, d)
+	d, _ = l.Reserve(ctx, "a", 100, 1000)
+	assert.Equal(t, 100*time.Millisecond, d)
+
+	// the change of rate applies at once
+	d, _ = l.Reserve(ctx, "a", 100, 100)
+	assert.Equal(t, 2*time.Second, d)
+	d, _ = l.Reserve(ctx, "a", 1<<30, 0)
+	assert.Zero(t, d)
+
+	// the full buckets are swept
+	now = now.Add(localSweepInterval)
+	_, _ = l.Reserve(ctx, "c", 1, 1000)
+	assert.Len(t, l.buckets, 1)
+}
+
+type recordLimiter struct {
+	reserved []int
+	err      error
+}
+
+func (l *recordLimiter) Reserve(_ context.Context, _ string, n int, _ int64) (time.Duration, error) {
+	l.reserved = append(l.reserved, n)
+	return 0, l.err
+}
+
+func TestReader(t *testing.T) {
+	ctx := context.Background()
+	data := bytes.Repeat([]byte{'x'}, 2500)
+
+	l := &recordLimiter{}
+	b, err := io.ReadAll(NewReader(ctx, bytes.NewReader(data), l, "a", func() int64 { return 1000 }))
+	assert.NoError(t, err)
+	assert.Equal(t, data, b)
+	for _, n := range l.reserved {
+		assert.LessOrEqual(t, n, 1000)
+	}
+
+	// unlimited
+	l = &recordLimiter{}
+	b, err = io.ReadAll(NewReader(ctx, bytes.NewReader(data), l, "a", func() int64 { return 0 }))
+	assert.NoError(t, err)
+	assert.Equal(t, data, b)
+	assert.Empty(t, l.reserved)
+
+	// fails open
+	l = &recordLimiter{err: errors.New("unavailable")}
+	b, err = io.ReadAll(NewReader(ctx, bytes.NewReader(data), l, "a", func() int64 { return 1000 }))
+	assert.NoError(t, err)
+	assert.Equal(t, data, b)
+}
+
+func TestWriter(t *testing.T) {
+	ctx := context.Background()
+	data := bytes.Repeat([]byte{'x'}, 2500)
+
+	l := &recordLimiter{}
+	var buf bytes.Buffer
+	n, err := NewWriter(ctx, &buf, l, "a", func() int64 { return 1000 }).Write(data)
+	assert.NoError(t, err)
+	assert.Equal(t, len(data), n)
+	assert.Equal(t, data, buf.Bytes())
+	assert.Equal(t, []int{1000, 1000, 500}, l.reserved)
+
+	// waits for the tokens
+	buf.Reset()
+	start := time.Now()
+	w := NewWriter(ctx, &buf, NewLocalLimiter(), "a", func() int64 { return 10000 })
+	_, err = w.Write(bytes.Repeat([]byte{'x'}, 13000))
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, time.Since(start), 250*time.Millisecond)
+
+	// canceled while waiting
+	cctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	w = NewWriter(cctx, &buf, NewLocalLimiter(), "a", func() int64 { return 1000 })
+	_, err = w.Write(bytes.Repeat([]byte{'x'}, 3000))
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
@@ -0,0 +1,64 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var _ Limiter = (*RedisLimiter)(nil)
+
+// reserveScript is the token bucket of LocalLimiter in redis, the time of redis is used so that the clocks of
+// the instances do not matter. The bucket expires once refilled to full.
+var reserveScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local n = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+
+local b = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+local tokens = tonumber(b[1]) or rate
+local last = tonumber(b[2]) or now
+if now > last then
+	tokens = tokens + (now - last) * rate / 1000
+end
+tokens = math.min(rate, tokens) - n
+
+local wait = 0
+if tokens < 0 then
+	wait = math.ceil(-tokens * 1000 / rate)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'last', tostring(now))
+redis.call('PEXPIRE', KEYS[1], wait + 1000)
+return wait
+`)
+
+// RedisLimiter keeps the buckets in redis, it limits the streams across the instances.
+type RedisLimiter struct {
+	rdCmd     redis.Cmdable
+	keyPrefix string
+}
+
+func NewRedisLimiter(rdCmd redis.Cmdable) *RedisLimiter {
+	return &RedisLimiter{
+		rdCmd:     rdCmd,
+		keyPrefix: "pallas_ratelimit:",
+	}
+}
+
+// SetKeyPrefix sets the key prefix in the redis database.
+func (l *RedisLimiter) SetKeyPrefix(p string) {
+	l.keyPrefix = p
+}
+
+func (l *RedisLimiter) Reserve(ctx context.Context, key string, n int, rate int64) (time.Duration, error) {
+	if rate <= 0 {
+		return 0, nil
+	}
+	ms, err := reserveScript.Run(ctx, l.rdCmd, []string{l.keyPrefix + key}, rate, n).Int64()
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
@@ -0,0 +1,254 @@
+package sessions
+
+import (
+	"context"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	khttp "github.com/go-kratos/kratos/v2/transport/http"
+	"github.com/gorilla/securecookie"
+)
+
+// memorySweepInterval is how often the expired sessions are removed
+const memorySweepInterval = time.Minute
+
+var _ ServerStore = (*MemoryStore)(nil)
+
+// MemoryStore stores sessions in the memory of the instance, it is for a single instance without redis. The
+// sessions are lost on restart.
+type MemoryStore struct {
+	mu        sync.Mutex
+	sessions  map[string]*memorySession
+	owners    map[string]map[string][]byte
+	lastSweep time.Time
+	now       func() time.Time
+
+	serializer    SessionSerializer
+	Options       *Options
+	Codecs        []securecookie.Codec
+	DefaultMaxAge int
+	maxLength     int
+}
+
+type memorySession struct {
+	data     []byte
+	expireAt time.Time
+}
+
+func NewMemoryStore(keyPairs ...[]byte) (*MemoryStore, error) {
+	ms := &MemoryStore{
+		sessions:  make(map[string]*memorySession),
+		owners:    make(map[string]map[string][]byte),
+		lastSweep: time.Now(),
+		now:       time.Now,
+		Codecs:    securecookie.CodecsFromPairs(keyPairs...),
+		Options: &Options{
+			Path:   "/",
+			MaxAge: sessionExpire,
+		},
+		DefaultMaxAge: 60 * 20, // 20 minutes seems like a reasonable default
+		maxLength:     4096,
+		serializer:    GobSerializer{},
+	}
+	return ms, nil
+}
+
+func (s *MemoryStore) SetMaxLength(l int) {
+	if l >= 0 {
+		s.maxLength = l
+	}
+}
+
+// SetSerializer sets the serializer
+func (s *MemoryStore) SetSerializer(ss SessionSerializer) {
+	s.serializer = ss
+}
+
+func (s *MemoryStore) SetMaxAge(v int) {
+	var c *securecookie.SecureCookie
+	var ok bool
+	s.Options.MaxAge = v
+	for i := range s.Codecs {
+		if c, ok = s.Codecs[i].(*securecookie.SecureCookie); ok {
+			c.MaxAge(v)
+		} else {
+			fmt.Printf("Can't change MaxAge on codec %v\n", s.Codecs[i])
+		}
+	}
+}
+
+func (s *MemoryStore) Get(ht *khttp.Transport, name string) (*Session, error) {
+	return GetRegistry(ht).Get(s, name)
+}
+
+func (s *MemoryStore) New(ht *khttp.Transport, name string) (*Session, error) {
+	return s.Load(ht.Request(), name)
+}
+
+// Load returns the session of the request without registering it, it is for the http filters,
+// which run before the transport of kratos is available.
+func (s *MemoryStore) Load(r *http.Request, name string) (*Session, error) {
+	var (
+		err error
+		ok  bool
+	)
+	session := NewSession(s, name)
+	// make a copy
+	options := *s.Options
+	session.Options = &options
+	session.IsNew = true
+	if c, errCookie := r.Cookie(name); errCookie == nil {
+		err = securecookie.DecodeMulti(name, c.Value, &session.ID, s.Codecs...)
+		if err == nil {
+			ok, err = s.load(session)
+			session.IsNew = !(err == nil && ok) // not new if no error and data available
+		}
+	}
+	return session, err
+}
+
+func (s *MemoryStore) Save(ht *khttp.Transport, session *Session) error {
+	// Marked for deletion.
+	if session.Options.MaxAge <= 0 {
+		s.delete(session)
+		setCookie(ht, NewCookie(session.Name(), "", session.Options))
+	} else {
+		if err := s.Persist(ht.Request().Context(), session); err != nil {
+			return err
+		}
+		encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+		if err != nil {
+			return err
+		}
+		setCookie(ht, NewCookie(session.Name(), encoded, session.Options))
+	}
+	return nil
+}
+
+// Persist stores the session without writing the cookie, e.g. the session created out of a request. The id of
+// the session is generated if empty.
+func (s *MemoryStore) Persist(_ context.Context, session *Session) error {
+	if session.ID == "" {
+		session.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+	}
+	b, err := s.serializer.Serialize(session)
+	if err != nil {
+		return err
+	}
+	if s.maxLength != 0 && len(b) > s.maxLength {
+		return errors.New("SessionStore: the value to store is too big")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep()
+	s.sessions[session.ID] = &memorySession{data: b, expireAt: s.now().Add(s.age(session))}
+	return nil
+}
+
+func (s *MemoryStore) load(session *Session) (bool, error) {
+	s.mu.Lock()
+	ms, ok := s.sessions[session.ID]
+	if ok && !s.now().Before(ms.expireAt) {
+		delete(s.sessions, session.ID)
+		ok = false
+	}
+	s.mu.Unlock()
+	if !ok {
+		return false, nil // no data was associated with this id
+	}
+	return true, s.serializer.Deserialize(ms.data, session)
+}
+
+func (s *MemoryStore) delete(session *Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, session.ID)
+}
+
+// Track adds the session to the index of owner with the description info, so that all the sessions of
+// owner can be listed by List and revoked by RevokeAll.
+func (s *MemoryStore) Track(_ context.Context, owner string, session *Session, info []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids, ok := s.owners[owner]
+	if !ok {
+		ids = make(map[string][]byte)
+		s.owners[owner] = ids
+	}
+	ids[session.ID] = info
+	return nil
+}
+
+// List returns the sessions tracked for owner, the expired ones are removed from the index.
+func (s *MemoryStore) List(_ context.Context, owner string) ([]*TrackedSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	ids := s.owners[owner]
+	res := make([]*TrackedSession, 0, len(ids))
+	for id, info := range ids {
+		ms, ok := s.sessions[id]
+		if !ok || !now.Before(ms.expireAt) {
+			delete(ids, id)
+			continue
+		}
+		res = append(res, &TrackedSession{
+			ID:       id,
+			Info:     info,
+			ExpireAt: ms.expireAt,
+		})
+	}
+	if len(ids) == 0 {
+		delete(s.owners, owner)
+	}
+	return res, nil
+}
+
+// RevokeAll deletes all the sessions tracked for owner.
+func (s *MemoryStore) RevokeAll(_ context.Context, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id := range s.owners[owner] {
+		delete(s.sessions, id)
+	}
+	delete(s.owners, owner)
+	return nil
+}
+
+func (s *MemoryStore) age(session *Session) time.Duration {
+	age := session.Options.MaxAge
+	if age <= 0 {
+		age = s.DefaultMaxAge
+	}
+	return time.Duration(age) * time.Second
+}
+
+// sweep removes the expired sessions and the owners without sessions, it must be called with the lock held.
+func (s *MemoryStore) sweep() {
+	now := s.now()
+	if now.Sub(s.lastSweep) < memorySweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for id, ms := range s.sessions {
+		if !now.Before(ms.expireAt) {
+			delete(s.sessions, id)
+		}
+	}
+	for owner, ids := range s.owners {
+		for id := range ids {
+			if _, ok := s.sessions[id]; !ok {
+				delete(ids, id)
+			}
+		}
+		if len(ids) == 0 {
+			delete(s.owners, owner)
+		}
+	}
+}
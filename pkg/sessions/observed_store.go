@@ -0,0 +1,94 @@
+package sessions
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	khttp "github.com/go-kratos/kratos/v2/transport/http"
+)
+
+// The operations reported to the ObserveFunc
+const (
+	OperationLoad      = "load"
+	OperationSave      = "save"
+	OperationTrack     = "track"
+	OperationList      = "list"
+	OperationRevokeAll = "revoke_all"
+)
+
+// ObserveFunc is called after each operation of the store with the error and the time it took.
+type ObserveFunc func(operation string, err error, elapsed time.Duration)
+
+var _ ServerStore = (*ObservedStore)(nil)
+
+// ObservedStore reports the operations of the store, e.g. to collect the metrics. The sessions loaded by it are
+// saved through it as well.
+type ObservedStore struct {
+	store   ServerStore
+	observe ObserveFunc
+}
+
+func NewObservedStore(store ServerStore, observe ObserveFunc) *ObservedStore {
+	return &ObservedStore{
+		store:   store,
+		observe: observe,
+	}
+}
+
+func (s *ObservedStore) Get(ht *khttp.Transport, name string) (*Session, error) {
+	return GetRegistry(ht).Get(s, name)
+}
+
+func (s *ObservedStore) New(ht *khttp.Transport, name string) (*Session, error) {
+	return s.Load(ht.Request(), name)
+}
+
+func (s *ObservedStore) Load(r *http.Request, name string) (*Session, error) {
+	start := time.Now()
+	session, err := s.store.Load(r, name)
+	s.observe(OperationLoad, err, time.Since(start))
+	if session != nil {
+		session.store = s
+	}
+	return session, err
+}
+
+func (s *ObservedStore) Save(ht *khttp.Transport, session *Session) error {
+	start := time.Now()
+	err := s.store.Save(ht, session)
+	s.observe(OperationSave, err, time.Since(start))
+	return err
+}
+
+func (s *ObservedStore) Persist(ctx context.Context, session *Session) error {
+	start := time.Now()
+	err := s.store.Persist(ctx, session)
+	s.observe(OperationSave, err, time.Since(start))
+	return err
+}
+
+func (s *ObservedStore) SetMaxAge(v int) {
+	s.store.SetMaxAge(v)
+}
+
+func (s *ObservedStore) Track(ctx context.Context, owner string, session *Session, info []byte) error {
+	start := time.Now()
+	err := s.store.Track(ctx, owner, session, info)
+	s.observe(OperationTrack, err, time.Since(start))
+	return err
+}
+
+func (s *ObservedStore) List(ctx context.Context, owner string) ([]*TrackedSession, error) {
+	start := time.Now()
+	res, err := s.store.List(ctx, owner)
+	s.observe(OperationList, err, time.Since(start))
+	return res, err
+}
+
+func (s *ObservedStore) RevokeAll(ctx context.Context, owner string) error {
+	start := time.Now()
+	err := s.store.RevokeAll(ctx, owner)
+	s.observe(OperationRevokeAll, err, time.Since(start))
+	return err
+}
@@ -8,6 +8,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/http"
 	"strings"
 	"time"
 
@@ -71,6 +72,8 @@ func (s GobSerializer) Deserialize(d []byte, ss *Session) error {
 	return dec.Decode(&ss.Values)
 }
 
+var _ ServerStore = (*RedisStore)(nil)
+
 // RedisStore stores sessions in a redis backend.
 type RedisStore struct {
 	rdCmd         redis.Cmdable
@@ -132,6 +135,12 @@ func (s *RedisStore) Get(ht *khttp.Transport, name string) (*Session, error) {
 }
 
 func (s *RedisStore) New(ht *khttp.Transport, name string) (*Session, error) {
+	return s.Load(ht.Request(), name)
+}
+
+// Load returns the session of the request without registering it, it is for the http filters,
+// which run before the transport of kratos is available.
+func (s *RedisStore) Load(r *http.Request, name string) (*Session, error) {
 	var (
 		err error
 		ok  bool
@@ -141,10 +150,10 @@ func (s *RedisStore) New(ht *khttp.Transport, name string) (*Session, error) {
 	options := *s.Options
 	session.Options = &options
 	session.IsNew = true
-	if c, errCookie := ht.Request().Cookie(name); errCookie == nil {
+	if c, errCookie := r.Cookie(name); errCookie == nil {
 		err = securecookie.DecodeMulti(name, c.Value, &session.ID, s.Codecs...)
 		if err == nil {
-			ok, err = s.load(ht.Request().Context(), session)
+			ok, err = s.load(r.Context(), session)
 			session.IsNew = !(err == nil && ok) // not new if no error and data available
 		}
 	}
@@ -175,6 +184,15 @@ func (s *RedisStore) Save(ht *khttp.Transport, session *Session) error {
 	return nil
 }
 
+// Persist stores the session without writing the cookie, e.g. the session created out of a request. The id of
+// the session is generated if empty.
+func (s *RedisStore) Persist(ctx context.Context, session *Session) error {
+	if session.ID == "" {
+		session.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+	}
+	return s.save(ctx, session)
+}
+
 // save stores the session in redis.
 func (s *RedisStore) save(ctx context.Context, session *Session) error {
 	b, err := s.serializer.Serialize(session)
@@ -209,3 +227,89 @@ func (s *RedisStore) delete(ctx context.Context, session *Session) error {
 	}
 	return nil
 }
+
+// TrackedSession is a session tracked for the owner.
+type TrackedSession struct {
+	ID string
+	// Info is the description of the session given to Track
+	Info     []byte
+	ExpireAt time.Time
+}
+
+// Track adds the session to the index of owner with the description info, so that all the sessions of
+// owner can be listed by List and revoked by RevokeAll.
+func (s *RedisStore) Track(ctx context.Context, owner string, session *Session, info []byte) error {
+	age := session.Options.MaxAge
+	if age <= 0 {
+		age = s.DefaultMaxAge
+	}
+	key := s.ownerKey(owner)
+	pipe := s.rdCmd.TxPipeline()
+	pipe.HSet(ctx, key, session.ID, info)
+	// the index lives as long as the latest session
+	pipe.Expire(ctx, key, time.Duration(age)*time.Second)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// List returns the sessions tracked for owner, the expired ones are removed from the index.
+func (s *RedisStore) List(ctx context.Context, owner string) ([]*TrackedSession, error) {
+	key := s.ownerKey(owner)
+	infos, err := s.rdCmd.HGetAll(ctx, key).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(infos))
+	ttls := make([]*redis.DurationCmd, 0, len(infos))
+	pipe := s.rdCmd.Pipeline()
+	for id := range infos {
+		ids = append(ids, id)
+		ttls = append(ttls, pipe.TTL(ctx, s.keyPrefix+id))
+	}
+	if _, err = pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	now := time.Now()
+	res := make([]*TrackedSession, 0, len(ids))
+	var expired []string
+	for i, id := range ids {
+		// a negative ttl means the session does not exist, or never expires which is not the case
+		ttl := ttls[i].Val()
+		if ttl < 0 {
+			expired = append(expired, id)
+			continue
+		}
+		res = append(res, &TrackedSession{
+			ID:       id,
+			Info:     []byte(infos[id]),
+			ExpireAt: now.Add(ttl),
+		})
+	}
+	if len(expired) > 0 {
+		if err = s.rdCmd.HDel(ctx, key, expired...).Err(); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// RevokeAll deletes all the sessions tracked for owner.
+func (s *RedisStore) RevokeAll(ctx context.Context, owner string) error {
+	key := s.ownerKey(owner)
+	ids, err := s.rdCmd.HKeys(ctx, key).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return err
+	}
+	keys := make([]string, 0, len(ids)+1)
+	for _, id := range ids {
+		keys = append(keys, s.keyPrefix+id)
+	}
+	keys = append(keys, key)
+	return s.rdCmd.Del(ctx, keys...).Err()
+}
+
+func (s *RedisStore) ownerKey(owner string) string {
+	return s.keyPrefix + "owner:" + owner
+}
@@ -125,9 +125,12 @@ type Registry struct {
 // GetRegistry returns a registry instance for the current request.
 func GetRegistry(ht *khttp.Transport) *Registry {
 	ctx := ht.Request().Context()
-	registry := ctx.Value(registryKey)
-	if registry != nil {
-		return registry.(*Registry)
+	if registry, ok := ctx.Value(registryKey).(*Registry); ok {
+		// registered by Register before the transport is available
+		if registry.ht == nil {
+			registry.ht = ht
+		}
+		return registry
 	}
 	newRegistry := &Registry{
 		ht:       ht,
@@ -137,6 +140,18 @@ func GetRegistry(ht *khttp.Transport) *Registry {
 	return newRegistry
 }
 
+// Register returns the request with the session returned by Load registered, so that Get returns it rather
+// than loading it again. It is for the http filters, which run before the transport of kratos is available.
+func Register(r *http.Request, session *Session) *http.Request {
+	registry, ok := r.Context().Value(registryKey).(*Registry)
+	if !ok {
+		registry = &Registry{sessions: make(map[string]sessionInfo)}
+		r = r.WithContext(context.WithValue(r.Context(), registryKey, registry))
+	}
+	registry.sessions[session.name] = sessionInfo{s: session}
+	return r
+}
+
 // Get registers and returns a session for the given name and session store.
 //
 // It returns a new session if there are no sessions registered for the name.
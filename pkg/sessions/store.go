@@ -1,6 +1,7 @@
 package sessions
 
 import (
+	"context"
 	"net/http"
 
 	khttp "github.com/go-kratos/kratos/v2/transport/http"
@@ -13,6 +14,19 @@ type Store interface {
 	Save(ht *khttp.Transport, s *Session) error
 }
 
+// ServerStore keeps the values of the sessions on the server and only the id in the cookie, so that the
+// sessions of an owner can be listed and revoked. It is implemented by RedisStore, and by MemoryStore for a
+// single instance.
+type ServerStore interface {
+	Store
+	Load(r *http.Request, name string) (*Session, error)
+	Persist(ctx context.Context, session *Session) error
+	SetMaxAge(v int)
+	Track(ctx context.Context, owner string, session *Session, info []byte) error
+	List(ctx context.Context, owner string) ([]*TrackedSession, error)
+	RevokeAll(ctx context.Context, owner string) error
+}
+
 // CookieStore stores sessions using secure cookies.
 type CookieStore struct {
 	Options *Options
@@ -0,0 +1,215 @@
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Algorithm is the HMAC hash function used to compute the one-time password.
+type Algorithm string
+
+const (
+	AlgorithmSHA1   Algorithm = "SHA1"
+	AlgorithmSHA256 Algorithm = "SHA256"
+	AlgorithmSHA512 Algorithm = "SHA512"
+)
+
+func (a Algorithm) hash() func() hash.Hash {
+	switch a {
+	case AlgorithmSHA256:
+		return sha256.New
+	case AlgorithmSHA512:
+		return sha512.New
+	default:
+		return sha1.New
+	}
+}
+
+// Options implement the TOTP parameters, see https://www.rfc-editor.org/rfc/rfc6238#section-4 for details
+type Options struct {
+	Algorithm Algorithm
+	Digits    int
+	Period    time.Duration
+	// Skew is the number of periods before and after the current one that are also accepted,
+	// to tolerate clock drift between the server and the authenticator
+	Skew int
+}
+
+// DefaultOptions are the parameters understood by all common authenticator apps.
+var DefaultOptions = Options{
+	Algorithm: AlgorithmSHA1,
+	Digits:    6,
+	Period:    30 * time.Second,
+	Skew:      1,
+}
+
+const secretSize = 20
+
+var (
+	ErrInvalidSecret = errors.New("totp: invalid secret")
+	ErrInvalidDigits = errors.New("totp: invalid digits")
+
+	b32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+// GenerateSecret generate a random base32 encoded shared secret
+func GenerateSecret() (string, error) {
+	b := make([]byte, secretSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return b32NoPadding.EncodeToString(b), nil
+}
+
+// Counter returns the time step counter of t.
+func Counter(t time.Time, opts Options) int64 {
+	return t.Unix() / int64(opts.Period/time.Second)
+}
+
+// GenerateCode compute the one-time password of the given time.
+func GenerateCode(secret string, t time.Time, opts Options) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, Counter(t, opts), opts)
+}
+
+// Validate reports whether code is valid at time t, and returns the time step counter it matched,
+// the caller should reject any further codes with a counter that has already been used.
+func Validate(code, secret string, t time.Time, opts Options) (int64, bool) {
+	key, err := decodeSecret(secret)
+	if err != nil || len(code) != opts.Digits {
+		return 0, false
+	}
+	counter := Counter(t, opts)
+	for i := -opts.Skew; i <= opts.Skew; i++ {
+		expected, err := hotp(key, counter+int64(i), opts)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return counter + int64(i), true
+		}
+	}
+	return 0, false
+}
+
+// ProvisioningURI returns the otpauth uri which can be rendered as a QR code and scanned by authenticator apps.
+// See https://github.com/google/google-authenticator/wiki/Key-Uri-Format for details
+func ProvisioningURI(issuer, account, secret string, opts Options) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", string(opts.Algorithm))
+	v.Set("digits", strconv.Itoa(opts.Digits))
+	v.Set("period", strconv.FormatInt(int64(opts.Period/time.Second), 10))
+
+	u := url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + account,
+		RawQuery: v.Encode(),
+	}
+	return u.String()
+}
+
+const (
+	recoveryCodeCharSet = "abcdefghjkmnpqrstuvwxyz23456789"
+	// recoveryCodeLen is the number of the characters of a recovery code, excluding the separator
+	recoveryCodeLen = 10
+)
+
+// GenerateRecoveryCodes generate n random one-time recovery codes in the form of "xxxxx-xxxxx"
+func GenerateRecoveryCodes(n int) ([]string, error) {
+	// the bytes not less than limit are dropped rather than wrapped, so that each character is equally likely
+	limit := 256 - 256%len(recoveryCodeCharSet)
+
+	codes := make([]string, n)
+	b := make([]byte, recoveryCodeLen)
+	for i := range codes {
+		sb := strings.Builder{}
+		for j := 0; j < recoveryCodeLen; {
+			if _, err := rand.Read(b); err != nil {
+				return nil, err
+			}
+			for _, c := range b {
+				if int(c) >= limit || j == recoveryCodeLen {
+					continue
+				}
+				if j == recoveryCodeLen/2 {
+					sb.WriteByte('-')
+				}
+				sb.WriteByte(recoveryCodeCharSet[int(c)%len(recoveryCodeCharSet)])
+				j++
+			}
+		}
+		codes[i] = sb.String()
+	}
+	return codes, nil
+}
+
+// IsRecoveryCode reports whether code is in the form of the recovery codes, regardless of the case and the
+// surrounding spaces.
+func IsRecoveryCode(code string) bool {
+	code = strings.ToLower(strings.TrimSpace(code))
+	if len(code) != recoveryCodeLen+1 {
+		return false
+	}
+	for i := 0; i < len(code); i++ {
+		if i == recoveryCodeLen/2 {
+			if code[i] != '-' {
+				return false
+			}
+			continue
+		}
+		if strings.IndexByte(recoveryCodeCharSet, code[i]) < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// hotp implement the HOTP algorithm, see https://www.rfc-editor.org/rfc/rfc4226#section-5.3 for details
+func hotp(key []byte, counter int64, opts Options) (string, error) {
+	if opts.Digits < 6 || opts.Digits > 10 {
+		return "", ErrInvalidDigits
+	}
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+
+	h := hmac.New(opts.Algorithm.hash(), key)
+	h.Write(msg)
+	sum := h.Sum(nil)
+
+	// dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := int64(binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff)
+
+	mod := int64(math.Pow10(opts.Digits))
+	return fmt.Sprintf("%0*d", opts.Digits, value%mod), nil
+}
+
+func decodeSecret(secret string) ([]byte, error) {
+	s := strings.ToUpper(strings.ReplaceAll(secret, " ", ""))
+	key, err := b32NoPadding.DecodeString(strings.TrimRight(s, "="))
+	if err != nil || len(key) == 0 {
+		return nil, ErrInvalidSecret
+	}
+	return key, nil
+}
@@ -0,0 +1,129 @@
+package totp
+
+import (
+	"encoding/base32"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// RFC 6238 Appendix B test vectors
+func TestRFC6238(t *testing.T) {
+	secrets := map[Algorithm]string{
+		AlgorithmSHA1:   b32NoPadding.EncodeToString([]byte("12345678901234567890")),
+		AlgorithmSHA256: b32NoPadding.EncodeToString([]byte("12345678901234567890123456789012")),
+		AlgorithmSHA512: b32NoPadding.EncodeToString([]byte("1234567890123456789012345678901234567890123456789012345678901234")),
+	}
+
+	testSuite := []struct {
+		unix      int64
+		algorithm Algorithm
+		expected  string
+	}{
+		{unix: 59, algorithm: AlgorithmSHA1, expected: "94287082"},
+		{unix: 59, algorithm: AlgorithmSHA256, expected: "46119246"},
+		{unix: 59, algorithm: AlgorithmSHA512, expected: "90693936"},
+		{unix: 1111111109, algorithm: AlgorithmSHA1, expected: "07081804"},
+		{unix: 1111111109, algorithm: AlgorithmSHA256, expected: "68084774"},
+		{unix: 1111111109, algorithm: AlgorithmSHA512, expected: "25091201"},
+		{unix: 1111111111, algorithm: AlgorithmSHA1, expected: "14050471"},
+		{unix: 1111111111, algorithm: AlgorithmSHA256, expected: "67062674"},
+		{unix: 1111111111, algorithm: AlgorithmSHA512, expected: "99943326"},
+		{unix: 1234567890, algorithm: AlgorithmSHA1, expected: "89005924"},
+		{unix: 1234567890, algorithm: AlgorithmSHA256, expected: "91819424"},
+		{unix: 1234567890, algorithm: AlgorithmSHA512, expected: "93441116"},
+		{unix: 2000000000, algorithm: AlgorithmSHA1, expected: "69279037"},
+		{unix: 2000000000, algorithm: AlgorithmSHA256, expected: "90698825"},
+		{unix: 2000000000, algorithm: AlgorithmSHA512, expected: "38618901"},
+		{unix: 20000000000, algorithm: AlgorithmSHA1, expected: "65353130"},
+		{unix: 20000000000, algorithm: AlgorithmSHA256, expected: "77737706"},
+		{unix: 20000000000, algorithm: AlgorithmSHA512, expected: "47863826"},
+	}
+
+	for _, tt := range testSuite {
+		opts := Options{Algorithm: tt.algorithm, Digits: 8, Period: 30 * time.Second}
+		code, err := GenerateCode(secrets[tt.algorithm], time.Unix(tt.unix, 0), opts)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.expected, code, "code at %d with %s should match", tt.unix, tt.algorithm)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	assert.NoError(t, err)
+
+	now := time.Now()
+	code, err := GenerateCode(secret, now, DefaultOptions)
+	assert.NoError(t, err)
+
+	counter, ok := Validate(code, secret, now, DefaultOptions)
+	assert.True(t, ok)
+	assert.Equal(t, Counter(now, DefaultOptions), counter)
+
+	// accepted within skew
+	_, ok = Validate(code, secret, now.Add(DefaultOptions.Period), DefaultOptions)
+	assert.True(t, ok)
+
+	// rejected out of skew
+	_, ok = Validate(code, secret, now.Add(3*DefaultOptions.Period), DefaultOptions)
+	assert.False(t, ok)
+
+	// rejected with wrong length or bad secret
+	_, ok = Validate(code[:5], secret, now, DefaultOptions)
+	assert.False(t, ok)
+	_, ok = Validate(code, "!!!", now, DefaultOptions)
+	assert.False(t, ok)
+}
+
+func TestGenerateSecret(t *testing.T) {
+	secret, err := GenerateSecret()
+	assert.NoError(t, err)
+
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	assert.NoError(t, err)
+	assert.Len(t, key, secretSize)
+}
+
+func TestProvisioningURI(t *testing.T) {
+	uri := ProvisioningURI("pallas", "admin@pallas.icu", "JBSWY3DPEHPK3PXP", DefaultOptions)
+
+	u, err := url.Parse(uri)
+	assert.NoError(t, err)
+	assert.Equal(t, "otpauth", u.Scheme)
+	assert.Equal(t, "totp", u.Host)
+	assert.Equal(t, "/pallas:admin@pallas.icu", u.Path)
+	assert.Equal(t, "JBSWY3DPEHPK3PXP", u.Query().Get("secret"))
+	assert.Equal(t, "pallas", u.Query().Get("issuer"))
+	assert.Equal(t, "SHA1", u.Query().Get("algorithm"))
+	assert.Equal(t, "6", u.Query().Get("digits"))
+	assert.Equal(t, "30", u.Query().Get("period"))
+}
+
+func TestGenerateRecoveryCodes(t *testing.T) {
+	codes, err := GenerateRecoveryCodes(10)
+	assert.NoError(t, err)
+	assert.Len(t, codes, 10)
+
+	seen := make(map[string]struct{}, len(codes))
+	for _, c := range codes {
+		assert.Len(t, c, 11)
+		assert.Equal(t, 1, strings.Count(c, "-"))
+		assert.True(t, IsRecoveryCode(c))
+		seen[c] = struct{}{}
+	}
+	assert.Len(t, seen, len(codes), "recovery codes should be unique")
+}
+
+func TestIsRecoveryCode(t *testing.T) {
+	assert.True(t, IsRecoveryCode("abcde-23456"))
+	assert.True(t, IsRecoveryCode(" ABCDE-23456\n"))
+	assert.False(t, IsRecoveryCode("123456"))
+	assert.False(t, IsRecoveryCode("-123456"))
+	assert.False(t, IsRecoveryCode("abcde23456-"))
+	assert.False(t, IsRecoveryCode("abcde-2345"))
+	// the characters confusable are never generated
+	assert.False(t, IsRecoveryCode("abcde-01lio"))
+}
@@ -1,8 +1,10 @@
 package utils
 
 import (
+	crand "crypto/rand"
 	"math/rand"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -22,18 +24,56 @@ const (
 	AllCharSet     CharSet = LowerCharSet + UpperCharSet + SpecialCharSet + NumberSet
 )
 
-var src = rand.NewSource(time.Now().UnixNano())
+// src is shared by the goroutines, the source of math/rand is not safe for concurrent use by itself
+var src = &lockedSource{src: rand.NewSource(time.Now().UnixNano())}
+
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
 
 func RandString(n int, charSet ...CharSet) string {
+	return randString(n, joinCharSet(charSet))
+}
+
+// SecureRandString is RandString reading crypto/rand, for the secrets, e.g. the passwords and salts generated.
+func SecureRandString(n int, charSet ...CharSet) (string, error) {
+	set := joinCharSet(charSet)
+	// the bytes not less than limit are dropped rather than wrapped, so that each character is equally likely
+	limit := 256 - 256%len(set)
+
+	sb := strings.Builder{}
+	sb.Grow(n)
+	b := make([]byte, n)
+	for sb.Len() < n {
+		if _, err := crand.Read(b); err != nil {
+			return "", err
+		}
+		for _, c := range b {
+			if int(c) < limit && sb.Len() < n {
+				sb.WriteByte(set[int(c)%len(set)])
+			}
+		}
+	}
+	return sb.String(), nil
+}
+
+func joinCharSet(charSet []CharSet) string {
 	if len(charSet) == 0 {
-		return randString(n, string(AllCharSet))
+		return string(AllCharSet)
 	}
 
 	s := ""
 	for _, set := range charSet {
 		s += string(set)
 	}
-	return randString(n, s)
+	return s
 }
 
 func randString(n int, charSet string) string {